@@ -0,0 +1,141 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchmarkSource creates a directory of small files, like a typical
+// Terraform configuration, for the benchmarks.
+func benchmarkSource(b *testing.B) string {
+	dir := b.TempDir()
+	content := bytes.Repeat([]byte("resource \"null_resource\" \"x\" {}\n"), 64)
+	for i := 0; i < 200; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%03d.tf", i))
+		if err := os.WriteFile(name, content, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func benchmarkPackers(b *testing.B) map[string]*Packer {
+	ret := make(map[string]*Packer)
+	for name, options := range map[string][]PackerOption{
+		"default": nil,
+		"pooled":  {WithBufferPool(NewBufferPool(32 * 1024))},
+	} {
+		p, err := NewPacker(options...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ret[name] = p
+	}
+	return ret
+}
+
+func BenchmarkPack(b *testing.B) {
+	src := benchmarkSource(b)
+	for name, p := range benchmarkPackers(b) {
+		b.Run(name, func(b *testing.B) {
+			var slug bytes.Buffer
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				slug.Reset()
+				if _, err := p.Pack(src, &slug); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	var slug bytes.Buffer
+	if _, err := Pack(benchmarkSource(b), &slug, true); err != nil {
+		b.Fatal(err)
+	}
+	data := slug.Bytes()
+	for name, p := range benchmarkPackers(b) {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dst := filepath.Join(b.TempDir(), "dst")
+				b.StartTimer()
+				if err := p.Unpack(bytes.NewReader(data), dst); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkSmallFiles creates a tree of many tiny files spread across
+// directories, where per-file overhead dominates the time taken to pack.
+func benchmarkSmallFiles(b *testing.B) string {
+	dir := b.TempDir()
+	for d := 0; d < 100; d++ {
+		sub := filepath.Join(dir, fmt.Sprintf("dir%03d", d))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			name := filepath.Join(sub, fmt.Sprintf("file%03d.tf", i))
+			if err := os.WriteFile(name, []byte("x = 1\n"), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+func BenchmarkPackSmallFiles(b *testing.B) {
+	src := benchmarkSmallFiles(b)
+	for name, p := range benchmarkPackers(b) {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.Pack(src, io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPackSmallFilesTerraformIgnore(b *testing.B) {
+	src := benchmarkSmallFiles(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Pack(src, io.Discard, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnpackSmallFiles(b *testing.B) {
+	var slug bytes.Buffer
+	if _, err := Pack(benchmarkSmallFiles(b), &slug, true); err != nil {
+		b.Fatal(err)
+	}
+	data := slug.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dst := filepath.Join(b.TempDir(), "dst")
+		b.StartTimer()
+		if err := Unpack(bytes.NewReader(data), dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+
+	"github.com/hashicorp/go-slug/internal/unpackinfo"
+)
+
+// WithBirthTimes is a PackerOption that makes Pack record the birth time of
+// each entry, also known as its creation time, and makes Unpack restore it.
+//
+// Pack records birth times only on platforms and filesystems that expose
+// them, which currently includes Linux, Darwin and Windows, using the same
+// PAX record as libarchive. Unpack restores them only on Darwin and
+// Windows, because other platforms don't allow changing birth times, and
+// otherwise ignores them.
+func WithBirthTimes() PackerOption {
+	return func(p *Packer) error {
+		p.birthTimes = true
+		return nil
+	}
+}
+
+// recordBirthTime adds the birth time of the file at the given path to the
+// given header, if [WithBirthTimes] is in effect and the platform exposes
+// the birth time.
+func (p *Packer) recordBirthTime(header *tar.Header, path string) {
+	if !p.birthTimes {
+		return
+	}
+	t, ok := unpackinfo.BirthTime(path)
+	if !ok {
+		return
+	}
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[unpackinfo.BirthTimePAXRecord] = unpackinfo.FormatBirthTime(t)
+}
+
+// restoreInfo restores the mode and timestamps of an extracted entry,
+// including its birth time if [WithBirthTimes] is in effect.
+func (p *Packer) restoreInfo(info unpackinfo.UnpackInfo) error {
+	if err := info.RestoreInfo(); err != nil {
+		return err
+	}
+	if p.birthTimes {
+		return info.RestoreBirthTime()
+	}
+	return nil
+}
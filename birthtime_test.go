@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-slug/internal/unpackinfo"
+)
+
+func TestPackBirthTimes(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "main.tf"), []byte("# main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	birthTime, ok := unpackinfo.BirthTime(filepath.Join(src, "main.tf"))
+	if !ok {
+		t.Skip("platform or filesystem doesn't record birth times")
+	}
+
+	records := func(t *testing.T, options ...PackerOption) map[string]string {
+		p, err := NewPacker(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var slug bytes.Buffer
+		if _, err := p.Pack(src, &slug); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		gzipR, err := gzip.NewReader(&slug)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		tarR := tar.NewReader(gzipR)
+		for {
+			header, err := tarR.Next()
+			if err == io.EOF {
+				t.Fatal("slug has no main.tf entry")
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if header.Name == "main.tf" {
+				return header.PAXRecords
+			}
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		if _, ok := records(t)[unpackinfo.BirthTimePAXRecord]; ok {
+			t.Error("birth time was recorded without WithBirthTimes")
+		}
+	})
+
+	t.Run("recorded", func(t *testing.T) {
+		got := records(t, WithBirthTimes())[unpackinfo.BirthTimePAXRecord]
+		if want := unpackinfo.FormatBirthTime(birthTime); got != want {
+			t.Errorf("wrong birth time record %q; want %q", got, want)
+		}
+	})
+}
+
+func TestUnpackBirthTimes(t *testing.T) {
+	if !unpackinfo.CanRestoreBirthTime() {
+		t.Skip("platform doesn't allow changing birth times")
+	}
+
+	birthTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	var slug bytes.Buffer
+	gzipW := gzip.NewWriter(&slug)
+	tarW := tar.NewWriter(gzipW)
+	if err := tarW.WriteHeader(&tar.Header{
+		Name:       "main.tf",
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		Size:       6,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{unpackinfo.BirthTimePAXRecord: unpackinfo.FormatBirthTime(birthTime)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tarW.Write([]byte("# main")); err != nil {
+		t.Fatal(err)
+	}
+	tarW.Close()
+	gzipW.Close()
+
+	p, err := NewPacker(WithBirthTimes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := p.Unpack(&slug, dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	got, ok := unpackinfo.BirthTime(filepath.Join(dst, "main.tf"))
+	if !ok {
+		t.Skip("filesystem doesn't record birth times")
+	}
+	if !got.Equal(birthTime) {
+		t.Errorf("wrong birth time %s; want %s", got, birthTime)
+	}
+}
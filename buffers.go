@@ -0,0 +1,113 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"fmt"
+	"sync"
+)
+
+// defaultBufferSize is the size of the buffers used to copy file content if
+// neither [WithBufferSize] nor [WithBufferPool] is used.
+const defaultBufferSize = sparseBlockSize
+
+// BufferPool provides the buffers that a [Packer] uses to copy file content,
+// for use with [WithBufferPool]. Implementations must be safe for concurrent
+// use, because a pool is typically shared by many packers.
+type BufferPool interface {
+	// Get returns a buffer, whose length is the number of bytes to copy at
+	// a time. The packer has exclusive use of the buffer until it passes
+	// it to Put.
+	Get() []byte
+
+	// Put returns a buffer obtained from Get to the pool, once the packer
+	// no longer refers to it.
+	Put(buf []byte)
+}
+
+// NewBufferPool returns a [BufferPool] backed by a [sync.Pool], whose buffers
+// all have the given size.
+func NewBufferPool(size int) BufferPool {
+	if size < blockSize {
+		size = blockSize
+	}
+	ret := &syncBufferPool{size: size}
+	ret.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return ret
+}
+
+type syncBufferPool struct {
+	pool sync.Pool
+	size int
+}
+
+func (p *syncBufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *syncBufferPool) Put(buf []byte) {
+	// Buffers from elsewhere might be the wrong size for this pool.
+	if len(buf) != p.size {
+		return
+	}
+	p.pool.Put(&buf)
+}
+
+// WithBufferSize is a PackerOption that sets the size of the buffers that
+// Pack and Unpack use to copy file content, which must be at least 512
+// bytes. Larger buffers mean fewer system calls for large files. Unpack
+// also uses the buffer size as the granularity at which it detects runs of
+// zero bytes to leave as holes in sparse files.
+//
+// This has no effect when using [WithBufferPool], since the pool then
+// decides the buffer size.
+func WithBufferSize(size int) PackerOption {
+	return func(p *Packer) error {
+		if size < blockSize {
+			return fmt.Errorf("buffer size must be at least %d bytes", blockSize)
+		}
+		p.bufferSize = size
+		return nil
+	}
+}
+
+// WithBufferPool is a PackerOption that makes Pack and Unpack take the
+// buffers they use to copy file content from the given pool, rather than
+// allocating a new buffer for each file. Services that pack or unpack many
+// slugs can share a single pool, such as one returned by [NewBufferPool],
+// between all of their packers to reduce garbage collection overhead.
+func WithBufferPool(pool BufferPool) PackerOption {
+	return func(p *Packer) error {
+		if pool == nil {
+			return fmt.Errorf("buffer pool must not be nil")
+		}
+		p.bufferPool = pool
+		return nil
+	}
+}
+
+// getBuffer returns a buffer for copying file content, which the caller
+// must pass to putBuffer once it no longer refers to it.
+func (p *Packer) getBuffer() []byte {
+	if p.bufferPool != nil {
+		if buf := p.bufferPool.Get(); len(buf) != 0 {
+			return buf
+		}
+	}
+	size := p.bufferSize
+	if size == 0 {
+		size = defaultBufferSize
+	}
+	return make([]byte, size)
+}
+
+// putBuffer returns a buffer obtained from getBuffer to the pool, if any.
+func (p *Packer) putBuffer(buf []byte) {
+	if p.bufferPool != nil {
+		p.bufferPool.Put(buf)
+	}
+}
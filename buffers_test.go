@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// countingBufferPool wraps a BufferPool to count the buffers taken from it
+// and returned to it.
+type countingBufferPool struct {
+	BufferPool
+	gets, puts atomic.Int64
+}
+
+func (p *countingBufferPool) Get() []byte {
+	p.gets.Add(1)
+	return p.BufferPool.Get()
+}
+
+func (p *countingBufferPool) Put(buf []byte) {
+	p.puts.Add(1)
+	p.BufferPool.Put(buf)
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := &countingBufferPool{BufferPool: NewBufferPool(1024)}
+	p, err := NewPacker(WithBufferPool(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var slug bytes.Buffer
+	meta, err := p.Pack("testdata/archive-dir-no-external", &slug)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pool.gets.Load() == 0 {
+		t.Fatal("Pack did not use the buffer pool")
+	}
+	if gets, puts := pool.gets.Load(), pool.puts.Load(); gets != puts {
+		t.Errorf("Pack took %d buffers but returned %d", gets, puts)
+	}
+
+	packed := pool.gets.Load()
+	dst := t.TempDir()
+	if err := p.Unpack(&slug, dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if pool.gets.Load() == packed {
+		t.Fatal("Unpack did not use the buffer pool")
+	}
+	if gets, puts := pool.gets.Load(), pool.puts.Load(); gets != puts {
+		t.Errorf("Unpack took %d buffers but returned %d", gets, puts)
+	}
+
+	// The small buffers must not affect the content.
+	for _, name := range meta.Files {
+		want, err := os.ReadFile(filepath.Join("testdata/archive-dir-no-external", name))
+		if err != nil {
+			continue // directories and symlinks
+		}
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("wrong content for %s", name)
+		}
+	}
+}
+
+func TestWithBufferSize(t *testing.T) {
+	if _, err := NewPacker(WithBufferSize(100)); err == nil {
+		t.Error("buffer smaller than a tar block was accepted")
+	}
+	if _, err := NewPacker(WithBufferPool(nil)); err == nil {
+		t.Error("nil buffer pool was accepted")
+	}
+
+	p, err := NewPacker(WithBufferSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(p.getBuffer()); got != 4096 {
+		t.Errorf("wrong buffer size %d; want 4096", got)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CaseCollisionPolicy describes how Unpack should react to entries whose
+// paths differ from an earlier entry's only in letter case, such as
+// "Main.tf" and "main.tf", which would refer to the same file on a
+// case-insensitive filesystem such as the defaults on Windows and macOS.
+//
+// The policy applies the same way on every platform, regardless of whether
+// the destination filesystem is actually case-insensitive, so that the
+// result doesn't depend on where Unpack happens to run.
+type CaseCollisionPolicy int
+
+const (
+	// AllowCaseCollisions extracts colliding entries under their own names,
+	// and so on a case-insensitive filesystem a later entry overwrites an
+	// earlier one, or is extracted into its directory. This is the default.
+	AllowCaseCollisions CaseCollisionPolicy = iota
+
+	// RejectCaseCollisions rejects colliding entries.
+	RejectCaseCollisions
+
+	// RenameCaseCollisions extracts each colliding entry under a name with
+	// a numbered suffix before its extension, so "Main.tf" colliding with
+	// "main.tf" becomes "Main~1.tf". The names are deterministic, since
+	// they depend only on the order of the entries in the slug. If a
+	// directory is renamed then everything in it is extracted into the
+	// renamed directory.
+	//
+	// Use [WithCaseCollisionReporter] to find out which entries were
+	// renamed. Symlink targets are not rewritten, so symlinks referring to
+	// a renamed entry will refer to the entry it collided with instead.
+	RenameCaseCollisions
+)
+
+// WithCaseCollisionPolicy is a PackerOption that selects how Unpack deals
+// with entries whose paths differ from an earlier entry's only in letter
+// case.
+func WithCaseCollisionPolicy(policy CaseCollisionPolicy) PackerOption {
+	return func(p *Packer) error {
+		switch policy {
+		case AllowCaseCollisions, RejectCaseCollisions, RenameCaseCollisions:
+			p.caseCollisionPolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid case collision policy %d", policy)
+		}
+	}
+}
+
+// CaseCollisionRecord describes an entry that Unpack renamed because of
+// [RenameCaseCollisions].
+type CaseCollisionRecord struct {
+	// Name is the name of the entry in the slug, as extracted before the
+	// collision was resolved.
+	Name string
+
+	// ExtractedAs is the slash-separated path, relative to the destination
+	// directory, that the entry was extracted to instead.
+	ExtractedAs string
+
+	// CollidesWith is the slash-separated path of the earlier entry or
+	// directory that the entry collided with.
+	CollidesWith string
+}
+
+// WithCaseCollisionReporter is a PackerOption that registers a callback
+// which Unpack calls once for each entry it renames because of
+// [RenameCaseCollisions], so that callers can map the extracted files back
+// to the entries in the slug. An entry inside a renamed directory is
+// reported too, even if its own name doesn't collide with anything.
+func WithCaseCollisionReporter(report func(CaseCollisionRecord)) PackerOption {
+	return func(p *Packer) error {
+		p.caseCollisionReporter = report
+		return nil
+	}
+}
+
+// caseCollisions tracks the paths that Unpack has extracted so far, to
+// apply the packer's case collision policy.
+type caseCollisions struct {
+	// renamed maps each path prefix that Unpack has seen to the path it
+	// was extracted as, which is the same unless it was renamed.
+	renamed map[string]string
+
+	// claimed maps the case-folded form of each extracted path to the
+	// path that claimed it first.
+	claimed map[string]string
+
+	// collided maps each path prefix that was renamed to the path that it
+	// collided with.
+	collided map[string]string
+}
+
+// newCaseCollisions returns a tracker for the packer's case collision
+// policy, or nil if the policy doesn't need one.
+func (p *Packer) newCaseCollisions() *caseCollisions {
+	if p.caseCollisionPolicy == AllowCaseCollisions {
+		return nil
+	}
+	return &caseCollisions{
+		renamed:  make(map[string]string),
+		claimed:  make(map[string]string),
+		collided: make(map[string]string),
+	}
+}
+
+// caseCollisionName applies the packer's case collision policy to the
+// given entry name, returning the name that the entry should be extracted
+// as.
+func (p *Packer) caseCollisionName(collisions *caseCollisions, name string) (string, error) {
+	if collisions == nil {
+		return name, nil
+	}
+	clean := path.Clean(name)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(clean) {
+		// We'll leave unpackinfo to reject or ignore these as usual.
+		return name, nil
+	}
+
+	var prefix, ret string
+	for _, part := range strings.Split(clean, "/") {
+		prefix = path.Join(prefix, part)
+		if renamed, ok := collisions.renamed[prefix]; ok {
+			ret = renamed
+			continue
+		}
+
+		candidate := path.Join(ret, part)
+		if first, ok := collisions.claimed[foldCase(candidate)]; ok {
+			if p.caseCollisionPolicy == RejectCaseCollisions {
+				return "", &IllegalSlugError{
+					Code: CaseCollision,
+					Err:  fmt.Errorf("entry %q differs only in case from %q", name, first),
+				}
+			}
+			collisions.collided[prefix] = first
+			candidate = collisions.unclaimedName(ret, part)
+		}
+		collisions.claimed[foldCase(candidate)] = prefix
+		collisions.renamed[prefix] = candidate
+		ret = candidate
+	}
+	if ret == clean {
+		return name, nil
+	}
+
+	if p.caseCollisionReporter != nil {
+		// The entry might be inside a directory that collided, rather than
+		// colliding itself.
+		var collidesWith string
+		for dir := clean; dir != "."; dir = path.Dir(dir) {
+			if first, ok := collisions.collided[dir]; ok {
+				collidesWith = first
+				break
+			}
+		}
+		p.caseCollisionReporter(CaseCollisionRecord{
+			Name:         name,
+			ExtractedAs:  ret,
+			CollidesWith: collidesWith,
+		})
+	}
+	if strings.HasSuffix(name, "/") {
+		ret += "/"
+	}
+	return ret, nil
+}
+
+// unclaimedName returns the first name in the given directory, made by
+// adding a numbered suffix to the given name, that doesn't collide with
+// any path claimed so far.
+func (c *caseCollisions) unclaimedName(dir, name string) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if stem == "" {
+		// For names like ".gitignore" the suffix goes at the end.
+		stem, ext = name, ""
+	}
+	for i := 1; ; i++ {
+		candidate := path.Join(dir, fmt.Sprintf("%s~%d%s", stem, i, ext))
+		if _, ok := c.claimed[foldCase(candidate)]; !ok {
+			return candidate
+		}
+	}
+}
+
+// foldCase returns a form of the given path that is the same for all paths
+// that differ only in letter case.
+func foldCase(name string) string {
+	// Converting to upper case first makes characters with more than
+	// one lower case form, such as the Kelvin sign, fold together.
+	return strings.ToLower(strings.ToUpper(name))
+}
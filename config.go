@@ -0,0 +1,158 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"crypto"
+	"os"
+	"time"
+)
+
+// PackerConfig is a snapshot of the configuration of a [Packer], as returned
+// by [Packer.Config], for callers that compose options dynamically and want
+// to log or validate the result.
+//
+// Each field corresponds to the option named in its comment, and is the
+// zero value if that option wasn't used. Changing a PackerConfig has no
+// effect on the packer it came from.
+type PackerConfig struct {
+	Dereference          bool            // DereferenceSymlinks
+	ApplyTerraformIgnore bool            // ApplyTerraformIgnore
+	IgnoreSemantics      IgnoreSemantics // WithIgnoreSemantics
+	AllowSymlinkTargets  []string        // AllowSymlinkTarget
+	LeadingEntries       []string        // WithLeadingEntries
+	PaxFormat            bool            // WithPaxFormat
+	FileLister           FileLister      // WithFileLister or WithGitTrackedOnly
+	BirthTimes           bool            // WithBirthTimes
+	EntryDetails         bool            // WithEntryDetails
+
+	DirModTimePolicy DirModTimePolicy // WithDirModTimePolicy
+	DirModTimeLimit  time.Time        // WithClampedDirModTimes
+
+	SkipUnreadable bool // WithSkipUnreadable
+
+	// AllowedExtensions is nil unless [WithAllowedExtensions] was used, in
+	// which case it's non-nil even if no extensions are allowed.
+	AllowedExtensions  []string         // WithAllowedExtensions
+	DeniedExtensions   []string         // WithDeniedExtensions
+	DeniedContent      []ContentKind    // WithDeniedContent
+	DeniedFilePolicy   DeniedFilePolicy // WithDeniedFilePolicy
+	SecretFilePolicy   SecretFilePolicy // WithSecretFilePolicy
+	SecretFilePatterns []string         // WithSecretFilePatterns
+
+	SizeLimit     int64 // WithSizeLimit
+	MaxPathDepth  int   // WithMaxPathDepth
+	MaxNameLength int   // WithMaxNameLength
+	MaxPathLength int   // WithMaxPathLength
+
+	ArchiveDigest bool          // WithArchiveDigest
+	ArchiveHashes []crypto.Hash // WithArchiveHashes
+
+	BufferSize int        // WithBufferSize
+	BufferPool BufferPool // WithBufferPool
+
+	BestEffortExtraction      bool                     // WithBestEffortExtraction
+	DuplicateEntryPolicy      DuplicateEntryPolicy     // WithDuplicateEntryPolicy
+	ExistingFilePolicy        ExistingFilePolicy       // WithExistingFilePolicy
+	WindowsNamePolicy         WindowsNamePolicy        // WithWindowsNamePolicy
+	ControlCharacterPolicy    ControlCharacterPolicy   // WithControlCharacterPolicy
+	PackControlCharacterCheck bool                     // WithPackControlCharacterCheck
+	CaseCollisionPolicy       CaseCollisionPolicy      // WithCaseCollisionPolicy
+	DestinationSymlinkPolicy  DestinationSymlinkPolicy // WithDestinationSymlinkPolicy
+	MultipleGzipMembers       bool                     // WithMultipleGzipMembers
+
+	HasModeMask    bool        // WithModeMask
+	ModeMask       os.FileMode // WithModeMask
+	ForcedFileMode os.FileMode // WithForcedModes
+	ForcedDirMode  os.FileMode // WithForcedModes
+
+	ClearedXattrs []string          // WithClearedXattrs
+	SetXattrs     map[string][]byte // WithSetXattr
+
+	HasUnpackReporter         bool // WithUnpackReporter
+	HasDuplicateEntryReporter bool // WithDuplicateEntryReporter
+	HasSymlinkReporter        bool // WithSymlinkReporter
+	HasCaseCollisionReporter  bool // WithCaseCollisionReporter
+	HasUnpackRemapper         bool // WithUnpackRemapper
+}
+
+// Config returns a snapshot of the packer's configuration.
+func (p *Packer) Config() PackerConfig {
+	ret := PackerConfig{
+		Dereference:          p.dereference,
+		ApplyTerraformIgnore: p.applyTerraformIgnore,
+		IgnoreSemantics:      p.ignoreSemantics,
+		AllowSymlinkTargets:  copyStrings(p.allowSymlinkTargets),
+		LeadingEntries:       copyStrings(p.leadingEntries),
+		PaxFormat:            p.paxFormat,
+		FileLister:           p.fileLister,
+		BirthTimes:           p.birthTimes,
+		EntryDetails:         p.entryDetails,
+
+		DirModTimePolicy: p.dirModTimePolicy,
+		DirModTimeLimit:  p.dirModTimeLimit,
+
+		SkipUnreadable: p.skipUnreadable,
+
+		DeniedExtensions:   copyStrings(p.deniedExts),
+		DeniedFilePolicy:   p.deniedFilePolicy,
+		SecretFilePolicy:   p.secretFilePolicy,
+		SecretFilePatterns: copyStrings(p.secretPatterns),
+
+		SizeLimit:     p.sizeLimit,
+		MaxPathDepth:  p.maxPathDepth,
+		MaxNameLength: p.maxNameLength,
+		MaxPathLength: p.maxPathLength,
+
+		ArchiveDigest: p.archiveDigest,
+		ArchiveHashes: append([]crypto.Hash(nil), p.archiveHashes...),
+
+		BufferSize: p.bufferSize,
+		BufferPool: p.bufferPool,
+
+		BestEffortExtraction:      p.bestEffort,
+		DuplicateEntryPolicy:      p.duplicatePolicy,
+		ExistingFilePolicy:        p.existingPolicy,
+		WindowsNamePolicy:         p.windowsNamePolicy,
+		ControlCharacterPolicy:    p.controlCharPolicy,
+		PackControlCharacterCheck: p.packControlCharCheck,
+		CaseCollisionPolicy:       p.caseCollisionPolicy,
+		DestinationSymlinkPolicy:  p.destSymlinkPolicy,
+		MultipleGzipMembers:       p.gzipMembers,
+
+		HasModeMask:    p.hasModeMask,
+		ModeMask:       p.modeMask,
+		ForcedFileMode: p.forcedFileMode,
+		ForcedDirMode:  p.forcedDirMode,
+
+		ClearedXattrs: copyStrings(p.clearedXattrs),
+
+		HasUnpackReporter:         p.unpackReporter != nil,
+		HasDuplicateEntryReporter: p.duplicateReporter != nil,
+		HasSymlinkReporter:        p.symlinkReporter != nil,
+		HasCaseCollisionReporter:  p.caseCollisionReporter != nil,
+		HasUnpackRemapper:         p.unpackRemapper != nil,
+	}
+	if p.allowedExtsSet {
+		ret.AllowedExtensions = append([]string{}, p.allowedExts...)
+	}
+	if len(p.deniedContent) != 0 {
+		ret.DeniedContent = append([]ContentKind(nil), p.deniedContent...)
+	}
+	if len(p.setXattrs) != 0 {
+		ret.SetXattrs = make(map[string][]byte, len(p.setXattrs))
+		for _, x := range p.setXattrs {
+			ret.SetXattrs[x.name] = append([]byte(nil), x.value...)
+		}
+	}
+	return ret
+}
+
+// copyStrings returns a copy of the given slice, or nil if it's empty.
+func copyStrings(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
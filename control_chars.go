@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ControlCharacterPolicy describes how Unpack should react to entries whose
+// names or symlink targets contain control characters, such as newlines or
+// terminal escape sequences, which can confuse downstream path handling and
+// logs. Pack applies the same policy only when the packer was created with
+// [WithPackControlCharacterCheck], and otherwise writes such names unchanged.
+//
+// Either way, Pack lists names in [Meta.Files] with each control character
+// replaced by its Go escape sequence, such as "\n" or "\x1b", so that the
+// list is safe to log.
+type ControlCharacterPolicy int
+
+const (
+	// RejectControlCharacters causes Unpack to fail with an
+	// [IllegalSlugError] using the code [ControlCharacterInName]. This is
+	// the default.
+	RejectControlCharacters ControlCharacterPolicy = iota
+
+	// AllowControlCharacters allows control characters other than NUL,
+	// which can never appear in a file name.
+	AllowControlCharacters
+)
+
+// WithControlCharacterPolicy is a PackerOption that selects how Unpack deals
+// with names that contain control characters.
+func WithControlCharacterPolicy(policy ControlCharacterPolicy) PackerOption {
+	return func(p *Packer) error {
+		switch policy {
+		case RejectControlCharacters, AllowControlCharacters:
+			p.controlCharPolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid control character policy %d", policy)
+		}
+	}
+}
+
+// WithPackControlCharacterCheck is a PackerOption that makes Pack also apply
+// the packer's [ControlCharacterPolicy] to the names it writes, so that it
+// fails instead of producing a slug that Unpack would reject.
+func WithPackControlCharacterCheck() PackerOption {
+	return func(p *Packer) error {
+		p.packControlCharCheck = true
+		return nil
+	}
+}
+
+// checkControlCharacters returns an error if the name or link target of the
+// given header contains a character that the packer's control character
+// policy doesn't allow.
+func (p *Packer) checkControlCharacters(header *tar.Header) error {
+	if p.controlCharPolicy == AllowControlCharacters {
+		// Unpack rejects NUL characters regardless, when it checks
+		// the header with unpackinfo.NewUnpackInfo.
+		if strings.IndexByte(header.Name, 0) < 0 && strings.IndexByte(header.Linkname, 0) < 0 {
+			return nil
+		}
+	}
+	if hasControlCharacter(header.Name) {
+		return &IllegalSlugError{
+			Code: ControlCharacterInName,
+			Err:  fmt.Errorf("entry %q has a name containing control characters", header.Name),
+		}
+	}
+	if hasControlCharacter(header.Linkname) {
+		return &IllegalSlugError{
+			Code: ControlCharacterInName,
+			Err:  fmt.Errorf("entry %q has a link target containing control characters", header.Name),
+		}
+	}
+	return nil
+}
+
+func hasControlCharacter(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// sanitizeName returns the given name with each control character replaced
+// by its Go escape sequence.
+func sanitizeName(name string) string {
+	if !hasControlCharacter(name) {
+		return name
+	}
+	var b strings.Builder
+	for _, r := range name {
+		if !unicode.IsControl(r) {
+			b.WriteRune(r)
+			continue
+		}
+		quoted := strconv.QuoteRune(r)
+		b.WriteString(quoted[1 : len(quoted)-1])
+	}
+	return b.String()
+}
@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DestinationSymlinkPolicy describes how Unpack should react when its
+// destination directory is a symlink, which would otherwise make Unpack
+// extract everything wherever the symlink refers to.
+//
+// The policy applies only to the destination directory itself. Unpack never
+// follows symlinks inside the destination, whichever policy is in effect:
+// it refuses to extract an entry through a symlinked parent directory or to
+// extract a directory over a symlink, and it replaces a symlink at the path
+// of a file or symlink entry rather than writing through it.
+type DestinationSymlinkPolicy int
+
+const (
+	// FollowDestinationSymlinks extracts into the directory that a
+	// symlinked destination refers to. This is the default.
+	//
+	// Unpack resolves the destination once before extracting anything, and
+	// then uses the resolved path for all of its checks, so changing the
+	// symlink during extraction can't redirect the remaining entries.
+	FollowDestinationSymlinks DestinationSymlinkPolicy = iota
+
+	// RejectDestinationSymlinks causes Unpack to fail before extracting
+	// anything if the destination directory is itself a symlink. Symlinks
+	// among its parent directories are still followed, since operating
+	// systems commonly use them for directories such as /tmp on macOS.
+	RejectDestinationSymlinks
+)
+
+// WithDestinationSymlinkPolicy is a PackerOption that selects how Unpack
+// deals with a destination directory that is a symlink.
+func WithDestinationSymlinkPolicy(policy DestinationSymlinkPolicy) PackerOption {
+	return func(p *Packer) error {
+		switch policy {
+		case FollowDestinationSymlinks, RejectDestinationSymlinks:
+			p.destSymlinkPolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid destination symlink policy %d", policy)
+		}
+	}
+}
+
+// resolveDestination returns the absolute path of the given destination
+// directory with all symlinks resolved, applying the packer's destination
+// symlink policy. The destination and any of its parent directories may not
+// exist yet, in which case Unpack will create them.
+func (p *Packer) resolveDestination(dst string) (string, error) {
+	if dst == "" {
+		// We'll leave unpackinfo to reject this as usual.
+		return dst, nil
+	}
+	abs, err := filepath.Abs(dst)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve destination %q: %w", dst, err)
+	}
+	if p.destSymlinkPolicy == RejectDestinationSymlinks {
+		if info, err := os.Lstat(abs); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("destination %q is a symlink", dst)
+		}
+	}
+
+	// We resolve the nearest directory that already exists, and then add
+	// back the parts that Unpack will create.
+	existing, rest := abs, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to resolve destination %q: %w", dst, err)
+		}
+		if _, err := os.Lstat(existing); err == nil {
+			// This must be a symlink whose target doesn't exist, which
+			// Unpack would fail to create directories through anyway.
+			return "", fmt.Errorf("destination %q refers to a dangling symlink at %q", dst, existing)
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
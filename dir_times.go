@@ -0,0 +1,76 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"fmt"
+	"time"
+)
+
+// DirModTimePolicy describes how Pack records the modification times of
+// directories.
+//
+// A directory's modification time changes whenever an entry is added to or
+// removed from it, even if the entry is a temporary file that's gone again
+// by the time Pack runs. Recording these times makes the bytes of the slug
+// change even when nothing in it has, which can cause spurious misses for
+// caches keyed by the slug's checksum.
+type DirModTimePolicy int
+
+const (
+	// KeepDirModTimes records the modification time of each directory.
+	// This is the default.
+	KeepDirModTimes DirModTimePolicy = iota
+
+	// OmitDirModTimes records no modification time for directories, which
+	// in the tar format means recording the Unix epoch. Unpack leaves the
+	// modification time of such a directory as the time it was extracted.
+	OmitDirModTimes
+)
+
+// WithDirModTimePolicy is a PackerOption that selects how Pack records the
+// modification times of directories. It doesn't affect the modification
+// times of other entries.
+func WithDirModTimePolicy(policy DirModTimePolicy) PackerOption {
+	return func(p *Packer) error {
+		switch policy {
+		case KeepDirModTimes, OmitDirModTimes:
+			p.dirModTimePolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid directory modification time policy %d", policy)
+		}
+	}
+}
+
+// WithClampedDirModTimes is a PackerOption that makes Pack record the
+// modification time of any directory modified after limit as limit instead,
+// in the same way as the --clamp-mtime option of GNU tar. Setting limit to
+// a fixed time, such as the time of the latest commit of the packed source
+// code, means that only the directories that haven't changed since then
+// keep their real modification times.
+//
+// This option has no effect with [OmitDirModTimes].
+func WithClampedDirModTimes(limit time.Time) PackerOption {
+	return func(p *Packer) error {
+		if limit.IsZero() {
+			return fmt.Errorf("directory modification time limit must not be zero")
+		}
+		p.dirModTimeLimit = limit
+		return nil
+	}
+}
+
+// dirModTime returns the modification time that Pack should record for a
+// directory whose real modification time is the given time.
+func (p *Packer) dirModTime(modTime time.Time) time.Time {
+	switch {
+	case p.dirModTimePolicy == OmitDirModTimes:
+		return time.Unix(0, 0)
+	case !p.dirModTimeLimit.IsZero() && modTime.After(p.dirModTimeLimit):
+		return p.dirModTimeLimit
+	default:
+		return modTime
+	}
+}
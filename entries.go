@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+	"fmt"
+)
+
+// EntryType is the type of an entry in a slug, as described by [Entry].
+type EntryType int
+
+const (
+	// RegularFileEntry is a regular file, including any file that Pack
+	// created by dereferencing a symlink.
+	RegularFileEntry EntryType = iota
+
+	// DirectoryEntry is a directory.
+	DirectoryEntry
+
+	// SymlinkEntry is a symlink.
+	SymlinkEntry
+)
+
+// String returns the name of the type, as used in the constant names.
+func (t EntryType) String() string {
+	switch t {
+	case RegularFileEntry:
+		return "RegularFileEntry"
+	case DirectoryEntry:
+		return "DirectoryEntry"
+	case SymlinkEntry:
+		return "SymlinkEntry"
+	default:
+		return fmt.Sprintf("EntryType(%d)", int(t))
+	}
+}
+
+// Entry describes an entry that Pack wrote to a slug, as recorded in
+// [Meta.Entries] when packing with [WithEntryDetails].
+type Entry struct {
+	// Name is the name of the entry, as listed in [Meta.Files].
+	Name string
+
+	// Type is the type of the entry.
+	Type EntryType
+
+	// Target is the target of a symlink, as recorded in the slug, or an
+	// empty string for other types of entry. Any control characters are
+	// escaped in the same way as in Name.
+	Target string
+
+	// Size is the size in bytes of the content of a regular file, or zero
+	// for other types of entry.
+	Size int64
+}
+
+// WithEntryDetails is a PackerOption that makes Pack describe each entry it
+// writes in [Meta.Entries], including the type of the entry and the target
+// of each symlink, so that callers can audit the content of a slug without
+// reading it back.
+func WithEntryDetails() PackerOption {
+	return func(p *Packer) error {
+		p.entryDetails = true
+		return nil
+	}
+}
+
+// entryFromHeader returns the description of the entry written with the
+// given header, whose name is recorded as the given name.
+func entryFromHeader(name string, header *tar.Header) Entry {
+	ret := Entry{Name: name}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		ret.Type = DirectoryEntry
+	case tar.TypeSymlink:
+		ret.Type = SymlinkEntry
+		ret.Target = sanitizeName(header.Linkname)
+	default:
+		ret.Type = RegularFileEntry
+		ret.Size = header.Size
+	}
+	return ret
+}
@@ -0,0 +1,258 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ContentKind classifies the content of a file by its leading "magic"
+// bytes, for use with [WithDeniedContent].
+type ContentKind int
+
+const (
+	// NativeExecutable matches compiled programs and libraries in the ELF,
+	// Mach-O, and PE formats. The Mach-O "universal binary" signature is
+	// shared with Java class files, which are therefore matched too. PE
+	// files are matched by their DOS stub only if it points to a PE header.
+	NativeExecutable ContentKind = iota + 1
+
+	// CompressedArchive matches zip, gzip, bzip2, xz, zstd, 7z, and rar
+	// files, and tar archives.
+	CompressedArchive
+)
+
+// String returns the name of the kind, as used in the constant names.
+func (k ContentKind) String() string {
+	switch k {
+	case NativeExecutable:
+		return "NativeExecutable"
+	case CompressedArchive:
+		return "CompressedArchive"
+	default:
+		return fmt.Sprintf("ContentKind(%d)", int(k))
+	}
+}
+
+// contentSignatures are the magic numbers that identify each kind of
+// content, at the start of a file.
+var contentSignatures = map[ContentKind][][]byte{
+	NativeExecutable: {
+		[]byte("\x7fELF"),
+		{0xfe, 0xed, 0xfa, 0xce}, {0xfe, 0xed, 0xfa, 0xcf}, // Mach-O, big-endian
+		{0xce, 0xfa, 0xed, 0xfe}, {0xcf, 0xfa, 0xed, 0xfe}, // Mach-O, little-endian
+		{0xca, 0xfe, 0xba, 0xbe}, // Mach-O universal binary
+		// PE is checked separately by isPE.
+	},
+	CompressedArchive: {
+		[]byte("PK\x03\x04"), []byte("PK\x05\x06"), // zip, including empty archives
+		{0x1f, 0x8b},                       // gzip
+		[]byte("BZh"),                      // bzip2
+		{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+		{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+		{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+		[]byte("Rar!\x1a\x07"),             // rar
+	},
+}
+
+// tarMagicOffset is the offset of the "ustar" magic in a tar header, which
+// identifies tar archives in both the POSIX and GNU formats.
+const tarMagicOffset = 257
+
+// peOffsetField is the offset of the e_lfanew field in the DOS header of a
+// PE file, which holds the offset of the "PE\0\0" signature.
+const peOffsetField = 0x3c
+
+// DeniedFilePolicy describes how Pack should react to a file that is
+// excluded by [WithAllowedExtensions], [WithDeniedExtensions], or
+// [WithDeniedContent].
+type DeniedFilePolicy int
+
+const (
+	// RejectDeniedFiles causes Pack to fail with an [IllegalSlugError]
+	// using the code [DeniedFileType]. This is the default.
+	RejectDeniedFiles DeniedFilePolicy = iota
+
+	// SkipDeniedFiles omits the file from the slug and lists it in
+	// [Meta.DeniedFiles].
+	SkipDeniedFiles
+)
+
+// DeniedFile describes a file that Pack skipped because of
+// [SkipDeniedFiles].
+type DeniedFile struct {
+	// Name is the name that the file would have had in the slug.
+	Name string
+
+	// Reason describes which rule excluded the file.
+	Reason string
+}
+
+// WithAllowedExtensions is a PackerOption that makes Pack deny any regular
+// file whose extension is not one of those given. Extensions are compared
+// without regard to case, and may be given with or without a leading
+// period. Pass an empty string to allow files with no extension, such as
+// "README" or "LICENSE".
+//
+// Calling WithAllowedExtensions more than once allows the extensions from
+// all of the calls. Denied files are handled according to
+// [WithDeniedFilePolicy].
+func WithAllowedExtensions(exts ...string) PackerOption {
+	return func(p *Packer) error {
+		p.allowedExts = append(p.allowedExts, normalizeExtensions(exts)...)
+		p.allowedExtsSet = true
+		return nil
+	}
+}
+
+// WithDeniedExtensions is a PackerOption that makes Pack deny any regular
+// file with one of the given extensions, which are compared without regard
+// to case and may be given with or without a leading period.
+//
+// Calling WithDeniedExtensions more than once denies the extensions from
+// all of the calls. Denied files are handled according to
+// [WithDeniedFilePolicy].
+func WithDeniedExtensions(exts ...string) PackerOption {
+	return func(p *Packer) error {
+		p.deniedExts = append(p.deniedExts, normalizeExtensions(exts)...)
+		return nil
+	}
+}
+
+// WithDeniedContent is a PackerOption that makes Pack deny any regular file
+// whose content begins with the signature of one of the given kinds,
+// regardless of its name. This requires Pack to read the start of every
+// file an extra time.
+//
+// Calling WithDeniedContent more than once denies the kinds from all of the
+// calls. Denied files are handled according to [WithDeniedFilePolicy].
+func WithDeniedContent(kinds ...ContentKind) PackerOption {
+	return func(p *Packer) error {
+		for _, kind := range kinds {
+			if _, ok := contentSignatures[kind]; !ok {
+				return fmt.Errorf("invalid content kind %d", kind)
+			}
+		}
+		p.deniedContent = append(p.deniedContent, kinds...)
+		return nil
+	}
+}
+
+// WithDeniedFilePolicy is a PackerOption that selects how Pack deals with
+// files that are denied by [WithAllowedExtensions], [WithDeniedExtensions],
+// or [WithDeniedContent].
+func WithDeniedFilePolicy(policy DeniedFilePolicy) PackerOption {
+	return func(p *Packer) error {
+		switch policy {
+		case RejectDeniedFiles, SkipDeniedFiles:
+			p.deniedFilePolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid denied file policy %d", policy)
+		}
+	}
+}
+
+// normalizeExtensions returns the given extensions in lowercase with a
+// leading period, except for the empty extension.
+func normalizeExtensions(exts []string) []string {
+	ret := make([]string, len(exts))
+	for i, ext := range exts {
+		ext = strings.ToLower(ext)
+		if ext != "" && !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		ret[i] = ext
+	}
+	return ret
+}
+
+// checkFileType returns a description of the rule that denies the regular
+// file at the given path, which will be named name in the slug and has the
+// given size, or an empty string if the file is allowed.
+func (p *Packer) checkFileType(filePath, name string, size int64) (string, error) {
+	ext := strings.ToLower(path.Ext(name))
+	if p.allowedExtsSet && !containsString(p.allowedExts, ext) {
+		if ext == "" {
+			return "files without an extension are not allowed", nil
+		}
+		return fmt.Sprintf("extension %q is not allowed", ext), nil
+	}
+	if ext != "" && containsString(p.deniedExts, ext) {
+		return fmt.Sprintf("extension %q is denied", ext), nil
+	}
+	if len(p.deniedContent) == 0 || size == 0 {
+		// An empty file can't match any content signature.
+		return "", nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed opening file %q to check its content: %w", filePath, err)
+	}
+	defer f.Close()
+	head := make([]byte, tarMagicOffset+5)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("failed reading file %q to check its content: %w", filePath, err)
+	}
+	head = head[:n]
+
+	for _, kind := range p.deniedContent {
+		if contentMatches(kind, head, f) {
+			return fmt.Sprintf("content is denied as %s", kind), nil
+		}
+	}
+	return "", nil
+}
+
+// contentMatches returns true if the given leading bytes of the file f
+// match the signature of the given kind of content.
+func contentMatches(kind ContentKind, head []byte, f io.ReaderAt) bool {
+	for _, sig := range contentSignatures[kind] {
+		if bytes.HasPrefix(head, sig) {
+			return true
+		}
+	}
+	switch kind {
+	case NativeExecutable:
+		return isPE(head, f)
+	case CompressedArchive:
+		if len(head) >= tarMagicOffset+5 {
+			return string(head[tarMagicOffset:tarMagicOffset+5]) == "ustar"
+		}
+	}
+	return false
+}
+
+// isPE returns true if the file f, with the given leading bytes, is in the
+// PE format. The "MZ" signature of the DOS stub is too short to identify a
+// PE file alone, and so the DOS header must also point to a PE header,
+// which may be anywhere in the file.
+func isPE(head []byte, f io.ReaderAt) bool {
+	if !bytes.HasPrefix(head, []byte("MZ")) || len(head) < peOffsetField+4 {
+		return false
+	}
+	offset := binary.LittleEndian.Uint32(head[peOffsetField:])
+	sig := make([]byte, 4)
+	if _, err := f.ReadAt(sig, int64(offset)); err != nil {
+		return false
+	}
+	return string(sig) == "PE\x00\x00"
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
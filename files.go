@@ -0,0 +1,127 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DefaultFileSizeLimit is the size limit that [PackDirToFile] and
+// [UnpackFileToDir] use unless overridden using [WithSizeLimit]. [FS] also
+// uses it unless overridden using [WithFSSizeLimit].
+const DefaultFileSizeLimit int64 = 1 << 30 // 1GiB
+
+// PackDirToFile packs the src directory into a new slug file at the dst path,
+// creating any missing parent directories of dst.
+//
+// The slug is written to a temporary file in the same directory as dst and
+// then renamed into place only if packing succeeds, so that dst is never
+// left containing an incomplete slug.
+//
+// By default PackDirToFile applies .terraformignore rules and enforces a
+// size limit of [DefaultFileSizeLimit]. The given options are applied after
+// those defaults, and so can override them. If ctx is cancelled then packing
+// stops at the next write and PackDirToFile returns the context's error.
+func PackDirToFile(ctx context.Context, src, dst string, options ...PackerOption) (*Meta, error) {
+	p, err := NewPacker(
+		append([]PackerOption{ApplyTerraformIgnore(), WithSizeLimit(DefaultFileSizeLimit)}, options...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for slug: %w", err)
+	}
+	f, err := os.CreateTemp(dir, ".tmp-"+filepath.Base(dst)+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create slug file: %w", err)
+	}
+	tmpPath := f.Name()
+	// If we return before the rename then this will clean up after us, but
+	// once the rename succeeds this will silently do nothing.
+	defer os.Remove(tmpPath)
+
+	meta, err := p.Pack(src, &contextWriter{ctx: ctx, w: f})
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write slug file: %w", closeErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// os.CreateTemp always uses mode 0600, but a slug file isn't secret
+	// and so we'll use the usual mode for a new file.
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return nil, fmt.Errorf("failed to set slug file permissions: %w", err)
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return nil, fmt.Errorf("failed to place slug file: %w", err)
+	}
+	return meta, nil
+}
+
+// UnpackFileToDir extracts the slug file at the src path into the dst
+// directory, creating dst and any missing parent directories if necessary.
+//
+// By default UnpackFileToDir enforces a size limit of [DefaultFileSizeLimit].
+// The given options are applied after that default, and so can override it.
+// If ctx is cancelled then extraction stops at the next read and
+// UnpackFileToDir returns the context's error, possibly leaving dst only
+// partially populated.
+func UnpackFileToDir(ctx context.Context, src, dst string, options ...PackerOption) error {
+	p, err := NewPacker(
+		append([]PackerOption{WithSizeLimit(DefaultFileSizeLimit)}, options...)...,
+	)
+	if err != nil {
+		return err
+	}
+
+	dst, err = filepath.Abs(dst)
+	if err != nil {
+		return fmt.Errorf("failed to read absolute path for destination: %w", err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open slug file: %w", err)
+	}
+	defer f.Close()
+
+	return p.Unpack(&contextReader{ctx: ctx, r: f}, dst)
+}
+
+// contextWriter is an io.Writer that fails once its context is cancelled.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// contextReader is an io.Reader that fails once its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
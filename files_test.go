@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackDirToFile(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "nested", "slug.tar.gz")
+	meta, err := PackDirToFile(context.Background(), "testdata/archive-dir-no-external", dst)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("slug file not created: %v", err)
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0644); got != want {
+		t.Errorf("wrong file mode %v; want %v", got, want)
+	}
+
+	// The temporary file should've been renamed into place.
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("unexpected extra files alongside the slug: %v", entries)
+	}
+
+	unpackDir := filepath.Join(t.TempDir(), "unpacked")
+	if err := UnpackFileToDir(context.Background(), dst, unpackDir); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, name := range meta.Files {
+		if _, err := os.Lstat(filepath.Join(unpackDir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("missing %s after unpacking: %s", name, err)
+		}
+	}
+}
+
+func TestPackDirToFile_sizeLimit(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "slug.tar.gz")
+	_, err := PackDirToFile(context.Background(), "testdata/archive-dir-no-external", dst, WithSizeLimit(5))
+	var illegal *IllegalSlugError
+	if !errors.As(err, &illegal) || illegal.Code != SizeLimitExceeded {
+		t.Fatalf("expected size limit error, got %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("failed pack left files behind: %v", entries)
+	}
+
+	// The limit also applies when unpacking.
+	if _, err := PackDirToFile(context.Background(), "testdata/archive-dir-no-external", dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = UnpackFileToDir(context.Background(), dst, t.TempDir(), WithSizeLimit(5))
+	if !errors.As(err, &illegal) || illegal.Code != SizeLimitExceeded {
+		t.Fatalf("expected size limit error, got %v", err)
+	}
+}
+
+func TestPackDirToFile_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	dst := filepath.Join(t.TempDir(), "slug.tar.gz")
+	_, err := PackDirToFile(ctx, "testdata/archive-dir-no-external", dst)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("slug file exists after cancelled pack")
+	}
+}
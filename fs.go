@@ -0,0 +1,388 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FSSymlinkPolicy describes how the filesystem returned by [FS] presents
+// symlinks from the slug.
+type FSSymlinkPolicy int
+
+const (
+	// FollowFSSymlinks makes symlinks behave as the entries they refer to,
+	// as they would after unpacking the slug. A symlink whose target is
+	// missing or outside of the slug behaves as if it doesn't exist when
+	// opened, but is still listed by ReadDir. This is the default.
+	FollowFSSymlinks FSSymlinkPolicy = iota
+
+	// ExposeFSSymlinks presents each symlink as a file with the mode
+	// [fs.ModeSymlink] whose content is the symlink's target. Paths that
+	// traverse a symlink to a directory cannot be opened.
+	ExposeFSSymlinks
+
+	// OmitFSSymlinks leaves symlinks out of the filesystem entirely.
+	OmitFSSymlinks
+)
+
+// FSOption is a functional option that can configure the filesystem
+// returned by [FS].
+type FSOption func(*slugFS) error
+
+// WithFSSymlinkPolicy is an FSOption that selects how the filesystem
+// presents the symlinks in the slug.
+func WithFSSymlinkPolicy(policy FSSymlinkPolicy) FSOption {
+	return func(f *slugFS) error {
+		switch policy {
+		case FollowFSSymlinks, ExposeFSSymlinks, OmitFSSymlinks:
+			f.symlinkPolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid symlink policy %d", policy)
+		}
+	}
+}
+
+// WithFSSizeLimit is an FSOption that limits the total size of the content
+// of the files in the slug to the given number of bytes, because [FS] holds
+// all of it in memory. FS fails with an [IllegalSlugError] using the code
+// [SizeLimitExceeded] if the slug exceeds the limit.
+//
+// The default limit is [DefaultFileSizeLimit]. A limit of zero means that
+// there is no limit, which is safe only for slugs from trusted sources.
+func WithFSSizeLimit(maxBytes int64) FSOption {
+	return func(f *slugFS) error {
+		if maxBytes < 0 {
+			return fmt.Errorf("size limit must not be negative")
+		}
+		f.sizeLimit = maxBytes
+		return nil
+	}
+}
+
+// maxFSSymlinkHops is the number of symlinks that the filesystem returned
+// by [FS] will follow while resolving a single path, to prevent cycles.
+const maxFSSymlinkHops = 255
+
+// FS reads the slug of the given size from r and returns a read-only
+// filesystem presenting its contents, so that callers can inspect a slug
+// using the standard [fs] functions without unpacking it to disk.
+//
+// FS reads the whole slug into memory immediately, and so the returned
+// filesystem doesn't refer to r after FS returns. Use [WithFSSizeLimit] to
+// change how much file content FS will accept. Entries of types other
+// than regular files, directories, and symlinks are omitted, and when the
+// slug contains more than one entry with the same name the last one wins.
+// Any parent directory that lacks its own entry is presented with the mode
+// 0755 and a zero modification time.
+func FS(r io.ReaderAt, size int64, options ...FSOption) (fs.FS, error) {
+	f := &slugFS{
+		sizeLimit: DefaultFileSizeLimit,
+		entries: map[string]*fsEntry{
+			".": {name: ".", mode: fs.ModeDir | 0755},
+		},
+	}
+	for _, opt := range options {
+		if err := opt(f); err != nil {
+			return nil, fmt.Errorf("option failed: %w", err)
+		}
+	}
+
+	uncompressed, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress slug: %w", err)
+	}
+	untar := tar.NewReader(uncompressed)
+	var total int64
+	for {
+		header, err := untar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to untar slug: %w", err)
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if !fs.ValidPath(name) || name == "." {
+			return nil, &IllegalSlugError{
+				Code: TraversalOutsideRoot,
+				Err:  fmt.Errorf("invalid filename %q", header.Name),
+			}
+		}
+
+		entry := &fsEntry{
+			name:    path.Base(name),
+			mode:    fs.FileMode(header.Mode).Perm(),
+			modTime: header.ModTime,
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.mode |= fs.ModeDir
+			if existing := f.entries[name]; existing != nil && existing.mode.IsDir() {
+				existing.mode, existing.modTime = entry.mode, entry.modTime
+				continue
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			// We check the size before reading anything, so that a slug
+			// that would exhaust memory fails early.
+			if f.sizeLimit != 0 && header.Size > f.sizeLimit-total {
+				return nil, &IllegalSlugError{
+					Code: SizeLimitExceeded,
+					Err:  fmt.Errorf("entry %q exceeds the size limit of %d bytes", header.Name, f.sizeLimit),
+				}
+			}
+			total += header.Size
+			entry.data, err = io.ReadAll(untar)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %q from slug: %w", header.Name, err)
+			}
+		case tar.TypeSymlink:
+			if f.symlinkPolicy == OmitFSSymlinks {
+				continue
+			}
+			entry.mode = fs.ModeSymlink | 0777
+			entry.data = []byte(header.Linkname)
+		default:
+			continue
+		}
+		if err := f.add(name, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	// We sort each directory's children only once they're all known, so
+	// that ReadDir never modifies the shared entries and can be called
+	// concurrently.
+	for _, entry := range f.entries {
+		if entry.mode.IsDir() {
+			sort.Strings(entry.children)
+		}
+	}
+	return f, nil
+}
+
+// slugFS is the implementation of [fs.FS] returned by [FS].
+type slugFS struct {
+	symlinkPolicy FSSymlinkPolicy
+	sizeLimit     int64
+
+	// entries are all of the entries in the slug, keyed by their full
+	// names in the form used by the fs package.
+	entries map[string]*fsEntry
+}
+
+var _ fs.FS = (*slugFS)(nil)
+
+type fsEntry struct {
+	name    string
+	mode    fs.FileMode
+	modTime time.Time
+
+	// data is the content of a regular file or the target of a symlink.
+	data []byte
+
+	// children are the base names of the entries in a directory, sorted
+	// once the whole slug has been read.
+	children []string
+}
+
+// add records the given entry, creating any missing parent directories and
+// replacing any earlier entry with the same name.
+func (f *slugFS) add(name string, entry *fsEntry) error {
+	if existing := f.entries[name]; existing != nil {
+		if existing.mode.IsDir() {
+			f.removeTree(name)
+		}
+	} else {
+		parentName := path.Dir(name)
+		parent := f.entries[parentName]
+		if parent == nil {
+			parent = &fsEntry{name: path.Base(parentName), mode: fs.ModeDir | 0755}
+			if err := f.add(parentName, parent); err != nil {
+				return err
+			}
+		} else if !parent.mode.IsDir() {
+			code := UnknownIllegalSlug
+			if parent.mode&fs.ModeSymlink != 0 {
+				code = ExtractThroughSymlink
+			}
+			return &IllegalSlugError{
+				Code: code,
+				Err:  fmt.Errorf("entry %q is inside %q, which is not a directory", name, parentName),
+			}
+		}
+		parent.children = append(parent.children, entry.name)
+	}
+	f.entries[name] = entry
+	return nil
+}
+
+// removeTree removes everything below the directory with the given name,
+// so that the directory can be replaced by a later entry of another type.
+func (f *slugFS) removeTree(name string) {
+	dir := f.entries[name]
+	for _, child := range dir.children {
+		childName := path.Join(name, child)
+		if f.entries[childName].mode.IsDir() {
+			f.removeTree(childName)
+		}
+		delete(f.entries, childName)
+	}
+}
+
+// Open implements fs.FS.
+func (f *slugFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	fullName, entry, err := f.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	ret := &fsFile{
+		fs:       f,
+		fullName: fullName,
+		info:     fsFileInfo{entry: entry, name: path.Base(name)},
+	}
+	if !entry.mode.IsDir() {
+		ret.content = bytes.NewReader(entry.data)
+	}
+	return ret, nil
+}
+
+// resolve returns the entry with the given name, following symlinks in any
+// part of the name if the symlink policy calls for it, along with its full
+// name after following those symlinks.
+func (f *slugFS) resolve(name string) (string, *fsEntry, error) {
+	var remain []string
+	if name != "." {
+		remain = strings.Split(name, "/")
+	}
+	current := "."
+	hops := 0
+	for len(remain) != 0 {
+		next := path.Join(current, remain[0])
+		remain = remain[1:]
+		entry := f.entries[next]
+		if entry == nil {
+			return "", nil, fs.ErrNotExist
+		}
+
+		if entry.mode&fs.ModeSymlink != 0 && f.symlinkPolicy == FollowFSSymlinks {
+			hops++
+			if hops > maxFSSymlinkHops {
+				return "", nil, fmt.Errorf("too many levels of symbolic links")
+			}
+			target := string(entry.data)
+			if path.IsAbs(target) {
+				return "", nil, fs.ErrNotExist
+			}
+			target = path.Join(path.Dir(next), target)
+			if target == ".." || strings.HasPrefix(target, "../") {
+				return "", nil, fs.ErrNotExist
+			}
+			// We continue from the root with the target's components in
+			// place of the symlink's, which might include more symlinks.
+			if target != "." {
+				remain = append(strings.Split(target, "/"), remain...)
+			}
+			current = "."
+			continue
+		}
+
+		if len(remain) != 0 && !entry.mode.IsDir() {
+			return "", nil, fs.ErrNotExist
+		}
+		current = next
+	}
+	return current, f.entries[current], nil
+}
+
+// fsFile is the implementation of [fs.File] for [slugFS].
+type fsFile struct {
+	fs       *slugFS
+	fullName string
+	info     fsFileInfo
+
+	// content is used for anything other than directories.
+	content *bytes.Reader
+
+	// dirPos is the number of directory entries already returned by ReadDir.
+	dirPos int
+}
+
+var _ fs.ReadDirFile = (*fsFile)(nil)
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.content == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: fmt.Errorf("is a directory")}
+	}
+	return f.content.Read(p)
+}
+
+func (f *fsFile) Close() error {
+	return nil
+}
+
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	dir := f.info.entry
+	if !dir.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info.name, Err: fmt.Errorf("not a directory")}
+	}
+
+	remain := dir.children[f.dirPos:]
+	if n > 0 && len(remain) > n {
+		remain = remain[:n]
+	}
+	if n > 0 && len(remain) == 0 {
+		return nil, io.EOF
+	}
+	ret := make([]fs.DirEntry, len(remain))
+	for i, child := range remain {
+		childName := path.Join(f.fullName, child)
+		entry := f.fs.entries[childName]
+		if entry.mode&fs.ModeSymlink != 0 && f.fs.symlinkPolicy == FollowFSSymlinks {
+			// We present a symlink as its target if the target exists,
+			// so that the directory listing agrees with Open.
+			if _, target, err := f.fs.resolve(childName); err == nil {
+				entry = target
+			}
+		}
+		ret[i] = fs.FileInfoToDirEntry(fsFileInfo{entry: entry, name: child})
+	}
+	f.dirPos += len(remain)
+	return ret, nil
+}
+
+// fsFileInfo is the implementation of [fs.FileInfo] for [slugFS]. The name
+// is separate from the entry so that an entry reached through a symlink
+// has the symlink's name.
+type fsFileInfo struct {
+	entry *fsEntry
+	name  string
+}
+
+var _ fs.FileInfo = fsFileInfo{}
+
+func (i fsFileInfo) Name() string       { return i.name }
+func (i fsFileInfo) Size() int64        { return int64(len(i.entry.data)) }
+func (i fsFileInfo) Mode() fs.FileMode  { return i.entry.mode }
+func (i fsFileInfo) ModTime() time.Time { return i.entry.modTime }
+func (i fsFileInfo) IsDir() bool        { return i.entry.mode.IsDir() }
+func (i fsFileInfo) Sys() any           { return nil }
@@ -0,0 +1,189 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub", "deep"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "main.tf"), []byte("# main"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "deep", "file.txt"), []byte("deep"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink("main.tf", filepath.Join(src, "link.tf")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink("../sub/deep", filepath.Join(src, "sub", "dirlink")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Pack(src, &buf, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	slug := bytes.NewReader(buf.Bytes())
+
+	t.Run("follow", func(t *testing.T) {
+		fsys, err := FS(slug, slug.Size())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := fstest.TestFS(fsys, "main.tf", "link.tf", "sub/deep/file.txt", "sub/dirlink/file.txt"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := fs.ReadFile(fsys, "sub/dirlink/file.txt")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(got) != "deep" {
+			t.Errorf("wrong content %q", got)
+		}
+	})
+
+	t.Run("expose", func(t *testing.T) {
+		fsys, err := FS(slug, slug.Size(), WithFSSymlinkPolicy(ExposeFSSymlinks))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		info, err := fs.Stat(fsys, "link.tf")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			t.Errorf("wrong mode %s; want a symlink", info.Mode())
+		}
+		got, err := fs.ReadFile(fsys, "link.tf")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(got) != "main.tf" {
+			t.Errorf("wrong symlink target %q", got)
+		}
+		if _, err := fs.Stat(fsys, "sub/dirlink/file.txt"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("wrong error %v; want fs.ErrNotExist", err)
+		}
+	})
+
+	t.Run("omit", func(t *testing.T) {
+		fsys, err := FS(slug, slug.Size(), WithFSSymlinkPolicy(OmitFSSymlinks))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var got []string
+		err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			got = append(got, path)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		want := []string{".", "main.tf", "sub", "sub/deep", "sub/deep/file.txt"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong paths\ngot:  %#v\nwant: %#v", got, want)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		fsys, err := FS(slug, slug.Size())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		want := []string{"link.tf", "main.tf", "sub"}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				entries, err := fs.ReadDir(fsys, ".")
+				if err != nil {
+					t.Errorf("err: %v", err)
+					return
+				}
+				var got []string
+				for _, entry := range entries {
+					got = append(got, entry.Name())
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("wrong entries\ngot:  %#v\nwant: %#v", got, want)
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestFSInvalidSlug(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	tarW.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tarW.Write([]byte("hello"))
+	tarW.Close()
+	gzipW.Close()
+	slug := bytes.NewReader(buf.Bytes())
+	_, err := FS(slug, slug.Size())
+	var illegal *IllegalSlugError
+	if !errors.As(err, &illegal) || illegal.Code != TraversalOutsideRoot {
+		t.Fatalf("wrong error %v; want TraversalOutsideRoot", err)
+	}
+}
+
+func TestFSSizeLimit(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	for _, name := range []string{"a.tf", "b.tf", "c.tf"} {
+		tarW.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+		tarW.Write([]byte("hello"))
+	}
+	tarW.Close()
+	gzipW.Close()
+	slug := bytes.NewReader(buf.Bytes())
+
+	if _, err := FS(slug, slug.Size(), WithFSSizeLimit(15)); err != nil {
+		t.Fatalf("unexpected error at the limit: %v", err)
+	}
+	_, err := FS(slug, slug.Size(), WithFSSizeLimit(14))
+	var illegal *IllegalSlugError
+	if !errors.As(err, &illegal) || illegal.Code != SizeLimitExceeded {
+		t.Fatalf("wrong error %v; want SizeLimitExceeded", err)
+	}
+
+	// The default limit applies without any options, and FS rejects an
+	// oversized entry before reading its content, so this slug doesn't
+	// need to contain it.
+	buf.Reset()
+	gzipW = gzip.NewWriter(&buf)
+	tarW = tar.NewWriter(gzipW)
+	tarW.WriteHeader(&tar.Header{Name: "bomb", Typeflag: tar.TypeReg, Mode: 0644, Size: DefaultFileSizeLimit + 1})
+	tarW.Flush()
+	gzipW.Close()
+	slug = bytes.NewReader(buf.Bytes())
+	_, err = FS(slug, slug.Size())
+	if !errors.As(err, &illegal) || illegal.Code != SizeLimitExceeded {
+		t.Fatalf("wrong error %v; want SizeLimitExceeded", err)
+	}
+
+	// A limit of zero means that there is no limit.
+	if _, err := FS(slug, slug.Size(), WithFSSizeLimit(0)); errors.As(err, &illegal) {
+		t.Fatalf("unexpected size limit error without a limit: %v", err)
+	}
+}
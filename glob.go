@@ -0,0 +1,82 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// isGlobPattern returns true if the given string contains any of the
+// metacharacters recognized by [path.Match].
+func isGlobPattern(s string) bool {
+	return strings.ContainsAny(s, `*?[`)
+}
+
+// validateGlobPattern checks that the given slash-separated pattern is
+// valid for use with matchGlob. A relative pattern may begin with ".."
+// segments, which are resolved before matching, but ".." must not appear
+// anywhere else because it would be ambiguous after a wildcard.
+func validateGlobPattern(pattern string) error {
+	leading := !path.IsAbs(pattern)
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == ".." {
+			if leading {
+				continue
+			}
+			return fmt.Errorf("pattern %q may contain \"..\" segments only at the start of a relative path", pattern)
+		}
+		leading = false
+		if segment == "**" {
+			continue
+		}
+		if strings.Contains(segment, "**") {
+			return fmt.Errorf("pattern %q may use \"**\" only as an entire path segment", pattern)
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether the given slash-separated path matches the given
+// slash-separated pattern, which has the syntax of [path.Match] with the
+// addition of "**" segments that match zero or more whole path segments.
+//
+// Both the pattern and the path must already be clean, so that a path
+// can't use "." or ".." segments to escape from the part of the filesystem
+// the pattern describes. Invalid patterns never match.
+func matchGlob(pattern, name string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Collapse any adjacent "**" segments, which are redundant.
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); !ok || err != nil {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
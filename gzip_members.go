@@ -0,0 +1,131 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// gzipMagic is the sequence of bytes that begins every gzip member.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// maxTarPadding is the most uncompressed data that we accept after the end
+// of the tar archive in a gzip member. Tar writers pad an archive to a
+// whole number of records, which are 20 blocks long by default, and so the
+// padding never needs to be longer than one record.
+const maxTarPadding = 20 * 512
+
+// WithMultipleGzipMembers is a PackerOption that makes Unpack accept a slug
+// made of several gzip members, each containing a complete tar archive, as
+// produced by concatenating slug files. Unpack extracts the entries from all
+// of the members in order, as if they were in a single slug.
+//
+// By default Unpack fails with an [IllegalSlugError] using the code
+// [MultipleGzipMembers] when the gzip stream has more than one member,
+// because Pack never produces such a slug. Data after the last member that
+// is not another gzip member is always rejected using the code
+// [TrailingData].
+func WithMultipleGzipMembers() PackerOption {
+	return func(p *Packer) error {
+		p.gzipMembers = true
+		return nil
+	}
+}
+
+// newGzipMemberReader returns a reader that decompresses only the first gzip
+// member from r, along with the buffered reader that it reads from, for use
+// with [Packer.nextGzipMember].
+func newGzipMemberReader(r io.Reader) (*gzip.Reader, *bufio.Reader, error) {
+	// The gzip reader would buffer r itself if it weren't already
+	// buffered, but then we couldn't see what remains after a member.
+	br := bufio.NewReader(r)
+	uncompressed, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decompress slug: %w", err)
+	}
+	uncompressed.Multistream(false)
+	return uncompressed, br, nil
+}
+
+// nextGzipMember is called once the tar archive in the current gzip member
+// has ended. It verifies the rest of the member and then either prepares
+// uncompressed to read the next member, returning true, or returns false if
+// there are no more members.
+//
+// It returns an error if the rest of the stream isn't acceptable, which
+// includes any data that isn't a gzip member, any additional members if
+// the packer doesn't allow them, and more data after the end of the tar
+// archive than its padding could need.
+func (p *Packer) nextGzipMember(uncompressed *gzip.Reader, br *bufio.Reader) (bool, error) {
+	// Reading to the end of the member makes the gzip reader verify its
+	// checksum.
+	if err := discardTarPadding(uncompressed); err != nil {
+		return false, err
+	}
+
+	next, err := br.Peek(len(gzipMagic))
+	switch {
+	case len(next) == 0 && err == io.EOF:
+		return false, nil
+	case len(next) == 0:
+		return false, fmt.Errorf("failed to read slug: %w", err)
+	case !bytes.Equal(next, gzipMagic):
+		return false, &IllegalSlugError{
+			Code: TrailingData,
+			Err:  fmt.Errorf("unexpected data after the end of the gzip stream"),
+		}
+	case !p.gzipMembers:
+		return false, &IllegalSlugError{
+			Code: MultipleGzipMembers,
+			Err:  fmt.Errorf("gzip stream has more than one member"),
+		}
+	}
+
+	if err := uncompressed.Reset(br); err != nil {
+		return false, fmt.Errorf("failed to decompress slug: %w", err)
+	}
+	uncompressed.Multistream(false)
+	return true, nil
+}
+
+// discardTarPadding reads and discards the rest of a gzip member from r
+// once the tar archive in it has ended. The tar writer pads the archive with
+// zeros, which we don't need to check, but we don't read more than the
+// padding could need, so that the data after the archive can't bypass the
+// size limit.
+func discardTarPadding(r io.Reader) error {
+	n, err := io.Copy(io.Discard, io.LimitReader(r, maxTarPadding+1))
+	if err != nil {
+		return fmt.Errorf("failed to decompress slug: %w", err)
+	}
+	if n > maxTarPadding {
+		return &IllegalSlugError{
+			Code: TrailingData,
+			Err:  fmt.Errorf("unexpected data after the end of the tar archive"),
+		}
+	}
+	return nil
+}
+
+// gzipMemberTarError returns a clearer error than the given error from the
+// tar reader if the error was caused by the tar archive continuing into
+// another gzip member, which means that the members don't each contain a
+// complete archive.
+func gzipMemberTarError(err error, br *bufio.Reader) error {
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	if next, _ := br.Peek(len(gzipMagic)); !bytes.Equal(next, gzipMagic) {
+		return err
+	}
+	return &IllegalSlugError{
+		Code: MultipleGzipMembers,
+		Err:  fmt.Errorf("tar archive continues into another gzip member"),
+	}
+}
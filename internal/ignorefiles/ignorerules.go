@@ -12,6 +12,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // A Ruleset is the result of reading, parsing, and compiling a
@@ -25,9 +26,13 @@ type Ruleset struct {
 // Ruleset. A matching result is Dominating if none of the rules that follow it
 // contain a negation, implying that if the rule excludes a directory,
 // everything below that directory may be ignored.
+//
+// Rule is the text of the rule that caused an Excluded result, as it was
+// written in the ignore file, or an empty string if the path isn't excluded.
 type ExcludesResult struct {
 	Excluded   bool
 	Dominating bool
+	Rule       string
 }
 
 // ParseIgnoreFileContent takes a reader over the content of a .terraformignore
@@ -41,6 +46,27 @@ func ParseIgnoreFileContent(r io.Reader) (*Ruleset, error) {
 	return &Ruleset{rules: rules}, nil
 }
 
+// ParsePatterns returns a Ruleset containing only the given patterns, each
+// written in the same syntax as a line of a .terraformignore file. Unlike
+// ParseIgnoreFileContent, the result does not include the default exclusions.
+//
+// ParsePatterns returns an error if any of the patterns is invalid.
+func ParsePatterns(patterns []string) (*Ruleset, error) {
+	rules, err := appendRules(nil, strings.NewReader(strings.Join(patterns, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].regex != nil {
+			continue
+		}
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", rules[i].pattern, err)
+		}
+	}
+	return &Ruleset{rules: rules}, nil
+}
+
 // LoadPackageIgnoreRules implements reasonable default behavior for finding
 // ignore rules for a particular package root directory: if .terraformignore is
 // present then use it, or otherwise just return DefaultRuleset.
@@ -84,6 +110,7 @@ func (r *Ruleset) Excludes(path string) (ExcludesResult, error) {
 	var retErr error
 	foundMatch := false
 	dominating := false
+	matchedRule := ""
 	for _, rule := range r.rules {
 		match, err := rule.match(path)
 		if err != nil {
@@ -97,14 +124,41 @@ func (r *Ruleset) Excludes(path string) (ExcludesResult, error) {
 		if match {
 			foundMatch = !rule.negated
 			dominating = foundMatch && !rule.negationsAfter
+			matchedRule = rule.pattern
 		}
 	}
+	if !foundMatch {
+		matchedRule = ""
+	}
 	return ExcludesResult{
 		Excluded:   foundMatch,
 		Dominating: dominating,
+		Rule:       matchedRule,
 	}, retErr
 }
 
+// ExcludesEntry tests whether the directory entry at the given path should be
+// excluded when walking a package directory. If isDir is true then a match
+// for the path with a trailing separator also excludes it, so that rules
+// like "logs/" apply to the directory itself.
+//
+// Callers should treat an excluded directory as excluding everything below
+// it, even if later rules would re-include some of its contents, which
+// matches how Git treats negated patterns under an excluded directory.
+//
+// Errors are reported in the same way as for [Ruleset.Excludes].
+func (r *Ruleset) ExcludesEntry(path string, isDir bool) (ExcludesResult, error) {
+	result, err := r.Excludes(path)
+	if result.Excluded || !isDir {
+		return result, err
+	}
+	result, dirErr := r.Excludes(path + string(os.PathSeparator))
+	if err == nil {
+		err = dirErr
+	}
+	return result, err
+}
+
 // Includes is the inverse of [Ruleset.Excludes].
 func (r *Ruleset) Includes(path string) (bool, error) {
 	result, err := r.Excludes(path)
@@ -15,10 +15,15 @@ import (
 )
 
 func readRules(input io.Reader) ([]rule, error) {
-	rules := defaultExclusions
+	return appendRules(defaultExclusions, input)
+}
+
+// appendRules parses the rules from input and appends them to the given
+// initial rules, which may be nil.
+func appendRules(rules []rule, input io.Reader) ([]rule, error) {
 	scanner := bufio.NewScanner(input)
 	scanner.Split(bufio.ScanLines)
-	currentRuleIndex := len(defaultExclusions) - 1
+	currentRuleIndex := len(rules) - 1
 
 	for scanner.Scan() {
 		pattern := scanner.Text()
@@ -33,7 +38,7 @@ func readRules(input io.Reader) ([]rule, error) {
 			continue
 		}
 		// New rule structure
-		rule := rule{}
+		rule := rule{pattern: pattern}
 		// Exclusions
 		if pattern[0] == '!' {
 			rule.negated = true
@@ -58,6 +63,9 @@ func readRules(input io.Reader) ([]rule, error) {
 			pattern = "**" + string(os.PathSeparator) + pattern
 		}
 		rule.val = pattern
+		// We compile the rule now so that matching doesn't need to, and
+		// leave any invalid rule to be reported each time it's matched.
+		_ = rule.compile()
 		rules = append(rules, rule)
 		currentRuleIndex += 1
 	}
@@ -70,6 +78,7 @@ func readRules(input io.Reader) ([]rule, error) {
 
 type rule struct {
 	val            string         // the value of the rule itself
+	pattern        string         // the rule as written in the ignore file
 	negated        bool           // prefixed by !, a negated rule
 	negationsAfter bool           // negatied rules appear after this rule
 	regex          *regexp.Regexp // regular expression to match for the rule
@@ -172,17 +181,20 @@ func (r *rule) compile() error {
 var defaultExclusions = []rule{
 	{
 		val:            strings.Join([]string{"**", ".terraform", "**"}, string(os.PathSeparator)),
+		pattern:        ".terraform/",
 		negated:        false,
 		negationsAfter: true,
 	},
 	// Place negation rules as high as possible in the list
 	{
 		val:            strings.Join([]string{"**", ".terraform", "modules", "**"}, string(os.PathSeparator)),
+		pattern:        "!.terraform/modules/",
 		negated:        true,
 		negationsAfter: false,
 	},
 	{
 		val:            strings.Join([]string{"**", ".git", "**"}, string(os.PathSeparator)),
+		pattern:        ".git/",
 		negated:        false,
 		negationsAfter: false,
 	},
@@ -192,7 +204,8 @@ func init() {
 	// We'll precompile all of the default rules at initialization, so we
 	// don't need to recompile them every time we encounter a package that
 	// doesn't have any rules (the common case).
-	for _, r := range defaultExclusions {
+	for i := range defaultExclusions {
+		r := &defaultExclusions[i]
 		err := r.compile()
 		if err != nil {
 			panic(fmt.Sprintf("invalid default rule %q: %s", r.val, err))
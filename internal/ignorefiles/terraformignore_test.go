@@ -4,6 +4,7 @@
 package ignorefiles
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -164,3 +165,118 @@ func TestTerraformIgnoreNoExclusionOptimization(t *testing.T) {
 	}
 
 }
+
+func TestRulesetExcludesEntry(t *testing.T) {
+	rs, err := ParseIgnoreFileContent(strings.NewReader("logs/\n!logs/keep.txt\n*.tmp\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"logs", true, true},
+		{"logs", false, false},
+		{"main.tf", false, false},
+		{"scratch.tmp", false, true},
+		{"scratch.tmp", true, true},
+		{"src", true, false},
+	}
+	for _, test := range tests {
+		result, err := rs.ExcludesEntry(test.path, test.isDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Excluded != test.excluded {
+			t.Errorf("%q (isDir=%t) excluded = %t, want %t", test.path, test.isDir, result.Excluded, test.excluded)
+		}
+	}
+}
+
+func TestRulesetExcludesRule(t *testing.T) {
+	rs, err := ParseIgnoreFileContent(strings.NewReader("src/**/*\n!src/foo/bar.txt\n*.tmp\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		rule string
+	}{
+		{"src/baz/ignored", "src/**/*"},
+		{"src/foo/bar.txt", ""},
+		{"scratch.tmp", "*.tmp"},
+		{"src/foo/scratch.tmp", "*.tmp"},
+		{"main.tf", ""},
+	}
+	for _, test := range tests {
+		result, err := rs.Excludes(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Rule != test.rule {
+			t.Errorf("%q excluded by rule %q, want %q", test.path, result.Rule, test.rule)
+		}
+	}
+}
+
+func TestParsePatterns(t *testing.T) {
+	rs, err := ParsePatterns([]string{"LICENSE", "/docs/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		excluded bool
+	}{
+		{"LICENSE", true},
+		{"sub/LICENSE", true},
+		{"docs/index.md", true},
+		{"sub/docs/index.md", false},
+		// Unlike ParseIgnoreFileContent, the default exclusions don't apply.
+		{".git/config", false},
+		{".terraform/plugins/foo", false},
+	}
+	for _, test := range tests {
+		result, err := rs.Excludes(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Excluded != test.excluded {
+			t.Errorf("%q excluded = %t, want %t", test.path, result.Excluded, test.excluded)
+		}
+	}
+}
+
+func TestRulesetPrecompiled(t *testing.T) {
+	// Excludes matches each rule by value, so rules must be compiled
+	// before then for the compiled form to be reused between calls.
+	ruleset, err := ParseIgnoreFileContent(strings.NewReader("*.log\n[\n!keep.log\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range append(DefaultRuleset.rules, ruleset.rules...) {
+		if r.regex == nil && r.pattern != "[" {
+			t.Errorf("rule %q was not compiled", r.pattern)
+		}
+	}
+
+	// An invalid rule is still reported when matching.
+	if _, err := ruleset.Excludes("foo.log"); err == nil {
+		t.Error("no error for invalid rule")
+	}
+}
+
+func BenchmarkRulesetExcludes(b *testing.B) {
+	ruleset, err := ParseIgnoreFileContent(strings.NewReader("*.log\nbuild/\n!build/keep\n"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ruleset.Excludes("modules/network/main.tf")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package unpackinfo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BirthTimePAXRecord is the key of the PAX record that stores the birth
+// time of an entry, which is the same key that libarchive uses.
+const BirthTimePAXRecord = "LIBARCHIVE.creationtime"
+
+// FormatBirthTime returns the value of a BirthTimePAXRecord record for the
+// given time, using the same format as the standard PAX time records.
+func FormatBirthTime(t time.Time) string {
+	secs, nsecs := t.Unix(), t.Nanosecond()
+	if nsecs == 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+	sign := ""
+	if secs < 0 {
+		// The fraction extends the whole seconds away from zero, so we
+		// must move a second from one to the other.
+		sign = "-"
+		secs = -(secs + 1)
+		nsecs = 1e9 - nsecs
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, secs, nsecs), "0")
+}
+
+// parseBirthTime parses the value of a BirthTimePAXRecord record, returning
+// false if it's invalid.
+func parseBirthTime(s string) (time.Time, bool) {
+	ss, sn, _ := strings.Cut(s, ".")
+	secs, err := strconv.ParseInt(ss, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if sn == "" {
+		return time.Unix(secs, 0), true
+	}
+	if len(sn) > 9 {
+		sn = sn[:9]
+	}
+	sn += strings.Repeat("0", 9-len(sn))
+	nsecs, err := strconv.ParseUint(sn, 10, 32)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if strings.HasPrefix(ss, "-") {
+		return time.Unix(secs, -int64(nsecs)), true
+	}
+	return time.Unix(secs, int64(nsecs)), true
+}
+
+// RestoreBirthTime sets the birth time of the unpacked entry to the one
+// recorded in its header, if any. It does nothing if the header has no
+// birth time or if the platform doesn't support changing birth times.
+func (i UnpackInfo) RestoreBirthTime() error {
+	if i.OriginalBirthTime.IsZero() || !CanRestoreBirthTime() {
+		return nil
+	}
+	if err := SetBirthTime(i.Path, i.OriginalBirthTime); err != nil {
+		return fmt.Errorf("failed setting birth time on %q: %w", i.Path, err)
+	}
+	return nil
+}
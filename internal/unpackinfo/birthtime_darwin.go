@@ -0,0 +1,43 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build darwin
+// +build darwin
+
+package unpackinfo
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// BirthTime returns the birth time of the file at the given path, without
+// following a symlink at that path. It returns false if the platform or
+// the filesystem doesn't record birth times.
+func BirthTime(path string) (time.Time, bool) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Btim.Unix()), true
+}
+
+// SetBirthTime changes the birth time of the file at the given path,
+// without following a symlink at that path.
+func SetBirthTime(path string, t time.Time) error {
+	attrs := unix.Attrlist{
+		Bitmapcount: unix.ATTR_BIT_MAP_COUNT,
+		Commonattr:  unix.ATTR_CMN_CRTIME,
+	}
+	ts := unix.NsecToTimespec(t.UnixNano())
+	buf := (*[unsafe.Sizeof(ts)]byte)(unsafe.Pointer(&ts))[:]
+	return unix.Setattrlist(path, &attrs, buf, unix.FSOPT_NOFOLLOW)
+}
+
+// CanRestoreBirthTime returns true if SetBirthTime is supported on the
+// current platform.
+func CanRestoreBirthTime() bool {
+	return true
+}
@@ -0,0 +1,39 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+// +build linux
+
+package unpackinfo
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BirthTime returns the birth time of the file at the given path, without
+// following a symlink at that path. It returns false if the platform or
+// the filesystem doesn't record birth times.
+func BirthTime(path string) (time.Time, bool) {
+	var stx unix.Statx_t
+	err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx)
+	if err != nil || stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), true
+}
+
+// SetBirthTime changes the birth time of the file at the given path. This
+// capability is only available on Darwin and Windows as of now, because
+// Linux doesn't allow changing birth times.
+func SetBirthTime(path string, t time.Time) error {
+	return errors.New("SetBirthTime is not supported on this platform")
+}
+
+// CanRestoreBirthTime returns true if SetBirthTime is supported on the
+// current platform.
+func CanRestoreBirthTime() bool {
+	return false
+}
@@ -0,0 +1,31 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+package unpackinfo
+
+import (
+	"errors"
+	"time"
+)
+
+// BirthTime returns the birth time of the file at the given path. This
+// capability is only available on Linux, Darwin and Windows as of now, so
+// it always returns false.
+func BirthTime(path string) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// SetBirthTime changes the birth time of the file at the given path. This
+// capability is only available on Darwin and Windows as of now.
+func SetBirthTime(path string, t time.Time) error {
+	return errors.New("SetBirthTime is not supported on this platform")
+}
+
+// CanRestoreBirthTime returns true if SetBirthTime is supported on the
+// current platform.
+func CanRestoreBirthTime() bool {
+	return false
+}
@@ -0,0 +1,53 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build windows
+// +build windows
+
+package unpackinfo
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// BirthTime returns the birth time of the file at the given path, without
+// following a symlink at that path. It returns false if the platform or
+// the filesystem doesn't record birth times.
+func BirthTime(path string) (time.Time, bool) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, data.CreationTime.Nanoseconds()), true
+}
+
+// SetBirthTime changes the birth time of the file at the given path,
+// without following a symlink at that path.
+func SetBirthTime(path string, t time.Time) error {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(
+		pathp, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OPEN_REPARSE_POINT, 0,
+	)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(h)
+	ctime := syscall.NsecToFiletime(t.UnixNano())
+	return syscall.SetFileTime(h, &ctime, nil, nil)
+}
+
+// CanRestoreBirthTime returns true if SetBirthTime is supported on the
+// current platform.
+func CanRestoreBirthTime() bool {
+	return true
+}
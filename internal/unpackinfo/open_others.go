@@ -0,0 +1,16 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package unpackinfo
+
+import (
+	"os"
+)
+
+// OpenFile opens the file at the given path for reading, like [os.Open].
+func OpenFile(path string) (*os.File, error) {
+	return os.Open(path)
+}
@@ -14,6 +14,26 @@ import (
 	"time"
 )
 
+// These errors classify the reasons [NewUnpackInfo] may reject a tar header.
+// Use [errors.Is] to test for them; the errors returned by NewUnpackInfo
+// carry more specific messages.
+var (
+	ErrTraversal       = errors.New("path traversal outside of the destination")
+	ErrThroughSymlink  = errors.New("extraction through a symlink")
+	ErrUnsupportedType = errors.New("unsupported file type")
+	ErrNULCharacter    = errors.New("NUL character in name")
+)
+
+// kindError is an error with a specific message that also matches one of
+// the sentinel errors above when tested with errors.Is.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string        { return e.msg }
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
 // UnpackInfo stores information about the file (or directory, or symlink) being
 // unpacked. UnpackInfo ensures certain malicious tar files are not unpacked.
 // The information can be used later to restore the original permissions
@@ -22,6 +42,7 @@ type UnpackInfo struct {
 	Path               string
 	OriginalAccessTime time.Time
 	OriginalModTime    time.Time
+	OriginalBirthTime  time.Time
 	OriginalMode       fs.FileMode
 	Typeflag           byte
 }
@@ -30,11 +51,37 @@ type UnpackInfo struct {
 // It will return an error if the header represents an illegal symlink extraction
 // or if the entry type is not supported by go-slug.
 func NewUnpackInfo(dst string, header *tar.Header) (UnpackInfo, error) {
+	return NewUnpackInfoWith(dst, header, func(path string) (bool, error) {
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return fi.Mode()&fs.ModeSymlink != 0, nil
+	})
+}
+
+// NewUnpackInfoWith is like NewUnpackInfo but uses the given function to
+// decide whether each parent directory of the entry is a symlink, instead
+// of inspecting the filesystem, so that an entry can be checked without
+// extracting anything.
+func NewUnpackInfoWith(dst string, header *tar.Header, isSymlink func(path string) (bool, error)) (UnpackInfo, error) {
 	// Check for empty destination
 	if len(dst) == 0 {
 		return UnpackInfo{}, errors.New("empty destination is not allowed")
 	}
 
+	// A NUL character can never appear in a real file name, and would
+	// truncate the name when passed to the operating system.
+	if strings.IndexByte(header.Name, 0) >= 0 || strings.IndexByte(header.Linkname, 0) >= 0 {
+		return UnpackInfo{}, &kindError{
+			kind: ErrNULCharacter,
+			msg:  fmt.Sprintf("invalid entry %q, names must not contain NUL characters", header.Name),
+		}
+	}
+
 	// Clean the destination path
 	dst = filepath.Clean(dst)
 	path := filepath.Clean(header.Name)
@@ -45,7 +92,10 @@ func NewUnpackInfo(dst string, header *tar.Header) (UnpackInfo, error) {
 	// Check for path traversal by ensuring the target is within the destination
 	rel, err := filepath.Rel(dst, target)
 	if err != nil || strings.HasPrefix(rel, "..") {
-		return UnpackInfo{}, errors.New("invalid filename, traversal with \"..\" outside of current directory")
+		return UnpackInfo{}, &kindError{
+			kind: ErrTraversal,
+			msg:  "invalid filename, traversal with \"..\" outside of current directory",
+		}
 	}
 
 	// Ensure the destination is not through any symlinks. This prevents
@@ -55,27 +105,24 @@ func NewUnpackInfo(dst string, header *tar.Header) (UnpackInfo, error) {
 	// and likely indicates a hand-crafted tar file, which we are not in
 	// the business of supporting here.
 	//
-	// The strategy is to Lstat each path  component from dst up to the
-	// immediate parent directory of the file name in the tarball, checking
-	// the mode on each to ensure we wouldn't be passing through any
-	// symlinks.
+	// The strategy is to check each path component from dst up to the
+	// immediate parent directory of the file name in the tarball, to
+	// ensure we wouldn't be passing through any symlinks. A component
+	// that doesn't exist yet cannot be a symlink.
 	currentPath := dst // Start at the root of the unpacked tarball.
 	components := strings.Split(header.Name, "/")
 
 	for i := 0; i < len(components)-1; i++ {
 		currentPath = filepath.Join(currentPath, components[i])
-		fi, err := os.Lstat(currentPath)
-		if os.IsNotExist(err) {
-			// Parent directory structure is incomplete. Technically this
-			// means from here upward cannot be a symlink, so we cancel the
-			// remaining path tests.
-			continue
-		}
+		symlink, err := isSymlink(currentPath)
 		if err != nil {
 			return UnpackInfo{}, fmt.Errorf("failed to evaluate path %q: %w", header.Name, err)
 		}
-		if fi.Mode()&fs.ModeSymlink != 0 {
-			return UnpackInfo{}, fmt.Errorf("cannot extract %q through symlink", header.Name)
+		if symlink {
+			return UnpackInfo{}, &kindError{
+				kind: ErrThroughSymlink,
+				msg:  fmt.Sprintf("cannot extract %q through symlink", header.Name),
+			}
 		}
 	}
 
@@ -86,9 +133,17 @@ func NewUnpackInfo(dst string, header *tar.Header) (UnpackInfo, error) {
 		OriginalMode:       header.FileInfo().Mode(),
 		Typeflag:           header.Typeflag,
 	}
+	if v, ok := header.PAXRecords[BirthTimePAXRecord]; ok {
+		// An invalid birth time is just ignored, like other records
+		// that we don't understand.
+		result.OriginalBirthTime, _ = parseBirthTime(v)
+	}
 
 	if !result.IsDirectory() && !result.IsSymlink() && !result.IsRegular() && !result.IsTypeX() {
-		return UnpackInfo{}, fmt.Errorf("failed creating %q, unsupported file type %c", path, result.Typeflag)
+		return UnpackInfo{}, &kindError{
+			kind: ErrUnsupportedType,
+			msg:  fmt.Sprintf("failed creating %q, unsupported file type %c", path, result.Typeflag),
+		}
 	}
 
 	return result, nil
@@ -135,6 +190,13 @@ func (i UnpackInfo) restoreDirectory() error {
 		return fmt.Errorf("failed setting permissions on directory %q: %w", i.Path, err)
 	}
 
+	// A slug packed without directory modification times records the Unix
+	// epoch instead, in which case we leave the directory's times as they
+	// were after extraction.
+	if i.OriginalModTime.IsZero() || i.OriginalModTime.Unix() == 0 {
+		return nil
+	}
+
 	if err := os.Chtimes(i.Path, i.OriginalAccessTime, i.OriginalModTime); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed setting times on directory %q: %w", i.Path, err)
 	}
@@ -5,6 +5,7 @@ package unpackinfo
 
 import (
 	"archive/tar"
+	"errors"
 	"os"
 	"path"
 	"path/filepath"
@@ -32,6 +33,17 @@ func TestNewUnpackInfo(t *testing.T) {
 		}
 	})
 
+	t.Run("disallow NUL characters", func(t *testing.T) {
+		_, err := NewUnpackInfo("test", &tar.Header{
+			Name:     "foo\x00.txt",
+			Typeflag: tar.TypeReg,
+		})
+
+		if !errors.Is(err, ErrNULCharacter) {
+			t.Fatalf("expected ErrNULCharacter, got %v", err)
+		}
+	})
+
 	t.Run("disallow zipslip", func(t *testing.T) {
 		dst := t.TempDir()
 
@@ -353,3 +365,35 @@ func TestUnpackInfo_RestoreInfo(t *testing.T) {
 		}
 	}
 }
+
+func TestBirthTimeRecord(t *testing.T) {
+	for _, want := range []time.Time{
+		time.Unix(1234567890, 0),
+		time.Unix(1234567890, 500000000),
+		time.Unix(1234567890, 1),
+		time.Unix(-1, -500000000),
+		time.Unix(0, -1),
+	} {
+		record := FormatBirthTime(want)
+		got, ok := parseBirthTime(record)
+		if !ok {
+			t.Errorf("failed to parse %q", record)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q parsed as %s; want %s", record, got, want)
+		}
+	}
+
+	info, err := NewUnpackInfo(t.TempDir(), &tar.Header{
+		Name:       "main.tf",
+		Typeflag:   tar.TypeReg,
+		PAXRecords: map[string]string{BirthTimePAXRecord: "1234567890.5"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1234567890, 500000000); !info.OriginalBirthTime.Equal(want) {
+		t.Errorf("wrong birth time %s; want %s", info.OriginalBirthTime, want)
+	}
+}
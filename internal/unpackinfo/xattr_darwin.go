@@ -0,0 +1,16 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build darwin
+// +build darwin
+
+package unpackinfo
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoXattr is the error that the extended attribute system calls return
+// when a file doesn't have the requested attribute, which is ENOATTR on
+// Darwin.
+const ErrNoXattr = unix.ENOATTR
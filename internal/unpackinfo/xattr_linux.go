@@ -0,0 +1,16 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+// +build linux
+
+package unpackinfo
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoXattr is the error that the extended attribute system calls return
+// when a file doesn't have the requested attribute, which is ENODATA on
+// Linux.
+const ErrNoXattr = unix.ENODATA
@@ -0,0 +1,31 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package unpackinfo
+
+import (
+	"errors"
+)
+
+// SetXattr sets the extended attribute with the given name on the file at
+// the given path. This capability is only available on Linux and Darwin as
+// of now.
+func SetXattr(path, name string, value []byte) error {
+	return errors.New("SetXattr is not supported on this platform")
+}
+
+// RemoveXattr removes the extended attribute with the given name from the
+// file at the given path. This capability is only available on Linux and
+// Darwin as of now.
+func RemoveXattr(path, name string) error {
+	return errors.New("RemoveXattr is not supported on this platform")
+}
+
+// CanManageXattrs returns true if SetXattr and RemoveXattr are supported
+// on the current platform.
+func CanManageXattrs() bool {
+	return false
+}
@@ -0,0 +1,36 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build darwin || linux
+// +build darwin linux
+
+package unpackinfo
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetXattr sets the extended attribute with the given name on the file at
+// the given path, without following a symlink at that path.
+func SetXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+// RemoveXattr removes the extended attribute with the given name from the
+// file at the given path, without following a symlink at that path. It
+// succeeds if the file doesn't have the attribute.
+func RemoveXattr(path, name string) error {
+	err := unix.Lremovexattr(path, name)
+	if errors.Is(err, ErrNoXattr) {
+		return nil
+	}
+	return err
+}
+
+// CanManageXattrs returns true if SetXattr and RemoveXattr are supported
+// on the current platform.
+func CanManageXattrs() bool {
+	return true
+}
@@ -0,0 +1,124 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// LayerOverride describes a path that exists in more than one of the roots
+// given to [Packer.PackLayered], and therefore in the slug is taken only
+// from the last of them.
+type LayerOverride struct {
+	// Name is the path of the entry in the slug, using the same form as
+	// [Meta.Files].
+	Name string
+
+	// Root is the index of the root that the entry was taken from.
+	Root int
+
+	// Overridden are the indices of the earlier roots that also contain
+	// the path, in ascending order.
+	Overridden []int
+}
+
+// PackLayered is like [Packer.Pack] but combines the contents of several
+// source directories into a single slug, as if each root were copied over
+// the previous ones in turn.
+//
+// Directories that exist in more than one root are merged. Any other path
+// that exists in more than one root is taken only from the last of them,
+// including when a directory in one root has the same path as a file or
+// symlink in another, in which case nothing below the overridden directory
+// is included. Each root's own .terraformignore file, if enabled, applies
+// only to that root. The overridden paths are reported in
+// [Meta.LayerOverrides].
+//
+// The entries from later roots are written to the slug before those from
+// earlier roots, after any entries requested by [WithLeadingEntries].
+func (p *Packer) PackLayered(w io.Writer, roots ...string) (*Meta, error) {
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("at least one root directory is required")
+	}
+	return p.pack(context.Background(), roots, w, newLayerState())
+}
+
+// layerState tracks which layer each path in a layered slug came from. A nil
+// *layerState is valid and represents a slug with only one layer.
+type layerState struct {
+	current int
+	owners  map[string]layerOwner
+	found   map[string]*LayerOverride
+}
+
+type layerOwner struct {
+	root  int
+	isDir bool
+}
+
+func newLayerState() *layerState {
+	return &layerState{
+		owners: make(map[string]layerOwner),
+		found:  make(map[string]*LayerOverride),
+	}
+}
+
+func (s *layerState) setCurrent(root int) {
+	if s != nil {
+		s.current = root
+	}
+}
+
+// claim records that the current layer contains an entry with the given
+// name, as used in a tar header. It returns true if a later layer has
+// already claimed the same path with an entry that overrides this one, and
+// also returns true for skipDir if this entry is a directory whose contents
+// must therefore be skipped too.
+func (s *layerState) claim(name string) (overridden, skipDir bool) {
+	if s == nil {
+		return false, false
+	}
+	isDir := strings.HasSuffix(name, "/")
+	key := strings.TrimSuffix(name, "/")
+
+	owner, exists := s.owners[key]
+	if !exists {
+		s.owners[key] = layerOwner{root: s.current, isDir: isDir}
+		return false, false
+	}
+	if owner.root == s.current || (owner.isDir && isDir) {
+		return false, false
+	}
+
+	override := s.found[key]
+	if override == nil {
+		override = &LayerOverride{Name: key, Root: owner.root}
+		if owner.isDir {
+			override.Name += "/"
+		}
+		s.found[key] = override
+	}
+	override.Overridden = append(override.Overridden, s.current)
+	return true, isDir
+}
+
+// overrides returns the overridden paths in a deterministic order.
+func (s *layerState) overrides() []LayerOverride {
+	if s == nil || len(s.found) == 0 {
+		return nil
+	}
+	ret := make([]LayerOverride, 0, len(s.found))
+	for _, override := range s.found {
+		sort.Ints(override.Overridden)
+		ret = append(ret, *override)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
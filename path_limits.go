@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// WithMaxPathDepth is a PackerOption that limits the number of path
+// components in the name of each entry, so that "a/b/c.tf" has a depth of
+// three. Pack and Unpack both fail with an [IllegalSlugError] using the
+// code [PathLimitExceeded] for an entry that is nested more deeply.
+//
+// A limit of zero, which is the default, means that there is no limit.
+func WithMaxPathDepth(maxDepth int) PackerOption {
+	return func(p *Packer) error {
+		if maxDepth < 0 {
+			return fmt.Errorf("path depth limit must not be negative")
+		}
+		p.maxPathDepth = maxDepth
+		return nil
+	}
+}
+
+// WithMaxNameLength is a PackerOption that limits the length in bytes of
+// each path component in the name of each entry. Pack and Unpack both fail
+// with an [IllegalSlugError] using the code [PathLimitExceeded] for an entry
+// with a longer component.
+//
+// A limit of zero, which is the default, means that there is no limit,
+// although most filesystems can't store names longer than 255 bytes.
+func WithMaxNameLength(maxBytes int) PackerOption {
+	return func(p *Packer) error {
+		if maxBytes < 0 {
+			return fmt.Errorf("name length limit must not be negative")
+		}
+		p.maxNameLength = maxBytes
+		return nil
+	}
+}
+
+// WithMaxPathLength is a PackerOption that limits the length in bytes of the
+// slash-separated name of each entry, relative to the root of the slug.
+// Pack and Unpack both fail with an [IllegalSlugError] using the code
+// [PathLimitExceeded] for an entry with a longer name.
+//
+// A limit of zero, which is the default, means that there is no limit.
+func WithMaxPathLength(maxBytes int) PackerOption {
+	return func(p *Packer) error {
+		if maxBytes < 0 {
+			return fmt.Errorf("path length limit must not be negative")
+		}
+		p.maxPathLength = maxBytes
+		return nil
+	}
+}
+
+// checkPathLimits returns an error if the given entry name exceeds any of
+// the packer's path limits.
+func (p *Packer) checkPathLimits(name string) error {
+	if p.maxPathDepth == 0 && p.maxNameLength == 0 && p.maxPathLength == 0 {
+		return nil
+	}
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if clean == "." {
+		return nil
+	}
+
+	if p.maxPathLength != 0 && len(clean) > p.maxPathLength {
+		return &IllegalSlugError{
+			Code: PathLimitExceeded,
+			Err:  fmt.Errorf("entry %q has a path longer than the limit of %d bytes", name, p.maxPathLength),
+		}
+	}
+	parts := strings.Split(clean, "/")
+	if p.maxPathDepth != 0 && len(parts) > p.maxPathDepth {
+		return &IllegalSlugError{
+			Code: PathLimitExceeded,
+			Err:  fmt.Errorf("entry %q is nested deeper than the limit of %d path components", name, p.maxPathDepth),
+		}
+	}
+	if p.maxNameLength != 0 {
+		for _, part := range parts {
+			if len(part) > p.maxNameLength {
+				return &IllegalSlugError{
+					Code: PathLimitExceeded,
+					Err:  fmt.Errorf("entry %q has a path component longer than the limit of %d bytes", name, p.maxNameLength),
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+	"fmt"
+)
+
+// UnpackRemapper is a callback that chooses where Unpack extracts each entry
+// from a slug, for use with [WithUnpackRemapper].
+//
+// It receives a copy of the header of each entry, and returns either the
+// slash-separated name to extract the entry as, or skip set to true to
+// ignore the entry entirely. Returning the entry's original name extracts it
+// as usual.
+type UnpackRemapper func(header *tar.Header) (newName string, skip bool)
+
+// WithUnpackRemapper is a PackerOption that makes Unpack call the given
+// function for each entry before checking or extracting it, so that callers
+// can strip or add prefixes, such as to place a package under a particular
+// sub-directory of the destination.
+//
+// All of the usual safety checks apply to the remapped name rather than
+// the original name, and so a remapper can't cause Unpack to write outside
+// of the destination directory. The targets of symlinks and hard links are
+// not remapped.
+func WithUnpackRemapper(remap UnpackRemapper) PackerOption {
+	return func(p *Packer) error {
+		if remap == nil {
+			return fmt.Errorf("unpack remapper must not be nil")
+		}
+		p.unpackRemapper = remap
+		return nil
+	}
+}
+
+// remapEntry applies the packer's [UnpackRemapper], if any, to the given
+// header. It returns nil if the entry should be skipped, or otherwise a
+// header with the remapped name, which is the given header if the name
+// is unchanged.
+func (p *Packer) remapEntry(header *tar.Header) (*tar.Header, error) {
+	if p.unpackRemapper == nil {
+		return header, nil
+	}
+	// The remapper gets its own copy, so that it can't modify anything
+	// other than the name.
+	copied := *header
+	name, skip := p.unpackRemapper(&copied)
+	switch {
+	case skip:
+		return nil, nil
+	case name == "":
+		return nil, fmt.Errorf("entry %q was remapped to an empty name", header.Name)
+	case name == header.Name:
+		return header, nil
+	}
+	remapped := *header
+	remapped.Name = name
+	return &remapped, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// SecretFilePolicy describes how Pack should react to files that seem
+// likely to contain credentials, such as private keys.
+type SecretFilePolicy int
+
+const (
+	// IgnoreSecretFiles disables the checks for secret files entirely.
+	// This is the default.
+	IgnoreSecretFiles SecretFilePolicy = iota
+
+	// ReportSecretFiles includes secret files in the slug as normal, but
+	// lists them in [Meta.SecretFiles] so that the caller can warn about
+	// them.
+	ReportSecretFiles
+
+	// SkipSecretFiles omits secret files from the slug and lists them in
+	// [Meta.SecretFiles].
+	SkipSecretFiles
+
+	// RejectSecretFiles causes Pack to fail with an [IllegalSlugError]
+	// using the code [SecretFileDetected].
+	RejectSecretFiles
+)
+
+// DefaultSecretFilePatterns are the file name patterns that Pack treats as
+// secret files when a [SecretFilePolicy] other than [IgnoreSecretFiles] is
+// in effect. The patterns use the syntax of [path.Match] and are matched
+// against the base name of each file, without regard to case.
+var DefaultSecretFilePatterns = []string{
+	"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519",
+	"*.pem", "*.key", "*.p12", "*.pfx",
+	".env", ".env.*",
+	"credentials.tfrc.json", ".terraformrc", "terraform.rc",
+	".netrc", ".npmrc", ".pgpass",
+}
+
+// SecretFile describes a file that Pack reported or skipped because of
+// the [SecretFilePolicy] given in [WithSecretFilePolicy].
+type SecretFile struct {
+	// Name is the name that the file has, or would have had, in the slug.
+	Name string
+
+	// Reason describes which rule identified the file as a secret.
+	Reason string
+}
+
+// WithSecretFilePolicy is a PackerOption that makes Pack check for files
+// that seem likely to contain credentials, to help prevent their accidental
+// upload, and selects how Pack deals with them.
+//
+// A regular file is treated as a secret if its name matches one of
+// [DefaultSecretFilePatterns] or the patterns given in
+// [WithSecretFilePatterns], or if its permissions allow only its owner to
+// read it, which is a common convention for files containing credentials.
+// The permissions are not checked on Windows, where they don't reflect who
+// can read a file.
+func WithSecretFilePolicy(policy SecretFilePolicy) PackerOption {
+	return func(p *Packer) error {
+		switch policy {
+		case IgnoreSecretFiles, ReportSecretFiles, SkipSecretFiles, RejectSecretFiles:
+			p.secretFilePolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid secret file policy %d", policy)
+		}
+	}
+}
+
+// WithSecretFilePatterns is a PackerOption that adds the given patterns to
+// [DefaultSecretFilePatterns] for the checks enabled by
+// [WithSecretFilePolicy]. The patterns use the syntax of [path.Match] and
+// are matched against the base name of each file, without regard to case.
+//
+// Calling WithSecretFilePatterns more than once adds the patterns from all
+// of the calls.
+func WithSecretFilePatterns(patterns ...string) PackerOption {
+	return func(p *Packer) error {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid secret file pattern %q: %w", pattern, err)
+			}
+			p.secretPatterns = append(p.secretPatterns, strings.ToLower(pattern))
+		}
+		return nil
+	}
+}
+
+// checkSecretFile returns a description of the rule that identifies the
+// regular file described by the given header as a secret, or an empty
+// string if it doesn't seem to be one.
+func (p *Packer) checkSecretFile(header *tar.Header) string {
+	if p.secretFilePolicy == IgnoreSecretFiles {
+		return ""
+	}
+	base := strings.ToLower(path.Base(header.Name))
+	for _, patterns := range [][]string{DefaultSecretFilePatterns, p.secretPatterns} {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), base); ok {
+				return fmt.Sprintf("name matches secret file pattern %q", pattern)
+			}
+		}
+	}
+	if runtime.GOOS != "windows" {
+		perm := os.FileMode(header.Mode).Perm()
+		if perm&0400 != 0 && perm&0044 == 0 {
+			return fmt.Sprintf("permissions %s allow only the owner to read it", perm)
+		}
+	}
+	return ""
+}
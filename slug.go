@@ -6,11 +6,19 @@ package slug
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/hashicorp/go-slug/internal/ignorefiles"
 	"github.com/hashicorp/go-slug/internal/unpackinfo"
@@ -23,15 +31,161 @@ type Meta struct {
 
 	// Total size of the slug in bytes.
 	Size int64
+
+	// ArchiveSize is the size in bytes of the compressed archive that Pack
+	// wrote, and ArchiveSHA256 is the SHA-256 digest of those bytes. These
+	// are populated only when packing with [WithArchiveDigest].
+	ArchiveSize   int64
+	ArchiveSHA256 []byte
+
+	// ArchiveHashes maps each of the hash functions given to
+	// [WithArchiveHashes] to the digest of the compressed archive that Pack
+	// wrote.
+	ArchiveHashes map[crypto.Hash][]byte
+
+	// DeniedFiles lists the files that Pack omitted because of
+	// [SkipDeniedFiles].
+	DeniedFiles []DeniedFile
+
+	// Entries describes each of the entries in Files, in the same order,
+	// including their types and symlink targets. This is populated only
+	// when packing with [WithEntryDetails].
+	Entries []Entry
+
+	// LayerOverrides lists the paths that PackLayered took from a later
+	// root in place of one or more earlier roots, sorted by name.
+	LayerOverrides []LayerOverride
+
+	// SecretFiles lists the files that seemed likely to contain
+	// credentials, when packing with [ReportSecretFiles] or
+	// [SkipSecretFiles].
+	SecretFiles []SecretFile
+
+	// UnreadableFiles lists the files and directories that Pack skipped
+	// because it didn't have permission to read them, when packing with
+	// [WithSkipUnreadable]. It never includes empty files, which Pack
+	// doesn't need to read.
+	UnreadableFiles []UnreadableFile
 }
 
 // IllegalSlugError indicates the provided slug (io.Writer for Pack, io.Reader
 // for Unpack) violates a rule about its contents. For example, an absolute or
 // external symlink. It implements the error interface.
 type IllegalSlugError struct {
+	// Code classifies the rule that the slug violates, so that callers can
+	// react to specific problems without matching on the error message.
+	Code IllegalSlugErrorCode
+
 	Err error
 }
 
+// IllegalSlugErrorCode is a machine-readable classification of an
+// [IllegalSlugError].
+type IllegalSlugErrorCode int
+
+const (
+	// UnknownIllegalSlug is the code for errors that don't fit any of the
+	// more specific classifications.
+	UnknownIllegalSlug IllegalSlugErrorCode = iota
+
+	// TraversalOutsideRoot indicates an entry whose path would place it
+	// outside of the destination directory.
+	TraversalOutsideRoot
+
+	// SymlinkExternalTarget indicates a symlink whose target is outside
+	// of the root directory and not explicitly allowed.
+	SymlinkExternalTarget
+
+	// ExtractThroughSymlink indicates an entry that would be extracted
+	// through a symlink created by an earlier entry.
+	ExtractThroughSymlink
+
+	// UnsupportedType indicates an entry of a file type that go-slug
+	// cannot extract.
+	UnsupportedType
+
+	// SizeLimitExceeded indicates a slug or entry that is larger than a
+	// configured limit.
+	SizeLimitExceeded
+
+	// DuplicateEntry indicates an entry whose path was already extracted,
+	// rejected because of [RejectDuplicateEntries].
+	DuplicateEntry
+
+	// WindowsIncompatibleName indicates an entry whose name cannot be used
+	// as a file name on Windows. See [WindowsNamePolicy].
+	WindowsIncompatibleName
+
+	// DeniedFileType indicates a file that Pack rejected because of its
+	// extension or content. See [DeniedFilePolicy].
+	DeniedFileType
+
+	// ControlCharacterInName indicates an entry whose name or symlink
+	// target contains a NUL byte or other control character. See
+	// [ControlCharacterPolicy].
+	ControlCharacterInName
+
+	// SecretFileDetected indicates a file that Pack rejected because it seems
+	// likely to contain credentials. See [SecretFilePolicy].
+	SecretFileDetected
+
+	// TrailingData indicates data after the end of the slug's gzip stream,
+	// or more data after the end of the tar archive in a gzip member than
+	// the archive's padding could need.
+	TrailingData
+
+	// MultipleGzipMembers indicates a slug whose gzip stream has more than
+	// one member, which Unpack rejects unless the Packer was created with
+	// [WithMultipleGzipMembers].
+	MultipleGzipMembers
+
+	// CaseCollision indicates an entry whose path differs from an earlier
+	// entry's only in letter case, rejected because of
+	// [RejectCaseCollisions].
+	CaseCollision
+
+	// PathLimitExceeded indicates an entry whose name is longer or more
+	// deeply nested than a configured limit. See [WithMaxPathDepth],
+	// [WithMaxNameLength], and [WithMaxPathLength].
+	PathLimitExceeded
+)
+
+// String returns the name of the code, as used in the constant names.
+func (c IllegalSlugErrorCode) String() string {
+	switch c {
+	case TraversalOutsideRoot:
+		return "TraversalOutsideRoot"
+	case SymlinkExternalTarget:
+		return "SymlinkExternalTarget"
+	case ExtractThroughSymlink:
+		return "ExtractThroughSymlink"
+	case UnsupportedType:
+		return "UnsupportedType"
+	case SizeLimitExceeded:
+		return "SizeLimitExceeded"
+	case DuplicateEntry:
+		return "DuplicateEntry"
+	case WindowsIncompatibleName:
+		return "WindowsIncompatibleName"
+	case DeniedFileType:
+		return "DeniedFileType"
+	case ControlCharacterInName:
+		return "ControlCharacterInName"
+	case SecretFileDetected:
+		return "SecretFileDetected"
+	case TrailingData:
+		return "TrailingData"
+	case MultipleGzipMembers:
+		return "MultipleGzipMembers"
+	case CaseCollision:
+		return "CaseCollision"
+	case PathLimitExceeded:
+		return "PathLimitExceeded"
+	default:
+		return "UnknownIllegalSlug"
+	}
+}
+
 func (e *IllegalSlugError) Error() string {
 	return fmt.Sprintf("illegal slug error: %v", e.Err)
 }
@@ -40,6 +194,23 @@ func (e *IllegalSlugError) Error() string {
 // chain.
 func (e *IllegalSlugError) Unwrap() error { return e.Err }
 
+// unpackInfoErrorCode returns the IllegalSlugErrorCode corresponding to an
+// error returned by unpackinfo.NewUnpackInfo.
+func unpackInfoErrorCode(err error) IllegalSlugErrorCode {
+	switch {
+	case errors.Is(err, unpackinfo.ErrTraversal):
+		return TraversalOutsideRoot
+	case errors.Is(err, unpackinfo.ErrThroughSymlink):
+		return ExtractThroughSymlink
+	case errors.Is(err, unpackinfo.ErrUnsupportedType):
+		return UnsupportedType
+	case errors.Is(err, unpackinfo.ErrNULCharacter):
+		return ControlCharacterInName
+	default:
+		return UnknownIllegalSlug
+	}
+}
+
 // externalSymlink is a simple abstraction for a information about a symlink target
 type externalSymlink struct {
 	absTarget string
@@ -77,20 +248,424 @@ func DereferenceSymlinks() PackerOption {
 // caution when using this option. A symlink matches path if its target
 // resolves to path exactly, or if path is a parent directory of target.
 //
+// If path contains any of the characters "*", "?", or "[" then it is instead
+// a glob pattern with the syntax of [path.Match], where a "**" path segment
+// additionally matches zero or more whole path segments. For example,
+// "/nix/store/**" allows any target under /nix/store. Targets are always
+// resolved to a clean absolute path before matching, so they can't use ".."
+// segments to escape from the directories a pattern describes. Patterns may
+// contain ".." segments only at the start of a relative pattern.
+//
 // Deprecated: This option is deprecated and will be removed in a future
 // release.
 func AllowSymlinkTarget(path string) PackerOption {
 	return func(p *Packer) error {
+		if isGlobPattern(path) {
+			if err := validateGlobPattern(filepath.ToSlash(path)); err != nil {
+				return err
+			}
+		}
 		p.allowSymlinkTargets = append(p.allowSymlinkTargets, path)
 		return nil
 	}
 }
 
+// WithPaxFormat is a PackerOption that forces every entry in the slug to be
+// written using the PAX tar format. This preserves sub-second modification
+// times, which Unpack restores, and avoids any limits on the length of
+// entry names. By default the most compatible format is chosen for each
+// entry, with modification times rounded to the nearest second.
+func WithPaxFormat() PackerOption {
+	return func(p *Packer) error {
+		p.paxFormat = true
+		return nil
+	}
+}
+
+// WithLeadingEntries is a PackerOption that makes Pack write the files at the
+// given slash-separated paths, relative to the source directory, before any
+// other entries in the slug, in the given order. This allows a reader to
+// find important files, such as a manifest, without reading the whole slug.
+//
+// Any of the given paths that don't exist are ignored. Each entry is still
+// subject to the same rules as it would be without this option, such as
+// .terraformignore exclusions.
+func WithLeadingEntries(paths ...string) PackerOption {
+	return func(p *Packer) error {
+		for _, path := range paths {
+			if path == "" || strings.HasPrefix(path, "/") || strings.HasPrefix(path, "../") || path == ".." {
+				return fmt.Errorf("invalid leading entry path %q", path)
+			}
+		}
+		p.leadingEntries = append(p.leadingEntries, paths...)
+		return nil
+	}
+}
+
+// WithSizeLimit is a PackerOption that limits the total size of the content
+// of the files in a slug to the given number of bytes, not counting the tar
+// headers or compression. Pack and Unpack both fail with an
+// [IllegalSlugError] using the code [SizeLimitExceeded] when they reach the
+// limit, even when using [WithBestEffortExtraction].
+//
+// A limit of zero, which is the default, means that there is no limit.
+func WithSizeLimit(maxBytes int64) PackerOption {
+	return func(p *Packer) error {
+		if maxBytes < 0 {
+			return fmt.Errorf("size limit must not be negative")
+		}
+		p.sizeLimit = maxBytes
+		return nil
+	}
+}
+
+// WithArchiveDigest is a PackerOption that makes Pack compute the size and
+// SHA-256 digest of the compressed archive as it is written, and return them
+// in the ArchiveSize and ArchiveSHA256 fields of [Meta]. This avoids the
+// need to buffer the slug or read it back to compute an integrity header.
+func WithArchiveDigest() PackerOption {
+	return func(p *Packer) error {
+		p.archiveDigest = true
+		return nil
+	}
+}
+
+// WithArchiveHashes is a PackerOption that makes Pack also compute digests
+// of the compressed archive as it is written, using each of the given hash
+// functions, so that callers can use other algorithms than the one
+// [WithArchiveDigest] uses. Pack returns the digests in the ArchiveHashes
+// field of [Meta].
+//
+// Each hash function must be linked into the binary, usually by importing
+// the package that implements it, such as crypto/sha512.
+func WithArchiveHashes(hashes ...crypto.Hash) PackerOption {
+	return func(p *Packer) error {
+		for _, h := range hashes {
+			if !h.Available() {
+				return fmt.Errorf("archive hash function %s is not available", h)
+			}
+		}
+		p.archiveHashes = append(p.archiveHashes, hashes...)
+		return nil
+	}
+}
+
+// WithBestEffortExtraction is a PackerOption that makes Unpack skip any
+// entries it cannot extract, such as illegal symlinks, and continue with the
+// rest of the slug, rather than stopping at the first problem. This is
+// intended for recovering as much as possible from a damaged slug.
+//
+// If any entries were skipped then Unpack returns a [*PartialUnpackError]
+// listing them. A problem reading the slug stream itself, such as corrupt
+// compressed data, still stops extraction because nothing after that point
+// can be read, but is also reported using PartialUnpackError.
+func WithBestEffortExtraction() PackerOption {
+	return func(p *Packer) error {
+		p.bestEffort = true
+		return nil
+	}
+}
+
+// SkippedEntry describes an entry that Unpack skipped because of
+// [WithBestEffortExtraction].
+type SkippedEntry struct {
+	// Name is the name of the entry as recorded in the slug.
+	Name string
+
+	// Err is the problem that prevented extracting the entry.
+	Err error
+}
+
+// PartialUnpackError is returned by Unpack in best-effort mode if it could
+// not extract everything in the slug. Everything not listed in Skipped was
+// extracted successfully, up to the point where Err occurred if it is set.
+type PartialUnpackError struct {
+	Skipped []SkippedEntry
+
+	// Err, if not nil, is the problem reading the slug stream that
+	// prevented extracting any entries after it.
+	Err error
+}
+
+func (e *PartialUnpackError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "partially unpacked slug, skipping %d entries", len(e.Skipped))
+	for _, entry := range e.Skipped {
+		fmt.Fprintf(&b, "\n  %s: %s", entry.Name, entry.Err)
+	}
+	if e.Err != nil {
+		fmt.Fprintf(&b, "\nstopped early: %s", e.Err)
+	}
+	return b.String()
+}
+
+// Unwrap returns the errors for each of the skipped entries, and the error
+// that stopped extraction if any, so that they're all visible to
+// [errors.Is] and [errors.As].
+func (e *PartialUnpackError) Unwrap() []error {
+	ret := make([]error, 0, len(e.Skipped)+1)
+	for _, entry := range e.Skipped {
+		ret = append(ret, entry.Err)
+	}
+	if e.Err != nil {
+		ret = append(ret, e.Err)
+	}
+	return ret
+}
+
+// DuplicateEntryPolicy describes how Unpack should react to an archive that
+// contains more than one entry with the same name.
+type DuplicateEntryPolicy int
+
+const (
+	// AllowDuplicateEntries silently allows later entries to overwrite
+	// earlier entries of the same name, mimicking the behavior of tar.
+	// This is the default.
+	AllowDuplicateEntries DuplicateEntryPolicy = iota
+
+	// WarnDuplicateEntries allows later entries to overwrite earlier
+	// entries of the same name, but reports each duplicate to the callback
+	// registered with [WithDuplicateEntryReporter], if any.
+	WarnDuplicateEntries
+
+	// RejectDuplicateEntries causes Unpack to fail with an
+	// [IllegalSlugError] when it encounters a duplicate entry.
+	RejectDuplicateEntries
+)
+
+// WithDuplicateEntryPolicy is a PackerOption that selects how Unpack deals
+// with archives containing multiple entries of the same name. Directory
+// entries are exempt from this policy, because repeating a directory entry
+// does not overwrite anything.
+func WithDuplicateEntryPolicy(policy DuplicateEntryPolicy) PackerOption {
+	return func(p *Packer) error {
+		switch policy {
+		case AllowDuplicateEntries, WarnDuplicateEntries, RejectDuplicateEntries:
+			p.duplicatePolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid duplicate entry policy %d", policy)
+		}
+	}
+}
+
+// WithDuplicateEntryReporter is a PackerOption that registers a callback
+// which Unpack calls with the name of each entry that overwrites an earlier
+// entry of the same name because of [WarnDuplicateEntries].
+func WithDuplicateEntryReporter(report func(name string)) PackerOption {
+	return func(p *Packer) error {
+		p.duplicateReporter = report
+		return nil
+	}
+}
+
+// ExistingFilePolicy describes how Unpack should react when the destination
+// directory already contains a file or symlink at the path of an entry.
+type ExistingFilePolicy int
+
+const (
+	// OverwriteExistingFiles replaces any existing file or symlink with the
+	// entry from the slug. This is the default. An existing symlink is
+	// itself replaced, rather than written through to its target.
+	OverwriteExistingFiles ExistingFilePolicy = iota
+
+	// FailIfExists causes Unpack to fail with an error wrapping
+	// [fs.ErrExist] when an entry would replace an existing file.
+	FailIfExists
+
+	// SkipExistingFiles leaves any existing file in place, ignoring the
+	// corresponding entry in the slug.
+	SkipExistingFiles
+
+	// OverwriteIfNewer replaces an existing file only if the entry in the
+	// slug has a newer modification time than the existing file. For an
+	// existing symlink this compares the time of the symlink itself.
+	OverwriteIfNewer
+)
+
+// WithExistingFilePolicy is a PackerOption that selects how Unpack deals
+// with entries that would replace files that already existed in the
+// destination directory before unpacking began. Directories are exempt
+// from this policy, because extracting a directory entry into an existing
+// directory does not replace anything.
+//
+// Entries replacing files that were extracted earlier from the same slug
+// are instead subject to [WithDuplicateEntryPolicy].
+func WithExistingFilePolicy(policy ExistingFilePolicy) PackerOption {
+	return func(p *Packer) error {
+		switch policy {
+		case OverwriteExistingFiles, FailIfExists, SkipExistingFiles, OverwriteIfNewer:
+			p.existingPolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid existing file policy %d", policy)
+		}
+	}
+}
+
+// UnpackAction describes what Unpack did with a particular file or symlink
+// entry from a slug, as reported to a callback registered with
+// [WithUnpackReporter].
+type UnpackAction int
+
+const (
+	// UnpackCreated means that the entry was extracted to a path that
+	// didn't previously exist.
+	UnpackCreated UnpackAction = iota
+
+	// UnpackOverwritten means that the entry was extracted in place of a
+	// file that already existed.
+	UnpackOverwritten
+
+	// UnpackSkipped means that the entry was not extracted, because of the
+	// selected [ExistingFilePolicy].
+	UnpackSkipped
+)
+
+// String returns a lowercase description of the action.
+func (a UnpackAction) String() string {
+	switch a {
+	case UnpackCreated:
+		return "created"
+	case UnpackOverwritten:
+		return "overwritten"
+	case UnpackSkipped:
+		return "skipped"
+	default:
+		return fmt.Sprintf("UnpackAction(%d)", int(a))
+	}
+}
+
+// WithUnpackReporter is a PackerOption that registers a callback which
+// Unpack calls once for each file or symlink entry it handles, with the
+// name of the entry and the action it took.
+func WithUnpackReporter(report func(name string, action UnpackAction)) PackerOption {
+	return func(p *Packer) error {
+		p.unpackReporter = report
+		return nil
+	}
+}
+
+// SymlinkRecord describes a symlink that Unpack created, as reported to a
+// callback registered with [WithSymlinkReporter].
+type SymlinkRecord struct {
+	// Name is the name of the symlink entry in the slug.
+	Name string
+
+	// Target is the target of the symlink, exactly as written.
+	Target string
+
+	// AllowedBy is the pattern given to [AllowSymlinkTarget] that permitted
+	// the symlink, or an empty string if the target is inside the
+	// destination directory and so needed no permission.
+	AllowedBy string
+}
+
+// WithSymlinkReporter is a PackerOption that registers a callback which
+// Unpack calls once for each symlink it creates, so that callers can audit
+// the symlinks in a slug without scanning the destination directory
+// afterwards. Unpack calls the callback only after successfully creating
+// each symlink.
+func WithSymlinkReporter(report func(SymlinkRecord)) PackerOption {
+	return func(p *Packer) error {
+		p.symlinkReporter = report
+		return nil
+	}
+}
+
+// WithModeMask is a PackerOption that makes Unpack clear any permission
+// bits of extracted files and directories that are not set in mask, much
+// like a umask of the inverse of mask. For example, a mask of 0755 ensures
+// that nothing extracted is writable by anyone other than its owner. The
+// setuid, setgid, and sticky bits are always cleared when a mask is in
+// effect.
+//
+// The mask must contain only permission bits. Symlinks are not affected.
+func WithModeMask(mask os.FileMode) PackerOption {
+	return func(p *Packer) error {
+		if mask&^os.ModePerm != 0 {
+			return fmt.Errorf("invalid mode mask %#o: must contain only permission bits", mask)
+		}
+		p.modeMask = mask
+		p.hasModeMask = true
+		return nil
+	}
+}
+
+// WithForcedModes is a PackerOption that makes Unpack ignore the
+// permissions recorded in the slug and instead give every extracted regular
+// file the permissions fileMode and every extracted directory the
+// permissions dirMode. If [WithModeMask] is also used then the mask is
+// applied to these forced permissions.
+//
+// Both modes must contain only permission bits, and must not be zero.
+func WithForcedModes(fileMode, dirMode os.FileMode) PackerOption {
+	return func(p *Packer) error {
+		for _, mode := range []os.FileMode{fileMode, dirMode} {
+			if mode == 0 || mode&^os.ModePerm != 0 {
+				return fmt.Errorf("invalid forced mode %#o: must contain only permission bits", mode)
+			}
+		}
+		p.forcedFileMode = fileMode
+		p.forcedDirMode = dirMode
+		return nil
+	}
+}
+
 // Packer holds options for the Pack function.
+//
+// A Packer is never modified after [NewPacker] returns it, so a single
+// Packer is safe to use concurrently from multiple goroutines. Use
+// [Packer.PackWithOptions] and [Packer.UnpackWithOptions] to override some
+// options for an individual call without affecting other callers.
 type Packer struct {
-	dereference          bool
-	applyTerraformIgnore bool
-	allowSymlinkTargets  []string // Deprecated
+	dereference           bool
+	applyTerraformIgnore  bool
+	allowSymlinkTargets   []string // Deprecated
+	duplicatePolicy       DuplicateEntryPolicy
+	paxFormat             bool
+	leadingEntries        []string
+	bestEffort            bool
+	fileLister            FileLister
+	windowsNamePolicy     WindowsNamePolicy
+	existingPolicy        ExistingFilePolicy
+	unpackReporter        func(name string, action UnpackAction)
+	duplicateReporter     func(name string)
+	sizeLimit             int64
+	archiveDigest         bool
+	archiveHashes         []crypto.Hash
+	ignoreSemantics       IgnoreSemantics
+	symlinkReporter       func(SymlinkRecord)
+	modeMask              os.FileMode
+	hasModeMask           bool
+	forcedFileMode        os.FileMode
+	forcedDirMode         os.FileMode
+	allowedExts           []string
+	allowedExtsSet        bool
+	deniedExts            []string
+	deniedContent         []ContentKind
+	deniedFilePolicy      DeniedFilePolicy
+	controlCharPolicy     ControlCharacterPolicy
+	packControlCharCheck  bool
+	clearedXattrs         []string
+	setXattrs             []xattr
+	entryDetails          bool
+	secretFilePolicy      SecretFilePolicy
+	secretPatterns        []string
+	gzipMembers           bool
+	bufferSize            int
+	bufferPool            BufferPool
+	birthTimes            bool
+	caseCollisionPolicy   CaseCollisionPolicy
+	caseCollisionReporter func(CaseCollisionRecord)
+	destSymlinkPolicy     DestinationSymlinkPolicy
+	maxPathDepth          int
+	maxNameLength         int
+	maxPathLength         int
+	dirModTimePolicy      DirModTimePolicy
+	dirModTimeLimit       time.Time
+	skipUnreadable        bool
+	unpackRemapper        UnpackRemapper
 }
 
 // NewPacker is a constructor for Packer.
@@ -109,6 +684,57 @@ func NewPacker(options ...PackerOption) (*Packer, error) {
 	return p, nil
 }
 
+// clone returns a copy of the receiver with the given options applied, leaving
+// the receiver unmodified.
+func (p *Packer) clone(options ...PackerOption) (*Packer, error) {
+	ret := *p
+	// We must copy the slice so that options appending to it can't
+	// modify the backing array shared with the receiver.
+	ret.allowSymlinkTargets = append([]string(nil), p.allowSymlinkTargets...)
+	if len(ret.allowSymlinkTargets) == 0 {
+		ret.allowSymlinkTargets = nil
+	}
+	ret.leadingEntries = append([]string(nil), p.leadingEntries...)
+	if len(ret.leadingEntries) == 0 {
+		ret.leadingEntries = nil
+	}
+	ret.archiveHashes = append([]crypto.Hash(nil), p.archiveHashes...)
+	if len(ret.archiveHashes) == 0 {
+		ret.archiveHashes = nil
+	}
+	ret.allowedExts = append([]string(nil), p.allowedExts...)
+	if len(ret.allowedExts) == 0 {
+		ret.allowedExts = nil
+	}
+	ret.deniedExts = append([]string(nil), p.deniedExts...)
+	if len(ret.deniedExts) == 0 {
+		ret.deniedExts = nil
+	}
+	ret.deniedContent = append([]ContentKind(nil), p.deniedContent...)
+	if len(ret.deniedContent) == 0 {
+		ret.deniedContent = nil
+	}
+	ret.clearedXattrs = append([]string(nil), p.clearedXattrs...)
+	if len(ret.clearedXattrs) == 0 {
+		ret.clearedXattrs = nil
+	}
+	ret.setXattrs = append([]xattr(nil), p.setXattrs...)
+	if len(ret.setXattrs) == 0 {
+		ret.setXattrs = nil
+	}
+	ret.secretPatterns = append([]string(nil), p.secretPatterns...)
+	if len(ret.secretPatterns) == 0 {
+		ret.secretPatterns = nil
+	}
+
+	for _, opt := range options {
+		if err := opt(&ret); err != nil {
+			return nil, fmt.Errorf("option failed: %w", err)
+		}
+	}
+	return &ret, nil
+}
+
 // Pack at the package level is used to maintain compatibility with existing
 // code that relies on this function signature. New options related to packing
 // slugs should be added to the Packer struct instead.
@@ -131,6 +757,50 @@ func Pack(src string, w io.Writer, dereference bool) (*Meta, error) {
 // false symlinks with a target outside the src directory are omitted
 // from the slug.
 func (p *Packer) Pack(src string, w io.Writer) (*Meta, error) {
+	return p.pack(context.Background(), []string{src}, w, nil)
+}
+
+// PackContext is like [Packer.Pack] but stops early if the given context is
+// canceled or reaches its deadline, in which case the returned error wraps
+// the context's error. The context is checked before each entry and while
+// copying the content of each file.
+//
+// If PackContext is canceled then whatever it already wrote to w is an
+// incomplete slug, which the caller should discard.
+func (p *Packer) PackContext(ctx context.Context, src string, w io.Writer) (*Meta, error) {
+	return p.pack(ctx, []string{src}, w, nil)
+}
+
+// pack implements both Pack and PackLayered, writing the contents of each
+// of the given source directories into a single slug. When layers is nil
+// there must be exactly one source directory.
+func (p *Packer) pack(ctx context.Context, srcs []string, w io.Writer, layers *layerState) (*Meta, error) {
+	// If requested, tee the compressed output into the digest and any
+	// other hashes as it is written.
+	// Each call uses its own hashes, so that concurrent calls on the same
+	// Packer don't share any state.
+	var digest hash.Hash
+	var counter *countingWriter
+	var hashes map[crypto.Hash]hash.Hash
+	if p.archiveDigest || len(p.archiveHashes) != 0 {
+		sinks := []io.Writer{w}
+		if p.archiveDigest {
+			digest = sha256.New()
+			counter = &countingWriter{}
+			sinks = append(sinks, digest, counter)
+		}
+		for _, h := range p.archiveHashes {
+			if hashes == nil {
+				hashes = make(map[crypto.Hash]hash.Hash, len(p.archiveHashes))
+			}
+			if _, exists := hashes[h]; !exists {
+				hashes[h] = h.New()
+				sinks = append(sinks, hashes[h])
+			}
+		}
+		w = io.MultiWriter(sinks...)
+	}
+
 	// Gzip compress all the output data.
 	gzipW, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
 	if err != nil {
@@ -145,36 +815,93 @@ func (p *Packer) Pack(src string, w io.Writer) (*Meta, error) {
 	// Track the metadata details as we go.
 	meta := &Meta{}
 
-	info, err := os.Lstat(src)
-	if err != nil {
-		return nil, err
-	}
+	// Track the names we've already written so that we can avoid writing
+	// the same path twice if dereferencing symlinks leads us back to a
+	// path we've already visited.
+	written := make(map[string]struct{})
 
-	// Check if the root (src) is a symlink
-	if info.Mode()&os.ModeSymlink != 0 {
-		src, err = os.Readlink(src)
+	// We use the same buffer to copy the content of every file, since we
+	// only copy one at a time.
+	buf := p.getBuffer()
+	defer p.putBuffer(buf)
+
+	roots := make([]string, len(srcs))
+	walkFns := make([]fs.WalkDirFunc, len(srcs))
+	for i, src := range srcs {
+		info, err := os.Lstat(src)
 		if err != nil {
 			return nil, err
 		}
+
+		// Check if the root (src) is a symlink
+		if info.Mode()&os.ModeSymlink != 0 {
+			src, err = os.Readlink(src)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Load the ignore rule configuration, which will use
+		// defaults if no .terraformignore is configured
+		var ignoreRules *ignorefiles.Ruleset
+		if p.applyTerraformIgnore {
+			ignoreRules, err = p.loadIgnoreRules(src)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Ensure the source path provided is absolute
+		src, err = filepath.Abs(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read absolute path for source: %w", err)
+		}
+
+		// If we have a file lister then it decides which files are candidates
+		// for inclusion.
+		var included *includedFiles
+		if p.fileLister != nil {
+			names, err := p.fileLister.ListFiles(src)
+			if err != nil {
+				return nil, err
+			}
+			included = newIncludedFiles(names)
+		}
+
+		roots[i] = src
+		walkFns[i] = p.packWalkFn(ctx, src, src, src, tarW, buf, meta, ignoreRules, written, included, layers)
 	}
 
-	// Load the ignore rule configuration, which will use
-	// defaults if no .terraformignore is configured
-	var ignoreRules *ignorefiles.Ruleset
-	if p.applyTerraformIgnore {
-		ignoreRules = parseIgnoreFile(src)
+	// Later layers take precedence over earlier ones, so we visit them
+	// in reverse order and let the first layer to claim each name win.
+	order := make([]int, len(srcs))
+	for i := range order {
+		order[i] = len(srcs) - 1 - i
 	}
 
-	// Ensure the source path provided is absolute
-	src, err = filepath.Abs(src)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read absolute path for source: %w", err)
+	// Write any leading entries first. The walk below will then skip them
+	// because they will already be in written.
+	for _, name := range p.leadingEntries {
+		for _, i := range order {
+			path := filepath.Join(roots[i], filepath.FromSlash(name))
+			info, err := os.Lstat(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			layers.setCurrent(i)
+			if err := walkFns[i](path, fs.FileInfoToDirEntry(info), err); err != nil && err != filepath.SkipDir {
+				return nil, err
+			}
+		}
 	}
 
 	// Walk the tree of files.
-	err = filepath.Walk(src, p.packWalkFn(src, src, src, tarW, meta, ignoreRules))
-	if err != nil {
-		return nil, err
+	for _, i := range order {
+		layers.setCurrent(i)
+		err = filepath.WalkDir(roots[i], walkFns[i])
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Flush the tar writer.
@@ -187,14 +914,67 @@ func (p *Packer) Pack(src string, w io.Writer) (*Meta, error) {
 		return nil, fmt.Errorf("failed to close the gzip writer: %w", err)
 	}
 
+	if digest != nil {
+		meta.ArchiveSize = counter.n
+		meta.ArchiveSHA256 = digest.Sum(nil)
+	}
+	if hashes != nil {
+		meta.ArchiveHashes = make(map[crypto.Hash][]byte, len(hashes))
+		for h, w := range hashes {
+			meta.ArchiveHashes[h] = w.Sum(nil)
+		}
+	}
+	meta.LayerOverrides = layers.overrides()
+
 	return meta, nil
 }
 
-func (p *Packer) packWalkFn(root, src, dst string, tarW *tar.Writer, meta *Meta, ignoreRules *ignorefiles.Ruleset) filepath.WalkFunc {
-	return func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+// countingWriter is an io.Writer that counts the bytes written to it and
+// discards them.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// PackWithOptions is like [Packer.Pack] but applies the given options in
+// addition to those the receiver was created with, for this call only.
+func (p *Packer) PackWithOptions(src string, w io.Writer, options ...PackerOption) (*Meta, error) {
+	callP, err := p.clone(options...)
+	if err != nil {
+		return nil, err
+	}
+	return callP.Pack(src, w)
+}
+
+// packWalkFn returns the function that visits each entry of the source
+// directory. It uses the directory entries from the walk to decide whether
+// to skip each one, and so finds out the full details only of the entries
+// that it includes in the slug.
+func (p *Packer) packWalkFn(ctx context.Context, root, src, dst string, tarW *tar.Writer, buf []byte, meta *Meta, ignoreRules *ignorefiles.Ruleset, written map[string]struct{}, included *includedFiles, layers *layerState) fs.WalkDirFunc {
+	unreadable := func(path string, isDir bool, err error) error {
+		// We can skip an unreadable file or directory inside the root,
+		// but not the root itself.
+		if path == root || !p.canSkipUnreadable(err) {
 			return err
 		}
+		meta.UnreadableFiles = append(meta.UnreadableFiles, UnreadableFile{
+			Name: unreadableName(root, src, dst, path, isDir),
+			Err:  err,
+		})
+		return nil
+	}
+
+	return func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return unreadable(path, d != nil && d.IsDir(), err)
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("packing canceled: %w", err)
+		}
 
 		// Get the relative path from the current src directory.
 		subpath, err := filepath.Rel(src, path)
@@ -205,31 +985,57 @@ func (p *Packer) packWalkFn(root, src, dst string, tarW *tar.Writer, meta *Meta,
 			return nil
 		}
 
-		if r := matchIgnoreRules(subpath, ignoreRules); r.Excluded {
+		skip, skipDir, err := p.ignoreAction(subpath, d.IsDir(), ignoreRules)
+		if err != nil {
+			return err
+		}
+		if skipDir {
+			return filepath.SkipDir
+		}
+		if skip {
 			return nil
 		}
 
-		// Catch directories so we don't end up with empty directories,
-		// the files are ignored correctly
-		if info.IsDir() {
-			if r := matchIgnoreRules(subpath+string(os.PathSeparator), ignoreRules); r.Excluded {
-				if r.Dominating {
-					return filepath.SkipDir
-				} else {
-					return nil
-				}
+		// Get the relative path from the initial root directory, which is
+		// the same unless we're following a dereferenced symlink.
+		if src != root || dst != root {
+			subpath, err = filepath.Rel(root, strings.Replace(path, src, dst, 1))
+			if err != nil {
+				return fmt.Errorf("failed to get relative path for file %q: %w", path, err)
+			}
+			if subpath == "." {
+				return nil
 			}
 		}
 
-		// Get the relative path from the initial root directory.
-		subpath, err = filepath.Rel(root, strings.Replace(path, src, dst, 1))
-		if err != nil {
-			return fmt.Errorf("failed to get relative path for file %q: %w", path, err)
-		}
-		if subpath == "." {
+		if included != nil && !included.Includes(filepath.ToSlash(subpath), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
+		// We open a regular file straight away and take its details from
+		// the open file, which costs fewer system calls than calling Lstat
+		// and then opening it. If that fails then we use Lstat instead, and
+		// report the problem below when we try to open it again.
+		var f *os.File
+		var info os.FileInfo
+		if d.Type().IsRegular() {
+			if f, err = unpackinfo.OpenFile(path); err == nil {
+				defer f.Close()
+				if info, err = f.Stat(); err != nil {
+					return fmt.Errorf("failed to get file info for %q: %w", path, err)
+				}
+			}
+		}
+		if info == nil {
+			info, err = d.Info()
+			if err != nil {
+				return unreadable(path, d.IsDir(), err)
+			}
+		}
+
 		// Check the file type and if we need to write the body.
 		keepFile, writeBody := checkFileMode(info.Mode())
 		if !keepFile {
@@ -240,18 +1046,28 @@ func (p *Packer) packWalkFn(root, src, dst string, tarW *tar.Writer, meta *Meta,
 		// An "Unknown" format is imposed because this is the default but also because
 		// it imposes the simplest behavior. Notably, the mod time is preserved by rounding
 		// to the nearest second. During unpacking, these rounded timestamps are restored
-		// upon the corresponding file/directory/symlink.
+		// upon the corresponding file/directory/symlink. WithPaxFormat opts in
+		// to PAX instead, which keeps the full precision of the mod time.
+		//
+		// With the "Unknown" format the tar writer still switches to PAX or
+		// GNU extensions automatically for any entry with values that don't
+		// fit in a USTAR header, such as files of 8GiB or more.
 		header := &tar.Header{
 			Format:  tar.FormatUnknown,
 			Name:    filepath.ToSlash(subpath),
 			ModTime: info.ModTime(),
 			Mode:    int64(fm.Perm()),
 		}
+		if p.paxFormat {
+			header.Format = tar.FormatPAX
+		}
+		birthPath := path
 
 		switch {
 		case info.IsDir():
 			header.Typeflag = tar.TypeDir
 			header.Name += "/"
+			header.ModTime = p.dirModTime(header.ModTime)
 
 		case fm.IsRegular():
 			header.Typeflag = tar.TypeReg
@@ -286,7 +1102,7 @@ func (p *Packer) packWalkFn(root, src, dst string, tarW *tar.Writer, meta *Meta,
 			// If the target is a directory we can recurse into the target
 			// directory by calling the packWalkFn with updated arguments.
 			if resolved.info.IsDir() {
-				return filepath.Walk(resolved.absTarget, p.packWalkFn(root, resolved.absTarget, path, tarW, meta, ignoreRules))
+				return filepath.WalkDir(resolved.absTarget, p.packWalkFn(ctx, root, resolved.absTarget, path, tarW, buf, meta, ignoreRules, written, included, layers))
 			}
 
 			// Dereference this symlink by updating the header with the target file
@@ -296,32 +1112,126 @@ func (p *Packer) packWalkFn(root, src, dst string, tarW *tar.Writer, meta *Meta,
 			header.Mode = int64(resolved.info.Mode().Perm())
 			header.Size = resolved.info.Size()
 			writeBody = true
+			birthPath = resolved.absTarget
 
 		default:
 			return fmt.Errorf("unexpected file mode %v", fm)
 		}
 
+		p.recordBirthTime(header, birthPath)
+
+		// When packing layers, skip any path that a later layer overrides.
+		if overridden, skipDir := layers.claim(header.Name); overridden {
+			if skipDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip any path we've already written, which can happen if
+		// dereferenced symlinks cause us to visit the same location twice.
+		if _, exists := written[header.Name]; exists {
+			return nil
+		}
+		written[header.Name] = struct{}{}
+
+		if p.packControlCharCheck {
+			if err := p.checkControlCharacters(header); err != nil {
+				return err
+			}
+		}
+		if err := p.checkPathLimits(header.Name); err != nil {
+			return err
+		}
+
+		// We open the file before writing anything for it, if we didn't
+		// already, so that we can still skip it entirely if it's
+		// unreadable. An empty file has no body to read.
+		var body *os.File
+		if writeBody && header.Size > 0 {
+			body = f
+			if body == nil {
+				body, err = unpackinfo.OpenFile(path)
+				if err != nil {
+					if p.canSkipUnreadable(err) {
+						meta.UnreadableFiles = append(meta.UnreadableFiles, UnreadableFile{Name: header.Name, Err: err})
+						return nil
+					}
+					return fmt.Errorf("failed opening file %q for archiving: %w", path, err)
+				}
+				defer body.Close()
+			}
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			reason, err := p.checkFileType(path, header.Name, header.Size)
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				if p.deniedFilePolicy == SkipDeniedFiles {
+					meta.DeniedFiles = append(meta.DeniedFiles, DeniedFile{Name: header.Name, Reason: reason})
+					return nil
+				}
+				return &IllegalSlugError{
+					Code: DeniedFileType,
+					Err:  fmt.Errorf("file %q is not allowed: %s", header.Name, reason),
+				}
+			}
+
+			if reason := p.checkSecretFile(header); reason != "" {
+				switch p.secretFilePolicy {
+				case RejectSecretFiles:
+					return &IllegalSlugError{
+						Code: SecretFileDetected,
+						Err:  fmt.Errorf("file %q seems to contain secrets: %s", header.Name, reason),
+					}
+				case SkipSecretFiles:
+					meta.SecretFiles = append(meta.SecretFiles, SecretFile{Name: header.Name, Reason: reason})
+					return nil
+				default:
+					meta.SecretFiles = append(meta.SecretFiles, SecretFile{Name: header.Name, Reason: reason})
+				}
+			}
+		}
+
+		if err := p.checkSizeLimit(meta.Size, header); err != nil {
+			return err
+		}
+
+		// USTAR headers can only represent ASCII names, so we'll use PAX
+		// explicitly for any other names to guarantee that they are stored
+		// as UTF-8 rather than leaving the choice to the tar writer.
+		if header.Format == tar.FormatUnknown && !(isASCII(header.Name) && isASCII(header.Linkname)) {
+			header.Format = tar.FormatPAX
+			// Unlike the "Unknown" format, PAX would keep the full
+			// precision of the mod time, so we round it ourselves to
+			// retain the same behavior as other entries.
+			header.ModTime = header.ModTime.Round(time.Second)
+		}
+
 		// Write the header first to the archive.
 		if err := tarW.WriteHeader(header); err != nil {
 			return fmt.Errorf("failed writing archive header for file %q: %w", path, err)
 		}
 
 		// Account for the file in the list.
-		meta.Files = append(meta.Files, header.Name)
-
-		// Skip writing file data for certain file types (above).
-		if !writeBody {
-			return nil
+		meta.Files = append(meta.Files, sanitizeName(header.Name))
+		if p.entryDetails {
+			meta.Entries = append(meta.Entries, entryFromHeader(sanitizeName(header.Name), header))
 		}
 
-		f, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("failed opening file %q for archiving: %w", path, err)
+		// Skip writing file data for certain file types (above), and for
+		// empty files.
+		if body == nil {
+			return nil
 		}
-		defer f.Close()
 
-		size, err := io.Copy(tarW, f)
+		size, err := p.copyFileBody(ctx, tarW, body, header.Size, buf)
 		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return fmt.Errorf("packing canceled while copying file %q: %w", path, ctxErr)
+			}
 			return fmt.Errorf("failed copying file %q to archive: %w", path, err)
 		}
 
@@ -332,6 +1242,33 @@ func (p *Packer) packWalkFn(root, src, dst string, tarW *tar.Writer, meta *Meta,
 	}
 }
 
+// copyFileBody copies the content of the given file, whose header gave its
+// size, into the archive. It fails if the file's size has changed since
+// then, because the header would no longer describe its content.
+func (p *Packer) copyFileBody(ctx context.Context, tarW *tar.Writer, f *os.File, size int64, buf []byte) (int64, error) {
+	if size >= int64(len(buf)) {
+		// The tar writer itself rejects a file that grew, and one that
+		// shrank leaves the entry incomplete, which fails the next write.
+		return io.CopyBuffer(tarW, &contextReader{ctx: ctx, r: f}, buf)
+	}
+
+	// A file that fits in the buffer can usually be read with a single
+	// call, rather than calling again to find the end of the file. We ask
+	// for one more byte than we expect, so that we notice if the file grew.
+	// We already checked the context before starting on this file.
+	n, err := io.ReadAtLeast(f, buf[:size+1], int(size))
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		return 0, fmt.Errorf("file was truncated while reading it")
+	case err != nil:
+		return 0, err
+	case int64(n) > size:
+		return 0, fmt.Errorf("file grew while reading it")
+	}
+	n, err = tarW.Write(buf[:n])
+	return int64(n), err
+}
+
 // resolveExternalSymlink attempts to recursively follow target paths if we
 // encounter a symbolic link chain. It returns path information about the final
 // target pointing to a regular file or directory.
@@ -378,8 +1315,29 @@ func Unpack(r io.Reader, dst string) error {
 	return p.Unpack(r, dst)
 }
 
+// UnpackWithOptions is like [Packer.Unpack] but applies the given options in
+// addition to those the receiver was created with, for this call only.
+func (p *Packer) UnpackWithOptions(r io.Reader, dst string, options ...PackerOption) error {
+	callP, err := p.clone(options...)
+	if err != nil {
+		return err
+	}
+	return callP.Unpack(r, dst)
+}
+
 // Unpack unpacks the archive data in r into directory dst.
+//
+// If the Packer was created with [WithBestEffortExtraction] then Unpack
+// skips any entries it cannot extract, and returns a [*PartialUnpackError]
+// describing them after extracting everything else it can.
 func (p *Packer) Unpack(r io.Reader, dst string) error {
+	// We resolve the destination once up front, so that all of the checks
+	// below are relative to the real directory we're extracting into.
+	dst, err := p.resolveDestination(dst)
+	if err != nil {
+		return err
+	}
+
 	// Track directory times and permissions so they can be restored after all files
 	// are extracted. This metadata modification is delayed because extracting files
 	// into a new directory would necessarily change its timestamps. By way of
@@ -388,10 +1346,25 @@ func (p *Packer) Unpack(r io.Reader, dst string) error {
 	// for more details about how tar attempts to preserve file metadata.
 	directoriesExtracted := []unpackinfo.UnpackInfo{}
 
+	// Track the paths of the non-directory entries we've extracted so far,
+	// so we can apply the duplicate entry policy.
+	extracted := make(map[string]struct{})
+
+	// Track the paths we've seen so far, if needed to apply the case
+	// collision policy.
+	collisions := p.newCaseCollisions()
+
+	// Track the entries we've skipped in best-effort mode.
+	var skipped []SkippedEntry
+	var streamErr error
+
+	// Track the total size of the file content, to enforce the size limit.
+	var totalSize int64
+
 	// Decompress as we read.
-	uncompressed, err := gzip.NewReader(r)
+	uncompressed, br, err := newGzipMemberReader(r)
 	if err != nil {
-		return fmt.Errorf("failed to decompress slug: %w", err)
+		return err
 	}
 
 	// Untar as we read.
@@ -401,10 +1374,25 @@ func (p *Packer) Unpack(r io.Reader, dst string) error {
 	for {
 		header, err := untar.Next()
 		if err == io.EOF {
-			break
+			var more bool
+			if more, err = p.nextGzipMember(uncompressed, br); err == nil {
+				if !more {
+					break
+				}
+				untar = tar.NewReader(uncompressed)
+				continue
+			}
+		} else if err != nil {
+			err = fmt.Errorf("failed to untar slug: %w", gzipMemberTarError(err, br))
 		}
 		if err != nil {
-			return fmt.Errorf("failed to untar slug: %w", err)
+			if !p.bestEffort {
+				return err
+			}
+			// We can't continue reading after a stream error, but we'll
+			// still restore the directories we already extracted.
+			streamErr = err
+			break
 		}
 
 		// If the entry has no name, ignore it.
@@ -412,96 +1400,302 @@ func (p *Packer) Unpack(r io.Reader, dst string) error {
 			continue
 		}
 
-		info, err := unpackinfo.NewUnpackInfo(dst, header)
+		original := header.Name
+		header, err = p.remapEntry(header)
 		if err != nil {
-			return &IllegalSlugError{Err: err}
+			if !p.bestEffort {
+				return err
+			}
+			skipped = append(skipped, SkippedEntry{Name: original, Err: err})
+			continue
+		}
+		if header == nil {
+			continue
 		}
 
-		// Make the directories to the path.
-		dir := filepath.Dir(info.Path)
-
-		// Timestamps and permissions will be restored after all files are extracted.
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %q: %w", dir, err)
+		if err := p.checkSizeLimit(totalSize, header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			totalSize += header.Size
 		}
 
-		// Handle symlinks, directories, non-regular files
-		if info.IsSymlink() {
-			if ok, err := p.validSymlink(dst, header.Name, header.Linkname); ok {
-				// Create the symlink.
-				if err = os.Symlink(header.Linkname, info.Path); err != nil {
-					return fmt.Errorf("failed creating symlink (%q -> %q): %w",
-						header.Name, header.Linkname, err)
-				}
-			} else {
+		err = p.unpackEntry(dst, header, untar, extracted, collisions, &directoriesExtracted)
+		if err != nil {
+			if !p.bestEffort {
 				return err
 			}
+			skipped = append(skipped, SkippedEntry{Name: header.Name, Err: err})
+		}
+	}
 
-			if err := info.RestoreInfo(); err != nil {
+	for _, dir := range directoriesExtracted {
+		if err := p.restoreInfo(dir); err != nil {
+			if !p.bestEffort {
 				return err
 			}
-
-			continue
+			skipped = append(skipped, SkippedEntry{Name: dir.Path, Err: err})
 		}
+	}
 
-		if info.IsDirectory() {
-			// Restore directory info after all files are extracted because
-			// the extraction process changes directory's timestamps.
-			directoriesExtracted = append(directoriesExtracted, info)
-			continue
-		}
+	if len(skipped) != 0 || streamErr != nil {
+		return &PartialUnpackError{Skipped: skipped, Err: streamErr}
+	}
+	return nil
+}
 
-		// The remaining logic only applies to regular files
-		if !info.IsRegular() {
-			continue
+// unpackEntry extracts a single entry from a slug, whose header has already
+// been read from untar.
+func (p *Packer) unpackEntry(dst string, header *tar.Header, untar io.Reader, extracted map[string]struct{}, collisions *caseCollisions, directoriesExtracted *[]unpackinfo.UnpackInfo) (err error) {
+	name, err := p.windowsEntryName(header.Name)
+	if err != nil {
+		return err
+	}
+	name, err = p.caseCollisionName(collisions, name)
+	if err != nil {
+		return err
+	}
+	if name != header.Name {
+		renamed := *header
+		renamed.Name = name
+		header = &renamed
+	}
+	if mode := p.entryMode(header); mode != header.Mode {
+		changed := *header
+		changed.Mode = mode
+		header = &changed
+	}
+
+	if err := p.checkControlCharacters(header); err != nil {
+		return err
+	}
+	if err := p.checkPathLimits(header.Name); err != nil {
+		return err
+	}
+
+	info, err := unpackinfo.NewUnpackInfo(dst, header)
+	if err != nil {
+		return &IllegalSlugError{Code: unpackInfoErrorCode(err), Err: err}
+	}
+
+	action := UnpackCreated
+	if !info.IsDirectory() && !info.IsTypeX() {
+		if _, exists := extracted[info.Path]; exists {
+			switch p.duplicatePolicy {
+			case RejectDuplicateEntries:
+				return &IllegalSlugError{
+					Code: DuplicateEntry,
+					Err:  fmt.Errorf("duplicate entry %q", header.Name),
+				}
+			case WarnDuplicateEntries:
+				if p.duplicateReporter != nil {
+					p.duplicateReporter(header.Name)
+				}
+			}
+			action = UnpackOverwritten
+		} else if existing, err := os.Lstat(info.Path); err == nil && !existing.IsDir() {
+			action = UnpackOverwritten
+			switch p.existingPolicy {
+			case FailIfExists:
+				return fmt.Errorf("cannot extract %q: %w", header.Name, fs.ErrExist)
+			case SkipExistingFiles:
+				action = UnpackSkipped
+			case OverwriteIfNewer:
+				if !header.ModTime.After(existing.ModTime()) {
+					action = UnpackSkipped
+				}
+			}
+		}
+		if action == UnpackSkipped {
+			p.reportUnpack(header.Name, action)
+			return nil
 		}
+		extracted[info.Path] = struct{}{}
+		defer func() {
+			if err == nil {
+				p.reportUnpack(header.Name, action)
+			}
+		}()
+	}
 
-		// Open a handle to the destination.
-		fh, err := os.Create(info.Path)
-		if err != nil {
-			// This mimics tar's behavior wrt the tar file containing duplicate files
-			// and it allowing later ones to clobber earlier ones even if the file
-			// has perms that don't allow overwriting. The file permissions will be restored
-			// once the file contents are copied.
-			if os.IsPermission(err) {
-				os.Chmod(info.Path, 0600)
-				fh, err = os.Create(info.Path)
+	// Make the directories to the path.
+	dir := filepath.Dir(info.Path)
+
+	// Timestamps and permissions will be restored after all files are extracted.
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	}
+
+	// Handle symlinks, directories, non-regular files
+	if info.IsSymlink() {
+		if allowedBy, ok, err := p.symlinkAllowed(dst, header.Name, header.Linkname); ok {
+			if action == UnpackOverwritten {
+				// Unlike files, symlinks can't be overwritten in place.
+				if err := os.Remove(info.Path); err != nil {
+					return fmt.Errorf("failed to replace %q with symlink: %w", header.Name, err)
+				}
 			}
+			// Create the symlink.
+			if err = os.Symlink(header.Linkname, info.Path); err != nil {
+				return fmt.Errorf("failed creating symlink (%q -> %q): %w",
+					header.Name, header.Linkname, err)
+			}
+			if p.symlinkReporter != nil {
+				p.symlinkReporter(SymlinkRecord{
+					Name:      header.Name,
+					Target:    header.Linkname,
+					AllowedBy: allowedBy,
+				})
+			}
+		} else {
+			return err
+		}
 
-			if err != nil {
-				return fmt.Errorf("failed creating file %q: %w", info.Path, err)
+		return p.restoreInfo(info)
+	}
+
+	if info.IsDirectory() {
+		// Restoring the directory's mode and times would otherwise apply
+		// them to wherever an existing symlink at its path refers to.
+		if existing, err := os.Lstat(info.Path); err == nil && existing.Mode()&fs.ModeSymlink != 0 {
+			return &IllegalSlugError{
+				Code: ExtractThroughSymlink,
+				Err:  fmt.Errorf("cannot extract directory %q over a symlink", header.Name),
 			}
 		}
 
-		// Copy the contents of the file.
-		_, err = io.Copy(fh, untar)
-		fh.Close()
-		if err != nil {
-			return fmt.Errorf("failed to copy slug file %q: %w", info.Path, err)
+		// Restore directory info after all files are extracted because
+		// the extraction process changes directory's timestamps.
+		*directoriesExtracted = append(*directoriesExtracted, info)
+		return nil
+	}
+
+	// The remaining logic only applies to regular files
+	if !info.IsRegular() {
+		return nil
+	}
+
+	// os.Create follows a symlink at the path, which could refer to
+	// anywhere, so we replace a symlink or any other kind of file that
+	// isn't a regular file instead of writing through it.
+	if existing, err := os.Lstat(info.Path); err == nil && !existing.Mode().IsRegular() && !existing.IsDir() {
+		if err := os.Remove(info.Path); err != nil {
+			return fmt.Errorf("failed to replace %q with file: %w", header.Name, err)
 		}
+	}
 
-		if err := info.RestoreInfo(); err != nil {
-			return err
+	// Open a handle to the destination.
+	fh, err := os.Create(info.Path)
+	if err != nil {
+		// This mimics tar's behavior wrt the tar file containing duplicate files
+		// and it allowing later ones to clobber earlier ones even if the file
+		// has perms that don't allow overwriting. The file permissions will be restored
+		// once the file contents are copied.
+		if os.IsPermission(err) {
+			os.Chmod(info.Path, 0600)
+			fh, err = os.Create(info.Path)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed creating file %q: %w", info.Path, err)
 		}
 	}
 
-	for _, dir := range directoriesExtracted {
-		if err := dir.RestoreInfo(); err != nil {
+	// Copy the contents of the file. There's nothing to copy for an empty
+	// file, which is common enough in some trees that it's worth avoiding
+	// the buffer and the read entirely.
+	if header.Size > 0 {
+		buf := p.getBuffer()
+		err = copySparse(fh, untar, buf)
+		p.putBuffer(buf)
+	}
+	fh.Close()
+	if err != nil {
+		return fmt.Errorf("failed to copy slug file %q: %w", info.Path, err)
+	}
+
+	if err := p.applyXattrs(info.Path, header.Name); err != nil {
+		return err
+	}
+
+	return p.restoreInfo(info)
+}
+
+// sparseBlockSize is the default granularity at which copySparse detects
+// runs of zero bytes.
+const sparseBlockSize = 64 * 1024
+
+// copySparse copies everything from r into the newly-created file f, but
+// seeks past any blocks that contain only zero bytes rather than writing
+// them, so that large sparse files in a slug remain sparse when unpacked
+// on filesystems that support it. The length of buf is the block size.
+func copySparse(f *os.File, r io.Reader, buf []byte) error {
+	var size int64
+	var hole bool
+	for {
+		// We don't use io.ReadFull here because it would hide whether an
+		// io.ErrUnexpectedEOF came from a truncated slug.
+		var n int
+		var err error
+		for n < len(buf) && err == nil {
+			var m int
+			m, err = r.Read(buf[n:])
+			n += m
+		}
+		if n > 0 {
+			block := buf[:n]
+			if isZeroBlock(block) {
+				if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+				hole = true
+			} else {
+				if _, err := f.Write(block); err != nil {
+					return err
+				}
+				hole = false
+			}
+			size += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
 			return err
 		}
 	}
-
+	if hole {
+		// Seeking past the end of a file doesn't extend it, so we must
+		// set the final size explicitly if the file ends with a hole.
+		return f.Truncate(size)
+	}
 	return nil
 }
 
+func isZeroBlock(block []byte) bool {
+	for _, b := range block {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // Given a "root" directory, the path to a symlink within said root, and the
 // target of said symlink, validSymlink checks that the target either falls
 // into root somewhere, or is explicitly allowed per the Packer's config.
 func (p *Packer) validSymlink(root, path, target string) (bool, error) {
+	_, ok, err := p.symlinkAllowed(root, path, target)
+	return ok, err
+}
+
+// symlinkAllowed is like validSymlink but also returns the pattern given to
+// AllowSymlinkTarget that allowed a target outside of root, if any.
+func (p *Packer) symlinkAllowed(root, path, target string) (allowedBy string, ok bool, err error) {
 	// Get the absolute path to root.
 	absRoot, err := filepath.Abs(root)
 	if err != nil {
-		return false, fmt.Errorf("failed making path %q absolute: %w", root, err)
+		return "", false, fmt.Errorf("failed making path %q absolute: %w", root, err)
 	}
 
 	// Get the absolute path to the file path.
@@ -520,19 +1714,31 @@ func (p *Packer) validSymlink(root, path, target string) (bool, error) {
 
 	// Target falls within root.
 	if strings.HasPrefix(absTarget, absRoot) {
-		return true, nil
+		return "", true, nil
 	}
 
 	// The link target is outside of root. Check if it is allowed.
-	for _, prefix := range p.allowSymlinkTargets {
+	for _, rule := range p.allowSymlinkTargets {
+		if isGlobPattern(rule) {
+			pattern := rule
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(absRoot, pattern)
+			}
+			if matchGlob(filepath.ToSlash(filepath.Clean(pattern)), filepath.ToSlash(absTarget)) {
+				return rule, true, nil
+			}
+			continue
+		}
+
 		// Ensure prefix is absolute.
+		prefix := rule
 		if !filepath.IsAbs(prefix) {
 			prefix = filepath.Join(absRoot, prefix)
 		}
 
 		// Exact match is allowed.
 		if absTarget == prefix {
-			return true, nil
+			return rule, true, nil
 		}
 
 		// Prefix match of a directory is allowed.
@@ -540,11 +1746,12 @@ func (p *Packer) validSymlink(root, path, target string) (bool, error) {
 			prefix += "/"
 		}
 		if strings.HasPrefix(absTarget, prefix) {
-			return true, nil
+			return rule, true, nil
 		}
 	}
 
-	return false, &IllegalSlugError{
+	return "", false, &IllegalSlugError{
+		Code: SymlinkExternalTarget,
 		Err: fmt.Errorf(
 			"invalid symlink (%q -> %q) has external target",
 			path, target,
@@ -552,6 +1759,58 @@ func (p *Packer) validSymlink(root, path, target string) (bool, error) {
 	}
 }
 
+// checkSizeLimit returns an error if adding the content of the entry with
+// the given header to the given total size would exceed the packer's size
+// limit.
+func (p *Packer) checkSizeLimit(total int64, header *tar.Header) error {
+	if p.sizeLimit == 0 || header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	if header.Size > p.sizeLimit-total {
+		return &IllegalSlugError{
+			Code: SizeLimitExceeded,
+			Err:  fmt.Errorf("entry %q exceeds the size limit of %d bytes", header.Name, p.sizeLimit),
+		}
+	}
+	return nil
+}
+
+// entryMode returns the mode that Unpack should give the entry with the
+// given header, after applying [WithForcedModes] and [WithModeMask].
+func (p *Packer) entryMode(header *tar.Header) int64 {
+	mode := header.Mode
+	switch fm := header.FileInfo().Mode(); {
+	case fm&os.ModeSymlink != 0:
+		return mode
+	case fm.IsDir() && p.forcedDirMode != 0:
+		mode = int64(p.forcedDirMode)
+	case fm.IsRegular() && p.forcedFileMode != 0:
+		mode = int64(p.forcedFileMode)
+	}
+	if p.hasModeMask {
+		mode &= int64(p.modeMask)
+	}
+	return mode
+}
+
+// reportUnpack passes the given action to the packer's unpack reporter, if
+// any.
+func (p *Packer) reportUnpack(name string, action UnpackAction) {
+	if p.unpackReporter != nil {
+		p.unpackReporter(name, action)
+	}
+}
+
+// isASCII returns true if the given string contains only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
 // checkFileMode is used to examine an os.FileMode and determine if it should
 // be included in the archive, and if it has a data body which needs writing.
 func checkFileMode(m os.FileMode) (keep, body bool) {
@@ -7,16 +7,22 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -428,6 +434,39 @@ func TestAllowSymlinkTarget(t *testing.T) {
 			target: "/foobar",
 			err:    "has external target",
 		},
+		{
+			desc:   "absolute symlink, doublestar pattern match",
+			allow:  "/nix/store/**",
+			target: "/nix/store/abc123-pkg/bin/tool",
+		},
+		{
+			desc:   "absolute symlink, single star pattern match",
+			allow:  "/nix/store/*/bin/*",
+			target: "/nix/store/abc123-pkg/bin/tool",
+		},
+		{
+			desc:   "absolute symlink, single star pattern non-match",
+			allow:  "/nix/store/*",
+			target: "/nix/store/abc123-pkg/bin/tool",
+			err:    "has external target",
+		},
+		{
+			desc:   "relative symlink, doublestar pattern match",
+			allow:  "../vendor/**/*.tf",
+			target: "../vendor/a/b/main.tf",
+		},
+		{
+			desc:   "absolute symlink, pattern with embedded traversal, non-match",
+			allow:  "/nix/store/**",
+			target: "/nix/store/../../etc/passwd",
+			err:    "has external target",
+		},
+		{
+			desc:   "similar file path, pattern non-match",
+			allow:  "/foo*/bar/**",
+			target: "/foo/baz/bar",
+			err:    "has external target",
+		},
 	}
 
 	for _, tc := range tcases {
@@ -467,250 +506,2593 @@ func TestAllowSymlinkTarget(t *testing.T) {
 			if err != nil {
 				t.Fatalf("err: %v", err)
 			}
-			tarR := tar.NewReader(gzipR)
-
-			symFound := false
-			for {
-				hdr, err := tarR.Next()
-				if err == io.EOF {
-					break
-				}
+			tarR := tar.NewReader(gzipR)
+
+			symFound := false
+			for {
+				hdr, err := tarR.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				if hdr.Name == "sym" {
+					symFound = true
+					if hdr.Typeflag != tar.TypeSymlink {
+						t.Fatalf("unexpected file type in slug: %q", hdr.Typeflag)
+					}
+					if hdr.Linkname != tc.target {
+						t.Fatalf("unexpected link target in slug: %q", hdr.Linkname)
+					}
+				}
+			}
+
+			if !symFound {
+				t.Fatal("did not find symlink in archive")
+			}
+		})
+
+		t.Run("Unpack: "+tc.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "slug")
+			if err != nil {
+				t.Fatalf("err:%v", err)
+			}
+			defer os.RemoveAll(dir)
+			in := filepath.Join(dir, "slug.tar.gz")
+
+			// Create the output file
+			wfh, err := os.Create(in)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			// Gzip compress all the output data
+			gzipW := gzip.NewWriter(wfh)
+
+			// Tar the file contents
+			tarW := tar.NewWriter(gzipW)
+
+			// Write the header.
+			tarW.WriteHeader(&tar.Header{
+				Name:     "l",
+				Linkname: tc.target,
+				Typeflag: tar.TypeSymlink,
+			})
+
+			tarW.Close()
+			gzipW.Close()
+			wfh.Close()
+
+			// Open the slug file for reading.
+			fh, err := os.Open(in)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			// Create a dir to unpack into.
+			dst, err := ioutil.TempDir(dir, "")
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer os.RemoveAll(dst)
+
+			// Unpack.
+			p, err := NewPacker(AllowSymlinkTarget(tc.allow))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Unpack(fh, dst); err != nil {
+				if tc.err != "" {
+					if !strings.Contains(err.Error(), tc.err) {
+						t.Fatalf("expected error %q, got %v", tc.err, err)
+					}
+				} else {
+					t.Fatal(err)
+				}
+			} else if tc.err != "" {
+				t.Fatalf("expected error %q, got nil", tc.err)
+			}
+		})
+	}
+}
+
+func TestAllowSymlinkTargetInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"/foo/[", "/foo/**/../bar/*", "/foo/a**/*"} {
+		if _, err := NewPacker(AllowSymlinkTarget(pattern)); err == nil {
+			t.Errorf("expected error for pattern %q", pattern)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"/a/**", "/a", true},
+		{"/a/**", "/a/b/c", true},
+		{"/a/**/c", "/a/c", true},
+		{"/a/**/c", "/a/b/b/c", true},
+		{"/a/**/c", "/a/b/c/d", false},
+		{"/a/*/c", "/a/b/c", true},
+		{"/a/*/c", "/a/b/b/c", false},
+		{"/a/b?", "/a/bc", true},
+		{"/a/**/**/d", "/a/d", true},
+		{"/a/[bc]/**", "/a/d/e", false},
+	} {
+		if got := matchGlob(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("matchGlob(%q, %q) = %t; want %t", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUnpack(t *testing.T) {
+	// First create the slug file so we can try to unpack it.
+	slug := bytes.NewBuffer(nil)
+
+	if _, err := Pack("testdata/archive-dir-no-external", slug, true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create a dir to unpack into.
+	dst, err := ioutil.TempDir("", "slug")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dst)
+
+	// Now try unpacking it.
+	if err := Unpack(slug, dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Verify all the files
+	verifyFile(t, filepath.Join(dst, "bar.txt"), 0, "bar\n")
+	verifyFile(t, filepath.Join(dst, "sub/bar.txt"), os.ModeSymlink, "../bar.txt")
+	verifyFile(t, filepath.Join(dst, "sub/zip.txt"), 0, "zip\n")
+
+	// Verify timestamps for files
+	verifyTimestamps(t, "testdata/archive-dir-no-external/bar.txt", filepath.Join(dst, "bar.txt"))
+	verifyTimestamps(t, "testdata/archive-dir-no-external/sub/zip.txt", filepath.Join(dst, "sub/zip.txt"))
+	verifyTimestamps(t, "testdata/archive-dir-no-external/sub2/zip.txt", filepath.Join(dst, "sub2/zip.txt"))
+
+	// Verify timestamps for symlinks
+	if unpackinfo.CanMaintainSymlinkTimestamps() {
+		verifyTimestamps(t, "testdata/archive-dir-no-external/sub/bar.txt", filepath.Join(dst, "sub/bar.txt"))
+	}
+
+	// Verify timestamps for directories
+	verifyTimestamps(t, "testdata/archive-dir-no-external/foo.terraform", filepath.Join(dst, "foo.terraform"))
+	verifyTimestamps(t, "testdata/archive-dir-no-external/sub", filepath.Join(dst, "sub"))
+	verifyTimestamps(t, "testdata/archive-dir-no-external/sub2", filepath.Join(dst, "sub2"))
+
+	// Check that we can set permissions properly
+	verifyPerms(t, filepath.Join(dst, "bar.txt"), 0644)
+	verifyPerms(t, filepath.Join(dst, "sub/zip.txt"), 0644)
+	verifyPerms(t, filepath.Join(dst, "sub/bar.txt"), 0644)
+	verifyPerms(t, filepath.Join(dst, "exe"), 0755)
+}
+
+func TestUnpack_HeaderOrdering(t *testing.T) {
+	// Tests that when a tar file has subdirectories ordered before parent directories, the
+	// timestamps get restored correctly in the plaform where the tests are run.
+
+	// This file is created by the go program found in `testdata/subdir-ordering`
+	f, err := os.Open("testdata/subdir-appears-first.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+
+	packer, err := NewPacker()
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	err = packer.Unpack(f, dir)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+
+	// These times were recorded when the archive was created
+	testCases := []struct {
+		Path string
+		TS   time.Time
+	}{
+		{TS: time.Unix(0, 1698787142347461403).Round(time.Second), Path: path.Join(dir, "super/duper")},
+		{TS: time.Unix(0, 1698780461367973574).Round(time.Second), Path: path.Join(dir, "super")},
+		{TS: time.Unix(0, 1698787142347461286).Round(time.Second), Path: path.Join(dir, "super/duper/trooper")},
+		{TS: time.Unix(0, 1698780470254368545).Round(time.Second), Path: path.Join(dir, "super/duper/trooper/foo.txt")},
+	}
+
+	for _, tc := range testCases {
+		info, err := os.Stat(tc.Path)
+		if err != nil {
+			t.Fatalf("error when stat %q: %s", tc.Path, err)
+		}
+		if info.ModTime() != tc.TS {
+			t.Errorf("timestamp of file %q (%d) did not match expected value %d", tc.Path, info.ModTime().UnixNano(), tc.TS.UnixNano())
+		}
+	}
+}
+
+func TestUnpackDuplicateNoWritePerm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slug")
+	if err != nil {
+		t.Fatalf("err:%v", err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "slug.tar.gz")
+
+	// Create the output file
+	wfh, err := os.Create(in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Gzip compress all the output data
+	gzipW := gzip.NewWriter(wfh)
+
+	// Tar the file contents
+	tarW := tar.NewWriter(gzipW)
+
+	var hdr tar.Header
+
+	data := "this is a\n"
+
+	hdr.Name = "a"
+	hdr.Mode = 0100000 | 0400
+	hdr.Size = int64(len(data))
+
+	tarW.WriteHeader(&hdr)
+	tarW.Write([]byte(data))
+
+	// write it twice
+	tarW.WriteHeader(&hdr)
+	tarW.Write([]byte(data))
+
+	tarW.Close()
+	gzipW.Close()
+	wfh.Close()
+
+	// Open the slug file for reading.
+	fh, err := os.Open(in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create a dir to unpack into.
+	dst, err := ioutil.TempDir(dir, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dst)
+
+	// Now try unpacking it.
+	if err := Unpack(fh, dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Verify all the files
+	verifyFile(t, filepath.Join(dst, "a"), 0, "this is a\n")
+
+	// Check that we can set permissions properly
+	verifyPerms(t, filepath.Join(dst, "a"), 0400)
+}
+
+func TestPackerConcurrentWithOptions(t *testing.T) {
+	p, err := NewPacker(AllowSymlinkTarget("/foo"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var opts []PackerOption
+			if i%2 == 0 {
+				opts = append(opts, WithPaxFormat(), AllowSymlinkTarget(fmt.Sprintf("/bar%d", i)))
+			}
+
+			var buf bytes.Buffer
+			if _, err := p.PackWithOptions("testdata/archive-dir-no-external", &buf, opts...); err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = p.UnpackWithOptions(&buf, t.TempDir(), opts...)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("call %d failed: %s", i, err)
+		}
+	}
+
+	// The per-call options must not have modified the shared Packer.
+	want, err := NewPacker(AllowSymlinkTarget("/foo"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("packer was modified\nexpect:\n%#v\n\nactual:\n%#v", want, p)
+	}
+}
+
+func TestPackLeadingEntries(t *testing.T) {
+	p, err := NewPacker(WithLeadingEntries("sub/zip.txt", "baz.txt", "missing.txt"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	meta, err := p.Pack("testdata/archive-dir-no-external", &buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if got, want := meta.Files[:2], []string{"sub/zip.txt", "baz.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong leading entries\ngot:  %#v\nwant: %#v", got, want)
+	}
+	seen := make(map[string]bool)
+	for _, name := range meta.Files {
+		if seen[name] {
+			t.Errorf("duplicate entry %q", name)
+		}
+		seen[name] = true
+	}
+
+	if _, err := NewPacker(WithLeadingEntries("../escape")); err == nil {
+		t.Errorf("expected error for path traversal in leading entry")
+	}
+}
+
+func TestPackArchiveDigest(t *testing.T) {
+	p, err := NewPacker(WithArchiveDigest(), WithArchiveHashes(crypto.MD5))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	meta, err := p.Pack("testdata/archive-dir-no-external", &buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if got, want := meta.ArchiveSize, int64(buf.Len()); got != want {
+		t.Errorf("wrong archive size %d; want %d", got, want)
+	}
+	wantSHA256 := sha256.Sum256(buf.Bytes())
+	if got, want := meta.ArchiveSHA256, wantSHA256[:]; !bytes.Equal(got, want) {
+		t.Errorf("wrong archive SHA-256 %x; want %x", got, want)
+	}
+	wantMD5 := md5.Sum(buf.Bytes())
+	if got, want := meta.ArchiveHashes[crypto.MD5], wantMD5[:]; !bytes.Equal(got, want) {
+		t.Errorf("wrong archive MD5 %x; want %x", got, want)
+	}
+
+	// Each call computes its own digests, even when calls overlap.
+	var wg sync.WaitGroup
+	metas := make([]*Meta, 4)
+	bufs := make([]bytes.Buffer, len(metas))
+	for i := range metas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			metas[i], _ = p.Pack("testdata/archive-dir-no-external", &bufs[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, meta := range metas {
+		if meta == nil {
+			t.Fatalf("concurrent Pack %d failed", i)
+		}
+		wantMD5 := md5.Sum(bufs[i].Bytes())
+		if got, want := meta.ArchiveHashes[crypto.MD5], wantMD5[:]; !bytes.Equal(got, want) {
+			t.Errorf("wrong archive MD5 %x for concurrent Pack %d; want %x", got, i, want)
+		}
+	}
+
+	if _, err := NewPacker(WithArchiveHashes(crypto.Hash(0))); err == nil {
+		t.Errorf("expected error for unavailable hash function")
+	}
+
+	// Without the option the archive fields are left unpopulated.
+	meta, err = Pack("testdata/archive-dir-no-external", io.Discard, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta.ArchiveSize != 0 || meta.ArchiveSHA256 != nil || meta.ArchiveHashes != nil {
+		t.Errorf("unexpected archive digest %d %x", meta.ArchiveSize, meta.ArchiveSHA256)
+	}
+}
+
+func TestPackEntryDetails(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink("sub", filepath.Join(src, "sublink")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	p, err := NewPacker(WithEntryDetails())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta, err := p.Pack(src, io.Discard)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []Entry{
+		{Name: "a.txt", Type: RegularFileEntry, Size: 5},
+		{Name: "link", Type: SymlinkEntry, Target: "a.txt"},
+		{Name: "sub/", Type: DirectoryEntry},
+		{Name: "sublink", Type: SymlinkEntry, Target: "sub"},
+	}
+	if !reflect.DeepEqual(meta.Entries, want) {
+		t.Errorf("wrong entries\ngot:  %#v\nwant: %#v", meta.Entries, want)
+	}
+
+	// Without the option the entries are left unpopulated.
+	meta, err = Pack(src, io.Discard, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta.Entries != nil {
+		t.Errorf("unexpected entries %#v", meta.Entries)
+	}
+}
+
+func TestPackContext(t *testing.T) {
+	p, err := NewPacker()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	meta, err := p.PackContext(context.Background(), "testdata/archive-dir-no-external", io.Discard)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(meta.Files) == 0 {
+		t.Fatal("expected some files")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = p.PackContext(ctx, "testdata/archive-dir-no-external", io.Discard)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error %v; want context.Canceled", err)
+	}
+
+	// Cancellation must also interrupt the copy of a large file, which we
+	// arrange by canceling as soon as any compressed output is written.
+	src := t.TempDir()
+	data := make([]byte, 8<<20)
+	for i := range data {
+		data[i] = byte(i * 7919 >> 3)
+	}
+	if err := os.WriteFile(filepath.Join(src, "big.bin"), data, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancelingWriter{cancel: cancel}
+	_, err = p.PackContext(ctx, src, w)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("wrong error %v; want context.Canceled", err)
+	}
+	if !strings.Contains(err.Error(), "big.bin") {
+		t.Errorf("error should mention the file being copied: %s", err)
+	}
+}
+
+// cancelingWriter calls cancel on its first write.
+type cancelingWriter struct {
+	cancel func()
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	return len(p), nil
+}
+
+func TestPackIgnoreSemantics(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".terraformignore": "logs/\n!logs/keep.txt\n",
+		"logs/keep.txt":    "",
+		"logs/drop.txt":    "",
+		"main.tf":          "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]struct {
+		semantics IgnoreSemantics
+		want      []string
+	}{
+		"legacy": {
+			LegacyIgnoreSemantics,
+			[]string{".terraformignore", "logs/keep.txt", "main.tf"},
+		},
+		"source bundle": {
+			SourceBundleIgnoreSemantics,
+			[]string{".terraformignore", "main.tf"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := NewPacker(ApplyTerraformIgnore(), WithIgnoreSemantics(test.semantics))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			meta, err := p.Pack(dir, io.Discard)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !reflect.DeepEqual(meta.Files, test.want) {
+				t.Errorf("wrong files\ngot:  %#v\nwant: %#v", meta.Files, test.want)
+			}
+		})
+	}
+
+	if _, err := NewPacker(WithIgnoreSemantics(IgnoreSemantics(99))); err == nil {
+		t.Errorf("expected error for invalid ignore semantics")
+	}
+}
+
+func TestPackFileLister(t *testing.T) {
+	lister := FileListerFunc(func(root string) ([]string, error) {
+		return []string{"bar.txt", "sub/zip.txt", "missing.txt"}, nil
+	})
+	p, err := NewPacker(WithFileLister(lister))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	meta, err := p.Pack("testdata/archive-dir-no-external", &buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []string{"bar.txt", "sub/", "sub/zip.txt"}
+	if !reflect.DeepEqual(meta.Files, want) {
+		t.Fatalf("wrong files\ngot:  %#v\nwant: %#v", meta.Files, want)
+	}
+
+	failing := FileListerFunc(func(root string) ([]string, error) {
+		return nil, errors.New("boom")
+	})
+	p, err = NewPacker(WithFileLister(failing))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := p.Pack("testdata/archive-dir-no-external", &buf); err == nil || err.Error() != "boom" {
+		t.Fatalf("expected lister error, got %v", err)
+	}
+}
+
+func TestPackGitTrackedOnly(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	src := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = src
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	for name, content := range map[string]string{
+		"main.tf":          "tracked",
+		"modules/a/a.tf":   "tracked",
+		"untracked.tf":     "untracked",
+		"modules/b/new.tf": "untracked",
+	} {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	git("add", "main.tf", "modules/a/a.tf")
+
+	p, err := NewPacker(WithGitTrackedOnly())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	meta, err := p.Pack(src, &buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := []string{"main.tf", "modules/", "modules/a/", "modules/a/a.tf"}
+	if !reflect.DeepEqual(meta.Files, want) {
+		t.Fatalf("wrong files\ngot:  %#v\nwant: %#v", meta.Files, want)
+	}
+
+	// Packing a directory that isn't in a repository at all should fail.
+	if _, err := p.Pack(t.TempDir(), &buf); err == nil {
+		t.Fatal("expected error packing outside of a git repository")
+	}
+}
+
+func TestPackPaxFormat(t *testing.T) {
+	src := t.TempDir()
+	longName := strings.Repeat("d", 80) + "/" + strings.Repeat("f", 120)
+	if err := os.MkdirAll(filepath.Join(src, filepath.Dir(longName)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(src, longName)
+	if err := os.WriteFile(filePath, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	if err := os.Chtimes(filePath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPacker(WithPaxFormat())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := p.Pack(src, &buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every entry should be using the PAX format.
+	gzipR, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarR := tar.NewReader(gzipR)
+	for {
+		hdr, err := tarR.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Format != tar.FormatPAX {
+			t.Errorf("entry %q has format %s; want PAX", hdr.Name, hdr.Format)
+		}
+	}
+
+	dst := t.TempDir()
+	if err := p.Unpack(&buf, dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(dst, longName))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := fi.ModTime(); !got.Equal(mtime) {
+		t.Errorf("wrong mtime %s; want %s", got, mtime)
+	}
+}
+
+func TestUnpackBestEffort(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	for _, hdr := range []*tar.Header{
+		{Name: "good1", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"},
+		{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "good2", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	} {
+		tarW.WriteHeader(hdr)
+		if hdr.Size != 0 {
+			tarW.Write([]byte("hello"))
+		}
+	}
+	tarW.Close()
+	gzipW.Close()
+	slug := buf.Bytes()
+
+	// Without best-effort mode we stop at the first problem.
+	if err := Unpack(bytes.NewReader(slug), t.TempDir()); err == nil {
+		t.Fatal("expected error, got none")
+	}
+
+	p, err := NewPacker(WithBestEffortExtraction())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dst := t.TempDir()
+	err = p.Unpack(bytes.NewReader(slug), dst)
+
+	var partialErr *PartialUnpackError
+	if !errors.As(err, &partialErr) {
+		t.Fatalf("expected *PartialUnpackError, got %T %v", err, err)
+	}
+	var gotSkipped []string
+	for _, entry := range partialErr.Skipped {
+		gotSkipped = append(gotSkipped, entry.Name)
+	}
+	if want := []string{"evil", "../escape"}; !reflect.DeepEqual(gotSkipped, want) {
+		t.Errorf("wrong skipped entries\ngot:  %#v\nwant: %#v", gotSkipped, want)
+	}
+	if partialErr.Err != nil {
+		t.Errorf("unexpected stream error: %s", partialErr.Err)
+	}
+	var illegalErr *IllegalSlugError
+	if !errors.As(err, &illegalErr) {
+		t.Errorf("expected to find *IllegalSlugError in %v", err)
+	}
+
+	for _, name := range []string{"good1", "good2"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Errorf("entry %q was not extracted: %s", name, err)
+		}
+	}
+}
+
+func TestUnpackGzipMembers(t *testing.T) {
+	member := func(names ...string) []byte {
+		var buf bytes.Buffer
+		gzipW := gzip.NewWriter(&buf)
+		tarW := tar.NewWriter(gzipW)
+		for _, name := range names {
+			tarW.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+			tarW.Write([]byte("hello"))
+		}
+		tarW.Close()
+		gzipW.Close()
+		return buf.Bytes()
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	// A single tar archive split across two gzip members in the middle of
+	// an entry.
+	var tarBuf, split bytes.Buffer
+	tarW := tar.NewWriter(&tarBuf)
+	tarW.WriteHeader(&tar.Header{Name: "first", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tarW.Write([]byte("hello"))
+	tarW.Close()
+	for _, part := range [][]byte{tarBuf.Bytes()[:100], tarBuf.Bytes()[100:]} {
+		gzipW := gzip.NewWriter(&split)
+		gzipW.Write(part)
+		gzipW.Close()
+	}
+
+	// A tar archive followed by more data in the same gzip member than
+	// its padding could need.
+	var padded bytes.Buffer
+	gzipW := gzip.NewWriter(&padded)
+	gzipW.Write(tarBuf.Bytes())
+	gzipW.Write(make([]byte, maxTarPadding))
+	gzipW.Close()
+	var trailing bytes.Buffer
+	gzipW = gzip.NewWriter(&trailing)
+	gzipW.Write(tarBuf.Bytes())
+	gzipW.Write(make([]byte, 1<<20))
+	gzipW.Close()
+
+	tests := map[string]struct {
+		slug        []byte
+		options     []PackerOption
+		wantCode    IllegalSlugErrorCode
+		wantErr     bool
+		wantEntries []string
+	}{
+		"single member": {
+			slug:        member("first"),
+			wantEntries: []string{"first"},
+		},
+		"two members": {
+			slug:     concat(member("first"), member("second")),
+			wantErr:  true,
+			wantCode: MultipleGzipMembers,
+		},
+		"two members allowed": {
+			slug:        concat(member("first"), member("second")),
+			options:     []PackerOption{WithMultipleGzipMembers()},
+			wantEntries: []string{"first", "second"},
+		},
+		"archive split across members": {
+			slug:     split.Bytes(),
+			options:  []PackerOption{WithMultipleGzipMembers()},
+			wantErr:  true,
+			wantCode: MultipleGzipMembers,
+		},
+		"trailing garbage": {
+			slug:     concat(member("first"), []byte("garbage")),
+			wantErr:  true,
+			wantCode: TrailingData,
+		},
+		"padding after archive": {
+			slug:        padded.Bytes(),
+			wantEntries: []string{"first"},
+		},
+		"trailing data after archive": {
+			slug:     trailing.Bytes(),
+			options:  []PackerOption{WithSizeLimit(1024)},
+			wantErr:  true,
+			wantCode: TrailingData,
+		},
+		"trailing garbage after allowed members": {
+			slug:     concat(member("first"), member("second"), []byte{0}),
+			options:  []PackerOption{WithMultipleGzipMembers()},
+			wantErr:  true,
+			wantCode: TrailingData,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := NewPacker(test.options...)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			dst := t.TempDir()
+			err = p.Unpack(bytes.NewReader(test.slug), dst)
+			if test.wantErr {
+				var illegalErr *IllegalSlugError
+				if !errors.As(err, &illegalErr) {
+					t.Fatalf("expected *IllegalSlugError, got %T %v", err, err)
+				}
+				if illegalErr.Code != test.wantCode {
+					t.Errorf("wrong error code %s; want %s", illegalErr.Code, test.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			for _, name := range test.wantEntries {
+				if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+					t.Errorf("entry %q was not extracted: %s", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackDuplicateEntryPolicy(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	for _, data := range []string{"first\n", "second\n"} {
+		tarW.WriteHeader(&tar.Header{
+			Name:     "a",
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+		})
+		tarW.Write([]byte(data))
+	}
+	tarW.Close()
+	gzipW.Close()
+	slug := buf.Bytes()
+
+	for _, tc := range []struct {
+		desc         string
+		policy       DuplicateEntryPolicy
+		wantErr      string
+		wantReported []string
+	}{
+		{
+			desc:   "allow",
+			policy: AllowDuplicateEntries,
+		},
+		{
+			desc:         "warn",
+			policy:       WarnDuplicateEntries,
+			wantReported: []string{"a"},
+		},
+		{
+			desc:    "reject",
+			policy:  RejectDuplicateEntries,
+			wantErr: `illegal slug error: duplicate entry "a"`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var reported []string
+			p, err := NewPacker(
+				WithDuplicateEntryPolicy(tc.policy),
+				WithDuplicateEntryReporter(func(name string) {
+					reported = append(reported, name)
+				}),
+			)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			dst := t.TempDir()
+			err = p.Unpack(bytes.NewReader(slug), dst)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				if err.Error() != tc.wantErr {
+					t.Fatalf("wrong error\ngot:  %s\nwant: %s", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			verifyFile(t, filepath.Join(dst, "a"), 0, "second\n")
+			if !reflect.DeepEqual(reported, tc.wantReported) {
+				t.Errorf("wrong reported duplicates %q; want %q", reported, tc.wantReported)
+			}
+		})
+	}
+}
+
+func TestUnpackWindowsNames(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	for _, name := range []string{"mods/con.tf", "trailing. ", "aux/x.tf", "what?.tf", "ok.tf"} {
+		tarW.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(name)),
+		})
+		tarW.Write([]byte(name))
+	}
+	tarW.Close()
+	gzipW.Close()
+	slug := buf.Bytes()
+
+	for _, tc := range []struct {
+		desc      string
+		policy    WindowsNamePolicy
+		onWindows bool
+		wantErr   string
+		wantFiles map[string]string
+	}{
+		{
+			desc:   "check, not on windows",
+			policy: CheckWindowsNamesOnWindows,
+			wantFiles: map[string]string{
+				"mods/con.tf": "mods/con.tf",
+				"trailing. ":  "trailing. ",
+				"aux/x.tf":    "aux/x.tf",
+				"what?.tf":    "what?.tf",
+				"ok.tf":       "ok.tf",
+			},
+		},
+		{
+			desc:      "check, on windows",
+			policy:    CheckWindowsNamesOnWindows,
+			onWindows: true,
+			wantErr:   `illegal slug error: entry "mods/con.tf" cannot be extracted on Windows: name "con.tf" uses the reserved device name "con"`,
+		},
+		{
+			desc:    "reject",
+			policy:  RejectWindowsNames,
+			wantErr: `illegal slug error: entry "mods/con.tf" cannot be extracted on Windows: name "con.tf" uses the reserved device name "con"`,
+		},
+		{
+			desc:   "escape",
+			policy: EscapeWindowsNames,
+			wantFiles: map[string]string{
+				"mods/co%6E.tf": "mods/con.tf",
+				"trailing.%20":  "trailing. ",
+				"au%78/x.tf":    "aux/x.tf",
+				"what%3F.tf":    "what?.tf",
+				"ok.tf":         "ok.tf",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			defer func(old bool) { onWindows = old }(onWindows)
+			onWindows = tc.onWindows
+
+			p, err := NewPacker(WithWindowsNamePolicy(tc.policy))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			dst := t.TempDir()
+			err = p.Unpack(bytes.NewReader(slug), dst)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected error, got none")
+				}
+				if err.Error() != tc.wantErr {
+					t.Fatalf("wrong error\ngot:  %s\nwant: %s", err, tc.wantErr)
+				}
+				var illegal *IllegalSlugError
+				if !errors.As(err, &illegal) || illegal.Code != WindowsIncompatibleName {
+					t.Fatalf("wrong error code for %#v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			for name, content := range tc.wantFiles {
+				verifyFile(t, filepath.Join(dst, filepath.FromSlash(name)), 0, content)
+			}
+		})
+	}
+}
+
+func TestUnpackRemapper(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	for _, name := range []string{"vendor/mod/main.tf", "vendor/mod/sub/x.tf", "README.md"} {
+		tarW.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(name)),
+		})
+		tarW.Write([]byte(name))
+	}
+	tarW.Close()
+	gzipW.Close()
+	slug := buf.Bytes()
+
+	p, err := NewPacker()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Strip the vendored prefix and place the result under a module
+	// directory, skipping everything outside of the prefix.
+	dst := t.TempDir()
+	err = p.UnpackWithOptions(bytes.NewReader(slug), dst, WithUnpackRemapper(func(header *tar.Header) (string, bool) {
+		rest := strings.TrimPrefix(header.Name, "vendor/mod/")
+		if rest == header.Name {
+			return "", true
+		}
+		return ".terraform/modules/mod/" + rest, false
+	}))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	verifyFile(t, filepath.Join(dst, ".terraform", "modules", "mod", "main.tf"), 0, "vendor/mod/main.tf")
+	verifyFile(t, filepath.Join(dst, ".terraform", "modules", "mod", "sub", "x.tf"), 0, "vendor/mod/sub/x.tf")
+	for _, name := range []string{"vendor", "README.md"} {
+		if _, err := os.Lstat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should not have been extracted", name)
+		}
+	}
+
+	// The usual safety checks apply to the remapped names.
+	dst = filepath.Join(t.TempDir(), "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = p.UnpackWithOptions(bytes.NewReader(slug), dst, WithUnpackRemapper(func(header *tar.Header) (string, bool) {
+		return "../" + header.Name, false
+	}))
+	var illegal *IllegalSlugError
+	if !errors.As(err, &illegal) {
+		t.Fatalf("expected illegal slug error for traversal; got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "..", "README.md")); !os.IsNotExist(err) {
+		t.Errorf("remapped entry was extracted outside of the destination")
+	}
+
+	err = p.UnpackWithOptions(bytes.NewReader(slug), t.TempDir(), WithUnpackRemapper(func(header *tar.Header) (string, bool) {
+		return "", false
+	}))
+	if want := `entry "vendor/mod/main.tf" was remapped to an empty name`; err == nil || err.Error() != want {
+		t.Fatalf("wrong error\ngot:  %v\nwant: %s", err, want)
+	}
+
+	if _, err := NewPacker(WithUnpackRemapper(nil)); err == nil {
+		t.Fatal("expected error for nil remapper")
+	}
+}
+
+func TestUnpackCaseCollisions(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	tarW.WriteHeader(&tar.Header{
+		Name:     "Mods/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	})
+	for _, name := range []string{"main.tf", "Main.tf", "MAIN.tf", "mods/a.tf", "Mods/b.tf", ".gitignore", ".GitIgnore"} {
+		tarW.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(name)),
+		})
+		tarW.Write([]byte(name))
+	}
+	tarW.Close()
+	gzipW.Close()
+	slug := buf.Bytes()
+
+	t.Run("reject", func(t *testing.T) {
+		p, err := NewPacker(WithCaseCollisionPolicy(RejectCaseCollisions))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		err = p.Unpack(bytes.NewReader(slug), t.TempDir())
+		want := `illegal slug error: entry "Main.tf" differs only in case from "main.tf"`
+		if err == nil || err.Error() != want {
+			t.Fatalf("wrong error\ngot:  %v\nwant: %s", err, want)
+		}
+		var illegal *IllegalSlugError
+		if !errors.As(err, &illegal) || illegal.Code != CaseCollision {
+			t.Fatalf("wrong error code for %#v", err)
+		}
+
+		v := p.NewValidator()
+		v.Write(slug)
+		if err := v.Close(); err == nil || err.Error() != want {
+			t.Fatalf("wrong validator error\ngot:  %v\nwant: %s", err, want)
+		}
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		var records []CaseCollisionRecord
+		p, err := NewPacker(
+			WithCaseCollisionPolicy(RenameCaseCollisions),
+			WithCaseCollisionReporter(func(record CaseCollisionRecord) {
+				records = append(records, record)
+			}),
+		)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		dst := t.TempDir()
+		if err := p.Unpack(bytes.NewReader(slug), dst); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		wantFiles := map[string]string{
+			"main.tf":      "main.tf",
+			"Main~1.tf":    "Main.tf",
+			"MAIN~2.tf":    "MAIN.tf",
+			"mods~1/a.tf":  "mods/a.tf",
+			"Mods/b.tf":    "Mods/b.tf",
+			".gitignore":   ".gitignore",
+			".GitIgnore~1": ".GitIgnore",
+		}
+		for name, content := range wantFiles {
+			verifyFile(t, filepath.Join(dst, filepath.FromSlash(name)), 0, content)
+		}
+
+		wantRecords := []CaseCollisionRecord{
+			{Name: "Main.tf", ExtractedAs: "Main~1.tf", CollidesWith: "main.tf"},
+			{Name: "MAIN.tf", ExtractedAs: "MAIN~2.tf", CollidesWith: "main.tf"},
+			{Name: "mods/a.tf", ExtractedAs: "mods~1/a.tf", CollidesWith: "Mods"},
+			{Name: ".GitIgnore", ExtractedAs: ".GitIgnore~1", CollidesWith: ".gitignore"},
+		}
+		if !reflect.DeepEqual(records, wantRecords) {
+			t.Errorf("wrong records\ngot:  %#v\nwant: %#v", records, wantRecords)
+		}
+	})
+}
+
+func TestPackUnpackControlCharacters(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"main.tf", "bad\nname.tf", "\x1b[31mred.tf"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Pack writes the names unchanged by default, but lists them safely.
+	p, err := NewPacker()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	slug := bytes.NewBuffer(nil)
+	meta, err := p.Pack(src, slug)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	wantFiles := []string{`\x1b[31mred.tf`, `bad\nname.tf`, "main.tf"}
+	if !reflect.DeepEqual(meta.Files, wantFiles) {
+		t.Errorf("wrong files\ngot:  %q\nwant: %q", meta.Files, wantFiles)
+	}
+	archive := slug.Bytes()
+
+	// Pack applies the policy only when asked to.
+	strict, err := NewPacker(WithPackControlCharacterCheck())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, err = strict.Pack(src, io.Discard)
+	var illegal *IllegalSlugError
+	if !errors.As(err, &illegal) || illegal.Code != ControlCharacterInName {
+		t.Fatalf("expected IllegalSlugError with code ControlCharacterInName, got %v", err)
+	}
+
+	lenient, err := NewPacker(WithControlCharacterPolicy(AllowControlCharacters), WithPackControlCharacterCheck())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := lenient.Pack(src, io.Discard); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The default policy rejects the same names when unpacking.
+	err = p.Unpack(bytes.NewReader(archive), t.TempDir())
+	if !errors.As(err, &illegal) || illegal.Code != ControlCharacterInName {
+		t.Fatalf("expected IllegalSlugError with code ControlCharacterInName, got %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := lenient.Unpack(bytes.NewReader(archive), dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "bad\nname.tf")); err != nil {
+		t.Errorf("err: %v", err)
+	}
+}
+
+func TestPackDirModTimes(t *testing.T) {
+	src := t.TempDir()
+	fileTime := time.Date(2023, time.May, 29, 11, 22, 33, 0, time.UTC)
+	for _, name := range []string{"main.tf", "modules/a/main.tf"} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.Chtimes(path, fileTime, fileTime); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	setDirTimes := func(modTime time.Time) {
+		for _, name := range []string{"modules", "modules/a"} {
+			if err := os.Chtimes(filepath.Join(src, filepath.FromSlash(name)), modTime, modTime); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+	pack := func(opts ...PackerOption) []byte {
+		p, err := NewPacker(opts...)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var buf bytes.Buffer
+		if _, err := p.Pack(src, &buf); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return buf.Bytes()
+	}
+	dirTimes := func(archive []byte) map[string]time.Time {
+		ret := make(map[string]time.Time)
+		gzipR, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		tarR := tar.NewReader(gzipR)
+		for {
+			header, err := tarR.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if header.Typeflag == tar.TypeDir {
+				ret[header.Name] = header.ModTime
+			}
+		}
+		return ret
+	}
+
+	// By default, touching a directory changes the slug.
+	setDirTimes(fileTime)
+	before := pack()
+	setDirTimes(fileTime.Add(time.Hour))
+	if bytes.Equal(before, pack()) {
+		t.Fatalf("directory modification time didn't affect the slug")
+	}
+
+	// Omitting the times makes the slug independent of them.
+	setDirTimes(fileTime)
+	before = pack(WithDirModTimePolicy(OmitDirModTimes))
+	setDirTimes(fileTime.Add(time.Hour))
+	after := pack(WithDirModTimePolicy(OmitDirModTimes))
+	if !bytes.Equal(before, after) {
+		t.Errorf("directory modification time affected the slug")
+	}
+	for name, modTime := range dirTimes(after) {
+		if modTime.Unix() != 0 {
+			t.Errorf("directory %s has modification time %s; want none", name, modTime)
+		}
+	}
+
+	// Extracting directories without times leaves them at the time of
+	// extraction, rather than the Unix epoch.
+	dst := t.TempDir()
+	if err := Unpack(bytes.NewReader(after), dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "modules", "a"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(info.ModTime()) > time.Hour {
+		t.Errorf("extracted directory has modification time %s; want the time of extraction", info.ModTime())
+	}
+
+	// Clamping replaces only the times after the limit.
+	limit := fileTime.Add(time.Minute)
+	setDirTimes(fileTime.Add(time.Hour))
+	if err := os.Chtimes(filepath.Join(src, "modules"), fileTime, fileTime); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	got := dirTimes(pack(WithClampedDirModTimes(limit)))
+	if !got["modules/"].Equal(fileTime) {
+		t.Errorf("unclamped directory has modification time %s; want %s", got["modules/"], fileTime)
+	}
+	if !got["modules/a/"].Equal(limit) {
+		t.Errorf("clamped directory has modification time %s; want %s", got["modules/a/"], limit)
+	}
+
+	if _, err := NewPacker(WithDirModTimePolicy(DirModTimePolicy(99))); err == nil {
+		t.Errorf("invalid policy was accepted")
+	}
+}
+
+func TestCopyFileBodySizeChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	p, err := NewPacker()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The size we pass stands in for the size the file had when Pack read
+	// its header, to simulate the file changing afterwards.
+	for _, tc := range []struct {
+		size    int64
+		bufSize int
+		wantErr string
+	}{
+		{size: 5, bufSize: 64},
+		{size: 4, bufSize: 64, wantErr: "file grew while reading it"},
+		{size: 6, bufSize: 64, wantErr: "file was truncated while reading it"},
+		{size: 4, bufSize: 2, wantErr: "write too long"},
+	} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		tarW := tar.NewWriter(io.Discard)
+		if err := tarW.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Size: tc.size}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_, err = p.copyFileBody(context.Background(), tarW, f, tc.size, make([]byte, tc.bufSize))
+		f.Close()
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("size %d: unexpected error: %v", tc.size, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("size %d: wrong error %v; want %q", tc.size, err, tc.wantErr)
+		}
+	}
+}
+
+func TestPackUnpackEmptyFiles(t *testing.T) {
+	src := t.TempDir()
+	for name, content := range map[string]string{
+		"main.tf":         "# main",
+		"marker":          "",
+		"modules/a/.keep": "",
+	} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	// Pack never opens an empty file, even to check its content, so it
+	// doesn't matter that this one is unreadable.
+	if err := os.Chmod(filepath.Join(src, "marker"), 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	p, err := NewPacker(WithDeniedContent(NativeExecutable))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	meta, err := p.Pack(src, &buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if want := []string{"main.tf", "marker", "modules/", "modules/a/", "modules/a/.keep"}; !reflect.DeepEqual(meta.Files, want) {
+		t.Errorf("wrong files %q; want %q", meta.Files, want)
+	}
+	if got, want := meta.Size, int64(len("# main")); got != want {
+		t.Errorf("wrong size %d; want %d", got, want)
+	}
+
+	// An empty entry replaces the content of an existing file.
+	dst := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dst, "marker"), []byte("old content"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := p.Unpack(bytes.NewReader(buf.Bytes()), dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for name, want := range map[string]int64{
+		"main.tf":         int64(len("# main")),
+		"marker":          0,
+		"modules/a/.keep": 0,
+	} {
+		info, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if got := info.Size(); got != want {
+			t.Errorf("wrong size for %s %d; want %d", name, got, want)
+		}
+	}
+}
+
+func TestPackSkipUnreadable(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"main.tf", "secret.tf", "private/main.tf"} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for _, name := range []string{"secret.tf", "private"} {
+		path := filepath.Join(src, name)
+		if err := os.Chmod(path, 0); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(func() { os.Chmod(path, 0755) })
+	}
+	// Pack never opens an empty file, and so packs this one regardless.
+	empty := filepath.Join(src, "empty.tf")
+	if err := os.WriteFile(empty, nil, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// Permissions don't stop the superuser, or anyone on some platforms.
+	if f, err := os.Open(filepath.Join(src, "secret.tf")); err == nil {
+		f.Close()
+		t.Skip("file permissions are not enforced for this user")
+	}
+
+	p, err := NewPacker()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := p.Pack(src, io.Discard); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected permission error without WithSkipUnreadable; got %v", err)
+	}
+
+	p, err = NewPacker(WithSkipUnreadable())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var buf bytes.Buffer
+	meta, err := p.Pack(src, &buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var gotNames []string
+	for _, f := range meta.UnreadableFiles {
+		if !errors.Is(f.Err, fs.ErrPermission) {
+			t.Errorf("unexpected error for %s: %v", f.Name, f.Err)
+		}
+		gotNames = append(gotNames, f.Name)
+	}
+	if want := []string{"private/", "secret.tf"}; !reflect.DeepEqual(gotNames, want) {
+		t.Errorf("wrong unreadable files %q; want %q", gotNames, want)
+	}
+	if want := []string{"empty.tf", "main.tf"}; !reflect.DeepEqual(meta.Files, want) {
+		t.Errorf("wrong files %q; want %q", meta.Files, want)
+	}
+
+	// An unreadable root is still an error.
+	if err := os.Chmod(src, 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { os.Chmod(src, 0755) })
+	if _, err := p.Pack(src, io.Discard); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected permission error for unreadable root; got %v", err)
+	}
+}
+
+// TestPackSkipUnreadableWalkErrors checks how Pack handles the errors that
+// the walk reports for unreadable paths by passing them to the walk function
+// directly, because TestPackSkipUnreadable skips itself for users that file
+// permissions don't apply to, such as root. Only TestPackSkipUnreadable
+// covers a file that Pack can list but not open.
+func TestPackSkipUnreadableWalkErrors(t *testing.T) {
+	src := t.TempDir()
+	if err := os.Mkdir(filepath.Join(src, "private"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rootInfo, err := os.Lstat(src)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dirInfo, err := os.Lstat(filepath.Join(src, "private"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	permErr := func(path string) error {
+		return &fs.PathError{Op: "open", Path: path, Err: fs.ErrPermission}
+	}
+
+	p, err := NewPacker(WithSkipUnreadable())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	meta := &Meta{}
+	walkFn := p.packWalkFn(context.Background(), src, src, src, nil, nil, meta, nil, nil, nil, nil)
+
+	// A directory that can't be listed, and a file that can't be found
+	// out about at all.
+	private := filepath.Join(src, "private")
+	if err := walkFn(private, fs.FileInfoToDirEntry(dirInfo), permErr(private)); err != nil {
+		t.Fatalf("unexpected error for unreadable directory: %v", err)
+	}
+	secret := filepath.Join(src, "secret.tf")
+	if err := walkFn(secret, nil, permErr(secret)); err != nil {
+		t.Fatalf("unexpected error for unreadable file: %v", err)
+	}
+	var gotNames []string
+	for _, f := range meta.UnreadableFiles {
+		gotNames = append(gotNames, f.Name)
+	}
+	if want := []string{"private/", "secret.tf"}; !reflect.DeepEqual(gotNames, want) {
+		t.Errorf("wrong unreadable files %q; want %q", gotNames, want)
+	}
+
+	// An unreadable root and other kinds of errors still fail.
+	if err := walkFn(src, fs.FileInfoToDirEntry(rootInfo), permErr(src)); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected permission error for unreadable root; got %v", err)
+	}
+	ioErr := &fs.PathError{Op: "lstat", Path: secret, Err: errors.New("input/output error")}
+	if err := walkFn(secret, nil, ioErr); err != ioErr {
+		t.Errorf("expected other errors to be returned; got %v", err)
+	}
+	if len(meta.UnreadableFiles) != 2 {
+		t.Errorf("wrong number of unreadable files %d; want 2", len(meta.UnreadableFiles))
+	}
+
+	// Without WithSkipUnreadable, permission errors fail too.
+	p, err = NewPacker()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	walkFn = p.packWalkFn(context.Background(), src, src, src, nil, nil, &Meta{}, nil, nil, nil, nil)
+	if err := walkFn(secret, nil, permErr(secret)); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected permission error without WithSkipUnreadable; got %v", err)
+	}
+}
+
+func TestPackUnpackPathLimits(t *testing.T) {
+	src := t.TempDir()
+	longName := strings.Repeat("x", 40) + ".tf"
+	for _, name := range []string{"main.tf", "a/b/c/deep.tf", longName} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	slug := bytes.NewBuffer(nil)
+	if _, err := Pack(src, slug, true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	archive := slug.Bytes()
+
+	for _, tc := range []struct {
+		desc   string
+		option PackerOption
+		want   string
+	}{
+		{
+			desc:   "depth",
+			option: WithMaxPathDepth(3),
+			want:   `illegal slug error: entry "a/b/c/deep.tf" is nested deeper than the limit of 3 path components`,
+		},
+		{
+			desc:   "name length",
+			option: WithMaxNameLength(32),
+			want:   fmt.Sprintf(`illegal slug error: entry %q has a path component longer than the limit of 32 bytes`, longName),
+		},
+		{
+			desc:   "path length",
+			option: WithMaxPathLength(12),
+			want:   `illegal slug error: entry "a/b/c/deep.tf" has a path longer than the limit of 12 bytes`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := NewPacker(tc.option)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			check := func(op string, err error) {
+				t.Helper()
+				if err == nil || err.Error() != tc.want {
+					t.Fatalf("wrong %s error\ngot:  %v\nwant: %s", op, err, tc.want)
+				}
+				var illegal *IllegalSlugError
+				if !errors.As(err, &illegal) || illegal.Code != PathLimitExceeded {
+					t.Fatalf("wrong %s error code for %#v", op, err)
+				}
+			}
+			_, err = p.Pack(src, io.Discard)
+			check("pack", err)
+			check("unpack", p.Unpack(bytes.NewReader(archive), t.TempDir()))
+			v := p.NewValidator()
+			v.Write(archive)
+			check("validator", v.Close())
+		})
+	}
+
+	// Limits that every entry meets must have no effect.
+	p, err := NewPacker(WithMaxPathDepth(4), WithMaxNameLength(64), WithMaxPathLength(64))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := p.Pack(src, io.Discard); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := p.Unpack(bytes.NewReader(archive), t.TempDir()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := NewPacker(WithMaxPathDepth(-1)); err == nil {
+		t.Error("negative path depth limit was accepted")
+	}
+}
+
+func TestUnpackSymlinkedDestination(t *testing.T) {
+	slug := bytes.NewBuffer(nil)
+	if _, err := Pack("testdata/archive-dir-no-external", slug, true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	archive := slug.Bytes()
+
+	dir := t.TempDir()
+	real := filepath.Join(dir, "real")
+	if err := os.Mkdir(real, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		p, err := NewPacker(WithDestinationSymlinkPolicy(RejectDestinationSymlinks))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		err = p.Unpack(bytes.NewReader(archive), link)
+		want := fmt.Sprintf("destination %q is a symlink", link)
+		if err == nil || err.Error() != want {
+			t.Fatalf("wrong error\ngot:  %v\nwant: %s", err, want)
+		}
+		if entries, _ := os.ReadDir(real); len(entries) != 0 {
+			t.Fatalf("extracted %d entries despite the error", len(entries))
+		}
+
+		// A symlink in a parent directory is still followed.
+		dst := filepath.Join(link, "rejected-parent")
+		if err := p.Unpack(bytes.NewReader(archive), dst); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(real, "rejected-parent", "bar.txt")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	})
+	t.Run("symlinks inside", func(t *testing.T) {
+		p, err := NewPacker(WithDestinationSymlinkPolicy(RejectDestinationSymlinks))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// A file entry replaces an existing symlink at its path.
+		outside := filepath.Join(t.TempDir(), "outside.txt")
+		if err := os.WriteFile(outside, []byte("outside\n"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		dst := t.TempDir()
+		if err := os.Symlink(outside, filepath.Join(dst, "bar.txt")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := p.Unpack(bytes.NewReader(archive), dst); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		verifyFile(t, filepath.Join(dst, "bar.txt"), 0, "bar\n")
+		verifyFile(t, outside, 0, "outside\n")
+
+		// A directory entry can't be extracted over an existing symlink.
+		var buf bytes.Buffer
+		gzipW := gzip.NewWriter(&buf)
+		tarW := tar.NewWriter(gzipW)
+		tarW.WriteHeader(&tar.Header{Name: "d", Typeflag: tar.TypeDir, Mode: 0555})
+		tarW.Close()
+		gzipW.Close()
+		outsideDir := t.TempDir()
+		dst = t.TempDir()
+		if err := os.Symlink(outsideDir, filepath.Join(dst, "d")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		err = p.Unpack(bytes.NewReader(buf.Bytes()), dst)
+		var illegal *IllegalSlugError
+		if !errors.As(err, &illegal) || illegal.Code != ExtractThroughSymlink {
+			t.Fatalf("wrong error %v; want ExtractThroughSymlink", err)
+		}
+		if info, err := os.Stat(outsideDir); err != nil || info.Mode().Perm() == 0555 {
+			t.Fatalf("mode of the symlink's target changed: %v, %v", info, err)
+		}
+	})
+	t.Run("follow", func(t *testing.T) {
+		dst := filepath.Join(link, "new", "dir")
+		if err := Unpack(bytes.NewReader(archive), dst); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(real, "new", "dir", "bar.txt")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	})
+	t.Run("dangling", func(t *testing.T) {
+		dangling := filepath.Join(dir, "dangling")
+		if err := os.Symlink(filepath.Join(dir, "nonexistent"), dangling); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		err := Unpack(bytes.NewReader(archive), dangling)
+		if err == nil || !strings.Contains(err.Error(), "dangling symlink") {
+			t.Fatalf("wrong error: %v", err)
+		}
+	})
+	if _, err := NewPacker(WithDestinationSymlinkPolicy(DestinationSymlinkPolicy(-1))); err == nil {
+		t.Error("invalid policy was accepted")
+	}
+}
+
+func TestUnpackExistingFilePolicy(t *testing.T) {
+	slugTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	for _, name := range []string{"older", "newer", "new"} {
+		tarW.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len("slug\n")),
+			ModTime:  slugTime,
+		})
+		tarW.Write([]byte("slug\n"))
+	}
+	tarW.WriteHeader(&tar.Header{
+		Name:     "link",
+		Linkname: "new",
+		Typeflag: tar.TypeSymlink,
+		ModTime:  slugTime,
+	})
+	tarW.Close()
+	gzipW.Close()
+	slug := buf.Bytes()
+
+	prepare := func(t *testing.T) string {
+		dst := t.TempDir()
+		for name, mtime := range map[string]time.Time{
+			"older": slugTime.Add(-time.Hour),
+			"newer": slugTime.Add(time.Hour),
+			"link":  slugTime.Add(-time.Hour),
+		} {
+			path := filepath.Join(dst, name)
+			if err := os.WriteFile(path, []byte("existing\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dst
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		policy      ExistingFilePolicy
+		wantActions map[string]UnpackAction
+		wantLink    bool
+	}{
+		{
+			desc:   "overwrite",
+			policy: OverwriteExistingFiles,
+			wantActions: map[string]UnpackAction{
+				"older": UnpackOverwritten,
+				"newer": UnpackOverwritten,
+				"new":   UnpackCreated,
+				"link":  UnpackOverwritten,
+			},
+			wantLink: true,
+		},
+		{
+			desc:   "skip",
+			policy: SkipExistingFiles,
+			wantActions: map[string]UnpackAction{
+				"older": UnpackSkipped,
+				"newer": UnpackSkipped,
+				"new":   UnpackCreated,
+				"link":  UnpackSkipped,
+			},
+		},
+		{
+			desc:   "if newer",
+			policy: OverwriteIfNewer,
+			wantActions: map[string]UnpackAction{
+				"older": UnpackOverwritten,
+				"newer": UnpackSkipped,
+				"new":   UnpackCreated,
+				"link":  UnpackOverwritten,
+			},
+			wantLink: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			gotActions := make(map[string]UnpackAction)
+			p, err := NewPacker(
+				WithExistingFilePolicy(tc.policy),
+				WithUnpackReporter(func(name string, action UnpackAction) {
+					gotActions[name] = action
+				}),
+			)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			dst := prepare(t)
+			if err := p.Unpack(bytes.NewReader(slug), dst); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !reflect.DeepEqual(gotActions, tc.wantActions) {
+				t.Fatalf("wrong actions\ngot:  %v\nwant: %v", gotActions, tc.wantActions)
+			}
+			for name, action := range tc.wantActions {
+				if name == "link" {
+					continue
+				}
+				want := "slug\n"
+				if action == UnpackSkipped {
+					want = "existing\n"
+				}
+				verifyFile(t, filepath.Join(dst, name), 0, want)
+			}
+			if tc.wantLink {
+				verifyFile(t, filepath.Join(dst, "link"), os.ModeSymlink, "new")
+			} else {
+				verifyFile(t, filepath.Join(dst, "link"), 0, "existing\n")
+			}
+		})
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		p, err := NewPacker(WithExistingFilePolicy(FailIfExists))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		err = p.Unpack(bytes.NewReader(slug), prepare(t))
+		if !errors.Is(err, fs.ErrExist) {
+			t.Fatalf("expected error wrapping fs.ErrExist, got %v", err)
+		}
+	})
+}
+
+func TestUnpackExistingSymlink(t *testing.T) {
+	// The slug's entry is newer than the symlink, so that every policy
+	// which can overwrite replaces it.
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	tarW.WriteHeader(&tar.Header{
+		Name:     "x",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len("slug\n")),
+		ModTime:  time.Now().Add(time.Hour),
+	})
+	tarW.Write([]byte("slug\n"))
+	tarW.Close()
+	gzipW.Close()
+	slug := buf.Bytes()
+
+	for name, policy := range map[string]ExistingFilePolicy{
+		"overwrite": OverwriteExistingFiles,
+		"if newer":  OverwriteIfNewer,
+	} {
+		t.Run(name, func(t *testing.T) {
+			outside := filepath.Join(t.TempDir(), "outside")
+			if err := os.WriteFile(outside, []byte("outside\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			dst := t.TempDir()
+			if err := os.Symlink(outside, filepath.Join(dst, "x")); err != nil {
+				t.Fatal(err)
+			}
+
+			p, err := NewPacker(WithExistingFilePolicy(policy))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := p.Unpack(bytes.NewReader(slug), dst); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			// The symlink is replaced, rather than written through.
+			verifyFile(t, filepath.Join(dst, "x"), 0, "slug\n")
+			verifyFile(t, outside, 0, "outside\n")
+		})
+	}
+}
+
+func TestUnpackSymlinkReporter(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	tarW.WriteHeader(&tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+	})
+	for name, target := range map[string]string{
+		"internal": "file",
+		"external": "../shared/modules",
+	} {
+		tarW.WriteHeader(&tar.Header{
+			Name:     name,
+			Linkname: target,
+			Typeflag: tar.TypeSymlink,
+		})
+	}
+	tarW.Close()
+	gzipW.Close()
+
+	var got []SymlinkRecord
+	p, err := NewPacker(
+		AllowSymlinkTarget("../shared"),
+		WithSymlinkReporter(func(record SymlinkRecord) {
+			got = append(got, record)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := p.Unpack(&buf, t.TempDir()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	want := map[string]SymlinkRecord{
+		"internal": {Name: "internal", Target: "file"},
+		"external": {Name: "external", Target: "../shared/modules", AllowedBy: "../shared"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wrong number of symlink records %d; want %d", len(got), len(want))
+	}
+	for _, record := range got {
+		if record != want[record.Name] {
+			t.Errorf("wrong record for %q\ngot:  %#v\nwant: %#v", record.Name, record, want[record.Name])
+		}
+	}
+}
+
+func TestPackFileTypes(t *testing.T) {
+	// A PE file's DOS header holds the offset of its PE header at 0x3c.
+	pe := make([]byte, 0x84)
+	copy(pe, "MZ")
+	pe[0x3c] = 0x80
+	copy(pe[0x80:], "PE\x00\x00")
+
+	src := t.TempDir()
+	files := map[string]string{
+		"main.tf":    "# main",
+		"README":     "readme",
+		"notes.EXE":  "not really a program",
+		"tool":       "\x7fELF\x02\x01\x01",
+		"tool2":      string(pe),
+		"MZ":         "MZ is not a program, despite its first two bytes, because it has no PE header\n",
+		"bundle.zip": "PK\x03\x04",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	tests := map[string]struct {
+		opts       []PackerOption
+		wantErr    string
+		wantDenied []DeniedFile
+	}{
+		"no restrictions": {},
+		"denied extension": {
+			opts:    []PackerOption{WithDeniedExtensions("exe")},
+			wantErr: `file "notes.EXE" is not allowed: extension ".exe" is denied`,
+		},
+		"allowed extensions": {
+			opts: []PackerOption{
+				WithAllowedExtensions(".tf", ""),
+				WithDeniedFilePolicy(SkipDeniedFiles),
+			},
+			wantDenied: []DeniedFile{
+				{Name: "bundle.zip", Reason: `extension ".zip" is not allowed`},
+				{Name: "notes.EXE", Reason: `extension ".exe" is not allowed`},
+			},
+		},
+		"denied content": {
+			opts: []PackerOption{
+				WithDeniedContent(NativeExecutable, CompressedArchive),
+				WithDeniedFilePolicy(SkipDeniedFiles),
+			},
+			wantDenied: []DeniedFile{
+				{Name: "bundle.zip", Reason: "content is denied as CompressedArchive"},
+				{Name: "tool", Reason: "content is denied as NativeExecutable"},
+				{Name: "tool2", Reason: "content is denied as NativeExecutable"},
+			},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := NewPacker(test.opts...)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			meta, err := p.Pack(src, io.Discard)
+			if test.wantErr != "" {
+				var illegal *IllegalSlugError
+				if !errors.As(err, &illegal) || illegal.Code != DeniedFileType {
+					t.Fatalf("expected IllegalSlugError with code DeniedFileType, got %v", err)
+				}
+				if got := illegal.Err.Error(); got != test.wantErr {
+					t.Errorf("wrong error\ngot:  %s\nwant: %s", got, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !reflect.DeepEqual(meta.DeniedFiles, test.wantDenied) {
+				t.Errorf("wrong denied files\ngot:  %#v\nwant: %#v", meta.DeniedFiles, test.wantDenied)
+			}
+			for _, denied := range test.wantDenied {
+				for _, name := range meta.Files {
+					if name == denied.Name {
+						t.Errorf("denied file %q was included in the slug", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPackSecretFiles(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]os.FileMode{
+		"main.tf":               0644,
+		"keys/id_rsa":           0644,
+		"server.PEM":            0644,
+		".env.production":       0644,
+		"token.txt":             0600,
+		"custom.secret":         0644,
+		"modules/readme.md":     0644,
+		"credentials.tfrc.json": 0644,
+	}
+	for name, mode := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("x"), mode); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	wantSecrets := []SecretFile{
+		{Name: ".env.production", Reason: `name matches secret file pattern ".env.*"`},
+		{Name: "credentials.tfrc.json", Reason: `name matches secret file pattern "credentials.tfrc.json"`},
+		{Name: "custom.secret", Reason: `name matches secret file pattern "*.secret"`},
+		{Name: "keys/id_rsa", Reason: `name matches secret file pattern "id_rsa"`},
+		{Name: "server.PEM", Reason: `name matches secret file pattern "*.pem"`},
+		{Name: "token.txt", Reason: "permissions -rw------- allow only the owner to read it"},
+	}
+
+	for _, policy := range []SecretFilePolicy{ReportSecretFiles, SkipSecretFiles} {
+		p, err := NewPacker(WithSecretFilePolicy(policy), WithSecretFilePatterns("*.secret"))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		meta, err := p.Pack(src, io.Discard)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !reflect.DeepEqual(meta.SecretFiles, wantSecrets) {
+			t.Errorf("wrong secret files\ngot:  %#v\nwant: %#v", meta.SecretFiles, wantSecrets)
+		}
+		included := 0
+		for _, name := range meta.Files {
+			for _, secret := range wantSecrets {
+				if name == secret.Name {
+					included++
+				}
+			}
+		}
+		if policy == SkipSecretFiles && included != 0 {
+			t.Errorf("%d secret files were included in the slug", included)
+		}
+		if policy == ReportSecretFiles && included != len(wantSecrets) {
+			t.Errorf("only %d of the secret files were included in the slug", included)
+		}
+	}
+
+	p, err := NewPacker(WithSecretFilePolicy(RejectSecretFiles))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, err = p.Pack(src, io.Discard)
+	var illegal *IllegalSlugError
+	if !errors.As(err, &illegal) || illegal.Code != SecretFileDetected {
+		t.Fatalf("expected IllegalSlugError with code SecretFileDetected, got %v", err)
+	}
+
+	// Without a policy nothing is checked.
+	meta, err := Pack(src, io.Discard, false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if meta.SecretFiles != nil {
+		t.Errorf("unexpected secret files %#v", meta.SecretFiles)
+	}
+}
+
+func TestPackLayered(t *testing.T) {
+	layers := []map[string]string{
+		{
+			"main.tf":         "base",
+			"vars.tf":         "base",
+			"modules/a/a.tf":  "base",
+			"config/base.yml": "base",
+		},
+		{
+			"main.tf":      "override",
+			"modules/b.tf": "override",
+			"config":       "override",
+		},
+		{
+			"vars.tf": "workspace",
+		},
+	}
+	var roots []string
+	for _, files := range layers {
+		root := t.TempDir()
+		for name, content := range files {
+			path := filepath.Join(root, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		roots = append(roots, root)
+	}
+
+	p, err := NewPacker()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	slug := bytes.NewBuffer(nil)
+	meta, err := p.PackLayered(slug, roots...)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	wantOverrides := []LayerOverride{
+		{Name: "config", Root: 1, Overridden: []int{0}},
+		{Name: "main.tf", Root: 1, Overridden: []int{0}},
+		{Name: "vars.tf", Root: 2, Overridden: []int{0}},
+	}
+	if !reflect.DeepEqual(meta.LayerOverrides, wantOverrides) {
+		t.Errorf("wrong overrides\ngot:  %#v\nwant: %#v", meta.LayerOverrides, wantOverrides)
+	}
+
+	dst := t.TempDir()
+	if err := p.Unpack(slug, dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	wantFiles := map[string]string{
+		"main.tf":        "override",
+		"vars.tf":        "workspace",
+		"modules/a/a.tf": "base",
+		"modules/b.tf":   "override",
+		"config":         "override",
+	}
+	for name, want := range wantFiles {
+		got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("err: %v", err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("wrong content for %s: got %q, want %q", name, got, want)
+		}
+	}
+
+	if _, err := p.PackLayered(io.Discard); err == nil {
+		t.Error("expected error with no roots")
+	}
+}
+
+func TestPackUnpackUnicodeNames(t *testing.T) {
+	src := t.TempDir()
+	names := []string{"テラフォーム.tf", "模块/main.tf", "🚀/launch.tf", "café.txt"}
+	for _, name := range names {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := os.Symlink("テラフォーム.tf", filepath.Join(src, "link.tf")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Pack(src, &buf, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every entry with a non-ASCII name or link target must use PAX, so
+	// that its name is stored as UTF-8.
+	gzipR, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tarR := tar.NewReader(gzipR)
+	for {
+		hdr, err := tarR.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if hdr.Name == "link.tf" && hdr.Linkname != "テラフォーム.tf" {
+			t.Errorf("wrong link target %q", hdr.Linkname)
+		}
+		if !isASCII(hdr.Name) || !isASCII(hdr.Linkname) {
+			if hdr.Format != tar.FormatPAX {
+				t.Errorf("entry %q has format %s; want PAX", hdr.Name, hdr.Format)
+			}
+		}
+	}
+
+	dst := t.TempDir()
+	if err := Unpack(&buf, dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, name := range append(names, "link.tf") {
+		got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("missing %s: %v", name, err)
+			continue
+		}
+		want := name
+		if name == "link.tf" {
+			want = "テラフォーム.tf"
+		}
+		if string(got) != want {
+			t.Errorf("wrong content for %s: %q", name, got)
+		}
+	}
+}
+
+func TestUnpackModes(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	tarW.WriteHeader(&tar.Header{
+		Name:     "dir/",
+		Typeflag: tar.TypeDir,
+		Mode:     0777,
+	})
+	for name, mode := range map[string]int64{
+		"dir/exec":   04777,
+		"dir/plain":  0666,
+		"dir/secret": 0600,
+	} {
+		tarW.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     mode,
+		})
+	}
+	tarW.Close()
+	gzipW.Close()
+	slug := buf.Bytes()
+
+	tests := map[string]struct {
+		opts []PackerOption
+		want map[string]os.FileMode
+	}{
+		"mask": {
+			opts: []PackerOption{WithModeMask(0755)},
+			want: map[string]os.FileMode{
+				"dir":        os.ModeDir | 0755,
+				"dir/exec":   0755,
+				"dir/plain":  0644,
+				"dir/secret": 0600,
+			},
+		},
+		"forced": {
+			opts: []PackerOption{WithForcedModes(0640, 0750)},
+			want: map[string]os.FileMode{
+				"dir":        os.ModeDir | 0750,
+				"dir/exec":   0640,
+				"dir/plain":  0640,
+				"dir/secret": 0640,
+			},
+		},
+		"forced and mask": {
+			opts: []PackerOption{WithForcedModes(0666, 0777), WithModeMask(0750)},
+			want: map[string]os.FileMode{
+				"dir":        os.ModeDir | 0750,
+				"dir/exec":   0640,
+				"dir/plain":  0640,
+				"dir/secret": 0640,
+			},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, err := NewPacker(test.opts...)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			dst := t.TempDir()
+			if err := p.Unpack(bytes.NewReader(slug), dst); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			for name, want := range test.want {
+				fi, err := os.Stat(filepath.Join(dst, name))
 				if err != nil {
 					t.Fatalf("err: %v", err)
 				}
-				if hdr.Name == "sym" {
-					symFound = true
-					if hdr.Typeflag != tar.TypeSymlink {
-						t.Fatalf("unexpected file type in slug: %q", hdr.Typeflag)
-					}
-					if hdr.Linkname != tc.target {
-						t.Fatalf("unexpected link target in slug: %q", hdr.Linkname)
-					}
+				if got := fi.Mode(); got != want {
+					t.Errorf("wrong mode for %q %s; want %s", name, got, want)
 				}
 			}
-
-			if !symFound {
-				t.Fatal("did not find symlink in archive")
-			}
 		})
+	}
 
-		t.Run("Unpack: "+tc.desc, func(t *testing.T) {
-			dir, err := ioutil.TempDir("", "slug")
-			if err != nil {
-				t.Fatalf("err:%v", err)
-			}
-			defer os.RemoveAll(dir)
-			in := filepath.Join(dir, "slug.tar.gz")
-
-			// Create the output file
-			wfh, err := os.Create(in)
-			if err != nil {
-				t.Fatalf("err: %v", err)
-			}
-
-			// Gzip compress all the output data
-			gzipW := gzip.NewWriter(wfh)
+	for _, opt := range []PackerOption{
+		WithModeMask(os.ModeSetuid | 0755),
+		WithForcedModes(0, 0755),
+		WithForcedModes(0644, os.ModeDir|0755),
+	} {
+		if _, err := NewPacker(opt); err == nil {
+			t.Errorf("expected error for invalid mode option")
+		}
+	}
+}
 
-			// Tar the file contents
+func TestUnpackLargeIDs(t *testing.T) {
+	for _, format := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			gzipW := gzip.NewWriter(&buf)
 			tarW := tar.NewWriter(gzipW)
-
-			// Write the header.
-			tarW.WriteHeader(&tar.Header{
-				Name:     "l",
-				Linkname: tc.target,
-				Typeflag: tar.TypeSymlink,
+			err := tarW.WriteHeader(&tar.Header{
+				Name:     "file",
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     int64(len("content\n")),
+				Uid:      1 << 22,
+				Gid:      1 << 22,
+				Format:   format,
 			})
-
-			tarW.Close()
-			gzipW.Close()
-			wfh.Close()
-
-			// Open the slug file for reading.
-			fh, err := os.Open(in)
 			if err != nil {
-				t.Fatalf("err: %v", err)
+				t.Fatal(err)
 			}
+			tarW.Write([]byte("content\n"))
+			tarW.Close()
+			gzipW.Close()
 
-			// Create a dir to unpack into.
-			dst, err := ioutil.TempDir(dir, "")
-			if err != nil {
+			dst := t.TempDir()
+			if err := Unpack(&buf, dst); err != nil {
 				t.Fatalf("err: %v", err)
 			}
-			defer os.RemoveAll(dst)
-
-			// Unpack.
-			p, err := NewPacker(AllowSymlinkTarget(tc.allow))
+			got, err := os.ReadFile(filepath.Join(dst, "file"))
 			if err != nil {
 				t.Fatal(err)
 			}
-			if err := p.Unpack(fh, dst); err != nil {
-				if tc.err != "" {
-					if !strings.Contains(err.Error(), tc.err) {
-						t.Fatalf("expected error %q, got %v", tc.err, err)
-					}
-				} else {
-					t.Fatal(err)
-				}
-			} else if tc.err != "" {
-				t.Fatalf("expected error %q, got nil", tc.err)
+			if string(got) != "content\n" {
+				t.Errorf("wrong content %q", got)
 			}
 		})
 	}
 }
 
-func TestUnpack(t *testing.T) {
-	// First create the slug file so we can try to unpack it.
-	slug := bytes.NewBuffer(nil)
+// errHeaderWritten stops packWalkFn once it starts to write a file body.
+var errHeaderWritten = errors.New("header written")
 
-	if _, err := Pack("testdata/archive-dir-no-external", slug, true); err != nil {
-		t.Fatalf("err: %v", err)
+// headerWriter collects what the tar writer writes before the first file
+// body, which is larger than any of the header blocks.
+type headerWriter struct {
+	bytes.Buffer
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if len(p) > 4096 {
+		return 0, errHeaderWritten
 	}
+	return w.Buffer.Write(p)
+}
 
-	// Create a dir to unpack into.
-	dst, err := ioutil.TempDir("", "slug")
+func TestPackLargeFileHeader(t *testing.T) {
+	// A USTAR header can only represent sizes up to 8GiB-1, so this file
+	// requires Pack to use an extended header. We stop as soon as Pack
+	// starts to write the body, so that the test doesn't need to compress
+	// or store that much data.
+	const size = 8<<30 + 4096
+	src := t.TempDir()
+	f, err := os.Create(filepath.Join(src, "large"))
 	if err != nil {
-		t.Fatalf("err: %v", err)
+		t.Fatal(err)
 	}
-	defer os.RemoveAll(dst)
-
-	// Now try unpacking it.
-	if err := Unpack(slug, dst); err != nil {
-		t.Fatalf("err: %v", err)
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		t.Fatal(err)
 	}
-
-	// Verify all the files
-	verifyFile(t, filepath.Join(dst, "bar.txt"), 0, "bar\n")
-	verifyFile(t, filepath.Join(dst, "sub/bar.txt"), os.ModeSymlink, "../bar.txt")
-	verifyFile(t, filepath.Join(dst, "sub/zip.txt"), 0, "zip\n")
-
-	// Verify timestamps for files
-	verifyTimestamps(t, "testdata/archive-dir-no-external/bar.txt", filepath.Join(dst, "bar.txt"))
-	verifyTimestamps(t, "testdata/archive-dir-no-external/sub/zip.txt", filepath.Join(dst, "sub/zip.txt"))
-	verifyTimestamps(t, "testdata/archive-dir-no-external/sub2/zip.txt", filepath.Join(dst, "sub2/zip.txt"))
-
-	// Verify timestamps for symlinks
-	if unpackinfo.CanMaintainSymlinkTimestamps() {
-		verifyTimestamps(t, "testdata/archive-dir-no-external/sub/bar.txt", filepath.Join(dst, "sub/bar.txt"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
 	}
 
-	// Verify timestamps for directories
-	verifyTimestamps(t, "testdata/archive-dir-no-external/foo.terraform", filepath.Join(dst, "foo.terraform"))
-	verifyTimestamps(t, "testdata/archive-dir-no-external/sub", filepath.Join(dst, "sub"))
-	verifyTimestamps(t, "testdata/archive-dir-no-external/sub2", filepath.Join(dst, "sub2"))
-
-	// Check that we can set permissions properly
-	verifyPerms(t, filepath.Join(dst, "bar.txt"), 0644)
-	verifyPerms(t, filepath.Join(dst, "sub/zip.txt"), 0644)
-	verifyPerms(t, filepath.Join(dst, "sub/bar.txt"), 0644)
-	verifyPerms(t, filepath.Join(dst, "exe"), 0755)
-}
-
-func TestUnpack_HeaderOrdering(t *testing.T) {
-	// Tests that when a tar file has subdirectories ordered before parent directories, the
-	// timestamps get restored correctly in the plaform where the tests are run.
-
-	// This file is created by the go program found in `testdata/subdir-ordering`
-	f, err := os.Open("testdata/subdir-appears-first.tar.gz")
+	p, err := NewPacker()
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	dir := t.TempDir()
-
-	packer, err := NewPacker()
-	if err != nil {
-		t.Fatalf("expected no error, got %s", err)
+	var out headerWriter
+	tarW := tar.NewWriter(&out)
+	walkFn := p.packWalkFn(context.Background(), src, src, src, tarW, make([]byte, 32*1024), &Meta{}, nil, make(map[string]struct{}), nil, nil)
+	if err := filepath.WalkDir(src, walkFn); !errors.Is(err, errHeaderWritten) {
+		t.Fatalf("expected Pack to start writing the body; got %v", err)
 	}
 
-	err = packer.Unpack(f, dir)
+	header, err := tar.NewReader(&out.Buffer).Next()
 	if err != nil {
-		t.Fatalf("expected no error, got %s", err)
+		t.Fatal(err)
 	}
-
-	// These times were recorded when the archive was created
-	testCases := []struct {
-		Path string
-		TS   time.Time
-	}{
-		{TS: time.Unix(0, 1698787142347461403).Round(time.Second), Path: path.Join(dir, "super/duper")},
-		{TS: time.Unix(0, 1698780461367973574).Round(time.Second), Path: path.Join(dir, "super")},
-		{TS: time.Unix(0, 1698787142347461286).Round(time.Second), Path: path.Join(dir, "super/duper/trooper")},
-		{TS: time.Unix(0, 1698780470254368545).Round(time.Second), Path: path.Join(dir, "super/duper/trooper/foo.txt")},
+	if header.Name != "large" || header.Size != size {
+		t.Errorf("wrong header for %q with size %d; want %q with size %d", header.Name, header.Size, "large", int64(size))
 	}
-
-	for _, tc := range testCases {
-		info, err := os.Stat(tc.Path)
-		if err != nil {
-			t.Fatalf("error when stat %q: %s", tc.Path, err)
-		}
-		if info.ModTime() != tc.TS {
-			t.Errorf("timestamp of file %q (%d) did not match expected value %d", tc.Path, info.ModTime().UnixNano(), tc.TS.UnixNano())
-		}
+	if header.Format&(tar.FormatPAX|tar.FormatGNU) == 0 {
+		t.Errorf("header uses format %s; want an extended format", header.Format)
 	}
 }
 
-func TestUnpackDuplicateNoWritePerm(t *testing.T) {
-	dir, err := ioutil.TempDir("", "slug")
-	if err != nil {
-		t.Fatalf("err:%v", err)
+func TestPackUnpackLargeFile(t *testing.T) {
+	// This pushes more than 8GiB through gzip, and so it runs only when
+	// requested. TestPackLargeFileHeader covers the header on every run.
+	if os.Getenv("SLUG_TEST_LARGE_FILES") == "" {
+		t.Skip("set SLUG_TEST_LARGE_FILES to pack and unpack a file larger than 8GiB")
 	}
-	defer os.RemoveAll(dir)
-	in := filepath.Join(dir, "slug.tar.gz")
 
-	// Create the output file
-	wfh, err := os.Create(in)
+	// A USTAR header can only represent sizes up to 8GiB-1, so this file
+	// requires Pack to use an extended header. The file is sparse, so it
+	// doesn't actually occupy that much space.
+	const size = 8<<30 + 4096
+	const tail = "tail"
+	src := t.TempDir()
+	f, err := os.Create(filepath.Join(src, "large"))
 	if err != nil {
-		t.Fatalf("err: %v", err)
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte(tail), size-int64(len(tail))); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
 	}
 
-	// Gzip compress all the output data
-	gzipW := gzip.NewWriter(wfh)
-
-	// Tar the file contents
-	tarW := tar.NewWriter(gzipW)
-
-	var hdr tar.Header
-
-	data := "this is a\n"
-
-	hdr.Name = "a"
-	hdr.Mode = 0100000 | 0400
-	hdr.Size = int64(len(data))
-
-	tarW.WriteHeader(&hdr)
-	tarW.Write([]byte(data))
-
-	// write it twice
-	tarW.WriteHeader(&hdr)
-	tarW.Write([]byte(data))
-
-	tarW.Close()
-	gzipW.Close()
-	wfh.Close()
-
-	// Open the slug file for reading.
-	fh, err := os.Open(in)
-	if err != nil {
+	r, w := io.Pipe()
+	go func() {
+		_, err := Pack(src, w, false)
+		w.CloseWithError(err)
+	}()
+	dst := t.TempDir()
+	if err := Unpack(r, dst); err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
-	// Create a dir to unpack into.
-	dst, err := ioutil.TempDir(dir, "")
+	unpacked, err := os.Open(filepath.Join(dst, "large"))
 	if err != nil {
-		t.Fatalf("err: %v", err)
+		t.Fatal(err)
 	}
-	defer os.RemoveAll(dst)
-
-	// Now try unpacking it.
-	if err := Unpack(fh, dst); err != nil {
-		t.Fatalf("err: %v", err)
+	defer unpacked.Close()
+	info, err := unpacked.Stat()
+	if err != nil {
+		t.Fatal(err)
 	}
+	if got, want := info.Size(), int64(size); got != want {
+		t.Fatalf("wrong size %d; want %d", got, want)
+	}
+	got := make([]byte, len(tail))
+	if _, err := unpacked.ReadAt(got, size-int64(len(tail))); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != tail {
+		t.Errorf("wrong tail %q; want %q", got, tail)
+	}
+}
 
-	// Verify all the files
-	verifyFile(t, filepath.Join(dst, "a"), 0, "this is a\n")
-
-	// Check that we can set permissions properly
-	verifyPerms(t, filepath.Join(dst, "a"), 0400)
+func TestCopySparse(t *testing.T) {
+	content := make([]byte, 3*sparseBlockSize+10)
+	copy(content[sparseBlockSize:], "data")
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := copySparse(f, bytes.NewReader(content), make([]byte, sparseBlockSize)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("wrong content after sparse copy")
+	}
 }
 
 func TestUnpackPaxHeaders(t *testing.T) {
@@ -844,9 +3226,14 @@ func TestUnpackErrorOnUnhandledType(t *testing.T) {
 	defer os.RemoveAll(dst)
 
 	// Now try unpacking it, which should fail
-	if err := Unpack(fh, dst); err == nil {
+	err = Unpack(fh, dst)
+	if err == nil {
 		t.Fatalf("should have gotten error unpacking slug with fifo, got none")
 	}
+	var e *IllegalSlugError
+	if !errors.As(err, &e) || e.Code != UnsupportedType {
+		t.Fatalf("expected *IllegalSlugError with code UnsupportedType, got %T %v", err, err)
+	}
 }
 
 func TestUnpackMaliciousSymlinks(t *testing.T) {
@@ -854,6 +3241,7 @@ func TestUnpackMaliciousSymlinks(t *testing.T) {
 		desc    string
 		headers []*tar.Header
 		err     string
+		code    IllegalSlugErrorCode
 	}{
 		{
 			desc: "symlink with absolute path",
@@ -864,7 +3252,8 @@ func TestUnpackMaliciousSymlinks(t *testing.T) {
 					Typeflag: tar.TypeSymlink,
 				},
 			},
-			err: "has external target",
+			err:  "has external target",
+			code: SymlinkExternalTarget,
 		},
 		{
 			desc: "symlink with external target",
@@ -875,7 +3264,8 @@ func TestUnpackMaliciousSymlinks(t *testing.T) {
 					Typeflag: tar.TypeSymlink,
 				},
 			},
-			err: "has external target",
+			err:  "has external target",
+			code: SymlinkExternalTarget,
 		},
 		{
 			desc: "symlink with nested external target",
@@ -886,7 +3276,8 @@ func TestUnpackMaliciousSymlinks(t *testing.T) {
 					Typeflag: tar.TypeSymlink,
 				},
 			},
-			err: "has external target",
+			err:  "has external target",
+			code: SymlinkExternalTarget,
 		},
 		{
 			desc: "zipslip vulnerability",
@@ -902,7 +3293,8 @@ func TestUnpackMaliciousSymlinks(t *testing.T) {
 					Typeflag: tar.TypeSymlink,
 				},
 			},
-			err: `cannot extract "subdir/parent/escapes" through symlink`,
+			err:  `cannot extract "subdir/parent/escapes" through symlink`,
+			code: ExtractThroughSymlink,
 		},
 		{
 			desc: "nested symlinks within symlinked dir",
@@ -918,7 +3310,8 @@ func TestUnpackMaliciousSymlinks(t *testing.T) {
 					Typeflag: tar.TypeSymlink,
 				},
 			},
-			err: `cannot extract "subdir/parent/otherdir/escapes" through symlink`,
+			err:  `cannot extract "subdir/parent/otherdir/escapes" through symlink`,
+			code: ExtractThroughSymlink,
 		},
 		{
 			desc: "regular file through symlink",
@@ -933,7 +3326,8 @@ func TestUnpackMaliciousSymlinks(t *testing.T) {
 					Typeflag: tar.TypeReg,
 				},
 			},
-			err: `cannot extract "subdir/parent/file" through symlink`,
+			err:  `cannot extract "subdir/parent/file" through symlink`,
+			code: ExtractThroughSymlink,
 		},
 		{
 			desc: "directory through symlink",
@@ -948,7 +3342,8 @@ func TestUnpackMaliciousSymlinks(t *testing.T) {
 					Typeflag: tar.TypeDir,
 				},
 			},
-			err: `cannot extract "subdir/parent/dir" through symlink`,
+			err:  `cannot extract "subdir/parent/dir" through symlink`,
+			code: ExtractThroughSymlink,
 		},
 	}
 
@@ -1001,6 +3396,9 @@ func TestUnpackMaliciousSymlinks(t *testing.T) {
 			if err == nil || !errors.As(err, &e) || !strings.Contains(err.Error(), tc.err) {
 				t.Fatalf("expected *IllegalSlugError %v, got %T %v", tc.err, err, err)
 			}
+			if e.Code != tc.code {
+				t.Fatalf("wrong error code %s; want %s", e.Code, tc.code)
+			}
 		})
 	}
 }
@@ -1010,16 +3408,19 @@ func TestUnpackMaliciousFiles(t *testing.T) {
 		desc string
 		name string
 		err  string
+		code IllegalSlugErrorCode
 	}{
 		{
 			desc: "filename containing path traversal",
 			name: "../../../../../../../../tmp/test",
 			err:  "invalid filename, traversal with \"..\" outside of current directory",
+			code: TraversalOutsideRoot,
 		},
 		{
 			desc: "should fail before attempting to create directories",
 			name: "../../../../../../../../Users/root",
 			err:  "invalid filename, traversal with \"..\" outside of current directory",
+			code: TraversalOutsideRoot,
 		},
 	}
 
@@ -1079,6 +3480,9 @@ func TestUnpackMaliciousFiles(t *testing.T) {
 			if err == nil || !errors.As(err, &e) || !strings.Contains(err.Error(), tc.err) {
 				t.Fatalf("expected *IllegalSlugError %v, got %T %v", tc.err, err, err)
 			}
+			if e.Code != tc.code {
+				t.Fatalf("wrong error code %s; want %s", e.Code, tc.code)
+			}
 		})
 	}
 }
@@ -1132,6 +3536,13 @@ func TestNewPacker(t *testing.T) {
 				applyTerraformIgnore: true,
 			},
 		},
+		{
+			desc:    "pax format",
+			options: []PackerOption{WithPaxFormat()},
+			expect: &Packer{
+				paxFormat: true,
+			},
+		},
 		{
 			desc:    "multiple options",
 			options: []PackerOption{ApplyTerraformIgnore(), DereferenceSymlinks()},
@@ -1154,6 +3565,59 @@ func TestNewPacker(t *testing.T) {
 	}
 }
 
+func TestPackerConfig(t *testing.T) {
+	p, err := NewPacker()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := p.Config(); !reflect.DeepEqual(got, PackerConfig{}) {
+		t.Errorf("wrong default config %#v", got)
+	}
+
+	p, err = NewPacker(
+		DereferenceSymlinks(),
+		WithLeadingEntries("manifest.json"),
+		WithAllowedExtensions(),
+		WithSizeLimit(1024),
+		WithModeMask(0755),
+		WithSetXattr("user.a", []byte("1")),
+		WithSetXattr("user.a", []byte("2")),
+		WithArchiveHashes(crypto.SHA256),
+		WithUnpackReporter(func(string, UnpackAction) {}),
+		WithDirModTimePolicy(OmitDirModTimes),
+		WithSkipUnreadable(),
+		WithUnpackRemapper(func(*tar.Header) (string, bool) { return "", true }),
+	)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	want := PackerConfig{
+		Dereference:       true,
+		DirModTimePolicy:  OmitDirModTimes,
+		SkipUnreadable:    true,
+		LeadingEntries:    []string{"manifest.json"},
+		AllowedExtensions: []string{},
+		SizeLimit:         1024,
+		HasModeMask:       true,
+		ModeMask:          0755,
+		SetXattrs:         map[string][]byte{"user.a": []byte("2")},
+		ArchiveHashes:     []crypto.Hash{crypto.SHA256},
+		HasUnpackReporter: true,
+		HasUnpackRemapper: true,
+	}
+	got := p.Config()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong config\ngot:  %#v\nwant: %#v", got, want)
+	}
+
+	// The snapshot must not share any state with the packer.
+	got.LeadingEntries[0] = "changed"
+	got.SetXattrs["user.a"][0] = 'x'
+	if again := p.Config(); !reflect.DeepEqual(again, want) {
+		t.Errorf("modifying the snapshot changed the packer\ngot:  %#v\nwant: %#v", again, want)
+	}
+}
+
 func TestUnpackEmptyName(t *testing.T) {
 	var buf bytes.Buffer
 
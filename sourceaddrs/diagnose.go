@@ -0,0 +1,267 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// SourceKind classifies a source address as one of the three address types.
+type SourceKind int
+
+const (
+	// LocalSourceKind is the kind of a [LocalSource].
+	LocalSourceKind SourceKind = iota + 1
+
+	// RegistrySourceKind is the kind of a [RegistrySource].
+	RegistrySourceKind
+
+	// RemoteSourceKind is the kind of a [RemoteSource].
+	RemoteSourceKind
+)
+
+// String returns the name of the kind, as used in the constant names.
+func (k SourceKind) String() string {
+	switch k {
+	case LocalSourceKind:
+		return "LocalSourceKind"
+	case RegistrySourceKind:
+		return "RegistrySourceKind"
+	case RemoteSourceKind:
+		return "RemoteSourceKind"
+	default:
+		return fmt.Sprintf("SourceKind(%d)", int(k))
+	}
+}
+
+// classifySource returns the kind of address that [ParseSource] will try to
+// parse the given string as, based on the syntax differences between the
+// address forms.
+func classifySource(given string) SourceKind {
+	switch {
+	case looksLikeLocalSource(given) || given == "." || given == "..":
+		return LocalSourceKind
+	case looksLikeRegistrySource(given) || looksLikeFinalRegistrySource(given):
+		return RegistrySourceKind
+	default:
+		// If it's neither a local source nor a module registry source then
+		// we'll assume it's intended to be a remote source.
+		return RemoteSourceKind
+	}
+}
+
+// SourceHintCode identifies a particular mistake that [DiagnoseSource]
+// recognized in a source address.
+type SourceHintCode int
+
+const (
+	// HintSurroundingSpaces indicates an address with leading or trailing
+	// spaces.
+	HintSurroundingSpaces SourceHintCode = iota + 1
+
+	// HintBackslashes indicates an address using backslashes as path
+	// separators, as is common for Windows paths.
+	HintBackslashes
+
+	// HintAbsolutePath indicates a local path that is absolute, which
+	// local source addresses cannot be. There is no correction for this.
+	HintAbsolutePath
+
+	// HintMissingLocalPrefix indicates a local path that doesn't start
+	// with "./" or "../".
+	HintMissingLocalPrefix
+
+	// HintSCPStyleGit indicates a Git repository written in the "scp-like"
+	// syntax, such as "git@github.com:org/repo.git", which source
+	// addresses don't support.
+	HintSCPStyleGit
+
+	// HintInsecureHTTP indicates a URL using the unencrypted http scheme.
+	HintInsecureHTTP
+
+	// HintGitRepository indicates an https URL that doesn't refer to an
+	// archive and so probably refers to a Git repository, but lacks the
+	// "git::" source type or the ".git" suffix.
+	HintGitRepository
+)
+
+// SourceHint describes a likely mistake in a source address.
+type SourceHint struct {
+	Code SourceHintCode
+
+	// Message describes the mistake as a full sentence suitable for
+	// display to the author of the address.
+	Message string
+}
+
+// SourceDiagnosis is the result of [DiagnoseSource].
+type SourceDiagnosis struct {
+	// Kind is the kind of address that the given string was parsed as, or
+	// that [ParseSource] tried to parse it as if it's invalid.
+	Kind SourceKind
+
+	// Source is the parsed address, or nil if the given string is invalid.
+	Source Source
+
+	// Err is the error that [ParseSource] returned, or nil if the given
+	// string is valid.
+	Err error
+
+	// Hints describes each of the likely mistakes that DiagnoseSource
+	// recognized in an invalid address, in the order it corrected them.
+	Hints []SourceHint
+
+	// Suggestion is a valid address that corrects all of the mistakes
+	// described in Hints, or nil if DiagnoseSource found no such address.
+	// It's only a guess at what the author intended, so a program should
+	// offer it to the author rather than using it automatically.
+	Suggestion Source
+}
+
+// DiagnoseSource parses the given string in the same way as [ParseSource],
+// but if it's invalid then also tries to recognize common mistakes, such as
+// using backslashes as path separators or an http:// URL instead of an
+// https:// URL, so that a user interface can explain the problem and suggest
+// a corrected address.
+func DiagnoseSource(given string) SourceDiagnosis {
+	ret := SourceDiagnosis{
+		Kind: classifySource(strings.TrimSpace(given)),
+	}
+	ret.Source, ret.Err = ParseSource(given)
+	if ret.Err == nil {
+		return ret
+	}
+
+	corrected := given
+	for _, rule := range sourceHintRules {
+		fixed, ok := rule.fix(corrected)
+		if !ok {
+			continue
+		}
+		ret.Hints = append(ret.Hints, SourceHint{Code: rule.code, Message: rule.message})
+		if fixed == "" {
+			// There's no correction for this mistake.
+			return ret
+		}
+		corrected = fixed
+		if addr, err := ParseSource(corrected); err == nil {
+			ret.Suggestion = addr
+			return ret
+		}
+	}
+	return ret
+}
+
+// sourceHintRule recognizes a particular mistake. Its fix function returns
+// the corrected address and true if the given address has the mistake, or
+// an empty string and true if it has the mistake but can't be corrected.
+type sourceHintRule struct {
+	code    SourceHintCode
+	message string
+	fix     func(given string) (string, bool)
+}
+
+var scpStyleGitPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+@([A-Za-z0-9.-]+):([^/].*)$`)
+
+// sourceHintRules are the rules that DiagnoseSource applies, in order, with
+// each one seeing the address as corrected by the ones before.
+var sourceHintRules = []sourceHintRule{
+	{
+		code:    HintSurroundingSpaces,
+		message: "Source addresses must not have leading or trailing spaces.",
+		fix: func(given string) (string, bool) {
+			trimmed := strings.TrimSpace(given)
+			return trimmed, trimmed != given
+		},
+	},
+	{
+		code:    HintBackslashes,
+		message: "Source addresses always use forward slashes to separate path segments, even on Windows.",
+		fix: func(given string) (string, bool) {
+			if !strings.Contains(given, `\`) {
+				return "", false
+			}
+			return strings.ReplaceAll(given, `\`, "/"), true
+		},
+	},
+	{
+		code:    HintAbsolutePath,
+		message: "Local source addresses must be relative paths, starting with ./ or ../, because absolute paths would not be valid on other computers.",
+		fix: func(given string) (string, bool) {
+			return "", strings.HasPrefix(given, "/") || windowsDrivePattern.MatchString(given)
+		},
+	},
+	{
+		code:    HintMissingLocalPrefix,
+		message: "Local source addresses must start with ./ or ../, to distinguish them from module registry and remote source addresses.",
+		fix: func(given string) (string, bool) {
+			if given == "" || strings.Contains(given, "::") || looksLikeLocalSource(given) || looksLikeFinalRegistrySource(given) {
+				return "", false
+			}
+			// If the first segment contains a dot or colon then it's more
+			// likely to be a hostname or URL scheme than a directory name.
+			first, _, _ := strings.Cut(given, "/")
+			if strings.ContainsAny(first, ".:@") {
+				return "", false
+			}
+			return "./" + given, true
+		},
+	},
+	{
+		code:    HintSCPStyleGit,
+		message: `Git repositories must be given as URLs with the "git::" prefix, such as "git::https://example.com/org/repo.git", rather than in the scp-like syntax.`,
+		fix: func(given string) (string, bool) {
+			matches := scpStyleGitPattern.FindStringSubmatch(given)
+			if matches == nil {
+				return "", false
+			}
+			return "git::https://" + matches[1] + "/" + matches[2], true
+		},
+	},
+	{
+		code:    HintInsecureHTTP,
+		message: "Source packages must be fetched using https:// rather than unencrypted http://.",
+		fix: func(given string) (string, bool) {
+			typePrefix, rest := "", given
+			if matches := remoteSourceTypePattern.FindStringSubmatch(given); len(matches) != 0 {
+				typePrefix, rest = matches[1]+"::", matches[2]
+			}
+			if len(rest) < len("http://") || !strings.EqualFold(rest[:len("http://")], "http://") {
+				return "", false
+			}
+			return typePrefix + "https://" + rest[len("http://"):], true
+		},
+	},
+	{
+		code:    HintGitRepository,
+		message: `An https:// URL must refer to a .tar.gz or .tgz archive. Git repository URLs need the "git::" prefix, and usually the ".git" suffix.`,
+		fix: func(given string) (string, bool) {
+			if remoteSourceTypePattern.MatchString(given) || !strings.HasPrefix(strings.ToLower(given), "https://") {
+				return "", false
+			}
+			pkgRaw, subPath := splitSubPath(given)
+			u, err := url.Parse(pkgRaw)
+			if err != nil || u.Query().Has("archive") {
+				return "", false
+			}
+			if strings.HasSuffix(u.Path, ".tgz") || strings.HasSuffix(u.Path, ".tar.gz") {
+				return "", false
+			}
+			if !strings.HasSuffix(u.Path, ".git") {
+				u.Path = strings.TrimSuffix(u.Path, "/") + ".git"
+				u.RawPath = ""
+			}
+			ret := "git::" + u.String()
+			if subPath != "" {
+				ret += "//" + subPath
+			}
+			return ret, true
+		},
+	},
+}
+
+var windowsDrivePattern = regexp.MustCompile(`^[A-Za-z]:/`)
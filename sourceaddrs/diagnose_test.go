@@ -0,0 +1,123 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiagnoseSource(t *testing.T) {
+	tests := []struct {
+		Given          string
+		WantKind       SourceKind
+		WantHints      []SourceHintCode
+		WantSuggestion string
+	}{
+		{
+			Given:    "./modules/vpc",
+			WantKind: LocalSourceKind,
+		},
+		{
+			Given:          `.\modules\vpc`,
+			WantKind:       RemoteSourceKind,
+			WantHints:      []SourceHintCode{HintBackslashes},
+			WantSuggestion: "./modules/vpc",
+		},
+		{
+			Given:          "modules/vpc",
+			WantKind:       RemoteSourceKind,
+			WantHints:      []SourceHintCode{HintMissingLocalPrefix},
+			WantSuggestion: "./modules/vpc",
+		},
+		{
+			Given:          ` modules\vpc `,
+			WantKind:       RemoteSourceKind,
+			WantHints:      []SourceHintCode{HintSurroundingSpaces, HintBackslashes, HintMissingLocalPrefix},
+			WantSuggestion: "./modules/vpc",
+		},
+		{
+			Given:     `C:\modules\vpc`,
+			WantKind:  RemoteSourceKind,
+			WantHints: []SourceHintCode{HintBackslashes, HintAbsolutePath},
+		},
+		{
+			Given:     "/home/user/modules/vpc",
+			WantKind:  RemoteSourceKind,
+			WantHints: []SourceHintCode{HintAbsolutePath},
+		},
+		{
+			Given:          "http://example.com/vpc.tgz",
+			WantKind:       RemoteSourceKind,
+			WantHints:      []SourceHintCode{HintInsecureHTTP},
+			WantSuggestion: "https://example.com/vpc.tgz",
+		},
+		{
+			Given:          "git::http://example.com/vpc.git?ref=v1",
+			WantKind:       RemoteSourceKind,
+			WantHints:      []SourceHintCode{HintInsecureHTTP},
+			WantSuggestion: "git::https://example.com/vpc.git?ref=v1",
+		},
+		{
+			Given:          "https://github.com/hashicorp/go-slug//sub",
+			WantKind:       RemoteSourceKind,
+			WantHints:      []SourceHintCode{HintGitRepository},
+			WantSuggestion: "git::https://github.com/hashicorp/go-slug.git//sub",
+		},
+		{
+			Given:          "http://github.com/hashicorp/go-slug.git",
+			WantKind:       RemoteSourceKind,
+			WantHints:      []SourceHintCode{HintInsecureHTTP, HintGitRepository},
+			WantSuggestion: "git::https://github.com/hashicorp/go-slug.git",
+		},
+		{
+			Given:          "git@github.com:hashicorp/go-slug.git",
+			WantKind:       RemoteSourceKind,
+			WantHints:      []SourceHintCode{HintSCPStyleGit},
+			WantSuggestion: "git::https://github.com/hashicorp/go-slug.git",
+		},
+		{
+			Given:    "hashicorp/subnets/cidr",
+			WantKind: RegistrySourceKind,
+		},
+		{
+			Given:    "hashicorp/subnets/cidr@1.0.0//modules/a",
+			WantKind: RegistrySourceKind,
+		},
+		{
+			Given:    "ftp://example.com/vpc.tgz",
+			WantKind: RemoteSourceKind,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Given, func(t *testing.T) {
+			got := DiagnoseSource(test.Given)
+			if got.Kind != test.WantKind {
+				t.Errorf("wrong kind %s; want %s", got.Kind, test.WantKind)
+			}
+			if (got.Err == nil) != (got.Source != nil) {
+				t.Errorf("inconsistent result: source %#v with error %v", got.Source, got.Err)
+			}
+			var gotHints []SourceHintCode
+			for _, hint := range got.Hints {
+				if hint.Message == "" {
+					t.Errorf("hint %d has no message", hint.Code)
+				}
+				gotHints = append(gotHints, hint.Code)
+			}
+			if diff := cmp.Diff(test.WantHints, gotHints); diff != "" {
+				t.Errorf("wrong hints\n%s", diff)
+			}
+			var gotSuggestion string
+			if got.Suggestion != nil {
+				gotSuggestion = got.Suggestion.String()
+			}
+			if gotSuggestion != test.WantSuggestion {
+				t.Errorf("wrong suggestion %q; want %q", gotSuggestion, test.WantSuggestion)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"strings"
+)
+
+// CanonicalString returns the canonical string representation of the
+// package address. See the documentation of [Source.CanonicalString] for
+// details.
+func (p RemotePackage) CanonicalString() string {
+	return p.String()
+}
+
+// DisplayString returns a shortened string representation of the package
+// address for display in a UI. See the documentation of
+// [Source.DisplayString] for details.
+//
+// The result includes only the hostname and path of the package URL,
+// omitting the scheme, the source type, and any ".git" suffix on a Git
+// repository path. A Git ref, if specified, is shown after an "@" sign.
+func (p RemotePackage) DisplayString() string {
+	return p.subPathDisplayString("")
+}
+
+func (p RemotePackage) subPathDisplayString(subPath string) string {
+	var buf strings.Builder
+	buf.WriteString(p.url.Host)
+	urlPath := p.url.Path
+	if p.sourceType == "git" {
+		urlPath = strings.TrimSuffix(urlPath, ".git")
+	}
+	buf.WriteString(urlPath)
+	if subPath != "" {
+		buf.WriteString("//")
+		buf.WriteString(subPath)
+	}
+	if p.sourceType == "git" {
+		if ref := p.url.Query().Get("ref"); ref != "" {
+			buf.WriteByte('@')
+			buf.WriteString(ref)
+		}
+	}
+	return buf.String()
+}
+
+// CanonicalString implements [Source] and [FinalSource].
+func (s RemoteSource) CanonicalString() string {
+	return s.String()
+}
+
+// DisplayString implements [Source] and [FinalSource], with the same
+// shortening rules as [RemotePackage.DisplayString].
+func (s RemoteSource) DisplayString() string {
+	return s.pkg.subPathDisplayString(s.subPath)
+}
+
+// CanonicalString implements [Source] and [FinalSource].
+func (s LocalSource) CanonicalString() string {
+	return s.String()
+}
+
+// DisplayString implements [Source] and [FinalSource]. Local source
+// addresses are already as short as possible, so this is the same as
+// [LocalSource.String].
+func (s LocalSource) DisplayString() string {
+	return s.String()
+}
+
+// CanonicalString implements [Source].
+//
+// Unlike [RegistrySource.String], this always includes the registry hostname
+// and uses the ASCII-only form of any internationalized hostname.
+func (s RegistrySource) CanonicalString() string {
+	ret := s.pkg.Host.String() + "/" + s.pkg.ForRegistryProtocol()
+	if s.subPath != "" {
+		ret += "//" + s.subPath
+	}
+	return ret
+}
+
+// DisplayString implements [Source], omitting the hostname of the default
+// public module registry.
+func (s RegistrySource) DisplayString() string {
+	ret := s.pkg.ForDisplay()
+	if s.subPath != "" {
+		ret += "//" + s.subPath
+	}
+	return ret
+}
+
+// CanonicalString implements [FinalSource], using the same rules as
+// [RegistrySource.CanonicalString].
+func (s RegistrySourceFinal) CanonicalString() string {
+	return s.versionedString(s.src.pkg.Host.String() + "/" + s.src.pkg.ForRegistryProtocol())
+}
+
+// DisplayString implements [FinalSource], using the same rules as
+// [RegistrySource.DisplayString].
+func (s RegistrySourceFinal) DisplayString() string {
+	return s.versionedString(s.src.pkg.ForDisplay())
+}
+
+func (s RegistrySourceFinal) versionedString(pkgStr string) string {
+	ret := pkgStr + "@" + s.version.String()
+	if subPath := s.src.SubPath(); subPath != "" {
+		ret += "//" + subPath
+	}
+	return ret
+}
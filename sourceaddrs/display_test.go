@@ -0,0 +1,81 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"testing"
+
+	"github.com/apparentlymart/go-versions/versions"
+)
+
+func TestSourceDisplayAndCanonicalStrings(t *testing.T) {
+	tests := []struct {
+		Addr          FinalSource
+		WantDisplay   string
+		WantCanonical string
+	}{
+		{
+			MustParseSource("./foo").(FinalSource),
+			"./foo",
+			"./foo",
+		},
+		{
+			MustParseSource("https://example.com/foo.tgz").(FinalSource),
+			"example.com/foo.tgz",
+			"https://example.com/foo.tgz",
+		},
+		{
+			MustParseSource("https://example.com/foo.tgz//bar?archive=tar.gz").(FinalSource),
+			"example.com/foo.tgz//bar",
+			"https://example.com/foo.tgz//bar?archive=tgz",
+		},
+		{
+			MustParseSource("git::https://github.com/hashicorp/go-slug.git//sourceaddrs?ref=v1.0.0").(FinalSource),
+			"github.com/hashicorp/go-slug//sourceaddrs@v1.0.0",
+			"git::https://github.com/hashicorp/go-slug.git//sourceaddrs?ref=v1.0.0",
+		},
+		{
+			MustParseSource("git::ssh://github.com/hashicorp/go-slug.git").(FinalSource),
+			"github.com/hashicorp/go-slug",
+			"git::ssh://github.com/hashicorp/go-slug.git",
+		},
+		{
+			MustParseSource("hashicorp/subnets/cidr//sub").(RegistrySource).Versioned(versions.MustParseVersion("1.2.0")),
+			"hashicorp/subnets/cidr@1.2.0//sub",
+			"registry.terraform.io/hashicorp/subnets/cidr@1.2.0//sub",
+		},
+		{
+			MustParseSource("example.com/hashicorp/subnets/cidr").(RegistrySource).Versioned(versions.MustParseVersion("1.2.0")),
+			"example.com/hashicorp/subnets/cidr@1.2.0",
+			"example.com/hashicorp/subnets/cidr@1.2.0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Addr.String(), func(t *testing.T) {
+			if got, want := test.Addr.DisplayString(), test.WantDisplay; got != want {
+				t.Errorf("wrong display string\ngot:  %s\nwant: %s", got, want)
+			}
+			got := test.Addr.CanonicalString()
+			if want := test.WantCanonical; got != want {
+				t.Errorf("wrong canonical string\ngot:  %s\nwant: %s", got, want)
+			}
+			reparsed, err := ParseFinalSource(got)
+			if err != nil {
+				t.Fatalf("can't parse canonical string: %s", err)
+			}
+			if reparsed.CanonicalString() != got {
+				t.Errorf("canonical string doesn't round-trip\ngot:  %s\nwant: %s", reparsed.CanonicalString(), got)
+			}
+		})
+	}
+
+	regSource := MustParseSource("hashicorp/subnets/cidr//sub").(RegistrySource)
+	if got, want := regSource.DisplayString(), "hashicorp/subnets/cidr//sub"; got != want {
+		t.Errorf("wrong display string\ngot:  %s\nwant: %s", got, want)
+	}
+	if got, want := regSource.CanonicalString(), "registry.terraform.io/hashicorp/subnets/cidr//sub"; got != want {
+		t.Errorf("wrong canonical string\ngot:  %s\nwant: %s", got, want)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"fmt"
+)
+
+// ParseSourceStrict is like [ParseSource] but accepts only addresses that
+// are already written in their normal form, which is the form returned by
+// the String method of the result. It rejects inputs that [ParseSource]
+// would accept only after normalizing them, such as shorthand addresses
+// like "github.com/org/repo", scheme names written in uppercase, and
+// "archive=tar.gz" instead of "archive=tgz".
+//
+// Every address type in this package satisfies the following invariants,
+// which [CheckNormalization] verifies for a particular address:
+//
+//   - Parsing the result of String returns an address equal to the
+//     original, and so ParseSourceStrict accepts the result of String.
+//   - Parsing the result of CanonicalString also returns an address equal
+//     to the original.
+//
+// ParseSourceStrict is therefore suitable for systems that store addresses
+// as strings and need to be sure that the stored strings are unambiguous.
+func ParseSourceStrict(given string) (Source, error) {
+	ret, err := ParseSource(given)
+	if err != nil {
+		return nil, err
+	}
+	if normal := ret.String(); normal != given {
+		return nil, fmt.Errorf("source address %q must be written in its normal form %q", given, normal)
+	}
+	return ret, nil
+}
+
+// CheckNormalization returns an error if the given address doesn't satisfy
+// the normalization invariants described for [ParseSourceStrict].
+//
+// This is intended for use in property-based tests and fuzz tests, including
+// those of other packages that construct addresses in other ways, such as
+// by using [MakeRemoteSource] or [ResolveRelativeSource].
+func CheckNormalization(addr Source) error {
+	str := addr.String()
+	fromStr, err := ParseSource(str)
+	if err != nil {
+		return fmt.Errorf("cannot parse String result %q: %w", str, err)
+	}
+	if fromStr != addr {
+		return fmt.Errorf("String result %q parses as a different address %#v", str, fromStr)
+	}
+	if again := fromStr.String(); again != str {
+		return fmt.Errorf("String result %q is not stable: becomes %q after parsing", str, again)
+	}
+
+	canon := addr.CanonicalString()
+	fromCanon, err := ParseSource(canon)
+	if err != nil {
+		return fmt.Errorf("cannot parse CanonicalString result %q: %w", canon, err)
+	}
+	if fromCanon != addr {
+		return fmt.Errorf("CanonicalString result %q parses as a different address %#v", canon, fromCanon)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"testing"
+)
+
+func TestParseSourceStrict(t *testing.T) {
+	tests := []struct {
+		Given   string
+		WantErr string
+	}{
+		{
+			Given: "./boop",
+		},
+		{
+			Given: "registry.terraform.io/hashicorp/subnets/cidr//sub",
+		},
+		{
+			Given:   "hashicorp/subnets/cidr",
+			WantErr: `source address "hashicorp/subnets/cidr" must be written in its normal form "registry.terraform.io/hashicorp/subnets/cidr"`,
+		},
+		{
+			Given: "git::https://github.com/hashicorp/go-slug.git?ref=main//sub",
+		},
+		{
+			Given: "https://example.com/foo.tgz?b=1&a=2",
+		},
+		{
+			Given:   "github.com/hashicorp/go-slug",
+			WantErr: `source address "github.com/hashicorp/go-slug" must be written in its normal form "git::https://github.com/hashicorp/go-slug.git"`,
+		},
+		{
+			Given:   "HTTPS://example.com/foo.tgz",
+			WantErr: `source address "HTTPS://example.com/foo.tgz" must be written in its normal form "https://example.com/foo.tgz"`,
+		},
+		{
+			Given:   "https://example.com/foo?archive=tar.gz",
+			WantErr: `source address "https://example.com/foo?archive=tar.gz" must be written in its normal form "https://example.com/foo?archive=tgz"`,
+		},
+		{
+			Given:   "https://example.com/foo.tgz#frag",
+			WantErr: `invalid remote source address "https://example.com/foo.tgz#frag": must not include a fragment in URL portion`,
+		},
+		{
+			Given:   "https:example.com/foo.tgz",
+			WantErr: `invalid remote source address "https:example.com/foo.tgz": must contain an absolute URL with a hostname`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Given, func(t *testing.T) {
+			got, err := ParseSourceStrict(test.Given)
+
+			if test.WantErr != "" {
+				if err == nil {
+					t.Fatalf("unexpected success\ngot result: %s\nwant error: %s", got, test.WantErr)
+				}
+				if got, want := err.Error(), test.WantErr; got != want {
+					t.Fatalf("wrong error\ngot error:  %s\nwant error: %s", got, want)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if err := CheckNormalization(got); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func FuzzParseSource(f *testing.F) {
+	for _, given := range []string{
+		"./boop",
+		"../beep/boop",
+		"hashicorp/subnets/cidr",
+		"example.com/foo/bar/baz//sub",
+		"github.com/hashicorp/go-slug",
+		"https://example.com/foo.tgz",
+		"https://example.com/foo?archive=tar.gz&b=1&a=2",
+		"git::https://example.com/foo.git?ref=main//sub/dir",
+		"git::ssh://git@example.com/foo.git",
+		"s3::https://s3.amazonaws.com/bucket/foo.zip",
+	} {
+		f.Add(given)
+	}
+	f.Fuzz(func(t *testing.T, given string) {
+		addr, err := ParseSource(given)
+		if err != nil {
+			return
+		}
+		if err := CheckNormalization(addr); err != nil {
+			t.Fatalf("%q: %s", given, err)
+		}
+		if _, err := ParseSourceStrict(addr.String()); err != nil {
+			t.Fatalf("%q: strict parser rejects normal form: %s", given, err)
+		}
+	})
+}
@@ -6,6 +6,7 @@ package sourceaddrs
 import (
 	"fmt"
 	"net/url"
+	"strings"
 )
 
 type RemotePackage struct {
@@ -30,6 +31,16 @@ func ParseRemotePackage(given string) (RemotePackage, error) {
 	return srcAddr.pkg, nil
 }
 
+// MustParseRemotePackage is like [ParseRemotePackage] but panics if the given
+// string is invalid.
+func MustParseRemotePackage(given string) RemotePackage {
+	ret, err := ParseRemotePackage(given)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
 func (p RemotePackage) String() string {
 	// Our address normalization rules are a bit odd since we inherited the
 	// fundamentals of this addressing scheme from go-getter.
@@ -88,3 +99,39 @@ func (p RemotePackage) SourceType() string {
 func (p RemotePackage) URL() *url.URL {
 	return &p.url
 }
+
+// HasWrapperDirectory returns true if the package address refers to a
+// release archive from a well-known source code hosting service whose
+// archives conventionally place all of the package contents under a single
+// top-level directory, such as the "codeload.github.com" tarballs that
+// GitHub generates for tags and branches.
+//
+// Fetchers and source bundle builders can use this as a hint that they
+// should strip the extra directory level after extraction so that sub-paths
+// in source addresses are resolved relative to the real root of the package.
+// The result is only a hint: callers should still verify that the extracted
+// archive really does contain exactly one top-level directory before
+// stripping it.
+func (p RemotePackage) HasWrapperDirectory() bool {
+	if p.sourceType != "https" {
+		return false
+	}
+	host := strings.ToLower(p.url.Hostname())
+	path := p.url.Path
+	switch {
+	case host == "codeload.github.com":
+		// e.g. https://codeload.github.com/org/repo/tar.gz/refs/tags/v1.0.0
+		return true
+	case host == "github.com":
+		// e.g. https://github.com/org/repo/archive/refs/tags/v1.0.0.tar.gz
+		parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+		return len(parts) > 3 && parts[2] == "archive"
+	case strings.Contains(path, "/-/archive/"):
+		// GitLab uses this path pattern both on gitlab.com and on
+		// self-hosted instances, so we don't check the hostname here.
+		// e.g. https://gitlab.com/org/repo/-/archive/v1.0.0/repo-v1.0.0.tar.gz
+		return true
+	default:
+		return false
+	}
+}
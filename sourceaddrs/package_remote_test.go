@@ -0,0 +1,52 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"testing"
+)
+
+func TestRemotePackageHasWrapperDirectory(t *testing.T) {
+	tests := []struct {
+		Given string
+		Want  bool
+	}{
+		{
+			"https://example.com/foo.tgz",
+			false,
+		},
+		{
+			"https://codeload.github.com/hashicorp/go-slug/tar.gz/refs/tags/v0.1.0?archive=tgz",
+			true,
+		},
+		{
+			"https://github.com/hashicorp/go-slug/archive/refs/tags/v0.1.0.tar.gz",
+			true,
+		},
+		{
+			"https://github.com/hashicorp/go-slug/releases/download/v0.1.0/go-slug.tar.gz",
+			false,
+		},
+		{
+			"https://gitlab.example.com/hashicorp/go-slug/-/archive/v0.1.0/go-slug-v0.1.0.tar.gz",
+			true,
+		},
+		{
+			"git::https://github.com/hashicorp/go-slug.git",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Given, func(t *testing.T) {
+			pkg, err := ParseRemotePackage(test.Given)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got, want := pkg.HasWrapperDirectory(), test.Want; got != want {
+				t.Errorf("wrong result\ngot:  %t\nwant: %t", got, want)
+			}
+		})
+	}
+}
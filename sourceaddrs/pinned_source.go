@@ -0,0 +1,154 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PinnedSource is a source address that is pinned to exactly one snapshot
+// of its package, as would typically be recorded in a lock file.
+//
+// A PinnedSource is either a [RegistrySourceFinal], which is pinned by its
+// selected version, or a [RemoteSource] that is optionally pinned to a
+// particular Git commit by its digest.
+//
+// The zero value of PinnedSource is not valid. Use [PinRemoteSource],
+// [PinRegistrySource], or [ParsePinnedSource] to construct one.
+type PinnedSource struct {
+	source FinalSource
+	digest string
+}
+
+// PinRemoteSource returns a [PinnedSource] for the given remote source,
+// pinned to the Git commit with the given digest.
+//
+// The digest may be empty to represent a remote source whose content isn't
+// pinned, such as for a source type that has no concept of commits. If not
+// empty then the source must be a Git source and the digest must be a
+// 40-digit SHA-1 or 64-digit SHA-256 commit ID in lowercase hexadecimal.
+func PinRemoteSource(source RemoteSource, digest string) (PinnedSource, error) {
+	if digest != "" {
+		if source.Package().SourceType() != "git" {
+			return PinnedSource{}, fmt.Errorf("only git sources can be pinned to a commit digest")
+		}
+		if !commitDigestPattern.MatchString(digest) {
+			return PinnedSource{}, fmt.Errorf("invalid commit digest %q: must be a full SHA-1 or SHA-256 commit ID in lowercase hexadecimal", digest)
+		}
+	}
+	return PinnedSource{
+		source: source,
+		digest: digest,
+	}, nil
+}
+
+// PinRegistrySource returns a [PinnedSource] for the given final registry
+// source, which is pinned by its selected version.
+func PinRegistrySource(source RegistrySourceFinal) PinnedSource {
+	return PinnedSource{
+		source: source,
+	}
+}
+
+// ParsePinnedSource parses the string representation of a pinned source, as
+// returned by [PinnedSource.String].
+//
+// A final registry source is written in the same way as for
+// [ParseFinalRegistrySource]. A remote source is written in the same way as
+// for [ParseRemoteSource], optionally followed by a space and a commit
+// digest.
+func ParsePinnedSource(given string) (PinnedSource, error) {
+	if strings.TrimSpace(given) != given {
+		return PinnedSource{}, fmt.Errorf("pinned source must not have leading or trailing spaces")
+	}
+	if looksLikeFinalRegistrySource(given) {
+		source, err := ParseFinalRegistrySource(given)
+		if err != nil {
+			return PinnedSource{}, fmt.Errorf("invalid module registry source address %q: %w", given, err)
+		}
+		return PinRegistrySource(source), nil
+	}
+
+	addr, digest := given, ""
+	if i := strings.LastIndexByte(given, ' '); i >= 0 {
+		addr, digest = given[:i], given[i+1:]
+	}
+	source, err := ParseRemoteSource(addr)
+	if err != nil {
+		return PinnedSource{}, fmt.Errorf("invalid remote source address %q: %w", addr, err)
+	}
+	return PinRemoteSource(source, digest)
+}
+
+// MustParsePinnedSource is like [ParsePinnedSource] but panics if the given
+// string is invalid.
+func MustParsePinnedSource(given string) PinnedSource {
+	ret, err := ParsePinnedSource(given)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// Source returns the address that the receiver pins, which is either a
+// [RemoteSource] or a [RegistrySourceFinal].
+func (p PinnedSource) Source() FinalSource {
+	return p.source
+}
+
+// RemoteSource returns the remote source address that the receiver pins,
+// or false if the receiver pins a registry source.
+func (p PinnedSource) RemoteSource() (RemoteSource, bool) {
+	ret, ok := p.source.(RemoteSource)
+	return ret, ok
+}
+
+// RegistrySource returns the final registry source address that the
+// receiver pins, or false if the receiver pins a remote source.
+func (p PinnedSource) RegistrySource() (RegistrySourceFinal, bool) {
+	ret, ok := p.source.(RegistrySourceFinal)
+	return ret, ok
+}
+
+// Digest returns the commit digest that a remote source is pinned to, or
+// an empty string if the receiver has no digest.
+func (p PinnedSource) Digest() string {
+	return p.digest
+}
+
+// String returns the string representation of the pinned source, which
+// [ParsePinnedSource] can parse.
+func (p PinnedSource) String() string {
+	if p.source == nil {
+		return ""
+	}
+	if p.digest == "" {
+		return p.source.String()
+	}
+	return p.source.String() + " " + p.digest
+}
+
+// MarshalText implements [encoding.TextMarshaler], so that a PinnedSource
+// can be used directly in serialized lock files.
+func (p PinnedSource) MarshalText() ([]byte, error) {
+	if p.source == nil {
+		return nil, fmt.Errorf("cannot marshal the zero value of PinnedSource")
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements [encoding.TextUnmarshaler] using
+// [ParsePinnedSource].
+func (p *PinnedSource) UnmarshalText(text []byte) error {
+	ret, err := ParsePinnedSource(string(text))
+	if err != nil {
+		return err
+	}
+	*p = ret
+	return nil
+}
+
+var commitDigestPattern = regexp.MustCompile(`^(?:[0-9a-f]{40}|[0-9a-f]{64})$`)
@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParsePinnedSource(t *testing.T) {
+	const digest = "0123456789abcdef0123456789abcdef01234567"
+
+	tests := map[string]struct {
+		wantRegistry bool
+		wantSource   string
+		wantDigest   string
+		wantErr      bool
+	}{
+		"hashicorp/subnets/cidr@1.0.0": {
+			wantRegistry: true,
+			wantSource:   "registry.terraform.io/hashicorp/subnets/cidr@1.0.0",
+		},
+		"hashicorp/subnets/cidr@1.0.0//modules/a@b": {
+			wantRegistry: true,
+			wantSource:   "registry.terraform.io/hashicorp/subnets/cidr@1.0.0//modules/a@b",
+		},
+		"git::https://github.com/hashicorp/go-slug.git?ref=main " + digest: {
+			wantSource: "git::https://github.com/hashicorp/go-slug.git?ref=main",
+			wantDigest: digest,
+		},
+		"https://example.com/foo.tgz": {
+			wantSource: "https://example.com/foo.tgz",
+		},
+		"https://example.com/foo.tgz " + digest: {
+			wantErr: true, // only git sources can have a digest
+		},
+		"git::https://github.com/hashicorp/go-slug.git abc123": {
+			wantErr: true, // abbreviated commit IDs are not allowed
+		},
+		"hashicorp/subnets/cidr": {
+			wantErr: true, // registry sources must have a version
+		},
+	}
+	for given, test := range tests {
+		t.Run(given, func(t *testing.T) {
+			got, err := ParsePinnedSource(given)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("unexpected success: %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			_, isRegistry := got.RegistrySource()
+			_, isRemote := got.RemoteSource()
+			if isRegistry != test.wantRegistry || isRemote == test.wantRegistry {
+				t.Errorf("wrong source type %T", got.Source())
+			}
+			if got, want := got.Source().String(), test.wantSource; got != want {
+				t.Errorf("wrong source\ngot:  %s\nwant: %s", got, want)
+			}
+			if got, want := got.Digest(), test.wantDigest; got != want {
+				t.Errorf("wrong digest\ngot:  %s\nwant: %s", got, want)
+			}
+
+			// The string representation must round-trip.
+			again, err := ParsePinnedSource(got.String())
+			if err != nil {
+				t.Fatalf("failed to parse %q again: %s", got.String(), err)
+			}
+			if again.String() != got.String() {
+				t.Errorf("string did not round-trip\ngot:  %s\nwant: %s", again.String(), got.String())
+			}
+		})
+	}
+}
+
+func TestPinnedSourceJSON(t *testing.T) {
+	type lockEntry struct {
+		Source PinnedSource `json:"source"`
+	}
+	want := lockEntry{
+		Source: MustParsePinnedSource("git::https://github.com/hashicorp/go-slug.git 0123456789abcdef0123456789abcdef01234567"),
+	}
+	src, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got lockEntry
+	if err := json.Unmarshal(src, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Source.String() != want.Source.String() {
+		t.Errorf("wrong result\ngot:  %s\nwant: %s", got.Source, want.Source)
+	}
+
+	if _, err := json.Marshal(lockEntry{}); err == nil {
+		t.Errorf("expected error marshaling zero value")
+	}
+}
@@ -23,6 +23,20 @@ type Source interface {
 
 	String() string
 	SupportsVersionConstraints() bool
+
+	// CanonicalString returns a string that is equal for two addresses if
+	// and only if the addresses are equal. Its format will not change in
+	// any future minor release, so it's suitable for use as a map key or
+	// for comparison with strings saved by earlier versions of a program,
+	// and it can always be parsed back into an equivalent address.
+	CanonicalString() string
+
+	// DisplayString returns a shortened form of the address that is more
+	// readable in a UI, but which might omit details such as the scheme or
+	// some query string arguments, and so can't reliably be parsed back
+	// into the same address. Its format may change in any release to
+	// improve readability, so it should never be saved or compared.
+	DisplayString() string
 }
 
 // ParseSource attempts to parse the given string as any one of the three
@@ -35,24 +49,25 @@ func ParseSource(given string) (Source, error) {
 	if len(given) == 0 {
 		return nil, fmt.Errorf("a valid source address is required")
 	}
-	switch {
-	case looksLikeLocalSource(given) || given == "." || given == "..":
+	switch classifySource(given) {
+	case LocalSourceKind:
 		ret, err := ParseLocalSource(given)
 		if err != nil {
 			return nil, fmt.Errorf("invalid local source address %q: %w", given, err)
 		}
 		return ret, nil
-	case looksLikeRegistrySource(given):
+	case RegistrySourceKind:
+		if looksLikeFinalRegistrySource(given) {
+			return nil, fmt.Errorf("invalid module registry source address %q: must not include a version, which is selected by a separate version constraint", given)
+		}
 		ret, err := ParseRegistrySource(given)
 		if err != nil {
 			return nil, fmt.Errorf("invalid module registry source address %q: %w", given, err)
 		}
 		return ret, nil
 	default:
-		// If it's neither a local source nor a module registry source then
-		// we'll assume it's intended to be a remote source.
-		// (This parser will return a suitable error if the given string
-		// is not of any of the supported address types.)
+		// (The remote source parser will return a suitable error if the
+		// given string is not of any of the supported address types.)
 		ret, err := ParseRemoteSource(given)
 		if err != nil {
 			return nil, fmt.Errorf("invalid remote source address %q: %w", given, err)
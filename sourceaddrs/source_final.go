@@ -20,6 +20,20 @@ type FinalSource interface {
 	finalSourceSigil()
 
 	String() string
+
+	// CanonicalString returns a string that is equal for two addresses if
+	// and only if the addresses are equal. Its format will not change in
+	// any future minor release, so it's suitable for use as a map key or
+	// for comparison with strings saved by earlier versions of a program,
+	// and it can always be parsed back into an equivalent address.
+	CanonicalString() string
+
+	// DisplayString returns a shortened form of the address that is more
+	// readable in a UI, but which might omit details such as the scheme or
+	// some query string arguments, and so can't reliably be parsed back
+	// into the same address. Its format may change in any release to
+	// improve readability, so it should never be saved or compared.
+	DisplayString() string
 }
 
 // ParseFinalSource attempts to parse the given string as any one of the three
@@ -39,7 +53,9 @@ func ParseFinalSource(given string) (FinalSource, error) {
 			return nil, fmt.Errorf("invalid local source address %q: %w", given, err)
 		}
 		return ret, nil
-	case looksLikeFinalRegistrySource(given):
+	case looksLikeFinalRegistrySource(given) || looksLikeRegistrySource(given):
+		// An unversioned registry source address isn't valid as a final
+		// source address, but ParseFinalRegistrySource will explain why.
 		ret, err := ParseFinalRegistrySource(given)
 		if err != nil {
 			return nil, fmt.Errorf("invalid module registry source address %q: %w", given, err)
@@ -58,6 +74,16 @@ func ParseFinalSource(given string) (FinalSource, error) {
 	}
 }
 
+// MustParseFinalSource is like [ParseFinalSource] but panics if the given
+// string is invalid.
+func MustParseFinalSource(given string) FinalSource {
+	ret, err := ParseFinalSource(given)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
 // FinalSourceFilename returns the base name (in the same sense as [path.Base])
 // of the sub-path or local path portion of the given final source address.
 //
@@ -142,6 +142,14 @@ func TestParseFinalSource(t *testing.T) {
 			Addr: "gitlab.com/hashicorp/go-slug/bleep@1.0.0",
 			Want: MustParseSource("gitlab.com/hashicorp/go-slug/bleep").(RegistrySource).Versioned(onePointOh),
 		},
+		{
+			Addr: "example.com/foo/bar/baz@1.0.0//beep@2.0.0/boop",
+			Want: MustParseSource("example.com/foo/bar/baz//beep@2.0.0/boop").(RegistrySource).Versioned(onePointOh),
+		},
+		{
+			Addr: "example.com/foo/bar/baz@1.0.0//",
+			Want: MustParseSource("example.com/foo/bar/baz").(RegistrySource).Versioned(onePointOh),
+		},
 		{
 			Addr: "./a/b@1.0.0",
 			Want: MustParseSource("./a/b@1.0.0").(FinalSource),
@@ -158,6 +166,18 @@ func TestParseFinalSource(t *testing.T) {
 			Addr:    "example.com/foo/bar/baz@1.0.x//beep",
 			WantErr: `invalid module registry source address "example.com/foo/bar/baz@1.0.x//beep": invalid version: can't use wildcard for patch number; an exact version is required`,
 		},
+		{
+			Addr:    "example.com/foo/bar/baz//beep@1.0.0",
+			WantErr: `invalid module registry source address "example.com/foo/bar/baz//beep@1.0.0": version must be given before the sub-path, as in "example.com/foo/bar/baz@1.0.0//beep"`,
+		},
+		{
+			Addr:    "example.com/foo/bar/baz//beep",
+			WantErr: `invalid module registry source address "example.com/foo/bar/baz//beep": must include a selected version, as in "example.com/foo/bar/baz@1.0.0"`,
+		},
+		{
+			Addr:    "example.com/foo/bar/baz@1.0.0//beep/../boop",
+			WantErr: `invalid module registry source address "example.com/foo/bar/baz@1.0.0//beep/../boop": invalid registry source: invalid sub-path: must be slash-separated relative path without any .. or . segments`,
+		},
 	}
 
 	for _, test := range tests {
@@ -192,3 +212,37 @@ func TestParseFinalSource(t *testing.T) {
 		})
 	}
 }
+
+func TestFinalSourceFilename(t *testing.T) {
+	tests := []struct {
+		Addr string
+		Want string
+	}{
+		{"./foo.tf", "foo.tf"},
+		{"git::https://example.com/foo.git//boop/foo.tf?ref=main", "foo.tf"},
+		{"hashicorp/subnets/cidr@1.0.0//test/simple.tf", "simple.tf"},
+		{"hashicorp/subnets/cidr@1.0.0//test@1/simple.tf", "simple.tf"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Addr, func(t *testing.T) {
+			addr, err := ParseFinalSource(test.Addr)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := FinalSourceFilename(addr); got != test.Want {
+				t.Errorf("wrong result\ngot:  %s\nwant: %s", got, test.Want)
+			}
+
+			// The canonical string of a final source must parse back to
+			// an equal address, including the version and sub-path.
+			roundTrip, err := ParseFinalSource(addr.CanonicalString())
+			if err != nil {
+				t.Fatalf("canonical string %q doesn't parse: %s", addr.CanonicalString(), err)
+			}
+			if roundTrip != addr {
+				t.Errorf("canonical string doesn't round-trip\ngot:  %#v\nwant: %#v", roundTrip, addr)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ package sourceaddrs
 import (
 	"fmt"
 	"path"
+	"path/filepath"
 	"strings"
 )
 
@@ -76,6 +77,56 @@ func ParseLocalSource(given string) (LocalSource, error) {
 	return LocalSource{relPath: clean}, nil
 }
 
+// MustParseLocalSource is like [ParseLocalSource] but panics if the given
+// string is invalid.
+func MustParseLocalSource(given string) LocalSource {
+	ret, err := ParseLocalSource(given)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// NewLocalSourceFromOSPath constructs a local source address describing the
+// path p relative to the directory base, where both are given using the
+// conventions of the current operating system.
+//
+// If p is not absolute then it's interpreted relative to the current working
+// directory, not relative to base. The result can traverse upwards from base
+// using "../" segments if p is not within base, but this function returns an
+// error if no relative path from base to p exists, such as if they are on
+// different volumes on Windows, or if the relative path cannot be written
+// in the canonical local source address syntax.
+func NewLocalSourceFromOSPath(base, p string) (LocalSource, error) {
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return LocalSource{}, fmt.Errorf("invalid base directory %q: %w", base, err)
+	}
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return LocalSource{}, fmt.Errorf("invalid path %q: %w", p, err)
+	}
+	rel, err := filepath.Rel(absBase, absPath)
+	if err != nil {
+		return LocalSource{}, fmt.Errorf("cannot describe %q relative to %q: %w", p, base, err)
+	}
+
+	given := filepath.ToSlash(rel)
+	switch {
+	case given == ".":
+		given = "./"
+	case given == "..":
+		given = "../"
+	case !looksLikeLocalSource(given):
+		given = "./" + given
+	}
+	ret, err := ParseLocalSource(given)
+	if err != nil {
+		return LocalSource{}, fmt.Errorf("cannot use %q as a local source address: %w", p, err)
+	}
+	return ret, nil
+}
+
 // String implements Source
 func (s LocalSource) String() string {
 	return s.relPath
@@ -91,3 +142,20 @@ func (s LocalSource) SupportsVersionConstraints() bool {
 func (s LocalSource) RelativePath() string {
 	return s.relPath
 }
+
+// AbsWithin returns the absolute operating-system-specific path that the
+// receiver refers to when interpreted relative to the given base directory.
+//
+// Returns an error if the local source traverses upwards out of baseDir,
+// because the result would then not be within the given base directory.
+func (s LocalSource) AbsWithin(baseDir string) (string, error) {
+	absBase, err := filepath.Abs(baseDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid base directory %q: %w", baseDir, err)
+	}
+	rel := filepath.FromSlash(path.Clean(s.relPath))
+	if !filepath.IsLocal(rel) && rel != "." {
+		return "", fmt.Errorf("local source %s traverses outside of the base directory", s.relPath)
+	}
+	return filepath.Join(absBase, rel), nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLocalSourceFromOSPath(t *testing.T) {
+	base := filepath.FromSlash("/base/dir")
+	tests := []struct {
+		Given string
+		Want  string
+	}{
+		{
+			Given: filepath.FromSlash("/base/dir"),
+			Want:  "./",
+		},
+		{
+			Given: filepath.FromSlash("/base/dir/a/b"),
+			Want:  "./a/b",
+		},
+		{
+			Given: filepath.FromSlash("/base/other"),
+			Want:  "../other",
+		},
+		{
+			Given: filepath.FromSlash("/base"),
+			Want:  "../",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Given, func(t *testing.T) {
+			got, err := NewLocalSourceFromOSPath(base, test.Given)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got.String() != test.Want {
+				t.Errorf("wrong result\ngot:  %s\nwant: %s", got, test.Want)
+			}
+
+			// Converting back again should produce the original path,
+			// as long as it's within the base directory.
+			if !strings.HasPrefix(test.Want, "./") {
+				return
+			}
+			abs, err := got.AbsWithin(base)
+			if err != nil {
+				t.Fatalf("unexpected error from AbsWithin: %s", err)
+			}
+			wantAbs, _ := filepath.Abs(test.Given)
+			if abs != wantAbs {
+				t.Errorf("wrong round-trip result\ngot:  %s\nwant: %s", abs, wantAbs)
+			}
+		})
+	}
+}
+
+func TestLocalSourceAbsWithin(t *testing.T) {
+	base, err := filepath.Abs(filepath.FromSlash("/base/dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := MustParseSource("./a/b").(LocalSource).AbsWithin(base)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := filepath.Join(base, "a", "b"); got != want {
+		t.Errorf("wrong result\ngot:  %s\nwant: %s", got, want)
+	}
+
+	_, err = MustParseSource("../a").(LocalSource).AbsWithin(base)
+	if err == nil {
+		t.Fatal("unexpected success; want error for traversal outside base directory")
+	}
+	if got, want := err.Error(), "local source ../a traverses outside of the base directory"; got != want {
+		t.Errorf("wrong error\ngot:  %s\nwant: %s", got, want)
+	}
+}
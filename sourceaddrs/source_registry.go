@@ -69,6 +69,16 @@ func ParseRegistrySource(given string) (RegistrySource, error) {
 	}, nil
 }
 
+// MustParseRegistrySource is like [ParseRegistrySource] but panics if the
+// given string is invalid.
+func MustParseRegistrySource(given string) RegistrySource {
+	ret, err := ParseRegistrySource(given)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
 // ParseRegistryPackage parses the given string as a registry package address,
 // which is the same syntax as a registry source address with no sub-path
 // portion.
@@ -83,6 +93,16 @@ func ParseRegistryPackage(given string) (regaddr.ModulePackage, error) {
 	return srcAddr.pkg, nil
 }
 
+// MustParseRegistryPackage is like [ParseRegistryPackage] but panics if the
+// given string is invalid.
+func MustParseRegistryPackage(given string) regaddr.ModulePackage {
+	ret, err := ParseRegistryPackage(given)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
 func (s RegistrySource) String() string {
 	if s.subPath != "" {
 		return s.pkg.String() + "//" + s.subPath
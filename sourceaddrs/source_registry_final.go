@@ -5,7 +5,7 @@ package sourceaddrs
 
 import (
 	"fmt"
-	"regexp"
+	"strings"
 
 	"github.com/apparentlymart/go-versions/versions"
 	regaddr "github.com/hashicorp/terraform-registry-address"
@@ -31,14 +31,41 @@ type RegistrySourceFinal struct {
 var _ FinalSource = RegistrySourceFinal{}
 
 func looksLikeFinalRegistrySource(given string) bool {
-	var addr string
-	if matches := finalRegistrySourcePattern.FindStringSubmatch(given); len(matches) != 0 {
-		addr = matches[1]
-		if len(matches) == 5 {
-			addr = fmt.Sprintf("%s//%s", addr, matches[4])
-		}
+	addr, _, ok := splitFinalRegistrySource(given)
+	return ok && looksLikeRegistrySource(addr)
+}
+
+// looksLikeMisplacedRegistryVersion returns true if the given string is a
+// registry source address whose sub-path ends with what was probably
+// intended as its version, as in "example.com/foo/bar/baz//beep@1.0.0".
+func looksLikeMisplacedRegistryVersion(given string) bool {
+	pkgRaw, subPath := splitSubPath(given)
+	i := strings.LastIndexByte(subPath, '@')
+	if i < 0 || !looksLikeRegistrySource(pkgRaw) {
+		return false
 	}
-	return looksLikeRegistrySource(addr)
+	_, err := versions.ParseVersion(subPath[i+1:])
+	return err == nil
+}
+
+// splitFinalRegistrySource splits the given string into the unversioned
+// registry source address and the version string, or returns false if it
+// doesn't have a version.
+//
+// The version is attached to the package portion of the address, before
+// any sub-path, and so an "@" within the sub-path is just part of the
+// sub-path.
+func splitFinalRegistrySource(given string) (addr, version string, ok bool) {
+	pkgRaw, subPath := splitSubPath(given)
+	i := strings.LastIndexByte(pkgRaw, '@')
+	if i < 0 {
+		return "", "", false
+	}
+	addr, version = pkgRaw[:i], pkgRaw[i+1:]
+	if subPath != "" {
+		addr += "//" + subPath
+	}
+	return addr, version, true
 }
 
 // finalSourceSigil implements FinalSource
@@ -47,14 +74,17 @@ func (s RegistrySourceFinal) finalSourceSigil() {}
 // ParseFinalRegistrySource parses the given string as a final registry source
 // address, or returns an error if it does not use the correct syntax for
 // interpretation as a final registry source address.
+//
+// The selected version follows the package address and precedes the
+// optional sub-path, as in "example.com/foo/bar/baz@1.0.0//beep", which is
+// the same form that [RegistrySourceFinal.String] returns.
 func ParseFinalRegistrySource(given string) (RegistrySourceFinal, error) {
-	var addr, ver string
-	if matches := finalRegistrySourcePattern.FindStringSubmatch(given); len(matches) != 0 {
-		addr = matches[1]
-		ver = matches[2]
-		if len(matches) == 5 {
-			addr = fmt.Sprintf("%s//%s", addr, matches[4])
+	addr, ver, ok := splitFinalRegistrySource(given)
+	if !ok {
+		if looksLikeMisplacedRegistryVersion(given) {
+			return RegistrySourceFinal{}, fmt.Errorf("version must be given before the sub-path, as in \"example.com/foo/bar/baz@1.0.0//beep\"")
 		}
+		return RegistrySourceFinal{}, fmt.Errorf("must include a selected version, as in \"example.com/foo/bar/baz@1.0.0\"")
 	}
 	version, err := versions.ParseVersion(ver)
 	if err != nil {
@@ -67,6 +97,16 @@ func ParseFinalRegistrySource(given string) (RegistrySourceFinal, error) {
 	return regSrc.Versioned(version), nil
 }
 
+// MustParseFinalRegistrySource is like [ParseFinalRegistrySource] but panics
+// if the given string is invalid.
+func MustParseFinalRegistrySource(given string) RegistrySourceFinal {
+	ret, err := ParseFinalRegistrySource(given)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
 // Unversioned returns the address of the registry package that this final
 // address is a version of.
 func (s RegistrySourceFinal) Unversioned() RegistrySource {
@@ -102,8 +142,3 @@ func (s RegistrySourceFinal) FinalSourceAddr(realSource RemoteSource) RemoteSour
 	// paths together, so we can just delegate to our unversioned equivalent.
 	return s.Unversioned().FinalSourceAddr(realSource)
 }
-
-// finalRegistrySourcePattern is a non-exhaustive regexp which looks only for
-// the expected three components of a RegistrySourceFinal string encoding: the
-// package address, version, and subpath. The subpath is optional.
-var finalRegistrySourcePattern = regexp.MustCompile(`^(.+)@([^/]+)(//(.+))?$`)
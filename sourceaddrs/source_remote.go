@@ -61,9 +61,25 @@ func ParseRemoteSource(given string) (RemoteSource, error) {
 	if u.Scheme == "" {
 		return RemoteSource{}, fmt.Errorf("must contain an absolute URL with a scheme")
 	}
+	if u.Opaque != "" || u.Host == "" {
+		// A URL without a hostname, like "https:example.com", has no
+		// unambiguous string representation.
+		return RemoteSource{}, fmt.Errorf("must contain an absolute URL with a hostname")
+	}
 	if u.User != nil {
 		return RemoteSource{}, fmt.Errorf("must not use username or password in URL portion")
 	}
+	if u.Fragment != "" || strings.HasSuffix(pkgRaw, "#") {
+		// Fragments are never sent to the server, so they can only make
+		// two addresses for the same package appear different.
+		return RemoteSource{}, fmt.Errorf("must not include a fragment in URL portion")
+	}
+
+	if u.RawPath != "" && u.EscapedPath() != u.RawPath {
+		// The URL package ignores a raw path that isn't a valid encoding
+		// of the path, so we discard it to make String round-trip.
+		u.RawPath = ""
+	}
 
 	u.Scheme = strings.ToLower(u.Scheme)
 	sourceType = strings.ToLower(sourceType)
@@ -84,6 +100,16 @@ func ParseRemoteSource(given string) (RemoteSource, error) {
 	return makeRemoteSource(sourceType, u, subPath)
 }
 
+// MustParseRemoteSource is like [ParseRemoteSource] but panics if the given
+// string is invalid.
+func MustParseRemoteSource(given string) RemoteSource {
+	ret, err := ParseRemoteSource(given)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
 // MakeRemoteSource constructs a [RemoteSource] from its component parts.
 //
 // This is useful for deriving one remote source from another, by disassembling
@@ -80,6 +80,13 @@ func (httpSourceType) PrepareURL(u *url.URL) error {
 	// on the Content-Type of the response, like a sensible HTTP client would,
 	// but for now compatibility with go-getter is more important than being
 	// sensible.
+	//
+	// Any query string arguments other than "archive" and "checksum" are
+	// passed through to the server exactly as given, preserving both their
+	// order and their escaping, so that pre-signed URLs (such as those
+	// generated for Amazon S3 or Azure Blob Storage) remain valid. The only
+	// normalization we perform is rewriting "archive=tar.gz" as
+	// "archive=tgz", which affects only that one argument.
 
 	qs := u.Query()
 	if vs := qs["archive"]; len(vs) > 0 {
@@ -90,7 +97,8 @@ func (httpSourceType) PrepareURL(u *url.URL) error {
 			return fmt.Errorf("the special 'archive' query string argument must be set to 'tgz' if present")
 		}
 		if vs[0] == "tar.gz" {
-			qs.Set("archive", "tgz") // normalize on the shorter form
+			// normalize on the shorter form
+			u.RawQuery = replaceRawQueryArg(u.RawQuery, "archive", "tgz")
 		}
 		// NOTE: We don't remove the "archive" argument here because the code
 		// which eventually fetches this will need it to understand what kind
@@ -98,7 +106,6 @@ func (httpSourceType) PrepareURL(u *url.URL) error {
 		// to remove this argument itself to avoid potentially confusing the
 		// remote server, since this is an argument reserved for go-getter and
 		// for the subset of go-getter's syntax we're implementing here.
-		u.RawQuery = qs.Encode()
 	} else {
 		p := u.EscapedPath()
 		if !(strings.HasSuffix(p, ".tar.gz") || strings.HasSuffix(p, ".tgz")) {
@@ -121,3 +128,19 @@ func (httpSourceType) PrepareURL(u *url.URL) error {
 
 	return nil
 }
+
+// replaceRawQueryArg replaces the value of each argument with the given name
+// in the given raw query string, leaving all other arguments untouched.
+//
+// This assumes that rawQuery has already been validated using
+// url.ParseQuery.
+func replaceRawQueryArg(rawQuery, name, value string) string {
+	args := strings.Split(rawQuery, "&")
+	for i, arg := range args {
+		k, _, _ := strings.Cut(arg, "=")
+		if k, err := url.QueryUnescape(k); err == nil && k == name {
+			args[i] = url.QueryEscape(name) + "=" + url.QueryEscape(value)
+		}
+	}
+	return strings.Join(args, "&")
+}
@@ -98,6 +98,10 @@ func TestParseSource(t *testing.T) {
 				subPath: "blah/blah",
 			},
 		},
+		{
+			Given:   "hashicorp/subnets/cidr@1.0.0//blah",
+			WantErr: `invalid module registry source address "hashicorp/subnets/cidr@1.0.0//blah": must not include a version, which is selected by a separate version constraint`,
+		},
 		{
 			Given:   "hashicorp/subnets/cidr//blah/blah/../bloop",
 			WantErr: `invalid module registry source address "hashicorp/subnets/cidr//blah/blah/../bloop": invalid sub-path: must be slash-separated relative path without any .. or . segments`,
@@ -365,6 +369,24 @@ func TestParseSource(t *testing.T) {
 				},
 			},
 		},
+		{
+			Given: "https://example.com/foo?sv=2020-08-04&archive=tar.gz&sig=abc%2Bdef%3D",
+			Want: RemoteSource{
+				pkg: RemotePackage{
+					sourceType: "https",
+					url:        *mustParseURL("https://example.com/foo?sv=2020-08-04&archive=tgz&sig=abc%2Bdef%3D"),
+				},
+			},
+		},
+		{
+			Given: "https://bucket.s3.amazonaws.com/foo.tgz?X-Amz-Signature=abc&X-Amz-Expires=300",
+			Want: RemoteSource{
+				pkg: RemotePackage{
+					sourceType: "https",
+					url:        *mustParseURL("https://bucket.s3.amazonaws.com/foo.tgz?X-Amz-Signature=abc&X-Amz-Expires=300"),
+				},
+			},
+		},
 		{
 			Given:   "https://example.com/foo.zip",
 			WantErr: `invalid remote source address "https://example.com/foo.zip": a HTTPS URL's path must end with either .tar.gz or .tgz`,
@@ -584,3 +606,57 @@ func mustParseURL(s string) *url.URL {
 	}
 	return ret
 }
+
+func TestMustParse(t *testing.T) {
+	tests := map[string]struct {
+		Valid   func() interface{}
+		Invalid func() interface{}
+	}{
+		"MustParseSource": {
+			func() interface{} { return MustParseSource("./a") },
+			func() interface{} { return MustParseSource("") },
+		},
+		"MustParseFinalSource": {
+			func() interface{} { return MustParseFinalSource("hashicorp/subnets/cidr@1.0.0") },
+			func() interface{} { return MustParseFinalSource("hashicorp/subnets/cidr") },
+		},
+		"MustParseLocalSource": {
+			func() interface{} { return MustParseLocalSource("./a") },
+			func() interface{} { return MustParseLocalSource("/a") },
+		},
+		"MustParseRemoteSource": {
+			func() interface{} { return MustParseRemoteSource("https://example.com/foo.tgz") },
+			func() interface{} { return MustParseRemoteSource("./a") },
+		},
+		"MustParseRemotePackage": {
+			func() interface{} { return MustParseRemotePackage("https://example.com/foo.tgz") },
+			func() interface{} { return MustParseRemotePackage("https://example.com/foo.tgz//bar") },
+		},
+		"MustParseRegistrySource": {
+			func() interface{} { return MustParseRegistrySource("hashicorp/subnets/cidr") },
+			func() interface{} { return MustParseRegistrySource("hashicorp/subnets/cidr@1.0.0") },
+		},
+		"MustParseRegistryPackage": {
+			func() interface{} { return MustParseRegistryPackage("hashicorp/subnets/cidr") },
+			func() interface{} { return MustParseRegistryPackage("hashicorp/subnets/cidr//a") },
+		},
+		"MustParseFinalRegistrySource": {
+			func() interface{} { return MustParseFinalRegistrySource("hashicorp/subnets/cidr@1.0.0//a") },
+			func() interface{} { return MustParseFinalRegistrySource("hashicorp/subnets/cidr") },
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := test.Valid(); got == nil {
+				t.Errorf("valid address returned nil")
+			}
+			defer func() {
+				if recover() == nil {
+					t.Errorf("invalid address did not panic")
+				}
+			}()
+			test.Invalid()
+		})
+	}
+}
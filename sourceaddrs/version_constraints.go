@@ -0,0 +1,51 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apparentlymart/go-versions/versions"
+)
+
+// ParseVersionConstraints parses the given string as a comma-separated set
+// of version constraints, such as ">= 1.0, < 2.0", using the same syntax
+// that Terraform uses for module registry version constraints.
+func ParseVersionConstraints(given string) (versions.Set, error) {
+	if strings.TrimSpace(given) == "" {
+		return versions.None, fmt.Errorf("version constraints must not be empty")
+	}
+	ret, err := versions.MeetingConstraintsStringRuby(given)
+	if err != nil {
+		return versions.None, fmt.Errorf("invalid version constraints %q: %w", given, err)
+	}
+	return ret, nil
+}
+
+// ParseSourceWithConstraints parses a source address using [ParseSource]
+// along with an optional version constraints string using
+// [ParseVersionConstraints], returning an error if constraints are given
+// for a source address type that doesn't support them.
+//
+// If the constraints string is empty then the returned set is
+// [versions.All], so that the result is suitable to use directly with
+// installers that expect a set of allowed versions for every source.
+func ParseSourceWithConstraints(source string, constraints string) (Source, versions.Set, error) {
+	ret, err := ParseSource(source)
+	if err != nil {
+		return nil, versions.None, err
+	}
+	if constraints == "" {
+		return ret, versions.All, nil
+	}
+	if !ret.SupportsVersionConstraints() {
+		return nil, versions.None, fmt.Errorf("source address %q does not support version constraints", source)
+	}
+	allowed, err := ParseVersionConstraints(constraints)
+	if err != nil {
+		return nil, versions.None, err
+	}
+	return ret, allowed, nil
+}
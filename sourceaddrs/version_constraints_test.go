@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourceaddrs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/apparentlymart/go-versions/versions"
+)
+
+func TestParseSourceWithConstraints(t *testing.T) {
+	tests := []struct {
+		source      string
+		constraints string
+		wantIn      []string
+		wantNotIn   []string
+		wantErr     string
+	}{
+		{
+			source:      "example.com/a/b/c",
+			constraints: ">= 1.0, < 2.0",
+			wantIn:      []string{"1.0.0", "1.9.9"},
+			wantNotIn:   []string{"0.9.0", "2.0.0"},
+		},
+		{
+			source:    "example.com/a/b/c",
+			wantIn:    []string{"0.0.1", "2.0.0"},
+			wantNotIn: nil,
+		},
+		{
+			source: "https://example.com/foo.tgz",
+			wantIn: []string{"1.0.0"},
+		},
+		{
+			source:      "https://example.com/foo.tgz",
+			constraints: ">= 1.0",
+			wantErr:     `source address "https://example.com/foo.tgz" does not support version constraints`,
+		},
+		{
+			source:      "./foo",
+			constraints: "1.0.0",
+			wantErr:     `source address "./foo" does not support version constraints`,
+		},
+		{
+			source:      "example.com/a/b/c",
+			constraints: "not a version",
+			wantErr:     `invalid version constraints "not a version": `,
+		},
+		{
+			source:      "example.com/a/b/c",
+			constraints: " ",
+			wantErr:     `version constraints must not be empty`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.source+" "+test.constraints, func(t *testing.T) {
+			_, allowed, err := ParseSourceWithConstraints(test.source, test.constraints)
+			if test.wantErr != "" {
+				if err == nil {
+					t.Fatalf("unexpected success\nwant error: %s", test.wantErr)
+				}
+				if got := err.Error(); !strings.HasPrefix(got, test.wantErr) {
+					t.Fatalf("wrong error\ngot:  %s\nwant: %s", got, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for _, v := range test.wantIn {
+				if !allowed.Has(versions.MustParseVersion(v)) {
+					t.Errorf("version %s should be allowed", v)
+				}
+			}
+			for _, v := range test.wantNotIn {
+				if allowed.Has(versions.MustParseVersion(v)) {
+					t.Errorf("version %s should not be allowed", v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// analysisFS is the filesystem that the builder passes to a
+// [DependencyFinder], which wraps [os.DirFS] so that it behaves the same way
+// on all platforms, matching what a bundle archive will contain.
+//
+// In particular, names are always case-exact, even on case-insensitive
+// filesystems such as the defaults on Windows and macOS, and backslashes are
+// never treated as path separators. A finder that works on one platform
+// therefore can't then fail on another.
+type analysisFS struct {
+	dir fs.FS
+
+	// names caches the names of the entries in each directory that
+	// checkCase has visited, keyed by slash-separated directory path.
+	mu    sync.Mutex
+	names map[string]map[string]struct{}
+}
+
+var _ fs.FS = (*analysisFS)(nil)
+
+// newAnalysisFS returns an [analysisFS] rooted at the given directory.
+func newAnalysisFS(dir string) *analysisFS {
+	return &analysisFS{
+		dir:   os.DirFS(dir),
+		names: make(map[string]map[string]struct{}),
+	}
+}
+
+// Open implements [fs.FS].
+func (fsys *analysisFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) || strings.Contains(name, `\`) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if !fsys.caseExact(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return fsys.dir.Open(name)
+}
+
+// caseExact returns false if any element of the given valid path doesn't
+// exactly match the name of an entry in its parent directory, which can
+// happen only on a case-insensitive filesystem.
+//
+// It returns true if it can't read a parent directory, so that the caller
+// will report the error from trying to open the path instead.
+func (fsys *analysisFS) caseExact(name string) bool {
+	if name == "." {
+		return true
+	}
+	dir := "."
+	for _, elem := range strings.Split(name, "/") {
+		names, err := fsys.dirNames(dir)
+		if err != nil {
+			return true
+		}
+		if _, ok := names[elem]; !ok {
+			return false
+		}
+		dir = path.Join(dir, elem)
+	}
+	return true
+}
+
+// dirNames returns the names of the entries in the given directory.
+func (fsys *analysisFS) dirNames(dir string) (map[string]struct{}, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if names, ok := fsys.names[dir]; ok {
+		return names, nil
+	}
+	entries, err := fs.ReadDir(fsys.dir, dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = struct{}{}
+	}
+	fsys.names[dir] = names
+	return names, nil
+}
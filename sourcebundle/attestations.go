@@ -0,0 +1,188 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// AttestationsDirName is the name of the directory at the root of a source
+// bundle that contains the attestations generated by the [PackageAttestor]
+// given in [WithPackageAttestor], each named after the hex-encoded SHA256
+// checksum of its content.
+const AttestationsDirName = "attestations"
+
+// PackageProvenance describes how the builder obtained a remote package, as
+// the subject of an attestation generated by a [PackageAttestor].
+type PackageProvenance struct {
+	Package sourceaddrs.RemotePackage
+
+	// Checksum is the checksum of the package content as it appears in
+	// the bundle. See [PackageStats.Checksum].
+	Checksum string
+
+	// FetchTime, GitCommitID, ResolvedRef and UpstreamChecksum are the
+	// corresponding fields of the [PackageMeta] reported by the fetcher,
+	// and so are zero if the fetcher didn't report them.
+	FetchTime        time.Time
+	GitCommitID      string
+	ResolvedRef      string
+	UpstreamChecksum string
+}
+
+// PackageAttestor is the signature of a function that generates an
+// attestation for a remote package, for use with [WithPackageAttestor].
+//
+// The attestation is an opaque sequence of bytes, such as a signed in-toto
+// statement or a cosign bundle, which the bundle stores verbatim. The
+// attestor is responsible for including whatever identifies the party
+// that fetched the package, typically by signing the attestation with
+// that party's key.
+//
+// If the attestor returns an error then the builder treats it as a failure
+// to fetch the package.
+type PackageAttestor func(ctx context.Context, provenance PackageProvenance) ([]byte, error)
+
+// PackageAttestationVerifier is the signature of a function that verifies
+// an attestation generated by a [PackageAttestor], for use with
+// [Bundle.VerifyPackageAttestations].
+//
+// provenance is reconstructed from the bundle manifest, so the verifier
+// must check that the attestation actually makes the claims it describes,
+// as well as checking the attestation's signature.
+type PackageAttestationVerifier func(provenance PackageProvenance, attestation []byte) error
+
+// WithPackageAttestor is a BuilderOption that makes the builder call the
+// given attestor for each remote package it fetches or loads from its
+// package cache, once it has calculated the package checksum. The builder
+// stores each attestation in the bundle and records it in the manifest,
+// where it's available through [Bundle.RemotePackageAttestation].
+func WithPackageAttestor(attestor PackageAttestor) BuilderOption {
+	return func(b *Builder) error {
+		if attestor == nil {
+			return fmt.Errorf("package attestor must not be nil")
+		}
+		b.packageAttestor = attestor
+		return nil
+	}
+}
+
+// packageProvenance returns the provenance of a package with the given
+// content checksum and metadata, which may be nil.
+func packageProvenance(pkgAddr sourceaddrs.RemotePackage, checksum string, meta *PackageMeta) PackageProvenance {
+	ret := PackageProvenance{
+		Package:  pkgAddr,
+		Checksum: checksum,
+	}
+	if meta != nil {
+		ret.FetchTime = meta.FetchTime()
+		ret.GitCommitID = meta.GitCommitID()
+		ret.ResolvedRef = meta.ResolvedRef()
+		ret.UpstreamChecksum = meta.UpstreamChecksum()
+	}
+	return ret
+}
+
+// attestPackage runs the builder's attestor, if any, for the given package
+// and stores the resulting attestation in the bundle's attestations
+// directory.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) attestPackage(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, checksum string) error {
+	delete(b.packageAttestations, pkgAddr)
+	if b.packageAttestor == nil {
+		return nil
+	}
+	provenance := packageProvenance(pkgAddr, checksum, b.remotePackageMeta[pkgAddr])
+	attestation, err := b.packageAttestor(ctx, provenance)
+	if err != nil {
+		return fmt.Errorf("failed to attest package: %w", err)
+	}
+
+	sum := sha256.Sum256(attestation)
+	digest := hex.EncodeToString(sum[:])
+	attestationsDir := filepath.Join(b.targetDir, AttestationsDirName)
+	if err := os.MkdirAll(attestationsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create attestations directory: %w", err)
+	}
+	// Identical attestations are possible only if the attestor ignores
+	// some of the provenance, in which case we'll just store one copy.
+	finalPath := filepath.Join(attestationsDir, digest)
+	if _, err := os.Lstat(finalPath); err != nil {
+		if err := os.WriteFile(finalPath, attestation, 0644); err != nil {
+			return fmt.Errorf("failed to write attestation: %w", err)
+		}
+	}
+	b.packageAttestations[pkgAddr] = digest
+	b.packageReport(pkgAddr).Attestation = digest
+	return nil
+}
+
+// RemotePackageAttestation returns the attestation that was generated for
+// the given package by the [PackageAttestor] given in [WithPackageAttestor],
+// after checking that it's unchanged since the bundle was built.
+//
+// If the bundle has no attestation for the package then the returned error
+// wraps [fs.ErrNotExist].
+func (b *Bundle) RemotePackageAttestation(pkgAddr sourceaddrs.RemotePackage) ([]byte, error) {
+	digest, ok := b.remotePackageAttestations[pkgAddr]
+	if !ok {
+		return nil, fmt.Errorf("no attestation for %s: %w", pkgAddr, fs.ErrNotExist)
+	}
+	attestation, err := os.ReadFile(filepath.Join(b.rootDir, AttestationsDirName, digest))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read attestation for %s: %w", pkgAddr, err)
+	}
+	if sum := sha256.Sum256(attestation); hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("attestation for %s has been modified", pkgAddr)
+	}
+	return attestation, nil
+}
+
+// RemotePackageProvenance returns the provenance of the given package as
+// recorded in the bundle manifest, which is what an attestation for the
+// package should claim. The second return value is false if the bundle
+// doesn't include the package.
+func (b *Bundle) RemotePackageProvenance(pkgAddr sourceaddrs.RemotePackage) (PackageProvenance, bool) {
+	localDir, ok := b.remotePackageDirs[pkgAddr]
+	if !ok {
+		return PackageProvenance{}, false
+	}
+	var checksum string
+	if stats := b.packageDirStats[localDir]; stats != nil {
+		checksum = stats.Checksum()
+	}
+	return packageProvenance(pkgAddr, checksum, b.remotePackageMeta[pkgAddr]), true
+}
+
+// VerifyPackageAttestations calls the given verifier for each remote package
+// in the bundle, in order of package address, stopping at the first error.
+//
+// Every package must have an attestation, so this returns an error wrapping
+// [fs.ErrNotExist] if any package has none. VerifyPackageAttestations only
+// checks the attestations against the manifest, so callers should also use
+// [Bundle.CheckIntegrity] to make sure the package content still matches
+// the checksums in the manifest.
+func (b *Bundle) VerifyPackageAttestations(verifier PackageAttestationVerifier) error {
+	for _, pkgAddr := range b.RemotePackages() {
+		attestation, err := b.RemotePackageAttestation(pkgAddr)
+		if err != nil {
+			return err
+		}
+		provenance, _ := b.RemotePackageProvenance(pkgAddr)
+		if err := verifier(provenance, attestation); err != nil {
+			return fmt.Errorf("invalid attestation for %s: %w", pkgAddr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/hashicorp/go-slug/sourceaddrs"
+	regaddr "github.com/hashicorp/terraform-registry-address"
+)
+
+// BuildOptions is the set of settings for [BuildForRoot].
+//
+// This package doesn't include any real implementations of [PackageFetcher],
+// [RegistryClient], or [DependencyFinder], so callers must always provide
+// at least a fetcher and a dependency finder.
+type BuildOptions struct {
+	// TargetDir is the directory to create the source bundle in, which
+	// must already exist and be empty. If this is empty then BuildForRoot
+	// will create a new temporary directory, which the caller is then
+	// responsible for deleting once it's finished with the bundle.
+	TargetDir string
+
+	// Fetcher is the package fetcher used to fetch all remote packages.
+	// This is required.
+	Fetcher PackageFetcher
+
+	// RegistryClient is the client used to resolve module registry
+	// addresses. This can be nil if neither the root source nor any of its
+	// dependencies are registry addresses, in which case any attempt to
+	// resolve a module registry address will fail with an error diagnostic.
+	RegistryClient RegistryClient
+
+	// DependencyFinder is used to analyze the root source artifact, and
+	// it decides which dependency finders will analyze each of the
+	// dependencies it discovers. This is required.
+	DependencyFinder DependencyFinder
+
+	// BuilderOptions are passed to [NewBuilder] when creating the builder,
+	// for any additional customizations such as [WithPackageCache].
+	BuilderOptions []BuilderOption
+
+	// Tracer, if set, receives events about the progress of the build in
+	// the same way as if it had been attached to the context passed to
+	// [Builder] methods.
+	Tracer *BuildTracer
+}
+
+// BuildForRoot is a convenience wrapper around [Builder] for the common case
+// of creating a source bundle containing a single root source artifact and
+// all of its transitive dependencies.
+//
+// The root source must be either a [sourceaddrs.RemoteSource] or a
+// [sourceaddrs.RegistrySourceFinal], since a source bundle cannot contain
+// local sources.
+//
+// If the returned diagnostics contains errors then the returned bundle is
+// nil. If BuildForRoot created its own temporary target directory then it
+// deletes that directory before returning errors.
+func BuildForRoot(ctx context.Context, rootSource sourceaddrs.FinalSource, opts BuildOptions) (*Bundle, Diagnostics) {
+	var diags Diagnostics
+
+	if opts.Fetcher == nil || opts.DependencyFinder == nil {
+		diags = append(diags, &internalDiagnostic{
+			severity: DiagError,
+			summary:  "Invalid source bundle build options",
+			detail:   "A package fetcher and a dependency finder are both required.",
+		})
+		return nil, diags
+	}
+	registryClient := opts.RegistryClient
+	if registryClient == nil {
+		registryClient = noRegistryClient{}
+	}
+	if opts.Tracer != nil {
+		ctx = opts.Tracer.OnContext(ctx)
+	}
+
+	targetDir := opts.TargetDir
+	if targetDir == "" {
+		var err error
+		targetDir, err = os.MkdirTemp("", "terraform-sources-")
+		if err != nil {
+			diags = append(diags, &internalDiagnostic{
+				severity: DiagError,
+				summary:  "Cannot create source bundle directory",
+				detail:   fmt.Sprintf("Failed to create a temporary directory for the source bundle: %s.", err),
+			})
+			return nil, diags
+		}
+		defer func() {
+			if diags.HasErrors() {
+				os.RemoveAll(targetDir)
+			}
+		}()
+	}
+
+	builder, err := NewBuilder(targetDir, opts.Fetcher, registryClient, opts.BuilderOptions...)
+	if err != nil {
+		diags = append(diags, &internalDiagnostic{
+			severity: DiagError,
+			summary:  "Cannot create source bundle builder",
+			detail:   fmt.Sprintf("Failed to prepare to build a source bundle: %s.", err),
+		})
+		return nil, diags
+	}
+
+	switch rootSource := rootSource.(type) {
+	case sourceaddrs.RemoteSource:
+		diags = append(diags, builder.AddRemoteSource(ctx, rootSource, opts.DependencyFinder)...)
+	case sourceaddrs.RegistrySourceFinal:
+		diags = append(diags, builder.AddFinalRegistrySource(ctx, rootSource, opts.DependencyFinder)...)
+	default:
+		diags = append(diags, &internalDiagnostic{
+			severity: DiagError,
+			summary:  "Unsupported root source address",
+			detail:   fmt.Sprintf("Cannot build a source bundle rooted at %s: the root must be a remote source or a module registry source.", rootSource),
+		})
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	bundle, err := builder.Close()
+	if err != nil {
+		diags = append(diags, &internalDiagnostic{
+			severity: DiagError,
+			summary:  "Cannot finalize source bundle",
+			detail:   fmt.Sprintf("Failed to finalize the source bundle: %s.", err),
+		})
+		return nil, diags
+	}
+	return bundle, diags
+}
+
+// noRegistryClient is a [RegistryClient] that always fails, used by
+// [BuildForRoot] when the caller doesn't provide a registry client.
+type noRegistryClient struct{}
+
+func (noRegistryClient) ModulePackageVersions(ctx context.Context, pkgAddr regaddr.ModulePackage) (ModulePackageVersionsResponse, error) {
+	return ModulePackageVersionsResponse{}, fmt.Errorf("no module registry client is configured")
+}
+
+func (noRegistryClient) ModulePackageSourceAddr(ctx context.Context, pkgAddr regaddr.ModulePackage, version versions.Version) (ModulePackageSourceAddrResponse, error) {
+	return ModulePackageSourceAddrResponse{}, fmt.Errorf("no module registry client is configured")
+}
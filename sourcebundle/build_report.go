@@ -0,0 +1,198 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"sort"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// BuildReport describes details of how a [Builder] constructed a source
+// bundle that are not recorded in the bundle itself, for traceability.
+type BuildReport struct {
+	// Packages describes each of the remote packages that the builder
+	// fetched or loaded from its package cache, sorted by package address.
+	Packages []PackageReport
+
+	// RegistryOverlaps describes each pair of module registry packages
+	// whose real source addresses overlap within the same remote package,
+	// in the order that the builder found them.
+	RegistryOverlaps []RegistryOverlap
+
+	// PackageVariants describes each set of remote packages whose addresses
+	// differ only in their query strings, sorted by their shared address.
+	PackageVariants []PackageVariants
+
+	// Dedup counts how often the builder reused the result of an earlier
+	// registry request or package download instead of repeating it.
+	Dedup DedupStats
+}
+
+// DedupStats counts the registry requests and package downloads that a
+// [Builder] made, and those it avoided by reusing an earlier result from the
+// same build, for measuring how effective that reuse is across builds.
+//
+// Each of the ...Reused counts corresponds to the calls to the matching
+// ...Already callback of [BuildTracer].
+type DedupStats struct {
+	// RegistryVersionsFetched and RegistryVersionsReused count the lookups
+	// of the available versions of a module registry package that queried
+	// the registry and that reused an earlier response, respectively.
+	RegistryVersionsFetched int
+	RegistryVersionsReused  int
+
+	// RegistrySourcesFetched and RegistrySourcesReused count the lookups of
+	// the real source address of a module registry package version that
+	// queried the registry and that reused an earlier response,
+	// respectively.
+	RegistrySourcesFetched int
+	RegistrySourcesReused  int
+
+	// PackagesFetched and PackagesReused count the requests for a remote
+	// package that obtained it, either from the fetcher or from the
+	// [PackageCache], and that reused a package already in the bundle,
+	// respectively. [PackageReport.FromCache] describes which packages came
+	// from the cache.
+	PackagesFetched int
+	PackagesReused  int
+}
+
+// RegistryHitRate returns the fraction of all module registry lookups,
+// of either kind, that reused an earlier response, or zero if there were
+// no lookups.
+func (s DedupStats) RegistryHitRate() float64 {
+	reused := s.RegistryVersionsReused + s.RegistrySourcesReused
+	return hitRate(reused, reused+s.RegistryVersionsFetched+s.RegistrySourcesFetched)
+}
+
+// PackageHitRate returns the fraction of all remote package requests that
+// reused a package already in the bundle, or zero if there were no
+// requests.
+func (s DedupStats) PackageHitRate() float64 {
+	return hitRate(s.PackagesReused, s.PackagesReused+s.PackagesFetched)
+}
+
+func hitRate(hits, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+// PackageReport describes how a [Builder] obtained a particular remote
+// package.
+type PackageReport struct {
+	Package sourceaddrs.RemotePackage
+
+	// FromCache is true if the package content was loaded from the
+	// builder's [PackageCache] instead of being fetched. The other fields
+	// describe only packages that were fetched, since the cache doesn't
+	// retain the details of how its content was originally prepared.
+	FromCache bool
+
+	// PossiblyStale is true if the package content was loaded from the
+	// builder's [PackageCache] without first checking that it was still
+	// current, because of [WithStaleWhileRevalidate]. The builder resets
+	// this to false if its background revalidation confirms that the
+	// content was current before the report is generated.
+	PossiblyStale bool
+
+	// Checksum and Size are the checksum of the package content and the
+	// total size in bytes of its files, after the builder prepared it for
+	// inclusion in the bundle. See [PackageStats].
+	Checksum string
+	Size     int64
+
+	// RootSubdir is the sub-directory that the fetcher reported as the
+	// real root of the package, if any. See
+	// [FetchSourcePackageResponse.RootSubdir].
+	RootSubdir string
+
+	// StrippedVCSMetadata lists the slash-separated sub-paths of any
+	// version control metadata directories that the builder removed from
+	// the fetched package. See [WithVCSMetadata].
+	StrippedVCSMetadata []string
+
+	// KeptPaths lists the slash-separated sub-paths that the package's
+	// ignore rules or the builder's drop patterns would have removed, but
+	// that the builder retained because they match the patterns given in
+	// [WithAlwaysKeep].
+	KeptPaths []string
+
+	// DroppedPaths lists the slash-separated sub-paths that the builder
+	// removed because they match the patterns given in [WithAlwaysDrop].
+	DroppedPaths []string
+
+	// Licenses lists the findings of the [LicenseScanner] given in
+	// [WithLicenseScanner], sorted by path.
+	Licenses []LicenseFinding
+
+	// Attestation is the hex-encoded SHA256 checksum of the attestation
+	// that the [PackageAttestor] given in [WithPackageAttestor] generated
+	// for the package, or an empty string if there is none.
+	Attestation string
+}
+
+// TotalSize returns the total size in bytes of the files in all of the
+// packages in the report. Packages whose content was identical are counted
+// only once, because they share a single directory in the bundle.
+func (r *BuildReport) TotalSize() int64 {
+	var ret int64
+	seen := make(map[string]struct{})
+	for _, pkg := range r.Packages {
+		if _, ok := seen[pkg.Checksum]; ok {
+			continue
+		}
+		seen[pkg.Checksum] = struct{}{}
+		ret += pkg.Size
+	}
+	return ret
+}
+
+// Report returns a snapshot of the build report for everything the builder
+// has done so far. It's valid to call Report both before and after
+// [Builder.Close].
+func (b *Builder) Report() *BuildReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ret := &BuildReport{
+		Packages: make([]PackageReport, 0, len(b.packageReports)),
+	}
+	for _, report := range b.packageReports {
+		ret.Packages = append(ret.Packages, report.copy())
+	}
+	sort.Slice(ret.Packages, func(i, j int) bool {
+		return ret.Packages[i].Package.String() < ret.Packages[j].Package.String()
+	})
+	ret.RegistryOverlaps = append([]RegistryOverlap(nil), b.registryOverlaps...)
+	ret.PackageVariants = b.packageVariantsReport()
+	ret.Dedup = b.dedupStats
+	return ret
+}
+
+// packageReport returns the report object for the given package, creating
+// it first if necessary.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) packageReport(pkgAddr sourceaddrs.RemotePackage) *PackageReport {
+	report, ok := b.packageReports[pkgAddr]
+	if !ok {
+		report = &PackageReport{Package: pkgAddr}
+		b.packageReports[pkgAddr] = report
+	}
+	return report
+}
+
+// copy returns a copy of the report that shares no mutable data with the
+// receiver.
+func (r *PackageReport) copy() PackageReport {
+	ret := *r
+	ret.StrippedVCSMetadata = append([]string(nil), r.StrippedVCSMetadata...)
+	ret.KeptPaths = append([]string(nil), r.KeptPaths...)
+	ret.DroppedPaths = append([]string(nil), r.DroppedPaths...)
+	ret.Licenses = append([]LicenseFinding(nil), r.Licenses...)
+	return ret
+}
@@ -0,0 +1,84 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+func TestBuildForRoot(t *testing.T) {
+	// We use testingBuilder just to get its fake fetcher and registry client.
+	fakes := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/foo.tgz": "testdata/pkgs/hello",
+		},
+		map[string]map[string]string{
+			"example.com/foo/bar/baz": {
+				"1.0.0": "https://example.com/foo.tgz",
+			},
+		},
+		nil,
+	)
+
+	tracer := testBuildTracer{}
+	targetDir := t.TempDir()
+	rootSource, err := sourceaddrs.ParseFinalSource("example.com/foo/bar/baz@1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, diags := BuildForRoot(tracer.OnContext(context.Background()), rootSource, BuildOptions{
+		TargetDir:        targetDir,
+		Fetcher:          fakes.fetcher,
+		RegistryClient:   fakes.registryClient,
+		DependencyFinder: noDependencyFinder,
+	})
+	if len(diags) > 0 {
+		for _, diag := range diags {
+			t.Errorf("unexpected diagnostic\nSummary: %s\nDetail:  %s", diag.Description().Summary, diag.Description().Detail)
+		}
+		t.FailNow()
+	}
+
+	wantLog := []string{
+		"start requesting versions for example.com/foo/bar/baz",
+		"success requesting versions for example.com/foo/bar/baz",
+		"start requesting source address for example.com/foo/bar/baz 1.0.0",
+		"source address for example.com/foo/bar/baz 1.0.0 is https://example.com/foo.tgz",
+		"start downloading https://example.com/foo.tgz",
+		"downloaded https://example.com/foo.tgz",
+	}
+	if diff := cmp.Diff(wantLog, tracer.log); diff != "" {
+		t.Errorf("wrong trace events\n%s", diff)
+	}
+
+	localDir, err := bundle.LocalPathForSource(rootSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(localDir, "hello")); err != nil {
+		t.Errorf("problem with output file: %s", err)
+	}
+}
+
+func TestBuildForRoot_localSource(t *testing.T) {
+	_, diags := BuildForRoot(context.Background(), sourceaddrs.MustParseSource("./foo").(sourceaddrs.LocalSource), BuildOptions{
+		TargetDir:        t.TempDir(),
+		Fetcher:          packageFetcherFunc(nil),
+		DependencyFinder: noDependencyFinder,
+	})
+	if !diags.HasErrors() {
+		t.Fatal("unexpected success; want error")
+	}
+	if got, want := diags[0].Description().Summary, "Unsupported root source address"; got != want {
+		t.Errorf("wrong error summary\ngot:  %s\nwant: %s", got, want)
+	}
+}
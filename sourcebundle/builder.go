@@ -5,15 +5,17 @@ package sourcebundle
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/apparentlymart/go-versions/versions"
 	regaddr "github.com/hashicorp/terraform-registry-address"
@@ -39,8 +41,10 @@ type Builder struct {
 	registryClient RegistryClient
 
 	// pendingRemote is an unordered set of remote artifacts that we've
-	// discovered we need to analyze but have not yet done so.
-	pendingRemote []remoteArtifact
+	// discovered we need to analyze but have not yet done so. Each one
+	// carries its node in the work graph, which records the chain of
+	// artifacts that led to it.
+	pendingRemote []pendingRemoteArtifact
 
 	// analyzed is a set of remote artifacts that we've already analyzed and
 	// thus already found the dependencies of.
@@ -65,14 +69,37 @@ type Builder struct {
 	// the fetcher returned no metadata.
 	remotePackageMeta map[sourceaddrs.RemotePackage]*PackageMeta
 
+	// packageDirStats tracks the checksum, size, and file count of each
+	// of the local package directories we've created so far, keyed by the
+	// local directory name.
+	packageDirStats map[string]*PackageStats
+
 	// pendingRegistry is an unordered set of registry artifacts that need to
 	// be translated into remote artifacts before further processing.
-	pendingRegistry []registryArtifact
+	pendingRegistry []pendingRegistryArtifact
 
 	// resolvedRegistry tracks the underlying remote source address for each
 	// selected version of each module registry package.
 	resolvedRegistry map[registryPackageVersion]sourceaddrs.RemoteSource
 
+	// registrySourcesToConfirm records the package versions in
+	// resolvedRegistry whose real source addresses we must ask the registry
+	// for again the next time we select them, because we've since refreshed
+	// the list of available versions. See [InconsistentRegistryError].
+	registrySourcesToConfirm map[registryPackageVersion]struct{}
+
+	// registryOverlaps records the pairs of registry packages whose real
+	// source addresses overlap, in the order they were found.
+	registryOverlaps []RegistryOverlap
+
+	// dedupStats counts the registry requests and package downloads that
+	// the builder made or avoided. See [DedupStats].
+	dedupStats DedupStats
+
+	// packageVariants records the remote packages in the bundle grouped by
+	// their addresses without query strings. See [PackageVariants].
+	packageVariants map[string][]sourceaddrs.RemotePackage
+
 	// packageVersionDeprecations tracks potential deprecations for
 	// each package version. If a package version is not deprecated, its mapped value will be nil.
 	// This data, including both package versions and their potential deprecations, is gathered from the registry client and cached. It is included in the bundle,
@@ -83,12 +110,301 @@ type Builder struct {
 	// look up the available versions for a particular module package. Although
 	// these could potentially change while we're running, we assume that the
 	// lifetime of a particular Builder is short enough for that not to
-	// matter.
-	registryPackageVersions map[regaddr.ModulePackage][]ModulePackageInfo
+	// matter unless the caller says otherwise using [WithRegistryCacheMaxAge]
+	// or [Builder.InvalidateRegistryCache]. registryPackageVersionsAt
+	// records when each response was received.
+	registryPackageVersions   map[regaddr.ModulePackage][]ModulePackageInfo
+	registryPackageVersionsAt map[regaddr.ModulePackage]time.Time
+	registryCacheMaxAge       time.Duration
+
+	// versionStrategy, prereleasePolicy, preferBundledVersions, and
+	// previousBundles control how the builder selects a version of each
+	// registry package. See [WithVersionSelection],
+	// [WithPrereleasePolicy], and [WithPreferBundledVersions].
+	versionStrategy       VersionSelectionStrategy
+	prereleasePolicy      PrereleasePolicy
+	preferBundledVersions bool
+	previousBundles       []*Bundle
+
+	// registryPackageWarnings records any warnings that the registry
+	// returned along with the versions of each registry package.
+	registryPackageWarnings map[regaddr.ModulePackage][]string
+
+	// packageCache, if set, is consulted before fetching each remote
+	// package and is populated with each newly-fetched package.
+	packageCache PackageCache
+
+	// packageValidator, if set, produces the validator part of each
+	// cache key used with packageCache.
+	packageValidator PackageValidator
+
+	// staleWhileRevalidate enables the use of possibly-stale snapshots
+	// from packageCache, as described in [WithStaleWhileRevalidate].
+	// revalidating records the packages that currently have a background
+	// revalidation in progress, and revalidations tracks all of the
+	// background revalidations this builder has started.
+	staleWhileRevalidate bool
+	revalidating         map[sourceaddrs.RemotePackage]struct{}
+	revalidations        sync.WaitGroup
+
+	// dryRun records that [WithDryRun] was used, in which case dryRunDir
+	// is a scratch directory outside of the target directory where the
+	// builder places package content loaded from the package cache.
+	// dryRunPackages records each remote package the builder would've
+	// fetched in the order it found them.
+	dryRun         bool
+	dryRunDir      string
+	dryRunPackages []DryRunPackage
+
+	// ignoredPaths records, for each remote package fetched by this
+	// builder, the slash-separated sub-paths that were removed by the
+	// package's ignore rules, mapped to the rule that removed each one.
+	// Packages loaded from a package cache have no entry, because their
+	// ignore rules were applied before they were stored.
+	ignoredPaths map[sourceaddrs.RemotePackage]map[string]string
+
+	// packageReports tracks the details about each remote package that
+	// the builder exposes through [Builder.Report].
+	packageReports map[sourceaddrs.RemotePackage]*PackageReport
+
+	// keepVCSMetadata disables the removal of version control metadata
+	// from fetched packages.
+	keepVCSMetadata bool
+
+	// keepRules and dropRules are the rules given in [WithAlwaysKeep] and
+	// [WithAlwaysDrop], or nil if those options weren't used. keepPatterns
+	// and dropPatterns are the patterns they were parsed from, which the
+	// builder records in the manifest so that [Bundle.Repair] can prepare
+	// each package in the same way.
+	keepRules, dropRules       *ignorefiles.Ruleset
+	keepPatterns, dropPatterns []string
+
+	// licenseScanner, if set, is called for each remote package after it
+	// has been prepared. packageLicenses records its findings for each
+	// package. See [WithLicenseScanner].
+	licenseScanner  LicenseScanner
+	packageLicenses map[sourceaddrs.RemotePackage][]LicenseFinding
+
+	// minFreeSpace is the minimum number of bytes that must remain
+	// available in the target directory's filesystem, or zero if there is
+	// no minimum. See [WithMinFreeSpace].
+	minFreeSpace int64
+
+	// retainArchives is set by [WithRetainedArchives], in which case
+	// packageOriginals records the checksum of the original archive
+	// retained for each package that has one.
+	retainArchives   bool
+	packageOriginals map[sourceaddrs.RemotePackage]string
+
+	// packageAttestor, if set, is called for each remote package after its
+	// checksum is known. packageAttestations records the checksum of the
+	// attestation it generated for each package. See [WithPackageAttestor].
+	packageAttestor     PackageAttestor
+	packageAttestations map[sourceaddrs.RemotePackage]string
+
+	// sealOnClose makes Close seal the bundle. See [WithSealOnClose].
+	sealOnClose bool
+
+	// packageHasher calculates the local directory name for each remote
+	// package. See [WithPackageHasher].
+	packageHasher PackageHasher
+
+	// rootFiles is the content of the files that Close will write into the
+	// top-level bundle directory. See [Builder.AddRootFile].
+	rootFiles map[string][]byte
+
+	// externalRemote and externalRegistry record the packages marked as
+	// external using [Builder.AddExternalSource], mapped to the reason
+	// given for each.
+	externalRemote   map[sourceaddrs.RemotePackage]string
+	externalRegistry map[regaddr.ModulePackage]string
+
+	// clock is the clock used for any time-dependent behavior of the
+	// builder and of the bundle it produces. See [WithClock].
+	clock Clock
+
+	// lockDir makes NewBuilder acquire lock, an exclusive lock on the
+	// target directory, using lockOpts. See [WithDirLock].
+	lockDir  bool
+	lockOpts []LockOption
+	lock     *DirLock
+
+	// bundleMeta is the metadata to record for the bundle as a whole.
+	bundleMeta bundleMeta
+
+	// analysisWorkers is the maximum number of dependency finders that can
+	// run concurrently with package downloads, or zero to run each
+	// dependency finder inline as soon as its package is downloaded.
+	analysisWorkers int
+
+	// maxDepth is the maximum length of a chain of dependencies, or zero
+	// if there is no limit.
+	maxDepth int
+
+	// sparseFetching enables the use of SparsePackageFetcher. If enabled,
+	// packageSubPaths records the sub-paths included for each package that
+	// was fetched sparsely, and supersededDirs records the local directories
+	// of sparse packages that have since been fetched again with more
+	// sub-paths, which must be removed once no analysis is using them.
+	sparseFetching  bool
+	packageSubPaths map[sourceaddrs.RemotePackage][]string
+	supersededDirs  []string
 
 	mu sync.Mutex
 }
 
+// BuilderOption is a functional option for customizing the behavior of a
+// [Builder] created with [NewBuilder].
+type BuilderOption func(*Builder) error
+
+// WithPackageCache is a BuilderOption that makes the builder consult the
+// given cache before fetching each remote package, and store each package it
+// fetches into the cache. The same cache can be shared between many builders,
+// but builders use each other's snapshots only if they prepare packages in
+// the same way. See [PackageCacheKey].
+//
+// If validator is nil then cached snapshots are keyed only by package
+// address, and so a cached snapshot will be used even if the upstream
+// content has changed since it was stored.
+func WithPackageCache(cache PackageCache, validator PackageValidator) BuilderOption {
+	return func(b *Builder) error {
+		if cache == nil {
+			return fmt.Errorf("package cache must not be nil")
+		}
+		b.packageCache = cache
+		b.packageValidator = validator
+		return nil
+	}
+}
+
+// WithConcurrentAnalysis is a BuilderOption that allows the builder to run
+// up to the given number of [DependencyFinder] analyses concurrently with
+// each other and with the download of other packages, rather than analyzing
+// each source artifact immediately after downloading its package.
+//
+// Dependency finders must be safe to call concurrently when this option is
+// used. The diagnostics returned from each [Builder] method are still in
+// a deterministic order regardless of the order in which analyses complete.
+func WithConcurrentAnalysis(workers int) BuilderOption {
+	return func(b *Builder) error {
+		if workers < 1 {
+			return fmt.Errorf("concurrent analysis requires at least one worker")
+		}
+		b.analysisWorkers = workers
+		return nil
+	}
+}
+
+// WithMaxDependencyDepth is a BuilderOption that limits the length of the
+// chain of dependencies between a source passed directly to one of the
+// builder's Add methods and any of its indirect dependencies. A source
+// passed directly to the builder has depth one, its dependencies have
+// depth two, and so on.
+//
+// The builder returns an error diagnostic describing the whole chain for
+// any dependency that exceeds the limit, which can help to diagnose
+// unexpectedly-deep or self-perpetuating dependency graphs. By default
+// there is no limit.
+func WithMaxDependencyDepth(depth int) BuilderOption {
+	return func(b *Builder) error {
+		if depth < 1 {
+			return fmt.Errorf("maximum dependency depth must be at least one")
+		}
+		b.maxDepth = depth
+		return nil
+	}
+}
+
+// WithVCSMetadata is a BuilderOption that makes the builder keep any
+// version control metadata, such as .hg and .svn directories, that a
+// fetcher leaves in a fetched package. By default the builder removes
+// such metadata, because it wastes space and could expose the history of
+// the package.
+//
+// Git metadata is also excluded by the default ignore rules, and so this
+// option retains .git only for packages whose .terraformignore file
+// overrides that rule.
+func WithVCSMetadata() BuilderOption {
+	return func(b *Builder) error {
+		b.keepVCSMetadata = true
+		return nil
+	}
+}
+
+// WithAlwaysKeep is a BuilderOption that makes the builder retain any
+// files and directories matching the given patterns in every fetched
+// package, even if the package's .terraformignore file or the patterns
+// given in [WithAlwaysDrop] would otherwise remove them. This is useful for
+// retaining files such as README and LICENSE files regardless of how each
+// package author has chosen to configure their ignore rules.
+//
+// The patterns use the same syntax as lines in a .terraformignore file.
+// Calling WithAlwaysKeep more than once replaces the patterns from any
+// earlier call.
+func WithAlwaysKeep(patterns ...string) BuilderOption {
+	return func(b *Builder) error {
+		rules, err := ignorefiles.ParsePatterns(patterns)
+		if err != nil {
+			return fmt.Errorf("invalid keep patterns: %w", err)
+		}
+		b.keepRules = rules
+		b.keepPatterns = append([]string(nil), patterns...)
+		return nil
+	}
+}
+
+// WithAlwaysDrop is a BuilderOption that makes the builder remove any
+// files and directories matching the given patterns from every fetched
+// package, in addition to those removed by the package's .terraformignore
+// file. Paths matching the patterns given in [WithAlwaysKeep] are retained
+// regardless.
+//
+// The patterns use the same syntax as lines in a .terraformignore file.
+// Calling WithAlwaysDrop more than once replaces the patterns from any
+// earlier call.
+func WithAlwaysDrop(patterns ...string) BuilderOption {
+	return func(b *Builder) error {
+		rules, err := ignorefiles.ParsePatterns(patterns)
+		if err != nil {
+			return fmt.Errorf("invalid drop patterns: %w", err)
+		}
+		b.dropRules = rules
+		b.dropPatterns = append([]string(nil), patterns...)
+		return nil
+	}
+}
+
+// WithClock is a BuilderOption that makes the builder use the given clock
+// for all of its time-dependent behavior, instead of [SystemClock]. The
+// builder also passes the clock on to the [Bundle] returned by
+// [Builder.Close], for use by methods such as [Bundle.WatchIntegrity].
+//
+// This is primarily intended for tests that need deterministic results.
+func WithClock(clock Clock) BuilderOption {
+	return func(b *Builder) error {
+		if clock == nil {
+			return fmt.Errorf("clock must not be nil")
+		}
+		b.clock = clock
+		return nil
+	}
+}
+
+// WithDryRun is a BuilderOption that makes the builder resolve registry
+// addresses and discover dependencies without downloading any packages or
+// writing anything into the target directory. Use [Builder.DryRunPlan]
+// instead of [Builder.Close] to find out what a real build would download.
+//
+// Dependency discovery is possible in dry-run mode only for packages that
+// are available from a package cache set with [WithPackageCache], and so
+// the plan for any other packages doesn't include their dependencies.
+func WithDryRun() BuilderOption {
+	return func(b *Builder) error {
+		b.dryRun = true
+		return nil
+	}
+}
+
 // NewBuilder creates a new builder that will construct a source bundle in the
 // given target directory, which must already exist and be empty before any
 // work begins.
@@ -98,24 +414,79 @@ type Builder struct {
 // processes running on the system. The target directory is not a valid source
 // bundle until a call to [Builder.Close] returns successfully; the directory
 // may be apepar in an inconsistent state while the builder is working.
-func NewBuilder(targetDir string, fetcher PackageFetcher, registryClient RegistryClient) (*Builder, error) {
+// Use [WithDirLock] to coordinate with other processes that might use the
+// same directory.
+func NewBuilder(targetDir string, fetcher PackageFetcher, registryClient RegistryClient, opts ...BuilderOption) (*Builder, error) {
 	// We'll lock in our absolute path here just in case someone changes the
 	// process working directory out from under us for some reason.
 	absDir, err := filepath.Abs(targetDir)
 	if err != nil {
 		return nil, fmt.Errorf("invalid target directory: %w", err)
 	}
-	return &Builder{
+	b := &Builder{
+		clock:                      SystemClock,
 		targetDir:                  absDir,
 		fetcher:                    fetcher,
 		registryClient:             registryClient,
 		analyzed:                   make(map[remoteArtifact]struct{}),
 		remotePackageDirs:          make(map[sourceaddrs.RemotePackage]string),
 		remotePackageMeta:          make(map[sourceaddrs.RemotePackage]*PackageMeta),
+		ignoredPaths:               make(map[sourceaddrs.RemotePackage]map[string]string),
+		packageReports:             make(map[sourceaddrs.RemotePackage]*PackageReport),
+		revalidating:               make(map[sourceaddrs.RemotePackage]struct{}),
+		packageLicenses:            make(map[sourceaddrs.RemotePackage][]LicenseFinding),
+		packageOriginals:           make(map[sourceaddrs.RemotePackage]string),
+		packageAttestations:        make(map[sourceaddrs.RemotePackage]string),
+		packageSubPaths:            make(map[sourceaddrs.RemotePackage][]string),
+		packageDirStats:            make(map[string]*PackageStats),
 		resolvedRegistry:           make(map[registryPackageVersion]sourceaddrs.RemoteSource),
+		registrySourcesToConfirm:   make(map[registryPackageVersion]struct{}),
+		packageVariants:            make(map[string][]sourceaddrs.RemotePackage),
 		packageVersionDeprecations: make(map[registryPackageVersion]*RegistryVersionDeprecation),
 		registryPackageVersions:    make(map[regaddr.ModulePackage][]ModulePackageInfo),
-	}, nil
+		registryPackageVersionsAt:  make(map[regaddr.ModulePackage]time.Time),
+		registryPackageWarnings:    make(map[regaddr.ModulePackage][]string),
+		rootFiles:                  make(map[string][]byte),
+		externalRemote:             make(map[sourceaddrs.RemotePackage]string),
+		externalRegistry:           make(map[regaddr.ModulePackage]string),
+		packageHasher:              DefaultPackageHasher,
+	}
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, fmt.Errorf("option failed: %w", err)
+		}
+	}
+	if b.lockDir {
+		lockOpts := append([]LockOption{WithLockClock(b.clock)}, b.lockOpts...)
+		lock, err := LockDir(context.Background(), absDir, ExclusiveLock, lockOpts...)
+		if err != nil {
+			return nil, err
+		}
+		b.lock = lock
+	}
+	if err := b.checkFreeSpace(); err != nil {
+		b.unlock()
+		return nil, err
+	}
+	if b.dryRun {
+		// We create the scratch directory only once everything else has
+		// succeeded, so that we don't need to clean it up on failure.
+		dir, err := os.MkdirTemp("", "terraform-sources-dryrun-")
+		if err != nil {
+			b.unlock()
+			return nil, fmt.Errorf("failed to create dry-run scratch directory: %w", err)
+		}
+		b.dryRunDir = dir
+	}
+	return b, nil
+}
+
+// unlock releases the builder's lock on the target directory, if it has one.
+func (b *Builder) unlock() {
+	if b.lock != nil {
+		b.lock.Unlock()
+		b.lock = nil
+	}
 }
 
 // AddRemoteSource incorporates the package containing the given remote source
@@ -144,7 +515,10 @@ func (b *Builder) AddRemoteSource(ctx context.Context, addr sourceaddrs.RemoteSo
 		b.mu.Unlock()
 		return nil
 	}
-	b.pendingRemote = append(b.pendingRemote, af)
+	b.pendingRemote = append(b.pendingRemote, pendingRemoteArtifact{
+		artifact: af,
+		node:     newWorkNode(addr, nil),
+	})
 	b.mu.Unlock()
 
 	return b.resolvePending(ctx)
@@ -169,7 +543,10 @@ func (b *Builder) AddRegistrySource(ctx context.Context, addr sourceaddrs.Regist
 	}
 
 	b.mu.Lock()
-	b.pendingRegistry = append(b.pendingRegistry, registryArtifact{addr, allowedVersions, depFinder})
+	b.pendingRegistry = append(b.pendingRegistry, pendingRegistryArtifact{
+		artifact: registryArtifact{addr, allowedVersions, depFinder},
+		node:     newWorkNode(addr, nil),
+	})
 	b.mu.Unlock()
 
 	return b.resolvePending(ctx)
@@ -191,6 +568,123 @@ func (b *Builder) AddFinalRegistrySource(ctx context.Context, addr sourceaddrs.R
 	return b.AddRegistrySource(ctx, addr.Unversioned(), allowedVersions, depFinder)
 }
 
+// AddRegistryPackageAllVersions is a variant of [Builder.AddRegistrySource]
+// which incorporates every available version of the given registry package
+// that is in allowedVersions, rather than only the latest, and then analyzes
+// each of them for dependencies using the given dependency finder. This is
+// intended for building bundles that serve as an offline mirror of a
+// registry package.
+//
+// The manifest records the source address of every selected version, and
+// versions whose packages have identical content share a single package
+// directory in the bundle.
+//
+// If the returned diagnostics contains errors then the bundle is left in an
+// inconsistent state and must not be used for any other calls.
+func (b *Builder) AddRegistryPackageAllVersions(ctx context.Context, pkgAddr regaddr.ModulePackage, allowedVersions versions.Set, depFinder DependencyFinder) Diagnostics {
+	if b.targetDir == "" {
+		// The builder has been closed, so cannot be modified further.
+		// This is always a bug in the caller, which should discard a builder
+		// as soon as it's been closed.
+		panic("AddRegistryPackageAllVersions on closed sourcebundle.Builder")
+	}
+
+	addr, err := sourceaddrs.ParseRegistrySource(pkgAddr.String())
+	if err != nil {
+		// Should not get here because a valid package address is always
+		// also a valid source address.
+		panic(fmt.Sprintf("registry package %s has invalid source address: %s", pkgAddr, err))
+	}
+
+	b.mu.Lock()
+	_, available, err := b.registryPackageVersionList(ctx, pkgAddr)
+	var selected versions.List
+	if err == nil {
+		selected = available.Filter(allowedVersions)
+		if len(selected) == 0 {
+			err = fmt.Errorf("no available version of %s matches the specified version constraint", pkgAddr)
+		}
+	}
+	if err != nil {
+		b.mu.Unlock()
+		return Diagnostics{
+			&internalDiagnostic{
+				severity: DiagError,
+				summary:  "Cannot resolve module registry package",
+				detail:   fmt.Sprintf("Error resolving module registry source %s: %s.", addr, err),
+			},
+		}
+	}
+	selected.Sort()
+
+	// The pending queue is consumed in LIFO order, so we add the newest
+	// version first in order to process the versions in ascending order.
+	for i := len(selected) - 1; i >= 0; i-- {
+		b.pendingRegistry = append(b.pendingRegistry, pendingRegistryArtifact{
+			artifact: registryArtifact{addr, versions.Only(selected[i]), depFinder},
+			node:     newWorkNode(addr, nil),
+		})
+	}
+	b.mu.Unlock()
+
+	return b.resolvePending(ctx)
+}
+
+// AddPinnedSource incorporates the source described by the given pinned
+// source address, such as from a lock file, into the bundle, and then
+// analyzes the new artifact for dependencies using the given dependency
+// finder.
+//
+// A pinned registry source is handled as for [Builder.AddFinalRegistrySource].
+// A pinned remote source is handled as for [Builder.AddRemoteSource], but if
+// the pinned source has a commit digest then the package fetcher must also
+// report a matching Git commit ID for the package using
+// [PackageMeta.WithGitMetadata], or AddPinnedSource returns an error.
+//
+// If the returned diagnostics contains errors then the bundle is left in an
+// inconsistent state and must not be used for any other calls.
+func (b *Builder) AddPinnedSource(ctx context.Context, addr sourceaddrs.PinnedSource, depFinder DependencyFinder) Diagnostics {
+	if regAddr, ok := addr.RegistrySource(); ok {
+		return b.AddFinalRegistrySource(ctx, regAddr, depFinder)
+	}
+	remoteAddr, ok := addr.RemoteSource()
+	if !ok {
+		panic("AddPinnedSource with invalid sourceaddrs.PinnedSource")
+	}
+
+	diags := b.AddRemoteSource(ctx, remoteAddr, depFinder)
+	if diags.HasErrors() || addr.Digest() == "" {
+		return diags
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pkgAddr := remoteAddr.Package()
+	if _, fetched := b.remotePackageDirs[pkgAddr]; !fetched {
+		// In dry-run mode we might not have fetched the package at all,
+		// in which case there's nothing to verify.
+		return diags
+	}
+	var gotCommit string
+	if meta := b.remotePackageMeta[pkgAddr]; meta != nil {
+		gotCommit = meta.GitCommitID()
+	}
+	if gotCommit != addr.Digest() {
+		b.targetDir = "" // the bundle is now inconsistent with the caller's pin
+		b.unlock()
+		detail := fmt.Sprintf("The package %s is pinned to commit %s, but the fetched package is at commit %s.", pkgAddr, addr.Digest(), gotCommit)
+		if gotCommit == "" {
+			detail = fmt.Sprintf("The package %s is pinned to commit %s, but the package fetcher did not report which commit it fetched.", pkgAddr, addr.Digest())
+		}
+		diags = append(diags, &internalDiagnostic{
+			severity: DiagError,
+			summary:  "Source package does not match pinned commit",
+			detail:   detail,
+		})
+	}
+	return diags
+}
+
 // Close ensures that the target directory is in a valid and consistent state
 // to be used as a source bundle and then returns an object providing the
 // read-only API for that bundle.
@@ -203,14 +697,44 @@ func (b *Builder) Close() (*Bundle, error) {
 		b.mu.Unlock()
 		panic("Close on already-closed sourcebundle.Builder")
 	}
+	if b.dryRunDir != "" {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("a dry-run builder cannot produce a source bundle; use DryRunPlan instead")
+	}
 	baseDir := b.targetDir
 	b.targetDir = "" // makes the Add... methods panic when called, to avoid mutating the finalized bundle
 	b.mu.Unlock()
 
+	// Background revalidations work in temporary directories inside the
+	// bundle directory, so they must finish before we finalize it.
+	b.revalidations.Wait()
+
+	ret, err := b.finish(baseDir)
+	if b.lock != nil {
+		if err == nil {
+			err = b.lock.Downgrade()
+		}
+		if err != nil {
+			b.unlock()
+			return nil, err
+		}
+		ret.lock = b.lock
+	}
+	return ret, err
+}
+
+// finish writes the final files into the bundle directory for [Builder.Close]
+// and then opens the resulting bundle.
+func (b *Builder) finish(baseDir string) (*Bundle, error) {
+	rootFiles, err := b.writeRootFiles(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
 	// We need to freeze all of the metadata we've been tracking into the
 	// manifest file so that OpenDir can discover equivalent metadata itself
 	// when opening the finalized bundle.
-	err := b.writeManifest(filepath.Join(baseDir, manifestFilename))
+	err = b.writeManifest(filepath.Join(baseDir, ManifestFilename), rootFiles)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate source bundle manifest: %w", err)
 	}
@@ -222,6 +746,13 @@ func (b *Builder) Close() (*Bundle, error) {
 		// early checks.
 		return nil, fmt.Errorf("failed to open bundle after Close: %w", err)
 	}
+	ret.clock = b.clock
+	ret.packageHasher = b.packageHasher
+	if b.sealOnClose {
+		if err := ret.Seal(); err != nil {
+			return nil, err
+		}
+	}
 	return ret, nil
 }
 
@@ -236,56 +767,106 @@ func (b *Builder) resolvePending(ctx context.Context) (diags Diagnostics) {
 		// any further. This will make all subsequent calls panic.
 		if diags.HasErrors() {
 			b.targetDir = ""
+			b.unlock()
 		}
 
 		b.mu.Unlock()
 	}()
 
-	trace := buildTraceFromContext(ctx)
+	// If concurrent analysis is enabled then analysisSem limits how many
+	// dependency finders can run at once, and inflight tracks the analysis
+	// results we're still waiting for, in the order we started them.
+	var analysisSem chan struct{}
+	var inflight []*analysisJob
+	if b.analysisWorkers > 0 {
+		analysisSem = make(chan struct{}, b.analysisWorkers)
+	}
 
 	// We'll just keep iterating until we've depleted our queues.
 	// Note that the order of operations isn't actually important here and
 	// so we're consuming the "queues" in LIFO order instead of FIFO order,
 	// since that is easier to model using a Go slice.
-	for len(b.pendingRemote) > 0 || len(b.pendingRegistry) > 0 {
+	for len(b.pendingRemote) > 0 || len(b.pendingRegistry) > 0 || len(inflight) > 0 {
 		// We'll consume items from the "registry" queue first because resolving
 		// this will contribute additional items to the "remote" queue.
 		for len(b.pendingRegistry) > 0 {
-			next, remain := b.pendingRegistry[len(b.pendingRegistry)-1], b.pendingRegistry[:len(b.pendingRegistry)-1]
+			pending, remain := b.pendingRegistry[len(b.pendingRegistry)-1], b.pendingRegistry[:len(b.pendingRegistry)-1]
 			b.pendingRegistry = remain
+			next := pending.artifact
+			if moreDiags := b.checkDepth(pending.node); len(moreDiags) != 0 {
+				diags = append(diags, moreDiags...)
+				continue
+			}
+			if _, external := b.externalRegistry[next.sourceAddr.Package()]; external {
+				continue
+			}
 
+			knownOverlaps := len(b.registryOverlaps)
 			realSource, err := b.findRegistryPackageSource(ctx, next.sourceAddr, next.versions)
+			diags = append(diags, registryOverlapDiagnostics(b.registryOverlaps[knownOverlaps:])...)
+			var inconsistent *InconsistentRegistryError
+			if errors.As(err, &inconsistent) {
+				diags = append(diags, &internalDiagnostic{
+					severity: DiagError,
+					summary:  "Inconsistent module registry responses",
+					detail:   fmt.Sprintf("Error resolving module registry source %s: %s. The registry might be in the process of migrating this package to a new source; try again once the migration is complete.", next.sourceAddr, err) + pending.node.chainDetail(),
+				})
+				continue
+			}
 			if err != nil {
 				diags = append(diags, &internalDiagnostic{
 					severity: DiagError,
 					summary:  "Cannot resolve module registry package",
-					detail:   fmt.Sprintf("Error resolving module registry source %s: %s.", next.sourceAddr, err),
+					detail:   fmt.Sprintf("Error resolving module registry source %s: %s.", next.sourceAddr, err) + pending.node.chainDetail(),
 				})
 				continue
 			}
 
-			b.pendingRemote = append(b.pendingRemote, remoteArtifact{
-				sourceAddr: realSource,
-				depFinder:  next.depFinder,
+			// The resolved remote artifact shares the node of the registry
+			// artifact it came from, because it's just a different address
+			// for the same step in the dependency chain.
+			b.pendingRemote = append(b.pendingRemote, pendingRemoteArtifact{
+				artifact: remoteArtifact{
+					sourceAddr: realSource,
+					depFinder:  next.depFinder,
+				},
+				node: pending.node,
 			})
 		}
 
 		// Now we'll consume items from the "remote" queue, which might have
 		// grown as a result of resolving some registry queue items.
 		for len(b.pendingRemote) > 0 {
-			next, remain := b.pendingRemote[len(b.pendingRemote)-1], b.pendingRemote[:len(b.pendingRemote)-1]
+			pending, remain := b.pendingRemote[len(b.pendingRemote)-1], b.pendingRemote[:len(b.pendingRemote)-1]
 			b.pendingRemote = remain
+			next := pending.artifact
+			if moreDiags := b.checkDepth(pending.node); len(moreDiags) != 0 {
+				diags = append(diags, moreDiags...)
+				continue
+			}
 
 			pkgAddr := next.sourceAddr.Package()
-			pkgLocalDir, err := b.ensureRemotePackage(ctx, pkgAddr)
+			if _, external := b.externalRemote[pkgAddr]; external {
+				continue
+			}
+			_, known := b.remotePackageDirs[pkgAddr]
+			pkgLocalDir, err := b.ensureRemotePackage(ctx, pkgAddr, next.sourceAddr.SubPath())
 			if err != nil {
 				diags = append(diags, &internalDiagnostic{
 					severity: DiagError,
 					summary:  "Cannot install source package",
-					detail:   fmt.Sprintf("Error installing %s: %s.", next.sourceAddr.Package(), err),
+					detail:   fmt.Sprintf("Error installing %s: %s.", next.sourceAddr.Package(), err) + pending.node.chainDetail(),
 				})
 				continue
 			}
+			if !known {
+				diags = append(diags, b.recordPackageVariant(pkgAddr)...)
+			}
+			if pkgLocalDir == "" {
+				// In dry-run mode we have no content to analyze for
+				// packages that aren't already cached.
+				continue
+			}
 
 			// localDirPath now refers to the local equivalent of whatever
 			// sub-path or sub-file the source address referred to, so we
@@ -296,63 +877,201 @@ func (b *Builder) resolvePending(ctx context.Context) (diags Diagnostics) {
 				depFinder:  next.depFinder,
 			}
 			if _, exists := b.analyzed[artifact]; !exists {
-				fsys := os.DirFS(filepath.Join(b.targetDir, pkgLocalDir))
-				subPath := next.sourceAddr.SubPath()
-				depFinder := next.depFinder
-
-				deps := Dependencies{
-					baseAddr: next.sourceAddr,
-
-					remoteCb: func(source sourceaddrs.RemoteSource, depFinder DependencyFinder) {
-						b.pendingRemote = append(b.pendingRemote, remoteArtifact{
-							sourceAddr: source,
-							depFinder:  depFinder,
-						})
-					},
-					registryCb: func(source sourceaddrs.RegistrySource, allowedVersions versions.Set, depFinder DependencyFinder) {
-						b.pendingRegistry = append(b.pendingRegistry, registryArtifact{
-							sourceAddr: source,
-							versions:   allowedVersions,
-							depFinder:  depFinder,
-						})
-					},
-					localResolveErrCb: func(err error) {
-						diags = append(diags, &internalDiagnostic{
-							severity: DiagError,
-							summary:  "Invalid relative source address",
-							detail:   fmt.Sprintf("Invalid relative path from %s: %s.", next.sourceAddr, err),
-						})
-					},
-				}
-				moreDiags := depFinder.FindDependencies(fsys, subPath, &deps)
-				deps.disable()
+				// We mark the artifact as analyzed immediately, even if
+				// analysis is going to happen concurrently, so that we
+				// won't start analyzing the same artifact twice.
 				b.analyzed[artifact] = struct{}{}
-				if len(moreDiags) != 0 {
-					moreDiags = moreDiags.inRemoteSourcePackage(pkgAddr)
-					if cb := trace.Diagnostics; cb != nil {
-						cb(ctx, moreDiags)
-					}
-				}
-				diags = append(diags, moreDiags...)
-				if diags.HasErrors() {
+				pkgDir := b.localPackagePath(pkgLocalDir)
+
+				if analysisSem == nil {
+					result := analyzeArtifact(ctx, artifact, pending.node, pkgDir)
+					diags = append(diags, b.mergeAnalysis(ctx, result)...)
 					continue
 				}
+
+				job := &analysisJob{done: make(chan struct{})}
+				inflight = append(inflight, job)
+				analysisSem <- struct{}{}
+				go func() {
+					job.result = analyzeArtifact(ctx, artifact, pending.node, pkgDir)
+					<-analysisSem
+					close(job.done)
+				}()
 			}
 		}
+
+		// If we've depleted our queues but there's concurrent analysis still
+		// running then we'll wait for the oldest one to complete, which may
+		// then contribute more items to our queues. We merge results in the
+		// order we started the analysis so that our diagnostics are
+		// deterministic regardless of which analysis finishes first.
+		if len(b.pendingRemote) == 0 && len(b.pendingRegistry) == 0 && len(inflight) > 0 {
+			job := inflight[0]
+			inflight = inflight[1:]
+			<-job.done
+			diags = append(diags, b.mergeAnalysis(ctx, job.result)...)
+		}
+	}
+
+	// Now that no analysis is running we can clean up any package
+	// directories that were replaced by a sparse fetch of more sub-paths.
+	if err := b.removeSupersededPackageDirs(); err != nil {
+		diags = append(diags, &internalDiagnostic{
+			severity: DiagError,
+			summary:  "Cannot clean up source bundle",
+			detail:   fmt.Sprintf("Error cleaning up the source bundle directory: %s.", err),
+		})
 	}
 
 	return diags
 }
 
-func (b *Builder) findRegistryPackageSource(ctx context.Context, sourceAddr sourceaddrs.RegistrySource, allowedVersions versions.Set) (sourceaddrs.RemoteSource, error) {
+// analysisResult captures everything a [DependencyFinder] reported while
+// analyzing a remote artifact, so that it can be merged into the builder's
+// queues later.
+type analysisResult struct {
+	artifact remoteArtifact
+	node     *workNode
+	remote   []pendingRemoteArtifact
+	registry []pendingRegistryArtifact
+
+	// finderDiags are the diagnostics returned by the dependency finder,
+	// while resolveDiags are those generated by the builder itself while
+	// resolving relative source addresses.
+	finderDiags  Diagnostics
+	resolveDiags Diagnostics
+}
+
+// analysisJob tracks an analysis running concurrently. result must not be
+// accessed until done is closed.
+type analysisJob struct {
+	result *analysisResult
+	done   chan struct{}
+}
+
+// analyzeArtifact runs the dependency finder for the given artifact against
+// its package directory. It doesn't access any of the builder's state, so
+// it's safe to call without holding the builder's lock.
+func analyzeArtifact(ctx context.Context, artifact remoteArtifact, node *workNode, pkgDir string) *analysisResult {
+	result := &analysisResult{artifact: artifact, node: node}
+
+	trace := buildTraceFromContext(ctx)
+	finderType := fmt.Sprintf("%T", artifact.depFinder)
+	var reqCtx context.Context
+	if cb := trace.ArtifactAnalysisStart; cb != nil {
+		reqCtx = cb(ctx, artifact.sourceAddr, finderType)
+	}
+	if reqCtx == nil {
+		reqCtx = ctx
+	}
+	defer func() {
+		var diags Diagnostics
+		diags = append(diags, result.resolveDiags...)
+		diags = append(diags, result.finderDiags...)
+		if !diags.HasErrors() {
+			if cb := trace.ArtifactAnalysisSuccess; cb != nil {
+				cb(reqCtx, artifact.sourceAddr, finderType)
+			}
+		} else {
+			if cb := trace.ArtifactAnalysisFailure; cb != nil {
+				cb(reqCtx, artifact.sourceAddr, finderType, diags)
+			}
+		}
+	}()
+
+	fsys := newAnalysisFS(pkgDir)
+	subPath := artifact.sourceAddr.SubPath()
+
+	deps := Dependencies{
+		baseAddr: artifact.sourceAddr,
+
+		remoteCb: func(source sourceaddrs.RemoteSource, depFinder DependencyFinder) {
+			result.remote = append(result.remote, pendingRemoteArtifact{
+				artifact: remoteArtifact{
+					sourceAddr: source,
+					depFinder:  depFinder,
+				},
+				node: newWorkNode(source, node),
+			})
+		},
+		registryCb: func(source sourceaddrs.RegistrySource, allowedVersions versions.Set, depFinder DependencyFinder) {
+			result.registry = append(result.registry, pendingRegistryArtifact{
+				artifact: registryArtifact{
+					sourceAddr: source,
+					versions:   allowedVersions,
+					depFinder:  depFinder,
+				},
+				node: newWorkNode(source, node),
+			})
+		},
+		localResolveErrCb: func(err error) {
+			result.resolveDiags = append(result.resolveDiags, &internalDiagnostic{
+				severity: DiagError,
+				summary:  "Invalid relative source address",
+				detail:   fmt.Sprintf("Invalid relative path from %s: %s.", artifact.sourceAddr, err),
+			})
+		},
+	}
+	result.finderDiags = artifact.depFinder.FindDependencies(fsys, subPath, &deps)
+	deps.disable()
+	return result
+}
+
+// mergeAnalysis adds the dependencies discovered by an analysis to the
+// builder's queues and returns the diagnostics it produced.
+func (b *Builder) mergeAnalysis(ctx context.Context, result *analysisResult) Diagnostics {
+	// NOTE: This expects to be called while b.mu is already locked.
+
+	// We skip queuing any remote artifacts we've already analyzed, so that
+	// the queue can't grow without bound when many packages depend on the
+	// same sources.
+	for _, pending := range result.remote {
+		if _, exists := b.analyzed[pending.artifact]; !exists {
+			b.pendingRemote = append(b.pendingRemote, pending)
+		}
+	}
+	b.pendingRegistry = append(b.pendingRegistry, result.registry...)
+
+	diags := result.resolveDiags
+	if moreDiags := result.finderDiags; len(moreDiags) != 0 {
+		pkgAddr := result.artifact.sourceAddr.Package()
+		moreDiags = moreDiags.withIgnoredPaths(b.ignoredPaths[pkgAddr])
+		moreDiags = moreDiags.inRemoteSourcePackage(pkgAddr)
+		if cb := buildTraceFromContext(ctx).Diagnostics; cb != nil {
+			cb(ctx, moreDiags)
+		}
+		diags = append(diags, moreDiags...)
+	}
+	return diags
+}
+
+// checkDepth returns an error diagnostic if the given node exceeds the
+// builder's maximum dependency depth.
+func (b *Builder) checkDepth(node *workNode) Diagnostics {
+	if b.maxDepth == 0 || node.depth <= b.maxDepth {
+		return nil
+	}
+	return Diagnostics{
+		&internalDiagnostic{
+			severity: DiagError,
+			summary:  "Dependency chain too deep",
+			detail:   fmt.Sprintf("The source %s is at depth %d in the dependency chain %s, which exceeds the maximum depth of %d.", node.source, node.depth, node.chainString(), b.maxDepth),
+		},
+	}
+}
+
+// registryPackageVersionList returns the available versions of the given
+// registry package, querying the registry only if we haven't already done
+// so for this package.
+func (b *Builder) registryPackageVersionList(ctx context.Context, pkgAddr regaddr.ModulePackage) ([]ModulePackageInfo, versions.List, error) {
 	// NOTE: This expects to be called while b.mu is already locked.
 
 	trace := buildTraceFromContext(ctx)
 
-	pkgAddr := sourceAddr.Package()
-	availablePackageInfos, ok := b.registryPackageVersions[pkgAddr]
+	availablePackageInfos := b.registryPackageVersions[pkgAddr]
 	var availableVersions versions.List
-	if !ok {
+	if !b.registryPackageVersionsFresh(pkgAddr) {
+		b.dedupStats.RegistryVersionsFetched++
 		var reqCtx context.Context
 		if cb := trace.RegistryPackageVersionsStart; cb != nil {
 			reqCtx = cb(ctx, pkgAddr)
@@ -366,23 +1085,45 @@ func (b *Builder) findRegistryPackageSource(ctx context.Context, sourceAddr sour
 			if cb := trace.RegistryPackageVersionsFailure; cb != nil {
 				cb(reqCtx, pkgAddr, err)
 			}
-			return sourceaddrs.RemoteSource{}, fmt.Errorf("failed to query available versions for %s: %w", pkgAddr, err)
+			return nil, nil, fmt.Errorf("failed to query available versions for %s: %w", pkgAddr, err)
 		}
 
 		availablePackageInfos = resp.Versions
 		b.registryPackageVersions[pkgAddr] = resp.Versions
+		b.registryPackageVersionsAt[pkgAddr] = b.clock.Now()
+		b.reconfirmRegistrySources(pkgAddr)
+		if len(resp.Warnings) != 0 {
+			b.registryPackageWarnings[pkgAddr] = resp.Warnings
+		} else {
+			delete(b.registryPackageWarnings, pkgAddr)
+		}
 		availableVersions = extractVersionListFromResponse(availablePackageInfos)
 		if cb := trace.RegistryPackageVersionsSuccess; cb != nil {
 			cb(reqCtx, pkgAddr, availableVersions)
 		}
 	} else {
 		availableVersions = extractVersionListFromResponse(availablePackageInfos)
+		b.dedupStats.RegistryVersionsReused++
 		if cb := trace.RegistryPackageVersionsAlready; cb != nil {
 			cb(ctx, pkgAddr, availableVersions)
 		}
 	}
 
-	selectedVersion := availableVersions.NewestInSet(allowedVersions)
+	return availablePackageInfos, availableVersions, nil
+}
+
+func (b *Builder) findRegistryPackageSource(ctx context.Context, sourceAddr sourceaddrs.RegistrySource, allowedVersions versions.Set) (sourceaddrs.RemoteSource, error) {
+	// NOTE: This expects to be called while b.mu is already locked.
+
+	trace := buildTraceFromContext(ctx)
+
+	pkgAddr := sourceAddr.Package()
+	availablePackageInfos, availableVersions, err := b.registryPackageVersionList(ctx, pkgAddr)
+	if err != nil {
+		return sourceaddrs.RemoteSource{}, err
+	}
+
+	selectedVersion := b.selectRegistryVersion(pkgAddr, availableVersions, allowedVersions)
 	if selectedVersion == versions.Unspecified {
 		return sourceaddrs.RemoteSource{}, fmt.Errorf("no available version of %s matches the specified version constraint", pkgAddr)
 	}
@@ -392,7 +1133,12 @@ func (b *Builder) findRegistryPackageSource(ctx context.Context, sourceAddr sour
 		version: selectedVersion,
 	}
 	realSourceAddr, ok := b.resolvedRegistry[pkgVer]
-	if !ok {
+	if _, confirm := b.registrySourcesToConfirm[pkgVer]; ok && confirm {
+		if err := b.confirmRegistrySource(ctx, pkgVer, realSourceAddr); err != nil {
+			return sourceaddrs.RemoteSource{}, err
+		}
+	} else if !ok {
+		b.dedupStats.RegistrySourcesFetched++
 		var reqCtx context.Context
 		if cb := trace.RegistryPackageSourceStart; cb != nil {
 			reqCtx = cb(ctx, pkgAddr, selectedVersion)
@@ -409,6 +1155,7 @@ func (b *Builder) findRegistryPackageSource(ctx context.Context, sourceAddr sour
 			return sourceaddrs.RemoteSource{}, fmt.Errorf("failed to find real source address for %s %s: %w", pkgAddr, selectedVersion, err)
 		}
 		realSourceAddr = resp.SourceAddr
+		b.recordRegistryOverlaps(pkgVer, realSourceAddr)
 		b.resolvedRegistry[pkgVer] = realSourceAddr
 
 		var versionDeprecation *ModulePackageVersionDeprecation
@@ -433,6 +1180,7 @@ func (b *Builder) findRegistryPackageSource(ctx context.Context, sourceAddr sour
 			cb(reqCtx, pkgAddr, selectedVersion, realSourceAddr)
 		}
 	} else {
+		b.dedupStats.RegistrySourcesReused++
 		if cb := trace.RegistryPackageSourceAlready; cb != nil {
 			cb(ctx, pkgAddr, selectedVersion, realSourceAddr)
 		}
@@ -447,20 +1195,38 @@ func (b *Builder) findRegistryPackageSource(ctx context.Context, sourceAddr sour
 	return realSourceAddr, nil
 }
 
-func (b *Builder) ensureRemotePackage(ctx context.Context, pkgAddr sourceaddrs.RemotePackage) (localDir string, err error) {
+func (b *Builder) ensureRemotePackage(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, subPath string) (localDir string, err error) {
 	// NOTE: This expects to be called while b.mu is already locked.
 
 	trace := buildTraceFromContext(ctx)
 
+	// If sparse fetching is enabled then subPaths is the set of sub-paths
+	// we'll ask the fetcher for, or nil to fetch the whole package.
+	var subPaths []string
 	existingDir, ok := b.remotePackageDirs[pkgAddr]
 	if ok {
-		// We already have this package, so there's nothing more to do.
-		if cb := trace.RemotePackageDownloadAlready; cb != nil {
-			cb(ctx, pkgAddr)
+		fetchedSubPaths := b.packageSubPaths[pkgAddr]
+		if subPathsInclude(fetchedSubPaths, subPath) || b.dryRunDir != "" {
+			// We already have this package, so there's nothing more to do.
+			b.dedupStats.PackagesReused++
+			if cb := trace.RemotePackageDownloadAlready; cb != nil {
+				cb(ctx, pkgAddr)
+			}
+			return existingDir, nil
 		}
-		return existingDir, nil
+		// We previously fetched only some sub-paths of this package, so we
+		// must fetch it again including the new sub-path too.
+		subPaths = unionSubPaths(fetchedSubPaths, subPath)
+		b.supersededDirs = append(b.supersededDirs, existingDir)
+	} else if b.sparseFetching && subPath != "" {
+		subPaths = []string{subPath}
+	}
+
+	if b.dryRunDir != "" {
+		return b.dryRunRemotePackage(ctx, pkgAddr)
 	}
 
+	b.dedupStats.PackagesFetched++
 	var reqCtx context.Context
 	if cb := trace.RemotePackageDownloadStart; cb != nil {
 		reqCtx = cb(ctx, pkgAddr)
@@ -480,6 +1246,30 @@ func (b *Builder) ensureRemotePackage(ctx context.Context, pkgAddr sourceaddrs.R
 		}
 	}()
 
+	// The original archive from a successful fetch replaces the one from
+	// any earlier fetch of the same package, but a failed fetch leaves the
+	// earlier one in place. Either way we remove whichever archive the
+	// bundle no longer refers to.
+	prevOriginal, hadOriginal := b.packageOriginals[pkgAddr]
+	defer func() {
+		discarded := prevOriginal
+		if err != nil {
+			discarded = b.packageOriginals[pkgAddr]
+			if hadOriginal {
+				b.packageOriginals[pkgAddr] = prevOriginal
+			} else {
+				delete(b.packageOriginals, pkgAddr)
+			}
+		}
+		if releaseErr := b.releaseOriginalArchive(discarded); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}()
+
+	if err := b.checkFreeSpace(); err != nil {
+		return "", err
+	}
+
 	// We'll eventually name our local directory after a checksum of its
 	// content, but we don't know its content yet so we'll use a temporary
 	// name while we work on getting it populated.
@@ -487,68 +1277,45 @@ func (b *Builder) ensureRemotePackage(ctx context.Context, pkgAddr sourceaddrs.R
 	if err != nil {
 		return "", fmt.Errorf("failed to create new package directory: %w", err)
 	}
-
-	response, err := b.fetcher.FetchSourcePackage(reqCtx, pkgAddr.SourceType(), pkgAddr.URL(), workDir)
+	// If we succeed then workDir will have been renamed away before we
+	// return, in which case this will do nothing.
+	defer os.RemoveAll(workDir)
+
+	fetchCtx, stopWatching := b.watchFreeSpace(reqCtx)
+	pkgMeta, err := b.fetchRemotePackage(fetchCtx, pkgAddr, workDir, subPaths)
+	if spaceErr := stopWatching(); spaceErr != nil {
+		// The fetcher probably failed only because we cancelled it, so
+		// the lack of space is the more useful error to report.
+		return "", spaceErr
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch package: %w", err)
+		return "", err
 	}
-	if response.PackageMeta != nil {
+	if pkgMeta != nil {
 		// We'll remember the meta so we can use it when building a manifest later.
-		b.remotePackageMeta[pkgAddr] = response.PackageMeta
+		b.remotePackageMeta[pkgAddr] = pkgMeta
 	}
 
-	// If the package has a .terraformignore file then we now need to remove
-	// everything that we've been instructed to ignore.
-	ignoreRules, err := ignorefiles.LoadPackageIgnoreRules(workDir)
+	err = b.scanLicenses(reqCtx, pkgAddr, workDir)
 	if err != nil {
-		return "", fmt.Errorf("invalid .terraformignore file: %w", err)
+		return "", err
 	}
 
-	// NOTE: The checks in packagePrepareWalkFn are safe only if we are sure
-	// that no other process is concurrently modifying our temporary directory.
-	// Source bundle building should only occur on hosts that are trusted by
-	// whoever will ultimately be using the generated bundle.
-	err = filepath.Walk(workDir, packagePrepareWalkFn(workDir, ignoreRules))
+	dirName, stats, err := packageDirName(workDir, b.packageHasher)
 	if err != nil {
-		return "", fmt.Errorf("failed to prepare package directory: %#w", err)
+		return "", err
 	}
 
-	// If we got here then our tmpDir contains the final source code of a valid
-	// module package. We'll compute a hash of its contents so we can notice
-	// if it is identical to some other package we already installed, and then
-	// if not rename it into its final directory name.
-	// For this purpose we reuse the same directory tree hashing scheme that
-	// Go uses for its own modules, although that's an implementation detail
-	// subject to change in future versions: callers should always resolve
-	// paths through the source bundle's manifest rather than assuming a path.
-	//
-	// FIXME: We should implement our own thing similar to Go's dirhash but
-	// which can preserve file metadata at least to the level of detail that
-	// Git can, so that we can e.g. avoid coalescing two packages that differ
-	// only in whether a particular file is executable, or similar.
-	//
-	// We do currently _internally_ rely on the temporary directory being a
-	// hash when we build the final manifest for the bundle, so if you change
-	// this naming scheme you'll need to devise a new way for the manifest
-	// to learn about the checksum. External callers are forbidden from relying
-	// on it though, so you only have to worry about making the internals of
-	// this package self-consistent in how they deal with naming and hashes.
-	hash, err := dirhash.HashDir(workDir, "", dirhash.Hash1)
-	if err != nil {
-		return "", fmt.Errorf("failed to calculate package checksum: %w", err)
-	}
-	dirName := strings.TrimPrefix(hash, "h1:")
+	b.remotePackageDirs[pkgAddr] = dirName
+	b.packageDirStats[dirName] = stats
+	report := b.packageReport(pkgAddr)
+	report.Checksum = stats.Checksum()
+	report.Size = stats.Size()
 
-	// dirhash produces standard base64 encoding, but we need URL-friendly
-	// base64 encoding since we're using these as filenames.
-	rawChecksum, err := base64.StdEncoding.DecodeString(dirName)
+	err = b.attestPackage(reqCtx, pkgAddr, stats.Checksum())
 	if err != nil {
-		// Should not get here
-		return "", fmt.Errorf("package has invalid checksum: %w", err)
+		return "", err
 	}
-	dirName = base64.RawURLEncoding.EncodeToString(rawChecksum)
-
-	b.remotePackageDirs[pkgAddr] = dirName
 
 	// We might already have a directory with the same hash if we have two
 	// different package addresses that happen to return the same source code.
@@ -577,9 +1344,212 @@ func (b *Builder) ensureRemotePackage(ctx context.Context, pkgAddr sourceaddrs.R
 	return dirName, nil
 }
 
-func (b *Builder) writeManifest(filename string) error {
+// dryRunRemotePackage is the dry-run equivalent of ensureRemotePackage, which
+// records that the package would be fetched and returns a local directory
+// name for it only if its content is available from the package cache.
+func (b *Builder) dryRunRemotePackage(ctx context.Context, pkgAddr sourceaddrs.RemotePackage) (string, error) {
+	// NOTE: This expects to be called while b.mu is already locked.
+
+	planPkg := DryRunPackage{Package: pkgAddr}
+	defer func() {
+		b.dryRunPackages = append(b.dryRunPackages, planPkg)
+	}()
+
+	// We record an empty directory name until we know otherwise, so that
+	// we'll not try this package again.
+	b.remotePackageDirs[pkgAddr] = ""
+	if b.packageCache == nil {
+		return "", nil
+	}
+
+	cacheKey := b.packageCacheKey(pkgAddr)
+	if b.packageValidator != nil {
+		validator, err := b.packageValidator(ctx, pkgAddr)
+		if err != nil {
+			return "", nil
+		}
+		cacheKey.Validator = validator
+	}
+
+	workDir, err := ioutil.TempDir(b.dryRunDir, "pkg-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create dry-run package directory: %w", err)
+	}
+	_, ok, err := b.packageCache.LoadPackage(ctx, cacheKey, workDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to load package from cache: %w", err)
+	}
+	if !ok {
+		os.RemoveAll(workDir)
+		return "", nil
+	}
+
+	dirName := filepath.Base(workDir)
+	b.remotePackageDirs[pkgAddr] = dirName
+	planPkg.Analyzed = true
+	return dirName, nil
+}
+
+// localPackagePath returns the full path to the package directory with the
+// given name, which is in the scratch directory when in dry-run mode.
+func (b *Builder) localPackagePath(dirName string) string {
+	if b.dryRunDir != "" {
+		return filepath.Join(b.dryRunDir, dirName)
+	}
+	return filepath.Join(b.targetDir, dirName)
+}
+
+// DryRunPlan finalizes a builder created with [WithDryRun] and returns
+// a description of the packages that a real build would have downloaded.
+//
+// After calling DryRunPlan the receiving builder becomes invalid and must
+// not be used any further.
+func (b *Builder) DryRunPlan() (*DryRunPlan, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.targetDir == "" {
+		panic("DryRunPlan on already-closed sourcebundle.Builder")
+	}
+	if b.dryRunDir == "" {
+		return nil, fmt.Errorf("builder is not in dry-run mode")
+	}
+	b.targetDir = ""
+	b.unlock()
+	if err := os.RemoveAll(b.dryRunDir); err != nil {
+		return nil, fmt.Errorf("failed to clean dry-run scratch directory: %w", err)
+	}
+
+	return &DryRunPlan{
+		Packages: append([]DryRunPackage(nil), b.dryRunPackages...),
+	}, nil
+}
+
+// DryRunPlan describes what a [Builder] would download for a real build, as
+// determined by a builder created with [WithDryRun].
+type DryRunPlan struct {
+	// Packages describes each remote package that the build would download,
+	// in the order in which the builder discovered them.
+	Packages []DryRunPackage
+}
+
+// DryRunPackage is a remote package in a [DryRunPlan].
+type DryRunPackage struct {
+	Package sourceaddrs.RemotePackage
+
+	// Analyzed is true if the package content was available from the
+	// builder's package cache, and so its dependencies are also included
+	// in the plan.
+	Analyzed bool
+}
+
+// PackageCount returns the number of packages that the build would download.
+//
+// If [DryRunPlan.Complete] returns false then this is a lower bound, because
+// packages that were not analyzed may have additional dependencies.
+func (p *DryRunPlan) PackageCount() int {
+	return len(p.Packages)
+}
+
+// Complete returns true if all of the packages in the plan were analyzed,
+// and so the plan includes all of the indirect dependencies.
+func (p *DryRunPlan) Complete() bool {
+	for _, pkg := range p.Packages {
+		if !pkg.Analyzed {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchRemotePackage populates the given empty directory with the prepared
+// content of the given remote package, either by copying it from the
+// builder's package cache or by fetching and preparing it.
+//
+// If subPaths is not nil then the package is fetched sparsely if the
+// builder's fetcher supports it, as described for [WithSparseFetching].
+func (b *Builder) fetchRemotePackage(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, workDir string, subPaths []string) (*PackageMeta, error) {
+	var cacheKey PackageCacheKey
+	useCache := b.packageCache != nil && subPaths == nil
+	if useCache {
+		pkgMeta, ok, err := b.loadStalePackage(ctx, pkgAddr, workDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load package from cache: %w", err)
+		}
+		if ok {
+			return pkgMeta, nil
+		}
+
+		cacheKey = b.packageCacheKey(pkgAddr)
+		if b.packageValidator != nil {
+			validator, err := b.packageValidator(ctx, pkgAddr)
+			if err != nil {
+				// If we can't validate then we can't trust the cache, but
+				// we can still fetch the package directly.
+				useCache = false
+			}
+			cacheKey.Validator = validator
+		}
+	}
+	if useCache {
+		pkgMeta, ok, err := b.packageCache.LoadPackage(ctx, cacheKey, workDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load package from cache: %w", err)
+		}
+		if ok {
+			// The cached snapshot was already prepared before it was stored.
+			b.packageReport(pkgAddr).FromCache = true
+			delete(b.packageOriginals, pkgAddr)
+			return pkgMeta, nil
+		}
+	}
+
+	response, fetchedSubPaths, err := fetchPackage(ctx, b.fetcher, pkgAddr.SourceType(), pkgAddr.URL(), workDir, subPaths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch package: %w", err)
+	}
+	if fetchedSubPaths != nil {
+		b.packageSubPaths[pkgAddr] = fetchedSubPaths
+	} else {
+		delete(b.packageSubPaths, pkgAddr)
+	}
+	if err := b.takeOriginalArchive(pkgAddr, workDir, response.ArchiveFile); err != nil {
+		return nil, err
+	}
+
+	prepared, err := preparePackageDir(pkgAddr, workDir, prepareOptions{
+		rootSubdir:      response.RootSubdir,
+		keepVCSMetadata: b.keepVCSMetadata,
+		keepRules:       b.keepRules,
+		dropRules:       b.dropRules,
+		trace:           removedPathTracer(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(prepared.ignored) != 0 {
+		b.ignoredPaths[pkgAddr] = prepared.ignored
+	}
+	report := b.packageReport(pkgAddr)
+	report.RootSubdir = response.RootSubdir
+	report.StrippedVCSMetadata = prepared.strippedVCS
+	report.KeptPaths = prepared.kept
+	report.DroppedPaths = prepared.dropped
+
+	if useCache {
+		// Failing to populate the cache only means that a future builder
+		// will need to fetch this package again, so it isn't fatal.
+		_ = b.packageCache.StorePackage(ctx, cacheKey, workDir, response.PackageMeta)
+	}
+
+	return response.PackageMeta, nil
+}
+
+func (b *Builder) writeManifest(filename string, rootFiles []manifestRootFile) error {
 	var root manifestRoot
-	root.FormatVersion = 1
+	root.FormatVersion = 2
+	root.Meta = manifestBundleMetaFrom(b.bundleMeta)
+	root.RootFiles = rootFiles
+	root.External = b.manifestExternalSources()
 
 	for pkgAddr, localDirName := range b.remotePackageDirs {
 		pkgMeta := b.remotePackageMeta[pkgAddr]
@@ -588,17 +1558,26 @@ func (b *Builder) writeManifest(filename string) error {
 			SourceAddr: pkgAddr.String(),
 			LocalDir:   localDirName,
 		}
-		if pkgMeta != nil {
-			if pkgMeta.gitCommitID != "" {
-				manifestPkg.Meta.GitCommitID = pkgMeta.gitCommitID
-			}
-			if pkgMeta.gitCommitMessage != "" {
-				manifestPkg.Meta.GitCommitMessage = pkgMeta.gitCommitMessage
+		if stats := b.packageDirStats[localDirName]; stats != nil {
+			manifestPkg.Checksum = stats.checksum
+			if stats.hashScheme != DefaultPackageHasher.Name() {
+				manifestPkg.HashScheme = stats.hashScheme
 			}
+			manifestPkg.Size = stats.size
+			manifestPkg.FileCount = stats.fileCount
 		}
+		manifestPkg.SubPaths = b.packageSubPaths[pkgAddr]
+		manifestPkg.VCSMetadata = b.keepVCSMetadata
+		manifestPkg.KeepPatterns = b.keepPatterns
+		manifestPkg.DropPatterns = b.dropPatterns
+		manifestPkg.Licenses = manifestLicensesFrom(b.packageLicenses[pkgAddr])
+		manifestPkg.OriginalArchive = b.packageOriginals[pkgAddr]
+		manifestPkg.Attestation = b.packageAttestations[pkgAddr]
+		manifestPkg.Meta = manifestPackageMetaFrom(pkgMeta)
 
 		root.Packages = append(root.Packages, manifestPkg)
 	}
+	root.TotalSize = packageDirsSize(b.remotePackageDirs, b.packageDirStats)
 	sort.Slice(root.Packages, func(i, j int) bool {
 		return root.Packages[i].SourceAddr < root.Packages[j].SourceAddr
 	})
@@ -610,6 +1589,7 @@ func (b *Builder) writeManifest(filename string) error {
 			root.RegistryMeta = append(root.RegistryMeta, manifestRegistryMeta{
 				SourceAddr: rpv.pkg.String(),
 				Versions:   make(map[string]manifestRegistryVersion),
+				Warnings:   b.registryPackageWarnings[rpv.pkg],
 			})
 			manifestMeta = &root.RegistryMeta[len(root.RegistryMeta)-1]
 			registryObjs[rpv.pkg] = manifestMeta
@@ -653,7 +1633,412 @@ type registryPackageVersion struct {
 	version versions.Version
 }
 
-func packagePrepareWalkFn(root string, ignoreRules *ignorefiles.Ruleset) filepath.WalkFunc {
+// preparePackageDir applies our standard post-fetch transformations to a
+// newly-fetched package directory, including removing any files excluded by
+// the package's .terraformignore file, and then verifies that everything
+// that remains is acceptable for inclusion in a source bundle.
+//
+// It returns details about what it removed from the package directory.
+func preparePackageDir(pkgAddr sourceaddrs.RemotePackage, workDir string, opts prepareOptions) (*prepareResult, error) {
+	if opts.rootSubdir != "" {
+		err := relocatePackageRoot(workDir, opts.rootSubdir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to relocate package root to %q: %w", opts.rootSubdir, err)
+		}
+	} else if pkgAddr.HasWrapperDirectory() {
+		// Some release archives, such as the tarballs GitHub generates for
+		// tags, wrap the entire package in an extra top-level directory. We
+		// want sub-paths to be relative to the real package root, so we'll
+		// hoist the wrapped content up a level if the archive has the
+		// expected shape.
+		err := stripWrapperDirectory(workDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove archive wrapper directory: %w", err)
+		}
+	}
+
+	// If the package has a .terraformignore file then we now need to remove
+	// everything that we've been instructed to ignore.
+	ignoreRules, err := ignorefiles.LoadPackageIgnoreRules(workDir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid .terraformignore file: %w", err)
+	}
+
+	// NOTE: The checks in packagePrepareWalkFn are safe only if we are sure
+	// that no other process is concurrently modifying our temporary directory.
+	// Source bundle building should only occur on hosts that are trusted by
+	// whoever will ultimately be using the generated bundle.
+	result := &prepareResult{
+		ignored:     make(map[string]string),
+		removedDirs: make(map[string]removalReason),
+		keptDirs:    make(map[string]struct{}),
+	}
+	if opts.trace != nil {
+		result.trace = func(event IgnoreTraceEvent) {
+			event.Package = pkgAddr
+			opts.trace(event)
+		}
+	}
+	err = filepath.Walk(workDir, packagePrepareWalkFn(workDir, ignoreRules, opts, result))
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare package directory: %#w", err)
+	}
+	err = result.removeExcludedDirs(workDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare package directory: %w", err)
+	}
+
+	return result, nil
+}
+
+// removedPathTracer returns a function that reports removed paths to the
+// [BuildTracer] associated with the given context, or nil if it has no
+// PackagePathRemoved callback.
+func removedPathTracer(ctx context.Context) func(IgnoreTraceEvent) {
+	cb := buildTraceFromContext(ctx).PackagePathRemoved
+	if cb == nil {
+		return nil
+	}
+	return func(event IgnoreTraceEvent) {
+		cb(ctx, event)
+	}
+}
+
+// prepareOptions customizes the behavior of [preparePackageDir].
+type prepareOptions struct {
+	// rootSubdir, if not empty, is the sub-directory of the package
+	// directory that the fetcher reported as the real root of the package,
+	// as described for [FetchSourcePackageResponse.RootSubdir].
+	rootSubdir string
+
+	// keepVCSMetadata disables the removal of version control metadata
+	// directories, such as .hg and .svn, from the package.
+	keepVCSMetadata bool
+
+	// keepRules and dropRules, if not nil, are the rules given in
+	// [WithAlwaysKeep] and [WithAlwaysDrop] respectively.
+	keepRules, dropRules *ignorefiles.Ruleset
+
+	// trace, if not nil, is called for each path that is removed.
+	trace func(IgnoreTraceEvent)
+}
+
+// prepareResult describes what [preparePackageDir] removed from a package.
+type prepareResult struct {
+	// ignored maps the slash-separated sub-paths of the files and
+	// directories that were removed by ignore rules to the rule that
+	// removed each one.
+	ignored map[string]string
+
+	// strippedVCS lists the slash-separated sub-paths of the version
+	// control metadata directories that were removed.
+	strippedVCS []string
+
+	// kept lists the slash-separated sub-paths that the ignore rules or
+	// drop rules would have removed but that were retained by the keep
+	// rules.
+	kept []string
+
+	// dropped lists the slash-separated sub-paths that were removed by the
+	// drop rules.
+	dropped []string
+
+	// removedDirs tracks the directories that must be removed once the
+	// walk has visited their contents, because they are excluded but
+	// might contain paths matching the keep rules.
+	removedDirs map[string]removalReason
+
+	// keptDirs tracks the directories that matched the keep rules, so that
+	// everything beneath them is also kept.
+	keptDirs map[string]struct{}
+
+	// trace, if not nil, is called for each path that is removed, with
+	// the Package field already populated.
+	trace func(IgnoreTraceEvent)
+}
+
+// removalReason describes why preparePackageDir removes a path.
+type removalReason struct {
+	// rule is the text of the pattern that matched the path.
+	rule string
+
+	// dropped is true if the rule is one of the builder's drop rules, or
+	// false if it came from the package's ignore rules.
+	dropped bool
+}
+
+// removalReason decides whether the given path must be removed from the
+// package, either because it's inside a directory that is being removed or
+// because the ignore rules or drop rules exclude it. The ignore rules take
+// precedence over the drop rules when both match.
+func (r *prepareResult) removalReason(relPath string, isDir bool, ignoreRules, dropRules *ignorefiles.Ruleset) (removalReason, bool, error) {
+	for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+		if reason, ok := r.removedDirs[dir]; ok {
+			return reason, true, nil
+		}
+	}
+	result, err := ignoreRules.ExcludesEntry(relPath, isDir)
+	if err != nil {
+		return removalReason{}, false, fmt.Errorf("invalid .terraformignore rules: %#w", err)
+	}
+	if result.Excluded {
+		return removalReason{rule: result.Rule}, true, nil
+	}
+	result, err = dropRules.ExcludesEntry(relPath, isDir)
+	if err != nil {
+		return removalReason{}, false, fmt.Errorf("invalid drop rules: %w", err)
+	}
+	if result.Excluded {
+		return removalReason{rule: result.Rule, dropped: true}, true, nil
+	}
+	return removalReason{}, false, nil
+}
+
+// keeps returns true if the given path matches the keep rules, either
+// directly or because it's inside a directory that matched them.
+func (r *prepareResult) keeps(relPath string, isDir bool, keepRules *ignorefiles.Ruleset) (bool, error) {
+	for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+		if _, ok := r.keptDirs[dir]; ok {
+			return true, nil
+		}
+	}
+	result, err := keepRules.ExcludesEntry(relPath, isDir)
+	if err != nil {
+		return false, fmt.Errorf("invalid keep rules: %w", err)
+	}
+	return result.Excluded, nil
+}
+
+// recordRemoval records that the given slash-separated path was removed for
+// the given reason.
+func (r *prepareResult) recordRemoval(relPath string, isDir bool, reason removalReason) {
+	r.ignored[relPath] = reason.rule
+	traceReason := IgnoreFileRule
+	if reason.dropped {
+		r.dropped = append(r.dropped, relPath)
+		traceReason = DropPatternRule
+	}
+	if r.trace != nil {
+		r.trace(IgnoreTraceEvent{
+			Path:   relPath,
+			IsDir:  isDir,
+			Reason: traceReason,
+			Rule:   reason.rule,
+		})
+	}
+}
+
+// removeExcludedDirs removes any excluded directories that were left in
+// place while looking for paths matching the keep rules, unless they still
+// contain something that was kept.
+func (r *prepareResult) removeExcludedDirs(root string) error {
+	dirs := make([]string, 0, len(r.removedDirs))
+	for dir := range r.removedDirs {
+		dirs = append(dirs, dir)
+	}
+	// Sorting in reverse order visits each directory before its parent.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		absDir := filepath.Join(root, dir)
+		entries, err := os.ReadDir(absDir)
+		if err != nil {
+			return fmt.Errorf("failed to read ignored directory %s: %w", dir, err)
+		}
+		if len(entries) != 0 {
+			continue
+		}
+		err = os.Remove(absDir)
+		if err != nil {
+			return fmt.Errorf("failed to remove ignored directory %s: %w", dir, err)
+		}
+
+		// The directory's contents were recorded individually as we
+		// removed them, but now we can report the directory as a whole.
+		prefix := filepath.ToSlash(dir) + "/"
+		for path := range r.ignored {
+			if strings.HasPrefix(path, prefix) {
+				delete(r.ignored, path)
+			}
+		}
+		dropped := r.dropped[:0]
+		for _, path := range r.dropped {
+			if !strings.HasPrefix(path, prefix) {
+				dropped = append(dropped, path)
+			}
+		}
+		r.dropped = dropped
+		r.recordRemoval(filepath.ToSlash(dir), true, r.removedDirs[dir])
+	}
+	sort.Strings(r.dropped)
+	return nil
+}
+
+// vcsMetadataNames are the names of the files and directories that version
+// control systems use to store their metadata inside a working tree.
+//
+// Git uses a ".git" file rather than a directory for submodules and linked
+// worktrees, and so we remove files with these names too.
+var vcsMetadataNames = map[string]struct{}{
+	".git": {},
+	".hg":  {},
+	".svn": {},
+	".bzr": {},
+}
+
+// packageDirName calculates the local directory name that a package with
+// the content in the given directory should have in a source bundle, using
+// the given hasher, along with some statistics about the package content
+// gathered while hashing it.
+//
+// The given directory must already have been prepared using
+// [preparePackageDir].
+func packageDirName(dir string, hasher PackageHasher) (string, *PackageStats, error) {
+	// The directory name is a hash of the package contents, so that the
+	// builder can notice if a package is identical to some other package
+	// already installed. By default we reuse the same directory tree hashing
+	// scheme that Go uses for its own modules, although that's an
+	// implementation detail subject to change in future versions: callers
+	// should always resolve paths through the source bundle's manifest
+	// rather than assuming a path.
+	//
+	// FIXME: We should implement our own thing similar to Go's dirhash but
+	// which can preserve file metadata at least to the level of detail that
+	// Git can, so that we can e.g. avoid coalescing two packages that differ
+	// only in whether a particular file is executable, or similar. The
+	// manifest records the hasher used for each package, so such a scheme
+	// can be introduced as another PackageHasher.
+	//
+	// We do currently _internally_ rely on the temporary directory being a
+	// hash when we build the final manifest for the bundle, so if you change
+	// this naming scheme you'll need to devise a new way for the manifest
+	// to learn about the checksum. External callers are forbidden from relying
+	// on it though, so you only have to worry about making the internals of
+	// this package self-consistent in how they deal with naming and hashes.
+	//
+	// We list the files ourselves, rather than letting the hasher walk the
+	// directory, so that we can count the files and their total size as
+	// part of the same walk that's reading them to calculate the hash.
+	files, err := dirhash.DirFiles(dir, "")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to calculate package checksum: %w", err)
+	}
+	stats := &PackageStats{
+		hashScheme: hasher.Name(),
+		fileCount:  len(files),
+	}
+	hash, err := hasher.HashDir(dir, files, func(name string) (io.ReadCloser, error) {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		return &countingReadCloser{ReadCloser: f, count: &stats.size}, nil
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to calculate package checksum: %w", err)
+	}
+	stats.checksum = hash
+
+	dirName, err := hasher.DirName(hash)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := validDirName(hasher, dirName); err != nil {
+		return "", nil, err
+	}
+	return dirName, stats, nil
+}
+
+// countingReadCloser is an io.ReadCloser that adds the number of bytes read
+// through it to an external counter.
+type countingReadCloser struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	*r.count += int64(n)
+	return n, err
+}
+
+// stripWrapperDirectory checks whether the given directory contains exactly
+// one entry which is itself a directory, and if so moves all of the contents
+// of that directory up into the given directory and removes the now-empty
+// wrapper directory.
+//
+// If the directory has any other shape then it's left unchanged.
+func stripWrapperDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return nil // not a wrapped archive, so nothing to do
+	}
+	return relocatePackageRoot(dir, entries[0].Name())
+}
+
+// relocatePackageRoot replaces the content of dir with the content of the
+// given slash-separated sub-directory of dir, discarding everything else.
+func relocatePackageRoot(dir string, subdir string) error {
+	if !sourceaddrs.ValidSubPath(subdir) {
+		return fmt.Errorf("invalid sub-directory path")
+	}
+	rootDir := filepath.Join(dir, filepath.FromSlash(subdir))
+	info, err := os.Lstat(rootDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+
+	// We'll first rename the new root directory to a name that cannot
+	// collide with anything inside it, so we can safely move its
+	// children up to the top level.
+	tmpDir, err := ioutil.TempDir(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	err = os.Remove(tmpDir)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(rootDir, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	// Anything else that was outside of the new root is not part of the
+	// package, so we'll discard it.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == filepath.Base(tmpDir) {
+			continue
+		}
+		err := os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	children, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		err := os.Rename(filepath.Join(tmpDir, child.Name()), filepath.Join(dir, child.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(tmpDir)
+}
+
+func packagePrepareWalkFn(root string, ignoreRules *ignorefiles.Ruleset, opts prepareOptions, prepared *prepareResult) filepath.WalkFunc {
 	return func(absPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -668,37 +2053,68 @@ func packagePrepareWalkFn(root string, ignoreRules *ignorefiles.Ruleset) filepat
 			return nil
 		}
 
-		ignored, err := ignoreRules.Excludes(relPath)
-		if err != nil {
-			return fmt.Errorf("invalid .terraformignore rules: %#w", err)
-		}
-		if ignored.Excluded {
+		if _, isVCS := vcsMetadataNames[info.Name()]; isVCS && !opts.keepVCSMetadata {
 			err := os.RemoveAll(absPath)
 			if err != nil {
-				return fmt.Errorf("failed to remove ignored file %s: %s", relPath, err)
+				return fmt.Errorf("failed to remove version control metadata %s: %s", relPath, err)
+			}
+			prepared.strippedVCS = append(prepared.strippedVCS, filepath.ToSlash(relPath))
+			if prepared.trace != nil {
+				prepared.trace(IgnoreTraceEvent{
+					Path:   filepath.ToSlash(relPath),
+					IsDir:  info.IsDir(),
+					Reason: VCSMetadataRemoved,
+				})
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
 			return nil
 		}
 
-		// For directories we also need to check with a path separator on the
-		// end, which ignores entire subtrees.
-		//
-		// TODO: What about exclusion rules that follow a matching directory?
-		// Example:
-		//   /logs
-		//   !/logs/production/*
-		if info.IsDir() {
-			ignored, err := ignoreRules.Excludes(relPath + string(os.PathSeparator))
+		// An excluded directory excludes its entire subtree. slug.Packer
+		// matches this behavior when using slug.SourceBundleIgnoreSemantics,
+		// so that both produce the same set of files.
+		reason, remove, err := prepared.removalReason(relPath, info.IsDir(), ignoreRules, opts.dropRules)
+		if err != nil {
+			return err
+		}
+		if opts.keepRules != nil && (remove || info.IsDir()) {
+			// We check directories even if they aren't being removed,
+			// because a directory matching the keep rules also keeps
+			// everything beneath it.
+			kept, err := prepared.keeps(relPath, info.IsDir(), opts.keepRules)
 			if err != nil {
-				return fmt.Errorf("invalid .terraformignore rules: %#w", err)
+				return err
 			}
-			if ignored.Excluded {
-				err := os.RemoveAll(absPath)
-				if err != nil {
-					return fmt.Errorf("failed to remove ignored file %s: %s", relPath, err)
-				}
+			if kept && info.IsDir() {
+				prepared.keptDirs[relPath] = struct{}{}
+			}
+			switch {
+			case !remove:
+				// Nothing to do
+			case kept:
+				prepared.kept = append(prepared.kept, filepath.ToSlash(relPath))
+				remove = false
+			case info.IsDir():
+				// We can't remove the directory yet because some of its
+				// contents might match the keep rules, so we'll visit them
+				// individually and then remove the directory afterwards if
+				// nothing inside it was kept.
+				prepared.removedDirs[relPath] = reason
+				return nil
+			}
+		}
+		if remove {
+			err := os.RemoveAll(absPath)
+			if err != nil {
+				return fmt.Errorf("failed to remove ignored file %s: %s", relPath, err)
+			}
+			prepared.recordRemoval(filepath.ToSlash(relPath), info.IsDir(), reason)
+			if info.IsDir() {
 				return filepath.SkipDir
 			}
+			return nil
 		}
 
 		// If we get here then we have a file or directory that isn't
@@ -6,6 +6,8 @@ package sourcebundle
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -15,7 +17,10 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/apparentlymart/go-versions/versions"
 	"github.com/apparentlymart/go-versions/versions/constraints"
@@ -99,6 +104,155 @@ func TestBuilderSimple(t *testing.T) {
 	}
 }
 
+func TestBuildReportDedup(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/foo.tgz": "testdata/pkgs/hello",
+		},
+		map[string]map[string]string{
+			"example.com/foo/bar/baz": {
+				"1.0.0": "https://example.com/foo.tgz",
+			},
+		},
+		nil,
+	)
+
+	// Adding the same registry source twice should reuse every result the
+	// second time.
+	ctx := context.Background()
+	regSource := sourceaddrs.MustParseSource("example.com/foo/bar/baz").(sourceaddrs.RegistrySource)
+	for i := 0; i < 2; i++ {
+		if diags := builder.AddRegistrySource(ctx, regSource, versions.All, noDependencyFinder); len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
+		}
+	}
+
+	got := builder.Report().Dedup
+	want := DedupStats{
+		RegistryVersionsFetched: 1,
+		RegistryVersionsReused:  1,
+		RegistrySourcesFetched:  1,
+		RegistrySourcesReused:   1,
+		PackagesFetched:         1,
+		PackagesReused:          1,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong dedup stats\n%s", diff)
+	}
+	if got, want := got.RegistryHitRate(), 0.5; got != want {
+		t.Errorf("wrong registry hit rate %v; want %v", got, want)
+	}
+	if got, want := got.PackageHitRate(), 0.5; got != want {
+		t.Errorf("wrong package hit rate %v; want %v", got, want)
+	}
+	if got := (DedupStats{}).PackageHitRate(); got != 0 {
+		t.Errorf("wrong hit rate %v for no requests; want 0", got)
+	}
+}
+
+func TestBuilderAddRegistryPackageAllVersions(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/v1.0.tgz": "testdata/pkgs/hello",
+			"https://example.com/v1.1.tgz": "testdata/pkgs/hello",
+			"https://example.com/v1.2.tgz": "testdata/pkgs/subdirs",
+			"https://example.com/v2.0.tgz": "testdata/pkgs/subdirs",
+		},
+		map[string]map[string]string{
+			"example.com/foo/bar/baz": {
+				"1.0.0": "https://example.com/v1.0.tgz",
+				"1.1.0": "https://example.com/v1.1.tgz",
+				"1.2.0": "https://example.com/v1.2.tgz",
+				"2.0.0": "https://example.com/v2.0.tgz",
+			},
+		},
+		nil,
+	)
+
+	pkgAddr, err := sourceaddrs.ParseRegistryPackage("example.com/foo/bar/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnsts, err := constraints.ParseRubyStyleMulti("~> 1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diags := builder.AddRegistryPackageAllVersions(context.Background(), pkgAddr, versions.MeetingConstraints(cnsts), noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	wantVersions := versions.List{
+		versions.MustParseVersion("1.0.0"),
+		versions.MustParseVersion("1.1.0"),
+		versions.MustParseVersion("1.2.0"),
+	}
+	gotVersions := bundle.RegistryPackageVersions(pkgAddr)
+	if len(gotVersions) != len(wantVersions) {
+		t.Fatalf("wrong versions %s; want %s", gotVersions, wantVersions)
+	}
+	for i := range wantVersions {
+		if !gotVersions[i].Same(wantVersions[i]) {
+			t.Errorf("wrong versions %s; want %s", gotVersions, wantVersions)
+			break
+		}
+	}
+
+	// Versions with identical content share a package directory.
+	regSource := sourceaddrs.MustParseSource("example.com/foo/bar/baz").(sourceaddrs.RegistrySource)
+	var dirs []string
+	for _, version := range wantVersions {
+		dir, err := bundle.LocalPathForRegistrySource(regSource, version)
+		if err != nil {
+			t.Fatalf("no local directory for %s: %s", version, err)
+		}
+		dirs = append(dirs, dir)
+	}
+	if dirs[0] != dirs[1] {
+		t.Errorf("versions 1.0.0 and 1.1.0 should share a directory, but got %s and %s", dirs[0], dirs[1])
+	}
+	if dirs[0] == dirs[2] {
+		t.Errorf("versions 1.0.0 and 1.2.0 should not share a directory")
+	}
+
+	// The total size counts the shared directory only once.
+	var wantSize int64
+	for _, addr := range []string{"https://example.com/v1.0.tgz", "https://example.com/v1.2.tgz"} {
+		pkgAddr := sourceaddrs.MustParseSource(addr).(sourceaddrs.RemoteSource).Package()
+		wantSize += bundle.RemotePackageStats(pkgAddr).Size()
+	}
+	if got := builder.Report().TotalSize(); got != wantSize {
+		t.Errorf("wrong total size %d; want %d", got, wantSize)
+	}
+
+	t.Run("no matching versions", func(t *testing.T) {
+		builder := testingBuilder(
+			t, t.TempDir(),
+			nil,
+			map[string]map[string]string{
+				"example.com/foo/bar/baz": {
+					"1.0.0": "https://example.com/v1.0.tgz",
+				},
+			},
+			nil,
+		)
+		diags := builder.AddRegistryPackageAllVersions(context.Background(), pkgAddr, versions.Only(versions.MustParseVersion("3.0.0")), noDependencyFinder)
+		if !diags.HasErrors() {
+			t.Fatal("unexpected success")
+		}
+		if got, want := diags[0].Description().Detail, "no available version of example.com/foo/bar/baz matches"; !strings.Contains(got, want) {
+			t.Errorf("wrong error detail: %s", got)
+		}
+	})
+}
+
 func TestBuilderSubdirs(t *testing.T) {
 	tracer := testBuildTracer{}
 	ctx := tracer.OnContext(context.Background())
@@ -273,6 +427,235 @@ func TestBuilderRemoteDeps(t *testing.T) {
 	})
 }
 
+func TestBuilderDependencyChain(t *testing.T) {
+	startSource := sourceaddrs.MustParseSource("https://example.com/with-deps.tgz").(sourceaddrs.RemoteSource)
+
+	t.Run("max depth", func(t *testing.T) {
+		builder := testingBuilder(
+			t, t.TempDir(),
+			map[string]string{
+				"https://example.com/with-deps.tgz":   "testdata/pkgs/with-remote-deps",
+				"https://example.com/dependency1.tgz": "testdata/pkgs/hello",
+				"https://example.com/dependency2.tgz": "testdata/pkgs/hello",
+			},
+			nil,
+			nil,
+		)
+		if err := WithMaxDependencyDepth(1)(builder); err != nil {
+			t.Fatal(err)
+		}
+
+		diags := builder.AddRemoteSource(context.Background(), startSource, stubDependencyFinder{filename: "dependencies"})
+		if len(diags) != 2 {
+			t.Fatalf("wrong number of diagnostics %d; want 2", len(diags))
+		}
+		for _, diag := range diags {
+			desc := diag.Description()
+			if got, want := desc.Summary, "Dependency chain too deep"; got != want {
+				t.Errorf("wrong summary\ngot:  %s\nwant: %s", got, want)
+			}
+			if !strings.Contains(desc.Detail, "https://example.com/with-deps.tgz → https://example.com/dependency") {
+				t.Errorf("detail does not describe the dependency chain: %s", desc.Detail)
+			}
+		}
+	})
+
+	t.Run("install error", func(t *testing.T) {
+		builder := testingBuilder(
+			t, t.TempDir(),
+			map[string]string{
+				"https://example.com/with-deps.tgz":   "testdata/pkgs/with-remote-deps",
+				"https://example.com/dependency2.tgz": "testdata/pkgs/hello",
+			},
+			nil,
+			nil,
+		)
+
+		diags := builder.AddRemoteSource(context.Background(), startSource, stubDependencyFinder{filename: "dependencies"})
+		if len(diags) != 1 {
+			t.Fatalf("wrong number of diagnostics %d; want 1", len(diags))
+		}
+		desc := diags[0].Description()
+		if got, want := desc.Summary, "Cannot install source package"; got != want {
+			t.Errorf("wrong summary\ngot:  %s\nwant: %s", got, want)
+		}
+		wantChain := "dependency chain https://example.com/with-deps.tgz → https://example.com/dependency1.tgz."
+		if !strings.Contains(desc.Detail, wantChain) {
+			t.Errorf("detail does not describe the dependency chain: %s", desc.Detail)
+		}
+	})
+
+	if _, err := NewBuilder(t.TempDir(), nil, nil, WithMaxDependencyDepth(0)); err == nil {
+		t.Errorf("expected error for zero maximum depth")
+	}
+}
+
+func TestBuilderConcurrentAnalysis(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/with-deps.tgz":   "testdata/pkgs/with-remote-deps",
+			"https://example.com/dependency1.tgz": "testdata/pkgs/hello",
+			"https://example.com/dependency2.tgz": "testdata/pkgs/terraformignore",
+		},
+		nil,
+		nil,
+	)
+	if err := WithConcurrentAnalysis(2)(builder); err != nil {
+		t.Fatal(err)
+	}
+
+	startSource := sourceaddrs.MustParseSource("https://example.com/with-deps.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), startSource, stubDependencyFinder{filename: "dependencies"})
+	if len(diags) > 0 {
+		for _, diag := range diags {
+			t.Errorf("unexpected diagnostic\nSummary: %s\nDetail:  %s", diag.Description().Summary, diag.Description().Detail)
+		}
+		t.Fatal("unexpected diagnostics")
+	}
+
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+	for _, src := range []string{
+		"https://example.com/with-deps.tgz",
+		"https://example.com/dependency1.tgz",
+		"https://example.com/dependency2.tgz",
+	} {
+		source := sourceaddrs.MustParseSource(src).(sourceaddrs.RemoteSource)
+		if _, err := bundle.LocalPathForRemoteSource(source); err != nil {
+			t.Errorf("bundle does not include %s: %s", source, err)
+		}
+	}
+}
+
+func TestBuilderArtifactAnalysisTrace(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/with-deps.tgz":   "testdata/pkgs/with-remote-deps",
+			"https://example.com/dependency1.tgz": "testdata/pkgs/hello",
+			"https://example.com/dependency2.tgz": "testdata/pkgs/terraformignore",
+		},
+		nil,
+		nil,
+	)
+
+	var log []string
+	tracer := &BuildTracer{
+		ArtifactAnalysisStart: func(ctx context.Context, sourceAddr sourceaddrs.RemoteSource, finderType string) context.Context {
+			log = append(log, fmt.Sprintf("start analyzing %s with %s", sourceAddr, finderType))
+			return ctx
+		},
+		ArtifactAnalysisSuccess: func(ctx context.Context, sourceAddr sourceaddrs.RemoteSource, finderType string) {
+			log = append(log, fmt.Sprintf("analyzed %s with %s", sourceAddr, finderType))
+		},
+		ArtifactAnalysisFailure: func(ctx context.Context, sourceAddr sourceaddrs.RemoteSource, finderType string, diags Diagnostics) {
+			log = append(log, fmt.Sprintf("failed analyzing %s with %s", sourceAddr, finderType))
+		},
+	}
+	ctx := tracer.OnContext(context.Background())
+
+	startSource := sourceaddrs.MustParseSource("https://example.com/with-deps.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(ctx, startSource, stubDependencyFinder{filename: "dependencies"})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+
+	wantLog := []string{
+		"start analyzing https://example.com/with-deps.tgz with sourcebundle.stubDependencyFinder",
+		"analyzed https://example.com/with-deps.tgz with sourcebundle.stubDependencyFinder",
+		"start analyzing https://example.com/dependency2.tgz with sourcebundle.noopDependencyFinder",
+		"analyzed https://example.com/dependency2.tgz with sourcebundle.noopDependencyFinder",
+		"start analyzing https://example.com/dependency1.tgz with sourcebundle.noopDependencyFinder",
+		"analyzed https://example.com/dependency1.tgz with sourcebundle.noopDependencyFinder",
+	}
+	if diff := cmp.Diff(wantLog, log); diff != "" {
+		t.Errorf("wrong trace events\n%s", diff)
+	}
+}
+
+func TestBuilderDryRun(t *testing.T) {
+	cache, err := NewDirPackageCache(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startSource := sourceaddrs.MustParseSource("https://example.com/with-deps.tgz").(sourceaddrs.RemoteSource)
+	err = cache.StorePackage(context.Background(), PackageCacheKey{Package: startSource.Package()}, "testdata/pkgs/with-remote-deps", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targetDir := t.TempDir()
+	fakes := testingBuilder(t, targetDir, nil, nil, nil)
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		return FetchSourcePackageResponse{}, fmt.Errorf("dry run must not fetch %s", url)
+	})
+	builder, err := NewBuilder(targetDir, fetcher, fakes.registryClient, WithDryRun(), WithPackageCache(cache, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diags := builder.AddRemoteSource(context.Background(), startSource, stubDependencyFinder{filename: "dependencies"})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	if _, err := builder.Close(); err == nil {
+		t.Fatal("Close succeeded for dry-run builder; want error")
+	}
+	plan, err := builder.DryRunPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DryRunPackage{
+		{
+			Package:  startSource.Package(),
+			Analyzed: true,
+		},
+		{
+			Package: sourceaddrs.MustParseSource("https://example.com/dependency2.tgz").(sourceaddrs.RemoteSource).Package(),
+		},
+		{
+			Package: sourceaddrs.MustParseSource("https://example.com/dependency1.tgz").(sourceaddrs.RemoteSource).Package(),
+		},
+	}
+	if diff := cmp.Diff(want, plan.Packages, cmp.AllowUnexported(sourceaddrs.RemotePackage{}, url.URL{})); diff != "" {
+		t.Errorf("wrong plan\n%s", diff)
+	}
+	if got, want := plan.PackageCount(), 3; got != want {
+		t.Errorf("wrong package count %d; want %d", got, want)
+	}
+	if plan.Complete() {
+		t.Errorf("plan is complete; want incomplete")
+	}
+
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("dry run wrote %d entries into the target directory", len(entries))
+	}
+}
+
+func TestBuilderDryRunOptionFailure(t *testing.T) {
+	targetDir, tmpDir := t.TempDir(), t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	// A dry-run builder that fails to initialize must not leave its
+	// scratch directory behind.
+	failing := func(b *Builder) error {
+		return fmt.Errorf("failed")
+	}
+	if _, err := NewBuilder(targetDir, nil, nil, WithDryRun(), failing); err == nil {
+		t.Fatal("NewBuilder succeeded; want error")
+	}
+	assertEmptyDir(t, tmpDir)
+}
+
 func TestBuilderRegistryVersionDeprecation(t *testing.T) {
 	// This tests the common pattern of specifying a module registry address
 	// to start, having that translated into a real remote source address,
@@ -357,167 +740,1353 @@ func TestBuilderRegistryVersionDeprecation(t *testing.T) {
 	if registryPkgDir != localPkgDir {
 		t.Errorf("local dir for %s doesn't match local dir for %s", regSource, realSource)
 	}
-}
+}
+
+func TestBuilderRemoteDepsDifferingTypes(t *testing.T) {
+	tracer := testBuildTracer{}
+	ctx := tracer.OnContext(context.Background())
+
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/self_dependency.tgz": "testdata/pkgs/with-remote-deps",
+			"https://example.com/dependency1.tgz":     "testdata/pkgs/hello",
+			"https://example.com/dependency2.tgz":     "testdata/pkgs/terraformignore",
+		},
+		nil,
+		nil,
+	)
+
+	startSource := sourceaddrs.MustParseSource("https://example.com/self_dependency.tgz").(sourceaddrs.RemoteSource)
+	dep1Source := sourceaddrs.MustParseSource("https://example.com/dependency1.tgz").(sourceaddrs.RemoteSource)
+	dep2Source := sourceaddrs.MustParseSource("https://example.com/dependency2.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(ctx, startSource, stubDependencyFinder{
+		filename:     "self_dependency",
+		nextFilename: "dependencies",
+	})
+	if len(diags) > 0 {
+		for _, diag := range diags {
+			t.Errorf("unexpected diagnostic\nSummary: %s\nDetail:  %s", diag.Description().Summary, diag.Description().Detail)
+		}
+		t.Fatal("unexpected diagnostics")
+	}
+
+	wantLog := []string{
+		"start downloading https://example.com/self_dependency.tgz",
+		"downloaded https://example.com/self_dependency.tgz",
+		"reusing existing local copy of https://example.com/self_dependency.tgz",
+
+		// NOTE: The exact ordering of these two pairs is an implementation
+		// detail of Builder: it consumes its "queues" in LIFO order. If you've
+		// changed that implementation to a different order then it's expected
+		// for this to mismatch and you can just reorder these as long as
+		// all of the same events appear in any sensible order. Callers are
+		// not allowed to depend on the relative ordering of events relating
+		// to different packages.
+		"start downloading https://example.com/dependency2.tgz",
+		"downloaded https://example.com/dependency2.tgz",
+		"start downloading https://example.com/dependency1.tgz",
+		"downloaded https://example.com/dependency1.tgz",
+	}
+	gotLog := tracer.log
+	if diff := cmp.Diff(wantLog, gotLog); diff != "" {
+		t.Errorf("wrong trace events\n%s", diff)
+	}
+
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	t.Run("starting package", func(t *testing.T) {
+		localPkgDir, err := bundle.LocalPathForRemoteSource(startSource)
+		if err != nil {
+			for pkgAddr, localDir := range builder.remotePackageDirs {
+				t.Logf("contents of %s are in %s", pkgAddr, localDir)
+			}
+			t.Fatalf("builder does not know a local directory for %s: %s", startSource.Package(), err)
+		}
+
+		if info, err := os.Lstat(filepath.Join(localPkgDir, "dependencies")); err != nil {
+			t.Errorf("problem with output file: %s", err)
+		} else if !info.Mode().IsRegular() {
+			t.Errorf("output file is not a regular file")
+		}
+	})
+	t.Run("dependency 1", func(t *testing.T) {
+		localPkgDir, err := bundle.LocalPathForRemoteSource(dep1Source)
+		if err != nil {
+			for pkgAddr, localDir := range builder.remotePackageDirs {
+				t.Logf("contents of %s are in %s", pkgAddr, localDir)
+			}
+			t.Fatalf("builder does not know a local directory for %s: %s", dep1Source.Package(), err)
+		}
+
+		if info, err := os.Lstat(filepath.Join(localPkgDir, "hello")); err != nil {
+			t.Errorf("problem with output file: %s", err)
+		} else if !info.Mode().IsRegular() {
+			t.Errorf("output file is not a regular file")
+		}
+	})
+	t.Run("dependency 2", func(t *testing.T) {
+		localPkgDir, err := bundle.LocalPathForRemoteSource(dep2Source)
+		if err != nil {
+			for pkgAddr, localDir := range builder.remotePackageDirs {
+				t.Logf("contents of %s are in %s", pkgAddr, localDir)
+			}
+			t.Fatalf("builder does not know a local directory for %s: %s", dep2Source.Package(), err)
+		}
+
+		if info, err := os.Lstat(filepath.Join(localPkgDir, "included")); err != nil {
+			t.Errorf("problem with output file: %s", err)
+		} else if !info.Mode().IsRegular() {
+			t.Errorf("output file is not a regular file")
+		}
+	})
+}
+
+func TestBuilderTerraformIgnore(t *testing.T) {
+	tracer := testBuildTracer{}
+	ctx := tracer.OnContext(context.Background())
+
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/ignore.tgz": "testdata/pkgs/terraformignore",
+		},
+		nil,
+		nil,
+	)
+
+	startSource := sourceaddrs.MustParseSource("https://example.com/ignore.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(ctx, startSource, noDependencyFinder)
+	if len(diags) > 0 {
+		for _, diag := range diags {
+			t.Errorf("unexpected diagnostic\nSummary: %s\nDetail:  %s", diag.Description().Summary, diag.Description().Detail)
+		}
+		t.Fatal("unexpected diagnostics")
+	}
+
+	wantLog := []string{
+		"start downloading https://example.com/ignore.tgz",
+		"downloaded https://example.com/ignore.tgz",
+	}
+	gotLog := tracer.log
+	if diff := cmp.Diff(wantLog, gotLog); diff != "" {
+		t.Errorf("wrong trace events\n%s", diff)
+	}
+
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	localPkgDir, err := bundle.LocalPathForRemoteSource(startSource)
+	if err != nil {
+		for pkgAddr, localDir := range builder.remotePackageDirs {
+			t.Logf("contents of %s are in %s", pkgAddr, localDir)
+		}
+		t.Fatalf("builder does not know a local directory for %s: %s", startSource.Package(), err)
+	}
+
+	if info, err := os.Lstat(filepath.Join(localPkgDir, "included")); err != nil {
+		t.Errorf("problem with output file: %s", err)
+	} else if !info.Mode().IsRegular() {
+		t.Errorf("output file is not a regular file")
+	}
+
+	if _, err := os.Lstat(filepath.Join(localPkgDir, "excluded")); err == nil {
+		t.Errorf("excluded file exists; should have been removed")
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("excluded file exists but is not readable; should have been removed altogether")
+	}
+}
+
+func TestBuilderTerraformIgnoreMissingFile(t *testing.T) {
+	for _, filename := range []string{"excluded", "excluded-dir/excluded"} {
+		t.Run(filename, func(t *testing.T) {
+			builder := testingBuilder(
+				t, t.TempDir(),
+				map[string]string{
+					"https://example.com/ignore.tgz": "testdata/pkgs/terraformignore",
+				},
+				nil,
+				nil,
+			)
+			startSource := sourceaddrs.MustParseSource("https://example.com/ignore.tgz").(sourceaddrs.RemoteSource)
+			diags := builder.AddRemoteSource(context.Background(), startSource, stubDependencyFinder{filename: filename})
+			if len(diags) != 1 {
+				t.Fatalf("wrong number of diagnostics %d; want 1", len(diags))
+			}
+			desc := diags[0].Description()
+			if got, want := desc.Summary, "Missing stub dependency file"; got != want {
+				t.Errorf("wrong summary\ngot:  %s\nwant: %s", got, want)
+			}
+			wantRule := strings.SplitN(filename, "/", 2)[0]
+			if strings.Contains(filename, "/") {
+				wantRule += "/"
+			}
+			if want := fmt.Sprintf("excluded from this package by the ignore rule %q", wantRule); !strings.Contains(desc.Detail, want) {
+				t.Errorf("detail does not mention the ignore rule\ngot:  %s\nwant: ...%s...", desc.Detail, want)
+			}
+		})
+	}
+}
+
+func TestBuilderWrapperDirectory(t *testing.T) {
+	tracer := testBuildTracer{}
+	ctx := tracer.OnContext(context.Background())
+
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://github.com/example/hello/archive/refs/tags/v1.0.0.tar.gz": "testdata/pkgs/wrapped",
+		},
+		nil,
+		nil,
+	)
+
+	startSource := sourceaddrs.MustParseSource("https://github.com/example/hello/archive/refs/tags/v1.0.0.tar.gz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(ctx, startSource, noDependencyFinder)
+	if len(diags) > 0 {
+		for _, diag := range diags {
+			t.Errorf("unexpected diagnostic\nSummary: %s\nDetail:  %s", diag.Description().Summary, diag.Description().Detail)
+		}
+		t.Fatal("unexpected diagnostics")
+	}
+
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	localPkgDir, err := bundle.LocalPathForRemoteSource(startSource)
+	if err != nil {
+		t.Fatalf("builder does not know a local directory for %s: %s", startSource.Package(), err)
+	}
+
+	// The "hello-1.0.0" wrapper directory should've been removed, leaving
+	// its contents at the root of the package.
+	if info, err := os.Lstat(filepath.Join(localPkgDir, "hello")); err != nil {
+		t.Errorf("problem with output file: %s", err)
+	} else if !info.Mode().IsRegular() {
+		t.Errorf("output file is not a regular file")
+	}
+	if _, err := os.Lstat(filepath.Join(localPkgDir, "hello-1.0.0")); err == nil {
+		t.Errorf("wrapper directory still exists; should have been removed")
+	}
+}
+
+func TestBuilderFetcherRootSubdir(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		nestedDir := filepath.Join(targetDir, "nested", "pkg")
+		if err := os.MkdirAll(nestedDir, 0755); err != nil {
+			return ret, err
+		}
+		if err := copyDir(nestedDir, "testdata/pkgs/hello"); err != nil {
+			return ret, err
+		}
+		if err := os.WriteFile(filepath.Join(targetDir, "extraneous"), nil, 0644); err != nil {
+			return ret, err
+		}
+		ret.RootSubdir = "nested/pkg"
+		return ret, nil
+	})
+	builder, err := NewBuilder(t.TempDir(), fetcher, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startSource := sourceaddrs.MustParseSource("https://example.com/nested.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	localPkgDir, err := bundle.LocalPathForRemoteSource(startSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(localPkgDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if diff := cmp.Diff([]string{"hello"}, names); diff != "" {
+		t.Errorf("wrong package content\n%s", diff)
+	}
+
+	stats := bundle.RemotePackageStats(startSource.Package())
+	wantReport := &BuildReport{
+		Packages: []PackageReport{
+			{
+				Package:    startSource.Package(),
+				Checksum:   stats.Checksum(),
+				Size:       stats.Size(),
+				RootSubdir: "nested/pkg",
+			},
+		},
+		Dedup: DedupStats{PackagesFetched: 1},
+	}
+	if diff := cmp.Diff(wantReport, builder.Report(), remotePackageComparer); diff != "" {
+		t.Errorf("wrong build report\n%s", diff)
+	}
+}
+
+func TestBuilderVCSMetadata(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		if err := copyDir(targetDir, "testdata/pkgs/hello"); err != nil {
+			return ret, err
+		}
+		for _, dir := range []string{".hg", "sub/.svn"} {
+			if err := os.MkdirAll(filepath.Join(targetDir, dir), 0755); err != nil {
+				return ret, err
+			}
+			if err := os.WriteFile(filepath.Join(targetDir, dir, "metadata"), nil, 0644); err != nil {
+				return ret, err
+			}
+		}
+		return ret, nil
+	})
+	startSource := sourceaddrs.MustParseSource("https://example.com/vcs.tgz").(sourceaddrs.RemoteSource)
+
+	tests := map[string]struct {
+		opts       []BuilderOption
+		wantExist  bool
+		wantReport []string
+	}{
+		"default": {
+			wantExist:  false,
+			wantReport: []string{".hg", "sub/.svn"},
+		},
+		"WithVCSMetadata": {
+			opts:      []BuilderOption{WithVCSMetadata()},
+			wantExist: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			builder, err := NewBuilder(t.TempDir(), fetcher, nil, test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+			if len(diags) > 0 {
+				t.Fatalf("unexpected diagnostics: %#v", diags)
+			}
+			bundle, err := builder.Close()
+			if err != nil {
+				t.Fatalf("failed to close bundle: %s", err)
+			}
+
+			localPkgDir, err := bundle.LocalPathForRemoteSource(startSource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, dir := range []string{".hg", "sub/.svn"} {
+				_, err := os.Stat(filepath.Join(localPkgDir, dir))
+				if exists := err == nil; exists != test.wantExist {
+					t.Errorf("%s exists = %t, want %t", dir, exists, test.wantExist)
+				}
+			}
+
+			stats := bundle.RemotePackageStats(startSource.Package())
+			wantReport := &BuildReport{
+				Packages: []PackageReport{
+					{
+						Package:             startSource.Package(),
+						Checksum:            stats.Checksum(),
+						Size:                stats.Size(),
+						StrippedVCSMetadata: test.wantReport,
+					},
+				},
+				Dedup: DedupStats{PackagesFetched: 1},
+			}
+			if diff := cmp.Diff(wantReport, builder.Report(), remotePackageComparer); diff != "" {
+				t.Errorf("wrong build report\n%s", diff)
+			}
+
+			// Repair must prepare the package in the same way, or else the
+			// content it fetches again won't match.
+			err = os.WriteFile(filepath.Join(localPkgDir, "hello"), []byte("Corrupted!\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bundle.Repair(context.Background(), fetcher); err != nil {
+				t.Errorf("failed to repair bundle: %s", err)
+			}
+		})
+	}
+}
+
+func TestBuilderKeepDropPatterns(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		files := map[string]string{
+			".terraformignore": "docs/\nLICENSE\n",
+			"LICENSE":          "license",
+			"main.tf":          "# main",
+			"docs/README.md":   "readme",
+			"docs/guide.txt":   "guide",
+			"examples/a.tf":    "# example",
+		}
+		for name, content := range files {
+			path := filepath.Join(targetDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return ret, err
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				return ret, err
+			}
+		}
+		return ret, nil
+	})
+	startSource := sourceaddrs.MustParseSource("https://example.com/keepdrop.tgz").(sourceaddrs.RemoteSource)
+
+	tests := map[string]struct {
+		opts        []BuilderOption
+		wantExist   []string
+		wantMissing []string
+		wantKept    []string
+		wantDropped []string
+	}{
+		"default": {
+			wantExist:   []string{"main.tf", "examples/a.tf"},
+			wantMissing: []string{"LICENSE", "docs"},
+		},
+		"keep and drop": {
+			opts: []BuilderOption{
+				WithAlwaysKeep("README.md", "LICENSE"),
+				WithAlwaysDrop("examples/", "main.tf"),
+			},
+			wantExist:   []string{"LICENSE", "docs/README.md"},
+			wantMissing: []string{"main.tf", "docs/guide.txt", "examples"},
+			wantKept:    []string{"LICENSE", "docs/README.md"},
+			wantDropped: []string{"examples", "main.tf"},
+		},
+		"keep wins over drop": {
+			opts: []BuilderOption{
+				WithAlwaysKeep("/examples"),
+				WithAlwaysDrop("*.tf"),
+			},
+			wantExist:   []string{"examples/a.tf"},
+			wantMissing: []string{"main.tf"},
+			wantKept:    []string{"examples/a.tf"},
+			wantDropped: []string{"main.tf"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			builder, err := NewBuilder(t.TempDir(), fetcher, nil, test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+			if len(diags) > 0 {
+				t.Fatalf("unexpected diagnostics: %#v", diags)
+			}
+			bundle, err := builder.Close()
+			if err != nil {
+				t.Fatalf("failed to close bundle: %s", err)
+			}
+
+			localPkgDir, err := bundle.LocalPathForRemoteSource(startSource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range test.wantExist {
+				if _, err := os.Stat(filepath.Join(localPkgDir, name)); err != nil {
+					t.Errorf("%s should exist: %s", name, err)
+				}
+			}
+			for _, name := range test.wantMissing {
+				if _, err := os.Stat(filepath.Join(localPkgDir, name)); err == nil {
+					t.Errorf("%s should not exist", name)
+				}
+			}
+
+			stats := bundle.RemotePackageStats(startSource.Package())
+			wantReport := &BuildReport{
+				Packages: []PackageReport{
+					{
+						Package:      startSource.Package(),
+						Checksum:     stats.Checksum(),
+						Size:         stats.Size(),
+						KeptPaths:    test.wantKept,
+						DroppedPaths: test.wantDropped,
+					},
+				},
+				Dedup: DedupStats{PackagesFetched: 1},
+			}
+			if diff := cmp.Diff(wantReport, builder.Report(), remotePackageComparer); diff != "" {
+				t.Errorf("wrong build report\n%s", diff)
+			}
+
+			// Repair must apply the same keep and drop rules, or else the
+			// content it fetches again won't match.
+			err = os.WriteFile(filepath.Join(localPkgDir, test.wantExist[0]), []byte("Corrupted!\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bundle.Repair(context.Background(), fetcher); err != nil {
+				t.Errorf("failed to repair bundle: %s", err)
+			}
+		})
+	}
+}
+
+func TestBuilderMinFreeSpace(t *testing.T) {
+	var free atomic.Int64
+	defer func(old func(string) (int64, bool, error)) { freeDiskSpace = old }(freeDiskSpace)
+	freeDiskSpace = func(dir string) (int64, bool, error) {
+		return free.Load(), true, nil
+	}
+
+	free.Store(100)
+	if _, err := NewBuilder(t.TempDir(), nil, nil, WithMinFreeSpace(1000)); err == nil || !strings.Contains(err.Error(), "insufficient disk space") {
+		t.Fatalf("wrong error from preflight check: %v", err)
+	}
+
+	// If space runs out while the fetcher is running then the builder
+	// cancels the fetch and removes the partial package directory.
+	free.Store(5000)
+	started := make(chan struct{})
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		if err := os.WriteFile(filepath.Join(targetDir, "partial"), []byte("partial"), 0644); err != nil {
+			return FetchSourcePackageResponse{}, err
+		}
+		close(started)
+		<-ctx.Done()
+		return FetchSourcePackageResponse{}, ctx.Err()
+	})
+	clock := newTestClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	targetDir := t.TempDir()
+	builder, err := NewBuilder(targetDir, fetcher, nil, WithMinFreeSpace(1000), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-started
+		clock.tick()
+		free.Store(10)
+		clock.tick()
+	}()
+	startSource := sourceaddrs.MustParseSource("https://example.com/large.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+	if !diags.HasErrors() {
+		t.Fatal("unexpected success")
+	}
+	if got := diags[0].Description().Detail; !strings.Contains(got, "insufficient disk space: 10 bytes available, but at least 1000 bytes are required") {
+		t.Errorf("wrong error detail: %s", got)
+	}
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("unexpected leftover %s", entry.Name())
+	}
+
+	// If the caller cancels the fetch instead then that isn't a lack of
+	// space, even if the caller gives its own cause.
+	free.Store(5000)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	fetchCtx, stopWatching := builder.watchFreeSpace(ctx)
+	cancel(errors.New("caller gave up"))
+	<-fetchCtx.Done()
+	if err := stopWatching(); err != nil {
+		t.Errorf("caller cancellation reported as %q", err)
+	}
+}
+
+func TestBuilderLicenseScanner(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		files := map[string]string{
+			".terraformignore":   "vendor/\n",
+			"LICENSE":            "Mozilla Public License Version 2.0",
+			"main.tf":            "# SPDX-License-Identifier: MIT\n",
+			"vendor/LICENSE.txt": "GNU General Public License",
+		}
+		for name, content := range files {
+			path := filepath.Join(targetDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return ret, err
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				return ret, err
+			}
+		}
+		return ret, nil
+	})
+	startSource := sourceaddrs.MustParseSource("https://example.com/licensed.tgz").(sourceaddrs.RemoteSource)
+
+	// This scanner recognizes just enough to prove that it sees the
+	// package after the ignore rules have been applied.
+	scanner := func(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, dir string) ([]LicenseFinding, error) {
+		var ret []LicenseFinding
+		err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			switch {
+			case strings.Contains(string(content), "GNU General Public License"):
+				return fmt.Errorf("%s is GPL-licensed", filepath.ToSlash(rel))
+			case strings.HasPrefix(string(content), "Mozilla Public License"):
+				ret = append(ret, LicenseFinding{Path: filepath.ToSlash(rel), License: "MPL-2.0"})
+			case strings.HasPrefix(string(content), "# SPDX-License-Identifier: "):
+				id := strings.TrimSpace(strings.TrimPrefix(string(content), "# SPDX-License-Identifier: "))
+				ret = append(ret, LicenseFinding{Path: filepath.ToSlash(rel), License: id})
+			}
+			return nil
+		})
+		return ret, err
+	}
+
+	targetDir := t.TempDir()
+	builder, err := NewBuilder(targetDir, fetcher, nil, WithLicenseScanner(scanner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	if _, err := builder.Close(); err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	want := []LicenseFinding{
+		{Path: "LICENSE", License: "MPL-2.0"},
+		{Path: "main.tf", License: "MIT"},
+	}
+	report := builder.Report()
+	if len(report.Packages) != 1 {
+		t.Fatalf("wrong number of packages in report: %d", len(report.Packages))
+	}
+	if diff := cmp.Diff(want, report.Packages[0].Licenses); diff != "" {
+		t.Errorf("wrong licenses in report\n%s", diff)
+	}
+
+	// The findings must also survive a round-trip through the manifest.
+	bundle, err := OpenDir(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, bundle.RemotePackageLicenses(startSource.Package())); diff != "" {
+		t.Errorf("wrong licenses in bundle\n%s", diff)
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		reject := func(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, dir string) ([]LicenseFinding, error) {
+			return nil, fmt.Errorf("unacceptable license")
+		}
+		builder, err := NewBuilder(t.TempDir(), fetcher, nil, WithLicenseScanner(reject))
+		if err != nil {
+			t.Fatal(err)
+		}
+		diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+		if !diags.HasErrors() {
+			t.Fatal("unexpected success")
+		}
+		if got := diags[0].Description().Detail; !strings.Contains(got, "license scan failed: unacceptable license") {
+			t.Errorf("wrong error detail: %s", got)
+		}
+	})
+}
+
+func TestBuilderRegistryOverlaps(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/subdirs.tgz": "testdata/pkgs/subdirs",
+		},
+		map[string]map[string]string{
+			"example.com/foo/outer/baz": {
+				"1.0.0": "https://example.com/subdirs.tgz//a",
+			},
+			"example.com/foo/inner/baz": {
+				"1.0.0": "https://example.com/subdirs.tgz//a/b",
+			},
+			"example.com/foo/apart/baz": {
+				"1.0.0": "https://example.com/subdirs.tgz//ab",
+			},
+		},
+		nil,
+	)
+
+	var diags Diagnostics
+	for _, addr := range []string{"example.com/foo/outer/baz", "example.com/foo/inner/baz", "example.com/foo/apart/baz"} {
+		source := sourceaddrs.MustParseSource(addr).(sourceaddrs.RegistrySource)
+		diags = append(diags, builder.AddRegistrySource(context.Background(), source, versions.All, noDependencyFinder)...)
+	}
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %#v", diags)
+	}
+	if len(diags) != 1 {
+		t.Fatalf("wrong number of diagnostics %d; want 1", len(diags))
+	}
+	if got, want := diags[0].Severity(), DiagWarning; got != want {
+		t.Errorf("wrong severity %c; want %c", got, want)
+	}
+	if got, want := diags[0].Description().Summary, "Overlapping module registry packages"; got != want {
+		t.Errorf("wrong summary %q; want %q", got, want)
+	}
+
+	report := builder.Report()
+	if len(report.RegistryOverlaps) != 1 {
+		t.Fatalf("wrong number of overlaps in report: %#v", report.RegistryOverlaps)
+	}
+	overlap := report.RegistryOverlaps[0]
+	if got, want := overlap.Outer.Package.String(), "example.com/foo/outer/baz"; got != want {
+		t.Errorf("wrong outer package %s; want %s", got, want)
+	}
+	if got, want := overlap.Inner.Source.String(), "https://example.com/subdirs.tgz//a/b"; got != want {
+		t.Errorf("wrong inner source %s; want %s", got, want)
+	}
+}
+
+func TestBuilderPackageVariants(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"git::https://example.com/repo.git?ref=v1": "testdata/pkgs/hello",
+			"git::https://example.com/repo.git?ref=v2": "testdata/pkgs/hello",
+			"git::https://example.com/other.git":       "testdata/pkgs/hello",
+		},
+		nil,
+		nil,
+	)
+
+	var diags Diagnostics
+	for _, addr := range []string{"git::https://example.com/repo.git?ref=v1", "git::https://example.com/other.git", "git::https://example.com/repo.git?ref=v1", "git::https://example.com/repo.git?ref=v2"} {
+		source := sourceaddrs.MustParseSource(addr).(sourceaddrs.RemoteSource)
+		diags = append(diags, builder.AddRemoteSource(context.Background(), source, noDependencyFinder)...)
+	}
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %#v", diags)
+	}
+	if len(diags) != 1 {
+		t.Fatalf("wrong number of diagnostics %d; want 1", len(diags))
+	}
+	if got, want := diags[0].Severity(), DiagWarning; got != want {
+		t.Errorf("wrong severity %c; want %c", got, want)
+	}
+	if got, want := diags[0].Description().Summary, "Remote package fetched at more than one ref"; got != want {
+		t.Errorf("wrong summary %q; want %q", got, want)
+	}
+
+	report := builder.Report()
+	if len(report.PackageVariants) != 1 {
+		t.Fatalf("wrong number of package variants in report: %#v", report.PackageVariants)
+	}
+	variants := report.PackageVariants[0]
+	if got, want := variants.Base, "git::https://example.com/repo.git"; got != want {
+		t.Errorf("wrong base %s; want %s", got, want)
+	}
+	var got []string
+	for _, pkgAddr := range variants.Packages {
+		got = append(got, pkgAddr.String())
+	}
+	want := []string{"git::https://example.com/repo.git?ref=v1", "git::https://example.com/repo.git?ref=v2"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong variants\n%s", diff)
+	}
+}
+
+func TestBuilderInconsistentRegistry(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		return FetchSourcePackageResponse{}, os.WriteFile(filepath.Join(targetDir, "main.tf"), []byte("# main"), 0644)
+	})
+	version := versions.MustParseVersion("1.0.0")
+	sources := []string{"https://example.com/old.tgz", "https://example.com/new.tgz"}
+	calls := 0
+	registry := registryClientFuncs{
+		modulePackageVersions: func(ctx context.Context, pkgAddr regaddr.ModulePackage) (ModulePackageVersionsResponse, error) {
+			return ModulePackageVersionsResponse{
+				Versions: []ModulePackageInfo{{Version: version}},
+			}, nil
+		},
+		modulePackageSourceAddr: func(ctx context.Context, pkgAddr regaddr.ModulePackage, version versions.Version) (ModulePackageSourceAddrResponse, error) {
+			sourceAddr := sourceaddrs.MustParseSource(sources[calls]).(sourceaddrs.RemoteSource)
+			calls++
+			return ModulePackageSourceAddrResponse{SourceAddr: sourceAddr}, nil
+		},
+	}
+	builder, err := NewBuilder(t.TempDir(), fetcher, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := sourceaddrs.MustParseSource("example.com/foo/bar/baz").(sourceaddrs.RegistrySource)
+	diags := builder.AddRegistrySource(context.Background(), source, versions.All, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+
+	// The builder normally asks only once for each version, and so the
+	// same request again uses its earlier answer.
+	diags = builder.AddRegistrySource(context.Background(), source, versions.All, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	if calls != 1 {
+		t.Fatalf("registry was asked for the source address %d times; want 1", calls)
+	}
+
+	// After a refresh it asks again, and notices that the answer changed.
+	builder.InvalidateRegistryCache(source.Package())
+	diags = builder.AddRegistrySource(context.Background(), source, versions.All, noDependencyFinder)
+	if !diags.HasErrors() {
+		t.Fatal("unexpected success")
+	}
+	if got, want := diags[0].Description().Summary, "Inconsistent module registry responses"; got != want {
+		t.Errorf("wrong summary %q; want %q", got, want)
+	}
+	wantDetail := "the registry returned source address https://example.com/new.tgz for example.com/foo/bar/baz 1.0.0, but earlier in the same build it returned https://example.com/old.tgz"
+	if got := diags[0].Description().Detail; !strings.Contains(got, wantDetail) {
+		t.Errorf("wrong detail\ngot:  %s\nwant: %s", got, wantDetail)
+	}
+}
+
+func TestBuilderRegistryCacheRefresh(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		return FetchSourcePackageResponse{}, os.WriteFile(filepath.Join(targetDir, "main.tf"), []byte("# "+url.String()), 0644)
+	})
+	published := []string{"1.0.0"}
+	versionCalls := 0
+	registry := registryClientFuncs{
+		modulePackageVersions: func(ctx context.Context, pkgAddr regaddr.ModulePackage) (ModulePackageVersionsResponse, error) {
+			versionCalls++
+			var ret ModulePackageVersionsResponse
+			for _, v := range published {
+				ret.Versions = append(ret.Versions, ModulePackageInfo{Version: versions.MustParseVersion(v)})
+			}
+			return ret, nil
+		},
+		modulePackageSourceAddr: func(ctx context.Context, pkgAddr regaddr.ModulePackage, version versions.Version) (ModulePackageSourceAddrResponse, error) {
+			sourceAddr := sourceaddrs.MustParseSource("https://example.com/" + version.String() + ".tgz").(sourceaddrs.RemoteSource)
+			return ModulePackageSourceAddrResponse{SourceAddr: sourceAddr}, nil
+		},
+	}
+	source := sourceaddrs.MustParseSource("example.com/foo/bar/baz").(sourceaddrs.RegistrySource)
+	newest := versions.MustParseVersion("1.1.0")
+
+	// resolve adds the registry source to the builder and reports whether
+	// it selected the newest published version.
+	resolve := func(t *testing.T, builder *Builder) bool {
+		t.Helper()
+		diags := builder.AddRegistrySource(context.Background(), source, versions.All, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
+		}
+		_, ok := builder.resolvedRegistry[registryPackageVersion{pkg: source.Package(), version: newest}]
+		return ok
+	}
+
+	t.Run("invalidate", func(t *testing.T) {
+		published, versionCalls = []string{"1.0.0"}, 0
+		builder, err := NewBuilder(t.TempDir(), fetcher, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolve(t, builder)
+		published = append(published, newest.String())
+		if resolve(t, builder) {
+			t.Error("builder saw the new version without a refresh")
+		}
+		builder.InvalidateRegistryCache(source.Package())
+		if !resolve(t, builder) {
+			t.Error("builder didn't see the new version after invalidating its cache")
+		}
+		if versionCalls != 2 {
+			t.Errorf("builder queried versions %d times; want 2", versionCalls)
+		}
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		published, versionCalls = []string{"1.0.0"}, 0
+		now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock := newTestClock(now)
+		clock.now = func() time.Time { return now }
+		builder, err := NewBuilder(t.TempDir(), fetcher, registry, WithClock(clock), WithRegistryCacheMaxAge(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolve(t, builder)
+		published = append(published, newest.String())
+		now = now.Add(30 * time.Second)
+		if resolve(t, builder) {
+			t.Error("builder saw the new version before its cache expired")
+		}
+		now = now.Add(30 * time.Second)
+		if !resolve(t, builder) {
+			t.Error("builder didn't see the new version after its cache expired")
+		}
+		if versionCalls != 2 {
+			t.Errorf("builder queried versions %d times; want 2", versionCalls)
+		}
+	})
+
+	if _, err := NewBuilder(t.TempDir(), fetcher, registry, WithRegistryCacheMaxAge(0)); err == nil {
+		t.Error("zero max age was accepted")
+	}
+}
+
+func TestBuilderRetainedArchives(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		ret := FetchSourcePackageResponse{ArchiveFile: ".download/pkg.tgz"}
+		if err := os.Mkdir(filepath.Join(targetDir, ".download"), 0755); err != nil {
+			return ret, err
+		}
+		if err := os.WriteFile(filepath.Join(targetDir, ".download", "pkg.tgz"), []byte("original bytes"), 0644); err != nil {
+			return ret, err
+		}
+		return ret, os.WriteFile(filepath.Join(targetDir, "main.tf"), []byte("# main"), 0644)
+	})
+	startSource := sourceaddrs.MustParseSource("https://example.com/retained.tgz").(sourceaddrs.RemoteSource)
+
+	build := func(t *testing.T, options ...BuilderOption) (string, *Bundle) {
+		targetDir := t.TempDir()
+		builder, err := NewBuilder(targetDir, fetcher, nil, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
+		}
+		bundle, err := builder.Close()
+		if err != nil {
+			t.Fatalf("failed to close bundle: %s", err)
+		}
+		localDir, err := bundle.LocalPathForRemoteSource(startSource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(filepath.Join(localDir, ".download", "pkg.tgz")); !os.IsNotExist(err) {
+			t.Errorf("archive file was not removed from the package content: %v", err)
+		}
+		return targetDir, bundle
+	}
 
-func TestBuilderRemoteDepsDifferingTypes(t *testing.T) {
-	tracer := testBuildTracer{}
-	ctx := tracer.OnContext(context.Background())
+	t.Run("retained", func(t *testing.T) {
+		targetDir, _ := build(t, WithRetainedArchives())
 
-	targetDir := t.TempDir()
-	builder := testingBuilder(
-		t, targetDir,
-		map[string]string{
-			"https://example.com/self_dependency.tgz": "testdata/pkgs/with-remote-deps",
-			"https://example.com/dependency1.tgz":     "testdata/pkgs/hello",
-			"https://example.com/dependency2.tgz":     "testdata/pkgs/terraformignore",
-		},
-		nil,
-		nil,
-	)
+		// The originals directory must not be treated as unexpected content.
+		bundle, err := OpenDirStrict(targetDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte("original bytes"))
+		if got, want := bundle.RemotePackageOriginalArchiveChecksum(startSource.Package()), hex.EncodeToString(sum[:]); got != want {
+			t.Errorf("wrong checksum %q; want %q", got, want)
+		}
+		r, err := bundle.RemotePackageOriginalArchive(startSource.Package())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "original bytes" {
+			t.Errorf("wrong archive content %q", got)
+		}
+	})
 
-	startSource := sourceaddrs.MustParseSource("https://example.com/self_dependency.tgz").(sourceaddrs.RemoteSource)
-	dep1Source := sourceaddrs.MustParseSource("https://example.com/dependency1.tgz").(sourceaddrs.RemoteSource)
-	dep2Source := sourceaddrs.MustParseSource("https://example.com/dependency2.tgz").(sourceaddrs.RemoteSource)
-	diags := builder.AddRemoteSource(ctx, startSource, stubDependencyFinder{
-		filename:     "self_dependency",
-		nextFilename: "dependencies",
+	t.Run("discarded", func(t *testing.T) {
+		targetDir, bundle := build(t)
+		if _, err := bundle.RemotePackageOriginalArchive(startSource.Package()); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("wrong error %v; want fs.ErrNotExist", err)
+		}
+		if _, err := os.Lstat(filepath.Join(targetDir, OriginalsDirName)); !os.IsNotExist(err) {
+			t.Errorf("unexpected originals directory: %v", err)
+		}
 	})
-	if len(diags) > 0 {
-		for _, diag := range diags {
-			t.Errorf("unexpected diagnostic\nSummary: %s\nDetail:  %s", diag.Description().Summary, diag.Description().Detail)
+
+	// wantOriginals checks that the originals directory contains exactly
+	// the archives with the given content.
+	wantOriginals := func(t *testing.T, targetDir string, contents ...string) {
+		t.Helper()
+		want := []string{}
+		for _, content := range contents {
+			sum := sha256.Sum256([]byte(content))
+			want = append(want, hex.EncodeToString(sum[:]))
+		}
+		entries, err := os.ReadDir(filepath.Join(targetDir, OriginalsDirName))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, entry := range entries {
+			got = append(got, entry.Name())
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong original archives\n%s", diff)
 		}
-		t.Fatal("unexpected diagnostics")
 	}
 
-	wantLog := []string{
-		"start downloading https://example.com/self_dependency.tgz",
-		"downloaded https://example.com/self_dependency.tgz",
-		"reusing existing local copy of https://example.com/self_dependency.tgz",
+	t.Run("failed fetch", func(t *testing.T) {
+		fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+			// The missing root sub-directory makes the builder fail after
+			// it has already taken the archive.
+			ret := FetchSourcePackageResponse{ArchiveFile: "pkg.tgz", RootSubdir: "missing"}
+			return ret, os.WriteFile(filepath.Join(targetDir, "pkg.tgz"), []byte("original bytes"), 0644)
+		})
+		targetDir := t.TempDir()
+		builder, err := NewBuilder(targetDir, fetcher, nil, WithRetainedArchives())
+		if err != nil {
+			t.Fatal(err)
+		}
+		diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+		if len(diags) == 0 {
+			t.Fatal("unexpected success")
+		}
+		// The builder can't be closed after an error, but the bundle
+		// directory still mustn't contain the unused archive.
+		wantOriginals(t, targetDir)
+	})
 
-		// NOTE: The exact ordering of these two pairs is an implementation
-		// detail of Builder: it consumes its "queues" in LIFO order. If you've
-		// changed that implementation to a different order then it's expected
-		// for this to mismatch and you can just reorder these as long as
-		// all of the same events appear in any sensible order. Callers are
-		// not allowed to depend on the relative ordering of events relating
-		// to different packages.
-		"start downloading https://example.com/dependency2.tgz",
-		"downloaded https://example.com/dependency2.tgz",
-		"start downloading https://example.com/dependency1.tgz",
-		"downloaded https://example.com/dependency1.tgz",
-	}
-	gotLog := tracer.log
-	if diff := cmp.Diff(wantLog, gotLog); diff != "" {
-		t.Errorf("wrong trace events\n%s", diff)
+	t.Run("replaced by sparse fetch", func(t *testing.T) {
+		fetcher := sparsePackageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string, subPaths []string) (FetchSourcePackageResponse, error) {
+			ret := FetchSourcePackageResponse{ArchiveFile: "pkg.tgz", Sparse: true}
+			for _, subPath := range subPaths {
+				dst := filepath.Join(targetDir, filepath.FromSlash(subPath))
+				if err := os.MkdirAll(dst, 0755); err != nil {
+					return ret, err
+				}
+				if err := os.WriteFile(filepath.Join(dst, "main.tf"), []byte(subPath), 0644); err != nil {
+					return ret, err
+				}
+			}
+			archive := strings.Join(subPaths, ",")
+			return ret, os.WriteFile(filepath.Join(targetDir, "pkg.tgz"), []byte(archive), 0644)
+		})
+		targetDir := t.TempDir()
+		builder, err := NewBuilder(targetDir, fetcher, nil, WithRetainedArchives(), WithSparseFetching())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, addr := range []string{
+			"git::https://example.com/mono.git//modules/a",
+			"git::https://example.com/mono.git//modules/b",
+		} {
+			source := sourceaddrs.MustParseSource(addr).(sourceaddrs.RemoteSource)
+			diags := builder.AddRemoteSource(context.Background(), source, noDependencyFinder)
+			if len(diags) > 0 {
+				t.Fatalf("unexpected diagnostics: %#v", diags)
+			}
+		}
+		if _, err := builder.Close(); err != nil {
+			t.Fatalf("failed to close bundle: %s", err)
+		}
+		wantOriginals(t, targetDir, "modules/a,modules/b")
+		if _, err := OpenDirStrict(targetDir); err != nil {
+			t.Fatalf("failed to open bundle: %s", err)
+		}
+	})
+}
+
+func TestBuilderPackageAttestations(t *testing.T) {
+	fetchTime := time.Date(2023, 4, 5, 6, 7, 8, 9, time.UTC)
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		ret.PackageMeta = PackageMetaWithGitMetadata("abc123", "Initial commit").
+			WithResolvedRef("refs/heads/main").
+			WithFetchTime(fetchTime)
+		return ret, os.WriteFile(filepath.Join(targetDir, "main.tf"), []byte("# main"), 0644)
+	})
+	startSource := sourceaddrs.MustParseSource("git::https://example.com/attested.git").(sourceaddrs.RemoteSource)
+	attestation := func(provenance PackageProvenance) []byte {
+		return []byte(fmt.Sprintf("%s %s %s %s %s",
+			provenance.Package, provenance.Checksum, provenance.GitCommitID,
+			provenance.ResolvedRef, provenance.FetchTime.Format(time.RFC3339Nano),
+		))
 	}
 
-	bundle, err := builder.Close()
-	if err != nil {
-		t.Fatalf("failed to close bundle: %s", err)
+	build := func(t *testing.T, options ...BuilderOption) (string, *Builder) {
+		targetDir := t.TempDir()
+		builder, err := NewBuilder(targetDir, fetcher, nil, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
+		}
+		if _, err := builder.Close(); err != nil {
+			t.Fatalf("failed to close bundle: %s", err)
+		}
+		return targetDir, builder
+	}
+	verifier := func(provenance PackageProvenance, got []byte) error {
+		if want := attestation(provenance); string(got) != string(want) {
+			return fmt.Errorf("attestation %q does not match provenance %q", got, want)
+		}
+		return nil
 	}
 
-	t.Run("starting package", func(t *testing.T) {
-		localPkgDir, err := bundle.LocalPathForRemoteSource(startSource)
+	t.Run("attested", func(t *testing.T) {
+		targetDir, builder := build(t, WithPackageAttestor(func(ctx context.Context, provenance PackageProvenance) ([]byte, error) {
+			return attestation(provenance), nil
+		}))
+
+		// The attestations directory must not be treated as unexpected content.
+		bundle, err := OpenDirStrict(targetDir)
 		if err != nil {
-			for pkgAddr, localDir := range builder.remotePackageDirs {
-				t.Logf("contents of %s are in %s", pkgAddr, localDir)
-			}
-			t.Fatalf("builder does not know a local directory for %s: %s", startSource.Package(), err)
+			t.Fatal(err)
+		}
+		provenance, ok := bundle.RemotePackageProvenance(startSource.Package())
+		if !ok {
+			t.Fatal("bundle has no provenance for the package")
+		}
+		if provenance.GitCommitID != "abc123" || provenance.ResolvedRef != "refs/heads/main" || !provenance.FetchTime.Equal(fetchTime) {
+			t.Errorf("wrong provenance %#v", provenance)
+		}
+		if err := bundle.VerifyPackageAttestations(verifier); err != nil {
+			t.Fatal(err)
 		}
 
-		if info, err := os.Lstat(filepath.Join(localPkgDir, "dependencies")); err != nil {
-			t.Errorf("problem with output file: %s", err)
-		} else if !info.Mode().IsRegular() {
-			t.Errorf("output file is not a regular file")
+		sum := sha256.Sum256(attestation(provenance))
+		if got, want := builder.Report().Packages[0].Attestation, hex.EncodeToString(sum[:]); got != want {
+			t.Errorf("wrong reported attestation %q; want %q", got, want)
+		}
+
+		attestationPath := filepath.Join(targetDir, AttestationsDirName, hex.EncodeToString(sum[:]))
+		if err := os.WriteFile(attestationPath, []byte("forged"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := bundle.VerifyPackageAttestations(verifier); err == nil {
+			t.Error("modified attestation was accepted")
 		}
 	})
-	t.Run("dependency 1", func(t *testing.T) {
-		localPkgDir, err := bundle.LocalPathForRemoteSource(dep1Source)
+
+	t.Run("rejected", func(t *testing.T) {
+		builder, err := NewBuilder(t.TempDir(), fetcher, nil, WithPackageAttestor(func(ctx context.Context, provenance PackageProvenance) ([]byte, error) {
+			return nil, fmt.Errorf("signing key unavailable")
+		}))
 		if err != nil {
-			for pkgAddr, localDir := range builder.remotePackageDirs {
-				t.Logf("contents of %s are in %s", pkgAddr, localDir)
-			}
-			t.Fatalf("builder does not know a local directory for %s: %s", dep1Source.Package(), err)
+			t.Fatal(err)
 		}
-
-		if info, err := os.Lstat(filepath.Join(localPkgDir, "hello")); err != nil {
-			t.Errorf("problem with output file: %s", err)
-		} else if !info.Mode().IsRegular() {
-			t.Errorf("output file is not a regular file")
+		diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+		if !diags.HasErrors() {
+			t.Fatal("unexpected success")
+		}
+		if got, want := diags[0].Description().Detail, "signing key unavailable"; !strings.Contains(got, want) {
+			t.Errorf("wrong error detail %q; want it to contain %q", got, want)
 		}
 	})
-	t.Run("dependency 2", func(t *testing.T) {
-		localPkgDir, err := bundle.LocalPathForRemoteSource(dep2Source)
+
+	t.Run("unattested", func(t *testing.T) {
+		targetDir, _ := build(t)
+		bundle, err := OpenDir(targetDir)
 		if err != nil {
-			for pkgAddr, localDir := range builder.remotePackageDirs {
-				t.Logf("contents of %s are in %s", pkgAddr, localDir)
-			}
-			t.Fatalf("builder does not know a local directory for %s: %s", dep2Source.Package(), err)
+			t.Fatal(err)
 		}
-
-		if info, err := os.Lstat(filepath.Join(localPkgDir, "included")); err != nil {
-			t.Errorf("problem with output file: %s", err)
-		} else if !info.Mode().IsRegular() {
-			t.Errorf("output file is not a regular file")
+		if err := bundle.VerifyPackageAttestations(verifier); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("wrong error %v; want fs.ErrNotExist", err)
+		}
+		if _, err := os.Lstat(filepath.Join(targetDir, AttestationsDirName)); !os.IsNotExist(err) {
+			t.Errorf("unexpected attestations directory: %v", err)
 		}
 	})
 }
 
-func TestBuilderTerraformIgnore(t *testing.T) {
-	tracer := testBuildTracer{}
-	ctx := tracer.OnContext(context.Background())
+func TestBuilderPackagePathRemovedTrace(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		files := map[string]string{
+			".terraformignore": "docs/\n*.log\n",
+			".hg/store":        "",
+			"main.tf":          "# main",
+			"extra.tf":         "# extra",
+			"debug.log":        "log",
+			"docs/README.md":   "readme",
+		}
+		for name, content := range files {
+			path := filepath.Join(targetDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return ret, err
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				return ret, err
+			}
+		}
+		return ret, nil
+	})
+	startSource := sourceaddrs.MustParseSource("https://example.com/trace.tgz").(sourceaddrs.RemoteSource)
 
-	targetDir := t.TempDir()
-	builder := testingBuilder(
-		t, targetDir,
-		map[string]string{
-			"https://example.com/ignore.tgz": "testdata/pkgs/terraformignore",
+	var got []IgnoreTraceEvent
+	tracer := &BuildTracer{
+		PackagePathRemoved: func(ctx context.Context, event IgnoreTraceEvent) {
+			got = append(got, event)
 		},
-		nil,
-		nil,
-	)
+	}
+	ctx := tracer.OnContext(context.Background())
 
-	startSource := sourceaddrs.MustParseSource("https://example.com/ignore.tgz").(sourceaddrs.RemoteSource)
+	builder, err := NewBuilder(t.TempDir(), fetcher, nil, WithAlwaysDrop("extra.tf"))
+	if err != nil {
+		t.Fatal(err)
+	}
 	diags := builder.AddRemoteSource(ctx, startSource, noDependencyFinder)
 	if len(diags) > 0 {
-		for _, diag := range diags {
-			t.Errorf("unexpected diagnostic\nSummary: %s\nDetail:  %s", diag.Description().Summary, diag.Description().Detail)
-		}
-		t.Fatal("unexpected diagnostics")
+		t.Fatalf("unexpected diagnostics: %#v", diags)
 	}
 
-	wantLog := []string{
-		"start downloading https://example.com/ignore.tgz",
-		"downloaded https://example.com/ignore.tgz",
+	pkg := startSource.Package()
+	want := []IgnoreTraceEvent{
+		{Package: pkg, Path: ".hg", IsDir: true, Reason: VCSMetadataRemoved},
+		{Package: pkg, Path: "debug.log", Reason: IgnoreFileRule, Rule: "*.log"},
+		{Package: pkg, Path: "docs", IsDir: true, Reason: IgnoreFileRule, Rule: "docs/"},
+		{Package: pkg, Path: "extra.tf", Reason: DropPatternRule, Rule: "extra.tf"},
 	}
-	gotLog := tracer.log
-	if diff := cmp.Diff(wantLog, gotLog); diff != "" {
-		t.Errorf("wrong trace events\n%s", diff)
+	if diff := cmp.Diff(want, got, remotePackageComparer); diff != "" {
+		t.Errorf("wrong events\n%s", diff)
 	}
+}
 
-	bundle, err := builder.Close()
-	if err != nil {
-		t.Fatalf("failed to close bundle: %s", err)
+func TestBuilderAddPinnedSource(t *testing.T) {
+	const commitID = "0123456789abcdef0123456789abcdef01234567"
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		if err := copyDir(targetDir, "testdata/pkgs/hello"); err != nil {
+			return ret, err
+		}
+		ret.PackageMeta = PackageMetaWithGitMetadata(commitID, "Initial commit")
+		return ret, nil
+	})
+
+	t.Run("matching commit", func(t *testing.T) {
+		builder, err := NewBuilder(t.TempDir(), fetcher, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pinned := sourceaddrs.MustParsePinnedSource("git::https://example.com/hello.git " + commitID)
+		diags := builder.AddPinnedSource(context.Background(), pinned, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
+		}
+		if _, err := builder.Close(); err != nil {
+			t.Fatalf("failed to close bundle: %s", err)
+		}
+	})
+
+	t.Run("different commit", func(t *testing.T) {
+		builder, err := NewBuilder(t.TempDir(), fetcher, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pinned := sourceaddrs.MustParsePinnedSource("git::https://example.com/hello.git fedcba9876543210fedcba9876543210fedcba98")
+		diags := builder.AddPinnedSource(context.Background(), pinned, noDependencyFinder)
+		if !diags.HasErrors() {
+			t.Fatal("unexpected success")
+		}
+		if got, want := diags[0].Description().Summary, "Source package does not match pinned commit"; got != want {
+			t.Errorf("wrong summary\ngot:  %s\nwant: %s", got, want)
+		}
+	})
+}
+
+func TestBuilderSparseFetching(t *testing.T) {
+	repoDir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		dir := filepath.Join(repoDir, "modules", name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "main.tf"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	localPkgDir, err := bundle.LocalPathForRemoteSource(startSource)
+	var requests [][]string
+	fetcher := sparsePackageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string, subPaths []string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		requests = append(requests, subPaths)
+		if subPaths == nil {
+			return ret, copyDir(targetDir, repoDir)
+		}
+		for _, subPath := range subPaths {
+			dst := filepath.Join(targetDir, filepath.FromSlash(subPath))
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return ret, err
+			}
+			if err := copyDir(dst, filepath.Join(repoDir, filepath.FromSlash(subPath))); err != nil {
+				return ret, err
+			}
+		}
+		ret.Sparse = true
+		return ret, nil
+	})
+
+	targetDir := t.TempDir()
+	builder, err := NewBuilder(targetDir, fetcher, nil, WithSparseFetching())
 	if err != nil {
-		for pkgAddr, localDir := range builder.remotePackageDirs {
-			t.Logf("contents of %s are in %s", pkgAddr, localDir)
+		t.Fatal(err)
+	}
+	sourceA := sourceaddrs.MustParseSource("git::https://example.com/mono.git//modules/a").(sourceaddrs.RemoteSource)
+	sourceB := sourceaddrs.MustParseSource("git::https://example.com/mono.git//modules/b").(sourceaddrs.RemoteSource)
+	sourceC := sourceaddrs.MustParseSource("git::https://example.com/mono.git//modules/c").(sourceaddrs.RemoteSource)
+	for _, source := range []sourceaddrs.RemoteSource{sourceA, sourceB} {
+		diags := builder.AddRemoteSource(context.Background(), source, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
 		}
-		t.Fatalf("builder does not know a local directory for %s: %s", startSource.Package(), err)
+	}
+	if _, err := builder.Close(); err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
 	}
 
-	if info, err := os.Lstat(filepath.Join(localPkgDir, "included")); err != nil {
-		t.Errorf("problem with output file: %s", err)
-	} else if !info.Mode().IsRegular() {
-		t.Errorf("output file is not a regular file")
+	wantRequests := [][]string{
+		{"modules/a"},
+		{"modules/a", "modules/b"},
+	}
+	if diff := cmp.Diff(wantRequests, requests); diff != "" {
+		t.Errorf("wrong fetch requests\n%s", diff)
 	}
 
-	if _, err := os.Lstat(filepath.Join(localPkgDir, "excluded")); err == nil {
-		t.Errorf("excluded file exists; should have been removed")
-	} else if !errors.Is(err, fs.ErrNotExist) {
-		t.Errorf("excluded file exists but is not readable; should have been removed altogether")
+	// The bundle must not contain the directory from the first fetch.
+	bundle, err := OpenDirStrict(targetDir)
+	if err != nil {
+		t.Fatalf("failed to open bundle: %s", err)
+	}
+	if diff := cmp.Diff([]string{"modules/a", "modules/b"}, bundle.RemotePackageSubPaths(sourceA.Package())); diff != "" {
+		t.Errorf("wrong sub-paths\n%s", diff)
+	}
+	for _, source := range []sourceaddrs.RemoteSource{sourceA, sourceB} {
+		localDir, err := bundle.LocalPathForRemoteSource(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(localDir, "main.tf")); err != nil {
+			t.Errorf("missing content for %s: %s", source, err)
+		}
+	}
+	if _, err := bundle.LocalPathForRemoteSource(sourceC); err == nil {
+		t.Errorf("unexpected success for sub-path that wasn't fetched")
 	}
 }
 
@@ -843,6 +2412,16 @@ func (f packageFetcherFunc) FetchSourcePackage(ctx context.Context, sourceType s
 	return f(ctx, sourceType, url, targetDir)
 }
 
+type sparsePackageFetcherFunc func(ctx context.Context, sourceType string, url *url.URL, targetDir string, subPaths []string) (FetchSourcePackageResponse, error)
+
+func (f sparsePackageFetcherFunc) FetchSourcePackage(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+	return f(ctx, sourceType, url, targetDir, nil)
+}
+
+func (f sparsePackageFetcherFunc) FetchSourcePackageSubPaths(ctx context.Context, sourceType string, url *url.URL, targetDir string, subPaths []string) (FetchSourcePackageResponse, error) {
+	return f(ctx, sourceType, url, targetDir, subPaths)
+}
+
 type registryClientFuncs struct {
 	modulePackageVersions   func(ctx context.Context, pkgAddr regaddr.ModulePackage) (ModulePackageVersionsResponse, error)
 	modulePackageSourceAddr func(ctx context.Context, pkgAddr regaddr.ModulePackage, version versions.Version) (ModulePackageSourceAddrResponse, error)
@@ -856,6 +2435,44 @@ func (f registryClientFuncs) ModulePackageSourceAddr(ctx context.Context, pkgAdd
 	return f.modulePackageSourceAddr(ctx, pkgAddr, version)
 }
 
+// testClock is a [Clock] whose time is controlled by the test, and whose
+// tickers tick only when the test calls tick.
+type testClock struct {
+	now   func() time.Time
+	ticks chan time.Time
+}
+
+func newTestClock(now time.Time) testClock {
+	return testClock{
+		now:   func() time.Time { return now },
+		ticks: make(chan time.Time),
+	}
+}
+
+func (c testClock) Now() time.Time {
+	return c.now()
+}
+
+func (c testClock) NewTicker(d time.Duration) Ticker {
+	return testTicker{c.ticks}
+}
+
+// tick delivers a tick to one of the clock's tickers, blocking until it
+// has been received.
+func (c testClock) tick() {
+	c.ticks <- c.now()
+}
+
+type testTicker struct {
+	ch chan time.Time
+}
+
+func (t testTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t testTicker) Stop() {}
+
 type noopDependencyFinder struct{}
 
 func (f noopDependencyFinder) FindDependencies(fsys fs.FS, subPath string, deps *Dependencies) Diagnostics {
@@ -864,6 +2481,12 @@ func (f noopDependencyFinder) FindDependencies(fsys fs.FS, subPath string, deps
 
 var noDependencyFinder = noopDependencyFinder{}
 
+// remotePackageComparer is a cmp option for comparing values that contain
+// [sourceaddrs.RemotePackage], whose fields are unexported.
+var remotePackageComparer = cmp.Comparer(func(a, b sourceaddrs.RemotePackage) bool {
+	return a.String() == b.String()
+})
+
 // stubDependencyFinder is a test-only [DependencyFinder] which just reads
 // lines of text from a given filename and tries to treat each one as a source
 // address, which it then reports as a dependency.
@@ -1067,3 +2690,27 @@ func sameFile(a, b string) (bool, error) {
 
 	return os.SameFile(aInfo, bInfo), nil
 }
+
+func TestAnalysisFS(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "modules", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"main.tf", "modules/a/main.tf"} {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte("# "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fsys := newAnalysisFS(dir)
+	if err := fstest.TestFS(fsys, "main.tf", "modules/a/main.tf"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(fsys, `modules\a\main.tf`); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("wrong error for backslashes %v; want fs.ErrInvalid", err)
+	}
+	// This would succeed using os.DirFS on a case-insensitive filesystem.
+	if _, err := fs.ReadFile(fsys, "Modules/a/Main.tf"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("wrong error for different case %v; want fs.ErrNotExist", err)
+	}
+}
@@ -4,12 +4,16 @@
 package sourcebundle
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -18,22 +22,99 @@ import (
 
 	"github.com/apparentlymart/go-versions/versions"
 	"github.com/hashicorp/go-slug"
+	"github.com/hashicorp/go-slug/internal/ignorefiles"
 	"github.com/hashicorp/go-slug/sourceaddrs"
 	regaddr "github.com/hashicorp/terraform-registry-address"
 )
 
-const manifestFilename = "terraform-sources.json"
+// ManifestFilename is the name of the manifest file at the root of every
+// source bundle directory, which describes the packages that the bundle
+// contains.
+const ManifestFilename = "terraform-sources.json"
+
+// ChecksumPrefixV1 is the prefix used for checksums generated using our
+// first checksum scheme, which is the same as Go's "h1:" directory hash
+// scheme.
+const ChecksumPrefixV1 = "h1:"
+
+// IsBundleDir returns true if the given directory seems to be the root of
+// a source bundle, because it contains a manifest file.
+//
+// This is a cheap test that doesn't read or validate the manifest, so
+// [OpenDir] might still fail for a directory that IsBundleDir accepts.
+func IsBundleDir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, ManifestFilename))
+	return err == nil && info.Mode().IsRegular()
+}
 
 type Bundle struct {
 	rootDir string
 
-	manifestChecksum string
+	// manifestDigest is the SHA256 checksum of the manifest source code
+	// when the bundle was opened.
+	manifestDigest [sha256.Size]byte
+
+	meta bundleMeta
+
+	// clock is the clock used for any time-dependent behavior of the
+	// bundle. See [WithClock].
+	clock Clock
+
+	// packageHasher is the hasher used by the builder that created the
+	// bundle, if any, in addition to those registered using
+	// [RegisterPackageHasher].
+	packageHasher PackageHasher
 
 	remotePackageDirs map[sourceaddrs.RemotePackage]string
 	remotePackageMeta map[sourceaddrs.RemotePackage]*PackageMeta
+	packageDirStats   map[string]*PackageStats
+	totalSize         int64
+
+	// remotePackageSubPaths records the sub-paths included for each
+	// package that was fetched sparsely. Packages included in their
+	// entirety have no entry.
+	remotePackageSubPaths map[sourceaddrs.RemotePackage][]string
+
+	// remotePackageVCSMetadata records the packages in which the builder
+	// kept any version control metadata, so that [Bundle.Repair] can
+	// prepare them in the same way. See [WithVCSMetadata].
+	remotePackageVCSMetadata map[sourceaddrs.RemotePackage]struct{}
+
+	// remotePackageKeepRules and remotePackageDropRules record the rules
+	// the builder applied to each package, for the same reason. See
+	// [WithAlwaysKeep] and [WithAlwaysDrop].
+	remotePackageKeepRules map[sourceaddrs.RemotePackage]*ignorefiles.Ruleset
+	remotePackageDropRules map[sourceaddrs.RemotePackage]*ignorefiles.Ruleset
+
+	// remotePackageLicenses records the findings of the license scanner
+	// used when building the bundle, if any. See [WithLicenseScanner].
+	remotePackageLicenses map[sourceaddrs.RemotePackage][]LicenseFinding
+
+	// remotePackageOriginals records the checksum of the original archive
+	// retained for each package, if any. See [WithRetainedArchives].
+	remotePackageOriginals map[sourceaddrs.RemotePackage]string
+
+	// remotePackageAttestations records the checksum of the attestation
+	// generated for each package, if any. See [WithPackageAttestor].
+	remotePackageAttestations map[sourceaddrs.RemotePackage]string
 
 	registryPackageSources             map[regaddr.ModulePackage]map[versions.Version]sourceaddrs.RemoteSource
 	registryPackageVersionDeprecations map[regaddr.ModulePackage]map[versions.Version]*RegistryVersionDeprecation
+	registryPackageWarnings            map[regaddr.ModulePackage][]string
+
+	// rootFiles records the files added to the top-level bundle directory
+	// using [Builder.AddRootFile].
+	rootFiles map[string]manifestRootFile
+
+	// externalRemote and externalRegistry record the packages that the
+	// bundle deliberately doesn't include, mapped to the reason for each.
+	// See [Builder.AddExternalSource].
+	externalRemote   map[sourceaddrs.RemotePackage]string
+	externalRegistry map[regaddr.ModulePackage]string
+
+	// lock is the shared lock on the bundle directory that the bundle
+	// holds, if any. See [Bundle.Unlock].
+	lock *DirLock
 }
 
 // OpenDir opens a bundle rooted at the given base directory.
@@ -51,84 +132,254 @@ func OpenDir(baseDir string) (*Bundle, error) {
 		return nil, fmt.Errorf("cannot resolve base directory: %w", err)
 	}
 
+	f, err := os.Open(filepath.Join(rootDir, ManifestFilename))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %w", err)
+	}
+	defer f.Close()
+
+	return newBundleFromManifest(rootDir, f)
+}
+
+// newBundleFromManifest constructs a [Bundle] for the given root directory
+// from the manifest source code read from r, without accessing the root
+// directory.
+//
+// The manifest is decoded as a stream, one package at a time, so that
+// opening a bundle with a very large manifest doesn't require holding its
+// whole source code or its whole decoded form in memory at once.
+func newBundleFromManifest(rootDir string, r io.Reader) (*Bundle, error) {
 	ret := &Bundle{
 		rootDir:                            rootDir,
+		clock:                              SystemClock,
 		remotePackageDirs:                  make(map[sourceaddrs.RemotePackage]string),
 		remotePackageMeta:                  make(map[sourceaddrs.RemotePackage]*PackageMeta),
+		packageDirStats:                    make(map[string]*PackageStats),
+		remotePackageSubPaths:              make(map[sourceaddrs.RemotePackage][]string),
+		remotePackageVCSMetadata:           make(map[sourceaddrs.RemotePackage]struct{}),
+		remotePackageKeepRules:             make(map[sourceaddrs.RemotePackage]*ignorefiles.Ruleset),
+		remotePackageDropRules:             make(map[sourceaddrs.RemotePackage]*ignorefiles.Ruleset),
+		remotePackageLicenses:              make(map[sourceaddrs.RemotePackage][]LicenseFinding),
+		remotePackageOriginals:             make(map[sourceaddrs.RemotePackage]string),
+		remotePackageAttestations:          make(map[sourceaddrs.RemotePackage]string),
 		registryPackageSources:             make(map[regaddr.ModulePackage]map[versions.Version]sourceaddrs.RemoteSource),
 		registryPackageVersionDeprecations: make(map[regaddr.ModulePackage]map[versions.Version]*RegistryVersionDeprecation),
+		registryPackageWarnings:            make(map[regaddr.ModulePackage][]string),
+		rootFiles:                          make(map[string]manifestRootFile),
+		externalRemote:                     make(map[sourceaddrs.RemotePackage]string),
+		externalRegistry:                   make(map[regaddr.ModulePackage]string),
 	}
 
-	manifestSrc, err := os.ReadFile(filepath.Join(rootDir, manifestFilename))
+	hash := sha256.New()
+	err := decodeManifest(io.TeeReader(r, hash), manifestDecoder{
+		formatVersion: func(v uint64) error {
+			if v != 1 && v != 2 {
+				return fmt.Errorf("unsupported format version %d", v)
+			}
+			return nil
+		},
+		totalSize: func(size int64) error {
+			if size < 0 {
+				return fmt.Errorf("invalid total size %d", size)
+			}
+			ret.totalSize = size
+			return nil
+		},
+		meta: func(meta *manifestBundleMeta) error {
+			var err error
+			ret.meta, err = meta.bundleMeta()
+			return err
+		},
+		remotePackage: ret.addManifestRemotePackage,
+		registryMeta:  ret.addManifestRegistryMeta,
+		rootFile:      ret.addManifestRootFile,
+		external:      ret.addManifestExternalSource,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("cannot read manifest: %w", err)
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	copy(ret.manifestDigest[:], hash.Sum(nil))
+	if ret.totalSize == 0 {
+		// Older manifests don't record the total size, but we can still
+		// calculate it if they recorded the size of each package.
+		ret.totalSize = packageDirsSize(ret.remotePackageDirs, ret.packageDirStats)
 	}
 
-	hash := sha256.New()
-	ret.manifestChecksum = hex.EncodeToString(hash.Sum(manifestSrc))
+	return ret, nil
+}
 
-	var manifest manifestRoot
-	err = json.Unmarshal(manifestSrc, &manifest)
+// addManifestRemotePackage records the remote package described by the given
+// manifest package entry.
+func (b *Bundle) addManifestRemotePackage(rpm *manifestRemotePackage) error {
+	// We'll be quite fussy about the local directory name to avoid a
+	// crafted manifest sending us to other random places in the filesystem.
+	// It must be just a single directory name, without any path separators
+	// or any traversals.
+	localDir := filepath.ToSlash(rpm.LocalDir)
+	if !fs.ValidPath(localDir) || localDir == "." || strings.IndexByte(localDir, '/') >= 0 {
+		return fmt.Errorf("invalid package directory name %q", rpm.LocalDir)
+	}
+
+	pkgAddr, err := sourceaddrs.ParseRemotePackage(rpm.SourceAddr)
 	if err != nil {
-		return nil, fmt.Errorf("invalid manifest: %w", err)
+		return fmt.Errorf("invalid remote package address %q: %w", rpm.SourceAddr, err)
 	}
-	if manifest.FormatVersion != 1 {
-		return nil, fmt.Errorf("invalid manifest: unsupported format version %d", manifest.FormatVersion)
+	b.remotePackageDirs[pkgAddr] = localDir
+	if len(rpm.SubPaths) != 0 {
+		b.remotePackageSubPaths[pkgAddr] = rpm.SubPaths
 	}
-
-	for _, rpm := range manifest.Packages {
-		// We'll be quite fussy about the local directory name to avoid a
-		// crafted manifest sending us to other random places in the filesystem.
-		// It must be just a single directory name, without any path separators
-		// or any traversals.
-		localDir := filepath.ToSlash(rpm.LocalDir)
-		if !fs.ValidPath(localDir) || localDir == "." || strings.IndexByte(localDir, '/') >= 0 {
-			return nil, fmt.Errorf("invalid package directory name %q", rpm.LocalDir)
+	if rpm.VCSMetadata {
+		b.remotePackageVCSMetadata[pkgAddr] = struct{}{}
+	}
+	if len(rpm.KeepPatterns) != 0 {
+		rules, err := ignorefiles.ParsePatterns(rpm.KeepPatterns)
+		if err != nil {
+			return fmt.Errorf("invalid keep patterns for %s: %w", pkgAddr, err)
 		}
-
-		pkgAddr, err := sourceaddrs.ParseRemotePackage(rpm.SourceAddr)
+		b.remotePackageKeepRules[pkgAddr] = rules
+	}
+	if len(rpm.DropPatterns) != 0 {
+		rules, err := ignorefiles.ParsePatterns(rpm.DropPatterns)
 		if err != nil {
-			return nil, fmt.Errorf("invalid remote package address %q: %w", rpm.SourceAddr, err)
+			return fmt.Errorf("invalid drop patterns for %s: %w", pkgAddr, err)
 		}
-		ret.remotePackageDirs[pkgAddr] = localDir
+		b.remotePackageDropRules[pkgAddr] = rules
+	}
+	for _, finding := range rpm.Licenses {
+		b.remotePackageLicenses[pkgAddr] = append(b.remotePackageLicenses[pkgAddr], finding.licenseFinding())
+	}
+	if rpm.OriginalArchive != "" {
+		if !validOriginalDigest(rpm.OriginalArchive) {
+			return fmt.Errorf("invalid original archive checksum %q for %s", rpm.OriginalArchive, pkgAddr)
+		}
+		b.remotePackageOriginals[pkgAddr] = rpm.OriginalArchive
+	}
+	if rpm.Attestation != "" {
+		if !validOriginalDigest(rpm.Attestation) {
+			return fmt.Errorf("invalid attestation checksum %q for %s", rpm.Attestation, pkgAddr)
+		}
+		b.remotePackageAttestations[pkgAddr] = rpm.Attestation
+	}
 
-		if rpm.Meta.GitCommitID != "" {
-			ret.remotePackageMeta[pkgAddr] = PackageMetaWithGitMetadata(
-				rpm.Meta.GitCommitID,
-				rpm.Meta.GitCommitMessage,
-			)
+	// Format version 1 manifests don't include package statistics, so
+	// callers will just get nil stats for bundles of that version.
+	if rpm.Checksum != "" {
+		hashScheme := rpm.HashScheme
+		if hashScheme == "" {
+			hashScheme = DefaultPackageHasher.Name()
+		}
+		b.packageDirStats[localDir] = &PackageStats{
+			hashScheme: hashScheme,
+			checksum:   rpm.Checksum,
+			size:       rpm.Size,
+			fileCount:  rpm.FileCount,
 		}
 	}
 
-	for _, rpm := range manifest.RegistryMeta {
-		pkgAddr, err := sourceaddrs.ParseRegistryPackage(rpm.SourceAddr)
+	pkgMeta, err := rpm.Meta.packageMeta()
+	if err != nil {
+		return fmt.Errorf("invalid metadata for %s: %w", pkgAddr, err)
+	}
+	if pkgMeta != nil {
+		b.remotePackageMeta[pkgAddr] = pkgMeta
+	}
+	return nil
+}
+
+// addManifestRegistryMeta records the registry package versions described
+// by the given manifest registry entry.
+func (b *Bundle) addManifestRegistryMeta(rpm *manifestRegistryMeta) error {
+	pkgAddr, err := sourceaddrs.ParseRegistryPackage(rpm.SourceAddr)
+	if err != nil {
+		return fmt.Errorf("invalid registry package address %q: %w", rpm.SourceAddr, err)
+	}
+	vs := b.registryPackageSources[pkgAddr]
+	if vs == nil {
+		vs = make(map[versions.Version]sourceaddrs.RemoteSource)
+		b.registryPackageSources[pkgAddr] = vs
+	}
+	if len(rpm.Warnings) != 0 {
+		b.registryPackageWarnings[pkgAddr] = rpm.Warnings
+	}
+	deprecations := b.registryPackageVersionDeprecations[pkgAddr]
+	if deprecations == nil {
+		deprecations = make(map[versions.Version]*RegistryVersionDeprecation)
+		b.registryPackageVersionDeprecations[pkgAddr] = deprecations
+	}
+	for versionStr, mv := range rpm.Versions {
+		version, err := versions.ParseVersion(versionStr)
 		if err != nil {
-			return nil, fmt.Errorf("invalid registry package address %q: %w", rpm.SourceAddr, err)
-		}
-		vs := ret.registryPackageSources[pkgAddr]
-		if vs == nil {
-			vs = make(map[versions.Version]sourceaddrs.RemoteSource)
-			ret.registryPackageSources[pkgAddr] = vs
-		}
-		deprecations := ret.registryPackageVersionDeprecations[pkgAddr]
-		if deprecations == nil {
-			deprecations = make(map[versions.Version]*RegistryVersionDeprecation)
-			ret.registryPackageVersionDeprecations[pkgAddr] = deprecations
-		}
-		for versionStr, mv := range rpm.Versions {
-			version, err := versions.ParseVersion(versionStr)
-			if err != nil {
-				return nil, fmt.Errorf("invalid registry package version %q: %w", versionStr, err)
-			}
-			deprecations[version] = mv.Deprecation
-			sourceAddr, err := sourceaddrs.ParseRemoteSource(mv.SourceAddr)
-			if err != nil {
-				return nil, fmt.Errorf("invalid registry package source address %q: %w", mv.SourceAddr, err)
-			}
-			vs[version] = sourceAddr
+			return fmt.Errorf("invalid registry package version %q: %w", versionStr, err)
+		}
+		deprecations[version] = mv.Deprecation
+		sourceAddr, err := sourceaddrs.ParseRemoteSource(mv.SourceAddr)
+		if err != nil {
+			return fmt.Errorf("invalid registry package source address %q: %w", mv.SourceAddr, err)
 		}
+		vs[version] = sourceAddr
 	}
+	return nil
+}
 
+// OpenDirStrict is like [OpenDir] but additionally fails if the bundle
+// directory contains anything that the manifest doesn't refer to, which
+// suggests that the directory has been corrupted or tampered with.
+//
+// Callers that would prefer to warn about unreferenced content instead of
+// failing can use [OpenDir] followed by [Bundle.UnreferencedContent].
+func OpenDirStrict(baseDir string) (*Bundle, error) {
+	ret, err := OpenDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := ret.UnreferencedContent()
+	if err != nil {
+		return nil, err
+	}
+	if len(extra) != 0 {
+		return nil, fmt.Errorf("bundle directory contains content not referenced by the manifest: %s", strings.Join(extra, ", "))
+	}
+	return ret, nil
+}
+
+// UnreferencedContent returns the names of any entries in the top-level
+// bundle directory that are neither the manifest file, the local directory
+// of one of the bundle's remote packages, the directory of original
+// archives retained by [WithRetainedArchives], nor a file added using
+// [Builder.AddRootFile], in lexical order.
+//
+// A valid source bundle never contains any unreferenced content, so a
+// non-empty result indicates that the bundle directory has been modified
+// since it was created.
+func (b *Bundle) UnreferencedContent() ([]string, error) {
+	entries, err := os.ReadDir(b.rootDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read bundle directory: %w", err)
+	}
+
+	referenced := make(map[string]struct{}, len(b.remotePackageDirs)+1)
+	referenced[ManifestFilename] = struct{}{}
+	for _, localDir := range b.remotePackageDirs {
+		referenced[localDir] = struct{}{}
+	}
+	if len(b.remotePackageOriginals) != 0 {
+		referenced[OriginalsDirName] = struct{}{}
+	}
+	if len(b.remotePackageAttestations) != 0 {
+		referenced[AttestationsDirName] = struct{}{}
+	}
+
+	var ret []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, ok := referenced[name]; ok && (name == ManifestFilename || entry.IsDir()) {
+			continue
+		}
+		if _, ok := b.rootFiles[name]; ok && entry.Type().IsRegular() {
+			continue
+		}
+		ret = append(ret, name)
+	}
 	return ret, nil
 }
 
@@ -164,8 +415,14 @@ func (b *Bundle) LocalPathForRemoteSource(addr sourceaddrs.RemoteSource) (string
 	pkgAddr := addr.Package()
 	localName, ok := b.remotePackageDirs[pkgAddr]
 	if !ok {
+		if reason, external := b.externalRemote[pkgAddr]; external {
+			return "", externalSourceError(pkgAddr, reason)
+		}
 		return "", fmt.Errorf("source bundle does not include %s", pkgAddr)
 	}
+	if subPaths, sparse := b.remotePackageSubPaths[pkgAddr]; sparse && !subPathsInclude(subPaths, addr.SubPath()) {
+		return "", fmt.Errorf("source bundle includes only some sub-paths of %s, not including %q", pkgAddr, addr.SubPath())
+	}
 	subPath := filepath.FromSlash(addr.SubPath())
 	return filepath.Join(b.rootDir, localName, subPath), nil
 }
@@ -177,6 +434,9 @@ func (b *Bundle) LocalPathForRegistrySource(addr sourceaddrs.RegistrySource, ver
 	pkgAddr := addr.Package()
 	vs, ok := b.registryPackageSources[pkgAddr]
 	if !ok {
+		if reason, external := b.externalRegistry[pkgAddr]; external {
+			return "", externalSourceError(pkgAddr, reason)
+		}
 		return "", fmt.Errorf("source bundle does not include %s", pkgAddr)
 	}
 	baseSourceAddr, ok := vs[version]
@@ -293,14 +553,35 @@ func (b *Bundle) ChecksumV1() (string, error) {
 	// Our first checksum format assumes that the checksum of the manifest
 	// is sufficient to cover the entire archive, which in turn assumes that
 	// the builder either directly or indirectly encodes the checksum of
-	// each package into the manifest. For the initial implementation of
-	// Builder we achieve that by using the checksum as the directory name
-	// for each package, which avoids the need to redundantly store the
-	// checksum again. If a future Builder implementation moves away from
-	// using checksums as directory names then the builder will need to
-	// introduce explicit checksums as a separate property into the manifest
-	// in order to preserve our assumptions here.
-	return "h1:" + b.manifestChecksum, nil
+	// each package into the manifest. The builder records each package's
+	// checksum explicitly in its "checksum" property, because with a custom
+	// PackageHasher the directory names are not necessarily checksums.
+	// Manifests from before that property was introduced were always built
+	// with the default hasher, which uses the checksum as the directory name
+	// for each package, and so they encode it indirectly instead.
+	//
+	// The result is proportional to the size of the manifest, so rather
+	// than retaining it for the lifetime of the bundle we read the
+	// manifest again each time it's requested.
+	manifestSrc, err := b.readManifest()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	return ChecksumPrefixV1 + hex.EncodeToString(hash.Sum(manifestSrc)), nil
+}
+
+// readManifest reads the bundle's manifest source code, and returns an error
+// if it has changed since the bundle was opened.
+func (b *Bundle) readManifest() ([]byte, error) {
+	manifestSrc, err := os.ReadFile(filepath.Join(b.rootDir, ManifestFilename))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest: %w", err)
+	}
+	if sha256.Sum256(manifestSrc) != b.manifestDigest {
+		return nil, fmt.Errorf("manifest has changed since the bundle was opened")
+	}
+	return manifestSrc, nil
 }
 
 // RemotePackages returns a slice of all of the remote source packages that
@@ -318,12 +599,78 @@ func (b *Bundle) RemotePackages() []sourceaddrs.RemotePackage {
 	return ret
 }
 
+// RangeRemotePackages calls fn for each of the remote source packages that
+// contributed to this source bundle, in an unspecified order, stopping early
+// if fn returns false.
+//
+// Unlike [Bundle.RemotePackages], RangeRemotePackages doesn't allocate or
+// sort a list of all of the packages, and so is preferable for visiting
+// the packages of bundles that have very many of them.
+func (b *Bundle) RangeRemotePackages(fn func(pkgAddr sourceaddrs.RemotePackage) bool) {
+	for pkgAddr := range b.remotePackageDirs {
+		if !fn(pkgAddr) {
+			return
+		}
+	}
+}
+
 // RemotePackageMeta returns the package metadata for the given package address,
 // or nil if there is no metadata for that package tracked in the bundle.
 func (b *Bundle) RemotePackageMeta(pkgAddr sourceaddrs.RemotePackage) *PackageMeta {
 	return b.remotePackageMeta[pkgAddr]
 }
 
+// RemotePackageSubPaths returns the slash-separated sub-paths of the given
+// package that are included in the bundle, if the package was fetched only
+// partially using [WithSparseFetching]. It returns nil if the bundle
+// includes the entire package, or doesn't include the package at all.
+func (b *Bundle) RemotePackageSubPaths(pkgAddr sourceaddrs.RemotePackage) []string {
+	return append([]string(nil), b.remotePackageSubPaths[pkgAddr]...)
+}
+
+// RemotePackageStats returns the checksum, size, and file count of the
+// content of the given package, or nil if the bundle doesn't include that
+// package or was created by an older version of this library that didn't
+// record package statistics.
+func (b *Bundle) RemotePackageStats(pkgAddr sourceaddrs.RemotePackage) *PackageStats {
+	localDir, ok := b.remotePackageDirs[pkgAddr]
+	if !ok {
+		return nil
+	}
+	return b.packageDirStats[localDir]
+}
+
+// TotalSize returns the total size in bytes of the content of all of the
+// files in the bundle's remote packages, as recorded in the manifest when
+// the bundle was created. Packages whose content was identical are counted
+// only once, because they share a single directory in the bundle. Use
+// [Bundle.RemotePackageStats] to find the size of each package.
+//
+// The result doesn't include the size of the manifest, of any retained
+// original archives or attestations, or of any root files. It's zero for
+// bundles created by older versions of this library that didn't record
+// package statistics.
+func (b *Bundle) TotalSize() int64 {
+	return b.totalSize
+}
+
+// packageDirsSize returns the total size of the distinct package directories
+// used by the given packages, using whatever statistics are available.
+func packageDirsSize(dirs map[sourceaddrs.RemotePackage]string, stats map[string]*PackageStats) int64 {
+	var ret int64
+	seen := make(map[string]struct{}, len(dirs))
+	for _, localDir := range dirs {
+		if _, ok := seen[localDir]; ok {
+			continue
+		}
+		seen[localDir] = struct{}{}
+		if s := stats[localDir]; s != nil {
+			ret += s.size
+		}
+	}
+	return ret
+}
+
 // RegistryPackages returns a list of all of the distinct registry packages
 // that contributed to this bundle.
 //
@@ -339,6 +686,24 @@ func (b *Bundle) RegistryPackages() []regaddr.ModulePackage {
 	return ret
 }
 
+// RangeRegistryPackageVersions calls fn for each version of each registry
+// package that contributed to this bundle, along with the remote source
+// address that the version refers to, in an unspecified order, stopping
+// early if fn returns false.
+//
+// This is equivalent to calling [Bundle.RegistryPackageVersions] and
+// [Bundle.RegistryPackageSourceAddr] for each of [Bundle.RegistryPackages],
+// but without allocating or sorting any lists.
+func (b *Bundle) RangeRegistryPackageVersions(fn func(pkgAddr regaddr.ModulePackage, version versions.Version, sourceAddr sourceaddrs.RemoteSource) bool) {
+	for pkgAddr, vs := range b.registryPackageSources {
+		for version, sourceAddr := range vs {
+			if !fn(pkgAddr, version, sourceAddr) {
+				return
+			}
+		}
+	}
+}
+
 // RegistryPackageVersions returns a list of all of the versions of the given
 // module registry package that this bundle has package content for.
 //
@@ -362,10 +727,56 @@ func (b *Bundle) RegistryPackageVersions(pkgAddr regaddr.ModulePackage) versions
 	return ret
 }
 
+// RegistryPackageVersionDeprecation returns the deprecation that the
+// registry reported for the given version of the given module package when
+// the bundle was built, or nil if that version was not deprecated.
 func (b *Bundle) RegistryPackageVersionDeprecation(pkgAddr regaddr.ModulePackage, version versions.Version) *RegistryVersionDeprecation {
 	return b.registryPackageVersionDeprecations[pkgAddr][version]
 }
 
+// RegistryPackageWarnings returns any warnings that the registry returned
+// about the given module package when the bundle was built.
+func (b *Bundle) RegistryPackageWarnings(pkgAddr regaddr.ModulePackage) []string {
+	return append([]string(nil), b.registryPackageWarnings[pkgAddr]...)
+}
+
+// RegistryDiagnostics returns warning diagnostics describing each of the
+// deprecated registry package versions included in the bundle and each of
+// the warnings the registry returned about the included packages, so that
+// a caller using the bundle can report them just as they would have been
+// reported while building it.
+func (b *Bundle) RegistryDiagnostics() Diagnostics {
+	var diags Diagnostics
+	for _, pkgAddr := range b.RegistryPackages() {
+		for _, version := range b.RegistryPackageVersions(pkgAddr) {
+			deprecation := b.RegistryPackageVersionDeprecation(pkgAddr, version)
+			if deprecation == nil {
+				continue
+			}
+			detail := fmt.Sprintf("Version %s of %s is deprecated.", version, pkgAddr)
+			if deprecation.Reason != "" {
+				detail += " " + deprecation.Reason
+			}
+			if deprecation.Link != "" {
+				detail += fmt.Sprintf("\n\nFor more information, see %s.", deprecation.Link)
+			}
+			diags = append(diags, &internalDiagnostic{
+				severity: DiagWarning,
+				summary:  "Deprecated module package version",
+				detail:   detail,
+			})
+		}
+		for _, warning := range b.registryPackageWarnings[pkgAddr] {
+			diags = append(diags, &internalDiagnostic{
+				severity: DiagWarning,
+				summary:  "Module registry warning",
+				detail:   fmt.Sprintf("The registry returned a warning for %s: %s", pkgAddr, warning),
+			})
+		}
+	}
+	return diags
+}
+
 // RegistryPackageSourceAddr returns the remote source address corresponding
 // to the given version of the given module package, or sets its second return
 // value to false if no such version is included in the bundle.
@@ -374,6 +785,145 @@ func (b *Bundle) RegistryPackageSourceAddr(pkgAddr regaddr.ModulePackage, versio
 	return sourceAddr, ok
 }
 
+// Repair verifies that the content of each package directory in the bundle
+// still matches the checksum it was created with, and uses the given fetcher
+// to fetch a fresh copy from its origin of any package whose content does not.
+// Packages whose content is still valid are left untouched.
+//
+// This is intended for long-lived shared caches built from source bundles,
+// where the on-disk content might be damaged at some point after the bundle
+// was created. Repair is an exception to the rule that nothing may modify the
+// bundle directory while a [Bundle] is open, and so the caller must make sure
+// that nothing else is reading from the bundle while Repair is running.
+//
+// If a freshly-fetched package doesn't match the checksum recorded for it,
+// such as if the upstream package has changed since the bundle was built,
+// the damaged directory is left as-is and Repair returns an error describing
+// the problem.
+//
+// Repair reports its downloads to any [BuildTracer] associated with the
+// given context, using the same callbacks as [Builder].
+func (b *Bundle) Repair(ctx context.Context, fetcher PackageFetcher) error {
+	// Multiple packages can share a single directory if they happened to
+	// have identical content, so we'll group them so that we only need to
+	// re-fetch one of them.
+	pkgsByDir := make(map[string][]sourceaddrs.RemotePackage)
+	for _, pkgAddr := range b.RemotePackages() {
+		localDir := b.remotePackageDirs[pkgAddr]
+		pkgsByDir[localDir] = append(pkgsByDir[localDir], pkgAddr)
+	}
+	localDirs := make([]string, 0, len(pkgsByDir))
+	for localDir := range pkgsByDir {
+		localDirs = append(localDirs, localDir)
+	}
+	sort.Strings(localDirs)
+
+	var errs []error
+	for _, localDir := range localDirs {
+		hasher, err := b.packageHasherForDir(localDir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		gotDir, _, err := packageDirName(filepath.Join(b.rootDir, localDir), hasher)
+		if err == nil && gotDir == localDir {
+			continue // this package is still valid
+		}
+
+		err = b.repairPackageDir(ctx, fetcher, localDir, pkgsByDir[localDir])
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *Bundle) repairPackageDir(ctx context.Context, fetcher PackageFetcher, localDir string, pkgAddrs []sourceaddrs.RemotePackage) error {
+	trace := buildTraceFromContext(ctx)
+
+	// Any one of the given packages should be sufficient to reproduce the
+	// content, but we'll try each of them in turn just in case some of them
+	// have changed upstream since the bundle was created.
+	var errs []error
+	for _, pkgAddr := range pkgAddrs {
+		var reqCtx context.Context
+		if cb := trace.RemotePackageDownloadStart; cb != nil {
+			reqCtx = cb(ctx, pkgAddr)
+		}
+		if reqCtx == nil {
+			reqCtx = ctx
+		}
+
+		err := b.refetchPackageDir(reqCtx, fetcher, localDir, pkgAddr)
+		if err != nil {
+			if cb := trace.RemotePackageDownloadFailure; cb != nil {
+				cb(reqCtx, pkgAddr, err)
+			}
+			errs = append(errs, fmt.Errorf("failed to repair %s: %w", pkgAddr, err))
+			continue
+		}
+		if cb := trace.RemotePackageDownloadSuccess; cb != nil {
+			cb(reqCtx, pkgAddr)
+		}
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+func (b *Bundle) refetchPackageDir(ctx context.Context, fetcher PackageFetcher, localDir string, pkgAddr sourceaddrs.RemotePackage) error {
+	workDir, err := ioutil.TempDir(b.rootDir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create new package directory: %w", err)
+	}
+	// If we succeed then workDir will have been renamed away before we
+	// return, in which case this will do nothing.
+	defer os.RemoveAll(workDir)
+
+	// If the package was fetched sparsely then we must fetch the same
+	// sub-paths again to reproduce the same content.
+	subPaths := b.remotePackageSubPaths[pkgAddr]
+	response, _, err := fetchPackage(ctx, fetcher, pkgAddr.SourceType(), pkgAddr.URL(), workDir, subPaths)
+	if err != nil {
+		return fmt.Errorf("failed to fetch package: %w", err)
+	}
+	if err := removeOriginalArchive(workDir, response.ArchiveFile); err != nil {
+		return err
+	}
+	// The package must also be prepared in the same way as before.
+	_, keepVCSMetadata := b.remotePackageVCSMetadata[pkgAddr]
+	_, err = preparePackageDir(pkgAddr, workDir, prepareOptions{
+		rootSubdir:      response.RootSubdir,
+		keepVCSMetadata: keepVCSMetadata,
+		keepRules:       b.remotePackageKeepRules[pkgAddr],
+		dropRules:       b.remotePackageDropRules[pkgAddr],
+	})
+	if err != nil {
+		return err
+	}
+	hasher, err := b.packageHasherForDir(localDir)
+	if err != nil {
+		return err
+	}
+	gotDir, _, err := packageDirName(workDir, hasher)
+	if err != nil {
+		return err
+	}
+	if gotDir != localDir {
+		return fmt.Errorf("package content has changed since the source bundle was created")
+	}
+
+	finalDir := filepath.Join(b.rootDir, localDir)
+	err = os.RemoveAll(finalDir)
+	if err != nil {
+		return fmt.Errorf("failed to remove damaged package directory: %w", err)
+	}
+	err = os.Rename(workDir, finalDir)
+	if err != nil {
+		return fmt.Errorf("failed to place repaired package directory: %w", err)
+	}
+	return nil
+}
+
 // WriteArchive writes a source bundle archive containing the same contents
 // as the bundle to the given writer.
 //
@@ -384,7 +934,13 @@ func (b *Bundle) WriteArchive(w io.Writer) error {
 	// For this part we just delegate to the main slug packer, since a
 	// source bundle archive is effectively just a slug with multiple packages
 	// (and a manifest) inside it.
-	packer, err := slug.NewPacker(slug.DereferenceSymlinks())
+	//
+	// We write the manifest first so that [ExtractArchivePackage] can find
+	// the package it needs without reading the entire archive.
+	packer, err := slug.NewPacker(
+		slug.DereferenceSymlinks(),
+		slug.WithLeadingEntries(ManifestFilename),
+	)
 	if err != nil {
 		return fmt.Errorf("can't instantiate archive packer: %w", err)
 	}
@@ -392,6 +948,37 @@ func (b *Bundle) WriteArchive(w io.Writer) error {
 	return err
 }
 
+// PackagePackSlug writes a standalone slug archive to the given writer
+// containing only the content of the directory that the given source address
+// refers to, which must belong to a package included in the bundle.
+//
+// To pack an entire package, pass the source address of the package's root
+// directory, as returned by [sourceaddrs.RemotePackage.SourceAddr] with an
+// empty sub-path. Symlinks are dereferenced, so that the result is
+// self-contained even when packing a sub-path whose files refer to other
+// parts of the same package.
+func (b *Bundle) PackagePackSlug(source sourceaddrs.RemoteSource, w io.Writer) (*slug.Meta, error) {
+	localPath, err := b.LocalPathForRemoteSource(source)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot pack %s: %w", source, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("cannot pack %s: not a directory", source)
+	}
+
+	// The package content already had its ignore rules applied when it
+	// was added to the bundle, so we don't need to apply them again here.
+	packer, err := slug.NewPacker(slug.DereferenceSymlinks())
+	if err != nil {
+		return nil, fmt.Errorf("can't instantiate slug packer: %w", err)
+	}
+	return packer.Pack(localPath, w)
+}
+
 // ExtractArchive reads a source bundle archive from the given reader and
 // extracts it into the given target directory, which must already exist and
 // must be empty.
@@ -407,3 +994,173 @@ func ExtractArchive(r io.Reader, targetDir string) (*Bundle, error) {
 	}
 	return OpenDir(targetDir)
 }
+
+// ExtractArchiveVerified is like [ExtractArchive] but also verifies that the
+// extracted bundle has the given checksum, as returned by
+// [Bundle.ChecksumV1], and that the content of each package directory
+// matches the checksum recorded for it in the manifest.
+//
+// If extraction or verification fails then ExtractArchiveVerified removes
+// everything it extracted, leaving the target directory empty again.
+func ExtractArchiveVerified(r io.Reader, targetDir string, wantChecksum string) (*Bundle, error) {
+	ret, err := extractArchiveVerified(r, targetDir, wantChecksum)
+	if err != nil {
+		if cleanErr := emptyDir(targetDir); cleanErr != nil {
+			return nil, fmt.Errorf("%w; additionally, failed to remove partial extraction: %s", err, cleanErr)
+		}
+		return nil, err
+	}
+	return ret, nil
+}
+
+func extractArchiveVerified(r io.Reader, targetDir string, wantChecksum string) (*Bundle, error) {
+	ret, err := ExtractArchive(r, targetDir)
+	if err != nil {
+		return nil, err
+	}
+	gotChecksum, err := ret.ChecksumV1()
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate bundle checksum: %w", err)
+	}
+	if gotChecksum != wantChecksum {
+		return nil, fmt.Errorf("bundle checksum %s does not match expected checksum %s", gotChecksum, wantChecksum)
+	}
+	if err := ret.CheckIntegrity(CheckPackageContent); err != nil {
+		return nil, fmt.Errorf("bundle failed verification: %w", err)
+	}
+	return ret, nil
+}
+
+// emptyDir removes everything inside the given directory, but not the
+// directory itself.
+func emptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractArchivePackage reads a source bundle archive from the given reader
+// and extracts only the package containing the given source address into the
+// given target directory, which must already exist and must be empty.
+//
+// If successful, it returns the local path within the target directory that
+// corresponds with the given source address. The target directory is not
+// itself a valid source bundle, because it contains only the package content
+// and no manifest.
+//
+// This function requires the manifest to be the first file in the archive,
+// as it is for archives created by [Bundle.WriteArchive], so that it can
+// decide which entries to extract while reading the archive as a stream.
+func ExtractArchivePackage(r io.Reader, source sourceaddrs.FinalSource, targetDir string) (string, error) {
+	if _, ok := source.(sourceaddrs.LocalSource); ok {
+		return "", fmt.Errorf("cannot extract package for local source %s", source)
+	}
+	absDir, err := filepath.Abs(targetDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid target directory: %w", err)
+	}
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid target directory: %w", err)
+	}
+	if len(entries) != 0 {
+		return "", fmt.Errorf("target directory %s is not empty", targetDir)
+	}
+
+	gzipR, err := gzip.NewReader(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to decompress archive: %w", err)
+	}
+	tarR := tar.NewReader(gzipR)
+
+	// The manifest should be the first entry other than directories, which
+	// we can safely skip because the package directory's own entry would
+	// come after the manifest in any case.
+	//
+	// We use an empty root directory here so that LocalPathForSource will
+	// return a relative path whose first element is the package directory.
+	var manifestBundle *Bundle
+	for manifestBundle == nil {
+		header, err := tarR.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("archive does not contain a source bundle manifest")
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read archive: %w", err)
+		}
+		switch {
+		case header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeXGlobalHeader:
+			continue
+		case header.Name != ManifestFilename:
+			return "", fmt.Errorf("archive does not begin with a source bundle manifest")
+		}
+		manifestBundle, err = newBundleFromManifest("", tarR)
+		if err != nil {
+			return "", err
+		}
+	}
+	localPath, err := manifestBundle.LocalPathForSource(source)
+	if err != nil {
+		return "", err
+	}
+	localDir, subPath, _ := strings.Cut(filepath.ToSlash(localPath), "/")
+	prefix := localDir + "/"
+
+	// We'll pass just the entries in the package directory through to the
+	// usual slug unpacker, so that we get all of its safety checks.
+	pr, pw := io.Pipe()
+	filterErr := make(chan error, 1)
+	go func() {
+		gzipW, _ := gzip.NewWriterLevel(pw, gzip.NoCompression)
+		tarW := tar.NewWriter(gzipW)
+		err := func() error {
+			for {
+				header, err := tarR.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("failed to read archive: %w", err)
+				}
+				name, ok := strings.CutPrefix(header.Name, prefix)
+				if !ok || name == "" {
+					continue
+				}
+				header.Name = name
+				if err := tarW.WriteHeader(header); err != nil {
+					return err
+				}
+				if _, err := io.Copy(tarW, tarR); err != nil {
+					return err
+				}
+			}
+		}()
+		if err == nil {
+			err = tarW.Close()
+		}
+		if err == nil {
+			err = gzipW.Close()
+		}
+		pw.CloseWithError(err)
+		filterErr <- err
+	}()
+
+	err = slug.Unpack(pr, absDir)
+	// If Unpack failed early then we must unblock the filter goroutine.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if fErr := <-filterErr; fErr != nil && err == nil {
+		err = fErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(absDir, filepath.FromSlash(subPath)), nil
+}
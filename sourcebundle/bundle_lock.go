@@ -0,0 +1,717 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockMode selects whether a [DirLock] can be held by many processes at once
+// or by only one.
+type LockMode int
+
+const (
+	// SharedLock can be held by any number of holders at once, as long as
+	// nothing holds an [ExclusiveLock] for the same directory. Processes that
+	// only read a bundle directory should take a shared lock.
+	SharedLock LockMode = iota
+
+	// ExclusiveLock can be held by only one holder at a time, and only while
+	// nothing holds a [SharedLock] for the same directory. Processes that
+	// create or modify a bundle directory should take an exclusive lock.
+	ExclusiveLock
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case SharedLock:
+		return "shared"
+	case ExclusiveLock:
+		return "exclusive"
+	default:
+		return fmt.Sprintf("LockMode(%d)", int(m))
+	}
+}
+
+// DefaultLockTTL is how long a lock entry remains valid without being
+// refreshed, unless overridden using [WithLockTTL]. A [DirLock] refreshes
+// its entry several times per TTL for as long as it's held, so the TTL only
+// matters for deciding when the lock of a process that exited without
+// unlocking can be broken.
+const DefaultLockTTL = time.Minute
+
+// defaultLockPollInterval is how often a process waiting for a lock checks
+// whether it has become available, unless overridden using
+// [WithLockPollInterval].
+const defaultLockPollInterval = 100 * time.Millisecond
+
+// lockWriterEntry is the name of the entry that represents the exclusive
+// holder of a lock, while lockReaderPrefix is the prefix of the names of the
+// entries that represent each of the shared holders.
+const (
+	lockWriterEntry  = "write"
+	lockReaderPrefix = "read-"
+)
+
+// LockOption is a functional option for customizing the behavior of
+// [LockDir] and the functions that call it.
+type LockOption func(*lockOptions) error
+
+type lockOptions struct {
+	ttl          time.Duration
+	pollInterval time.Duration
+	timeout      time.Duration
+	clock        Clock
+}
+
+// WithLockTTL is a LockOption that sets how long the lock's entry remains
+// valid if the holder stops refreshing it, such as because the holding
+// process was killed. The default is [DefaultLockTTL].
+//
+// All processes sharing a directory should use the same TTL, because it's
+// the holder's TTL that decides how often the holder refreshes its entry.
+func WithLockTTL(ttl time.Duration) LockOption {
+	return func(o *lockOptions) error {
+		if ttl <= 0 {
+			return fmt.Errorf("lock TTL must be positive")
+		}
+		o.ttl = ttl
+		return nil
+	}
+}
+
+// WithLockPollInterval is a LockOption that sets how often a process waiting
+// for a lock checks whether it has become available.
+func WithLockPollInterval(interval time.Duration) LockOption {
+	return func(o *lockOptions) error {
+		if interval <= 0 {
+			return fmt.Errorf("lock poll interval must be positive")
+		}
+		o.pollInterval = interval
+		return nil
+	}
+}
+
+// WithLockTimeout is a LockOption that makes acquiring the lock fail if it
+// doesn't become available within the given duration. By default a process
+// waits for as long as its context allows.
+func WithLockTimeout(timeout time.Duration) LockOption {
+	return func(o *lockOptions) error {
+		if timeout <= 0 {
+			return fmt.Errorf("lock timeout must be positive")
+		}
+		o.timeout = timeout
+		return nil
+	}
+}
+
+// WithLockClock is a LockOption that makes the lock use the given clock for
+// its expiry times and polling, instead of [SystemClock].
+func WithLockClock(clock Clock) LockOption {
+	return func(o *lockOptions) error {
+		if clock == nil {
+			return fmt.Errorf("clock must not be nil")
+		}
+		o.clock = clock
+		return nil
+	}
+}
+
+// DirLock is an advisory lock on a directory, which processes on the same
+// host that share a bundle directory can use to coordinate with one another.
+// Use [LockDir] to acquire one.
+//
+// The lock is represented by a directory alongside the locked directory,
+// with the same name plus a ".lock" suffix, which contains one entry for
+// each holder. Each entry records the holder's process ID and hostname, and
+// a time after which the entry is considered stale unless the holder has
+// refreshed it. A DirLock refreshes its entry in the background until it's
+// unlocked.
+//
+// The lock is only advisory: it protects a directory only from processes
+// that also use DirLock, directly or through functions such as
+// [OpenDirLocked].
+type DirLock struct {
+	lockDir string
+	opts    lockOptions
+	self    lockEntry
+
+	// stop and stopped coordinate with the goroutine that refreshes the
+	// entries in entries.
+	stop    chan struct{}
+	stopped chan struct{}
+
+	mu      sync.Mutex
+	mode    LockMode
+	entries []string
+	lostErr error
+}
+
+// lockEntry is the content of each entry in a lock directory.
+type lockEntry struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// LockDir acquires a lock of the given mode on the given directory, waiting
+// until any conflicting lock has been released, the given context is
+// cancelled, or the timeout set using [WithLockTimeout] has passed.
+//
+// The lock is held until [DirLock.Unlock] is called. If the holding process
+// exits without unlocking, then the lock can be broken once its entry has
+// expired, or sooner by another process on the same host that can tell that
+// the holder is no longer running.
+//
+// An exclusive lock waits for existing shared holders to unlock, but new
+// shared holders wait for the exclusive holder, so a steady stream of
+// readers cannot starve a writer.
+func LockDir(ctx context.Context, dir string, mode LockMode, opts ...LockOption) (*DirLock, error) {
+	o := lockOptions{
+		ttl:          DefaultLockTTL,
+		pollInterval: defaultLockPollInterval,
+		clock:        SystemClock,
+	}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, fmt.Errorf("option failed: %w", err)
+		}
+	}
+	if mode != SharedLock && mode != ExclusiveLock {
+		return nil, fmt.Errorf("unsupported lock mode %s", mode)
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid directory: %w", err)
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	host, _ := os.Hostname()
+	l := &DirLock{
+		lockDir: absDir + ".lock",
+		opts:    o,
+		self: lockEntry{
+			PID:   os.Getpid(),
+			Host:  host,
+			Token: randomLockToken(),
+		},
+		mode:    mode,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	// We start refreshing before the lock is acquired, because an exclusive
+	// holder's entry must remain valid while it waits for shared holders.
+	go l.refresh(l.stop)
+
+	if mode == ExclusiveLock {
+		err = l.acquireExclusive(ctx)
+	} else {
+		err = l.acquireShared(ctx)
+	}
+	if err != nil {
+		l.Unlock()
+		return nil, fmt.Errorf("failed to acquire %s lock on %s: %w", mode, absDir, err)
+	}
+	return l, nil
+}
+
+// Mode returns the mode that the lock is currently held in.
+func (l *DirLock) Mode() LockMode {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.mode
+}
+
+// Downgrade converts an exclusive lock into a shared lock without releasing
+// it in between, so that a process that has finished creating a directory
+// can go on reading it without another writer changing it first.
+func (l *DirLock) Downgrade() error {
+	l.mu.Lock()
+	mode := l.mode
+	l.mu.Unlock()
+	if mode != ExclusiveLock {
+		return fmt.Errorf("only an exclusive lock can be downgraded")
+	}
+
+	// Our shared entry must exist before our exclusive entry disappears, so
+	// that there's no moment where another writer could take over.
+	name := l.readerEntryName()
+	if _, err := l.createEntry(name); err != nil {
+		return fmt.Errorf("failed to downgrade lock: %w", err)
+	}
+	l.mu.Lock()
+	l.entries = []string{name}
+	l.mode = SharedLock
+	l.mu.Unlock()
+	l.removeEntry(lockWriterEntry)
+	return nil
+}
+
+// Unlock releases the lock. Unlocking a lock that's already unlocked does
+// nothing.
+//
+// Unlock returns an error if the lock's entry was broken by another process
+// while it was held, such as because the holder was suspended for longer
+// than the lock's TTL, in which case the holder can't be sure that nothing
+// else modified the directory in the meantime.
+func (l *DirLock) Unlock() error {
+	l.mu.Lock()
+	if l.stop == nil {
+		l.mu.Unlock()
+		return nil
+	}
+	close(l.stop)
+	l.stop = nil
+	l.mu.Unlock()
+	<-l.stopped
+
+	l.mu.Lock()
+	entries := l.entries
+	l.entries = nil
+	err := l.lostErr
+	l.mu.Unlock()
+	for _, name := range entries {
+		if owned, _ := l.ownsEntry(name); owned {
+			os.Remove(filepath.Join(l.lockDir, name))
+		}
+	}
+	// This fails if anyone else is still using the lock directory, in which
+	// case they'll remove it once they're done.
+	os.Remove(l.lockDir)
+	return err
+}
+
+func (l *DirLock) acquireExclusive(ctx context.Context) error {
+	ticker := l.opts.clock.NewTicker(l.opts.pollInterval)
+	defer ticker.Stop()
+
+	// First we claim the writer entry, which also blocks any new shared
+	// holders from joining while we wait for the existing ones to leave.
+	for {
+		created, err := l.createEntry(lockWriterEntry)
+		if err != nil {
+			return err
+		}
+		if created {
+			l.mu.Lock()
+			l.entries = append(l.entries, lockWriterEntry)
+			l.mu.Unlock()
+			break
+		}
+		live, err := l.entryLive(lockWriterEntry)
+		if err != nil {
+			return err
+		}
+		if !live {
+			continue // the stale entry is gone, so we can try again immediately
+		}
+		if err := waitForTick(ctx, ticker); err != nil {
+			return err
+		}
+	}
+
+	for {
+		entries, err := os.ReadDir(l.lockDir)
+		if err != nil {
+			return err
+		}
+		busy := false
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasPrefix(name, lockReaderPrefix) {
+				continue
+			}
+			live, err := l.entryLive(name)
+			if err != nil {
+				return err
+			}
+			busy = busy || live
+		}
+		if !busy {
+			return nil
+		}
+		if err := waitForTick(ctx, ticker); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *DirLock) acquireShared(ctx context.Context) error {
+	ticker := l.opts.clock.NewTicker(l.opts.pollInterval)
+	defer ticker.Stop()
+
+	name := l.readerEntryName()
+	for {
+		// We must create our entry before checking for a writer: a writer
+		// that claims the lock after our check will then see our entry and
+		// wait for us, rather than both of us proceeding.
+		if _, err := l.createEntry(name); err != nil {
+			return err
+		}
+		l.mu.Lock()
+		l.entries = append(l.entries, name)
+		l.mu.Unlock()
+
+		live, err := l.entryLive(lockWriterEntry)
+		if err != nil {
+			return err
+		}
+		if !live {
+			return nil
+		}
+
+		// There's an active writer, so we'll step aside until it's done.
+		l.mu.Lock()
+		l.entries = l.entries[:len(l.entries)-1]
+		l.mu.Unlock()
+		l.removeEntry(name)
+		if err := waitForTick(ctx, ticker); err != nil {
+			return err
+		}
+	}
+}
+
+func waitForTick(ctx context.Context, ticker Ticker) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ticker.C():
+		return nil
+	}
+}
+
+// refresh periodically extends the expiry time of each of the receiver's
+// entries until the lock is unlocked.
+func (l *DirLock) refresh(stop <-chan struct{}) {
+	defer close(l.stopped)
+	ticker := l.opts.clock.NewTicker(l.opts.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+		}
+
+		l.mu.Lock()
+		entries := append([]string(nil), l.entries...)
+		l.mu.Unlock()
+		for _, name := range entries {
+			if err := l.refreshEntry(name); err != nil {
+				l.mu.Lock()
+				if l.lostErr == nil {
+					l.lostErr = err
+				}
+				l.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (l *DirLock) refreshEntry(name string) error {
+	owned, err := l.ownsEntry(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to refresh lock entry %s: %w", name, err)
+	}
+	if !owned {
+		return fmt.Errorf("lock entry %s was broken by another process", name)
+	}
+	// We write the new content to a temporary file first, so that nothing
+	// can see a partially-written entry. The temporary name doesn't look
+	// like a lock entry, so nothing else will consider it.
+	tmpName := filepath.Join(l.lockDir, ".tmp-"+name)
+	if err := os.WriteFile(tmpName, l.entryContent(), 0644); err != nil {
+		return fmt.Errorf("failed to refresh lock entry %s: %w", name, err)
+	}
+	if err := os.Rename(tmpName, filepath.Join(l.lockDir, name)); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to refresh lock entry %s: %w", name, err)
+	}
+	return nil
+}
+
+// createEntry creates the entry with the given name, or returns false if an
+// entry with that name already exists.
+func (l *DirLock) createEntry(name string) (bool, error) {
+	filename := filepath.Join(l.lockDir, name)
+	for {
+		if err := os.MkdirAll(l.lockDir, 0755); err != nil {
+			return false, err
+		}
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			return false, nil
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			// Another process removed the lock directory after we created
+			// it, because it was done with it, so we'll create it again.
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		_, err = f.Write(l.entryContent())
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(filename)
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+func (l *DirLock) removeEntry(name string) {
+	if owned, _ := l.ownsEntry(name); owned {
+		os.Remove(filepath.Join(l.lockDir, name))
+	}
+}
+
+// entryLive returns true if the entry with the given name exists and belongs
+// to a holder that still seems to be active. If the entry exists but is
+// stale then entryLive removes it.
+func (l *DirLock) entryLive(name string) (bool, error) {
+	filename := filepath.Join(l.lockDir, name)
+	entry, err := l.readEntry(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if entry.Token == l.self.Token || !l.entryStale(entry) {
+		return true, nil
+	}
+
+	// To avoid removing a fresh entry that another process created after
+	// we read the stale one, we move the entry aside before checking it
+	// again, and put it back if it turns out to be a different entry.
+	asideName := filepath.Join(l.lockDir, ".stale-"+randomLockToken())
+	if err := os.Rename(filename, asideName); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil // someone else already removed it
+		}
+		return false, err
+	}
+	if aside, err := l.readEntry(asideName); err == nil && aside.Token != entry.Token {
+		if err := os.Link(asideName, filename); err == nil {
+			os.Remove(asideName)
+			return true, nil
+		}
+	}
+	os.Remove(asideName)
+	return false, nil
+}
+
+func (l *DirLock) entryStale(entry lockEntry) bool {
+	if l.opts.clock.Now().After(entry.Expires) {
+		return true
+	}
+	if entry.Host == l.self.Host && entry.PID != l.self.PID && !processExists(entry.PID) {
+		return true
+	}
+	return false
+}
+
+// readEntry reads the lock entry in the given file. An entry that isn't
+// valid, such as because its holder is still writing it, is treated as
+// belonging to an unknown holder that will expire one TTL after the file
+// was last modified.
+func (l *DirLock) readEntry(filename string) (lockEntry, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return lockEntry{}, err
+	}
+	var ret lockEntry
+	if err := json.Unmarshal(content, &ret); err != nil || ret.Token == "" {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return lockEntry{}, err
+		}
+		return lockEntry{
+			Token:   "unknown",
+			Expires: info.ModTime().Add(l.opts.ttl),
+		}, nil
+	}
+	return ret, nil
+}
+
+// ownsEntry returns true if the entry with the given name belongs to the
+// receiver.
+func (l *DirLock) ownsEntry(name string) (bool, error) {
+	entry, err := l.readEntry(filepath.Join(l.lockDir, name))
+	if err != nil {
+		return false, err
+	}
+	return entry.Token == l.self.Token, nil
+}
+
+func (l *DirLock) entryContent() []byte {
+	entry := l.self
+	entry.Expires = l.opts.clock.Now().Add(l.opts.ttl)
+	ret, err := json.Marshal(entry)
+	if err != nil {
+		// Should not get here, because lockEntry always marshals.
+		panic(fmt.Sprintf("failed to marshal lock entry: %s", err))
+	}
+	return ret
+}
+
+func (l *DirLock) readerEntryName() string {
+	return fmt.Sprintf("%s%d-%s", lockReaderPrefix, l.self.PID, randomLockToken())
+}
+
+func randomLockToken() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// Should not get here, because crypto/rand doesn't fail on any
+		// platform we support.
+		panic(fmt.Sprintf("failed to generate lock token: %s", err))
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// OpenDirLocked is like [OpenDir] but first acquires a shared lock on the
+// bundle directory, waiting for any process holding an exclusive lock, such
+// as a [Builder] using [WithDirLock], to finish with it.
+//
+// The returned bundle holds the lock until [Bundle.Unlock] is called.
+func OpenDirLocked(ctx context.Context, baseDir string, opts ...LockOption) (*Bundle, error) {
+	lock, err := LockDir(ctx, baseDir, SharedLock, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := OpenDir(baseDir)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	ret.lock = lock
+	return ret, nil
+}
+
+// ExtractArchiveLocked is like [ExtractArchive] but holds an exclusive lock
+// on the target directory while extracting into it, and then a shared lock
+// on it for the lifetime of the returned bundle, until [Bundle.Unlock] is
+// called.
+//
+// If another process has already extracted a bundle into the target
+// directory, then ExtractArchiveLocked opens that bundle instead of
+// extracting the archive, and doesn't read from r at all. This allows many
+// processes to share a single extraction of the same archive.
+//
+// If extraction fails then ExtractArchiveLocked removes everything it
+// extracted before releasing the lock, leaving the target directory empty
+// again.
+func ExtractArchiveLocked(ctx context.Context, r io.Reader, targetDir string, opts ...LockOption) (*Bundle, error) {
+	// The bundle has usually been extracted already, in which case a shared
+	// lock is all we need and we won't block the other readers.
+	lock, err := LockDir(ctx, targetDir, SharedLock, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := openExistingBundle(targetDir)
+	if err != nil || ret != nil {
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+		ret.lock = lock
+		return ret, nil
+	}
+	if err := lock.Unlock(); err != nil {
+		return nil, err
+	}
+
+	lock, err = LockDir(ctx, targetDir, ExclusiveLock, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Another process might have extracted the bundle while we weren't
+	// holding the lock.
+	ret, err = openExistingBundle(targetDir)
+	if err == nil && ret == nil {
+		ret, err = ExtractArchive(r, targetDir)
+		if err != nil {
+			// The manifest is the first entry in the archive, so a partial
+			// extraction would otherwise look like a complete bundle to the
+			// next process.
+			if cleanErr := emptyDir(targetDir); cleanErr != nil {
+				err = fmt.Errorf("%w; additionally, failed to remove partial extraction: %s", err, cleanErr)
+			}
+		}
+	}
+	if err == nil {
+		err = lock.Downgrade()
+	}
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	ret.lock = lock
+	return ret, nil
+}
+
+// openExistingBundle opens the bundle in the given directory, or returns nil
+// if the directory doesn't contain a bundle manifest.
+func openExistingBundle(dir string) (*Bundle, error) {
+	_, err := os.Stat(filepath.Join(dir, ManifestFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot check for an existing bundle: %w", err)
+	}
+	return OpenDir(dir)
+}
+
+// Unlock releases the lock held by a bundle returned from [OpenDirLocked],
+// [ExtractArchiveLocked], or [Builder.Close] for a builder using
+// [WithDirLock]. It does nothing for a bundle that doesn't hold a lock.
+//
+// The bundle must not be used after calling Unlock, because the directory
+// might then be modified by another process.
+func (b *Bundle) Unlock() error {
+	if b.lock == nil {
+		return nil
+	}
+	return b.lock.Unlock()
+}
+
+// WithDirLock is a BuilderOption that makes [NewBuilder] acquire an
+// exclusive [DirLock] on the target directory before the builder starts
+// working, so that other processes using locks won't read the directory
+// while the bundle is incomplete.
+//
+// When [Builder.Close] succeeds, the lock is downgraded to a shared lock
+// that is held by the returned bundle until [Bundle.Unlock] is called. If
+// the builder fails then the lock is released.
+//
+// The lock uses the builder's clock unless the options include
+// [WithLockClock].
+func WithDirLock(opts ...LockOption) BuilderOption {
+	return func(b *Builder) error {
+		b.lockDir = true
+		b.lockOpts = opts
+		return nil
+	}
+}
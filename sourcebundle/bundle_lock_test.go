@@ -0,0 +1,208 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+func TestLockDir(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	quick := []LockOption{WithLockPollInterval(time.Millisecond), WithLockTimeout(50 * time.Millisecond)}
+
+	exclusive, err := LockDir(ctx, dir, ExclusiveLock, quick...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockDir(ctx, dir, ExclusiveLock, quick...); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second exclusive lock succeeded or failed unexpectedly: %v", err)
+	}
+	if _, err := LockDir(ctx, dir, SharedLock, quick...); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shared lock during exclusive lock succeeded or failed unexpectedly: %v", err)
+	}
+
+	// After downgrading, other shared holders can join but writers can't.
+	if err := exclusive.Downgrade(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := exclusive.Mode(), SharedLock; got != want {
+		t.Errorf("wrong mode after downgrade %s; want %s", got, want)
+	}
+	shared, err := LockDir(ctx, dir, SharedLock, quick...)
+	if err != nil {
+		t.Fatalf("shared lock during shared lock failed: %s", err)
+	}
+	if _, err := LockDir(ctx, dir, ExclusiveLock, quick...); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("exclusive lock during shared lock succeeded or failed unexpectedly: %v", err)
+	}
+	if err := exclusive.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := shared.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A waiting writer gets the lock as soon as the last reader leaves.
+	shared, err = LockDir(ctx, dir, SharedLock, quick...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		shared.Unlock()
+	}()
+	exclusive, err = LockDir(ctx, dir, ExclusiveLock, WithLockPollInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("waiting exclusive lock failed: %s", err)
+	}
+	if err := exclusive.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := exclusive.Unlock(); err != nil {
+		t.Errorf("second unlock failed: %s", err)
+	}
+
+	if _, err := os.Stat(dir + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock directory still exists after all locks were released")
+	}
+}
+
+func TestLockDirStale(t *testing.T) {
+	dir := t.TempDir()
+	lockDir := dir + ".lock"
+	if err := os.Mkdir(lockDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(lockDir) })
+
+	// An entry left behind by a holder that stopped refreshing it doesn't
+	// prevent anyone else from taking the lock.
+	stale, err := json.Marshal(lockEntry{
+		PID:     os.Getpid(),
+		Host:    "elsewhere.example.com",
+		Token:   "stale",
+		Expires: time.Now().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{lockWriterEntry, lockReaderPrefix + "stale"} {
+		if err := os.WriteFile(filepath.Join(lockDir, name), stale, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock, err := LockDir(context.Background(), dir, ExclusiveLock, WithLockTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("failed to break stale lock: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(lockDir, lockReaderPrefix+"stale")); !os.IsNotExist(err) {
+		t.Errorf("stale reader entry was not removed")
+	}
+
+	// If another process breaks our entry then refreshing it reports that.
+	if err := os.Remove(filepath.Join(lockDir, lockWriterEntry)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.refreshEntry(lockWriterEntry); err == nil {
+		t.Errorf("refreshing a broken entry succeeded")
+	}
+	lock.Unlock()
+}
+
+func TestBuilderDirLock(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		return FetchSourcePackageResponse{}, copyDir(targetDir, "testdata/pkgs/hello")
+	})
+	targetDir := t.TempDir()
+	quick := []LockOption{WithLockPollInterval(time.Millisecond), WithLockTimeout(50 * time.Millisecond)}
+	builder, err := NewBuilder(targetDir, fetcher, nil, WithDirLock(quick...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers can't open the bundle while it's being built.
+	if _, err := OpenDirLocked(context.Background(), targetDir, quick...); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("opened bundle during build, or failed unexpectedly: %v", err)
+	}
+
+	source := sourceaddrs.MustParseSource("https://example.com/hello.tgz").(sourceaddrs.RemoteSource)
+	if diags := builder.AddRemoteSource(context.Background(), source, noDependencyFinder); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	// Once the build is complete, the builder's lock becomes a shared lock
+	// held by the bundle.
+	reader, err := OpenDirLocked(context.Background(), targetDir, quick...)
+	if err != nil {
+		t.Fatalf("failed to open bundle after build: %s", err)
+	}
+	if _, err := LockDir(context.Background(), targetDir, ExclusiveLock, quick...); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("exclusive lock while bundles are open succeeded or failed unexpectedly: %v", err)
+	}
+	if err := reader.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bundle.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := LockDir(context.Background(), targetDir, ExclusiveLock, quick...)
+	if err != nil {
+		t.Fatalf("exclusive lock after bundles were unlocked failed: %s", err)
+	}
+	lock.Unlock()
+
+	// Several consumers extracting the same archive into the same directory
+	// share the first extraction.
+	var archive bytes.Buffer
+	if err := bundle.WriteArchive(&archive); err != nil {
+		t.Fatal(err)
+	}
+	extractDir := t.TempDir()
+	first, err := ExtractArchiveLocked(context.Background(), bytes.NewReader(archive.Bytes()), extractDir, quick...)
+	if err != nil {
+		t.Fatalf("first extraction failed: %s", err)
+	}
+	second, err := ExtractArchiveLocked(context.Background(), bytes.NewReader(nil), extractDir, quick...)
+	if err != nil {
+		t.Fatalf("second extraction failed: %s", err)
+	}
+	if got, want := len(second.RemotePackages()), len(first.RemotePackages()); got != want {
+		t.Errorf("second extraction has %d packages; want %d", got, want)
+	}
+	first.Unlock()
+	second.Unlock()
+
+	// A failed extraction mustn't leave behind a manifest that a later
+	// call would mistake for a complete bundle.
+	extractDir = t.TempDir()
+	truncated := archive.Bytes()[:archive.Len()/2]
+	if _, err := ExtractArchiveLocked(context.Background(), bytes.NewReader(truncated), extractDir, quick...); err == nil {
+		t.Fatal("extraction of truncated archive succeeded")
+	}
+	assertEmptyDir(t, extractDir)
+	third, err := ExtractArchiveLocked(context.Background(), bytes.NewReader(archive.Bytes()), extractDir, quick...)
+	if err != nil {
+		t.Fatalf("extraction after failed extraction failed: %s", err)
+	}
+	if err := third.CheckIntegrity(CheckPackageContent); err != nil {
+		t.Errorf("extraction after failed extraction is damaged: %s", err)
+	}
+	third.Unlock()
+}
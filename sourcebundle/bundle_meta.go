@@ -0,0 +1,87 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"fmt"
+	"time"
+)
+
+// bundleMeta is the optional metadata describing a whole bundle, which
+// callers can set using [WithCreatedAt], [WithCreator], and [WithLabels].
+type bundleMeta struct {
+	createdAt time.Time
+	creator   string
+	labels    map[string]string
+}
+
+// WithCreatedAt is a BuilderOption that records the given time in the
+// bundle manifest as the time when the bundle was created, which can then
+// be retrieved using [Bundle.CreatedAt].
+//
+// The builder doesn't record a creation time by default, so that building
+// the same sources twice produces identical bundles.
+func WithCreatedAt(t time.Time) BuilderOption {
+	return func(b *Builder) error {
+		b.bundleMeta.createdAt = t
+		return nil
+	}
+}
+
+// WithCreator is a BuilderOption that records the given free-form string in
+// the bundle manifest to describe what created the bundle, which can then be
+// retrieved using [Bundle.Creator].
+func WithCreator(creator string) BuilderOption {
+	return func(b *Builder) error {
+		b.bundleMeta.creator = creator
+		return nil
+	}
+}
+
+// WithLabels is a BuilderOption that records the given labels in the bundle
+// manifest, which can then be retrieved using [Bundle.Labels]. Labels are
+// intended for tagging a bundle with information such as run or tenant
+// identifiers without needing a separate file alongside the bundle.
+//
+// If used more than once then the labels are merged, with later values
+// taking precedence for any duplicate names. Label names must not be empty.
+func WithLabels(labels map[string]string) BuilderOption {
+	return func(b *Builder) error {
+		for name, value := range labels {
+			if name == "" {
+				return fmt.Errorf("label names must not be empty")
+			}
+			if b.bundleMeta.labels == nil {
+				b.bundleMeta.labels = make(map[string]string)
+			}
+			b.bundleMeta.labels[name] = value
+		}
+		return nil
+	}
+}
+
+// CreatedAt returns the creation time recorded for the bundle using
+// [WithCreatedAt], or the zero time if the bundle has no creation time.
+func (b *Bundle) CreatedAt() time.Time {
+	return b.meta.createdAt
+}
+
+// Creator returns the string recorded for the bundle using [WithCreator],
+// or an empty string if the bundle has no creator.
+func (b *Bundle) Creator() string {
+	return b.meta.creator
+}
+
+// Labels returns a copy of the labels recorded for the bundle using
+// [WithLabels], or nil if the bundle has no labels.
+func (b *Bundle) Labels() map[string]string {
+	if len(b.meta.labels) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(b.meta.labels))
+	for name, value := range b.meta.labels {
+		ret[name] = value
+	}
+	return ret
+}
@@ -0,0 +1,150 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// MissingDependency describes a dependency that [Bundle.CanSatisfy] found
+// to be missing from a bundle.
+type MissingDependency struct {
+	// Source is the address of the missing dependency, which is either a
+	// [sourceaddrs.RemoteSource] or a [sourceaddrs.RegistrySource], unless
+	// it is a [sourceaddrs.LocalSource] given as a root.
+	Source sourceaddrs.Source
+
+	// AllowedVersions is the set of versions that the dependency allows, if
+	// Source is a registry source.
+	AllowedVersions versions.Set
+
+	// Chain is the chain of source addresses from one of the roots to the
+	// missing dependency, inclusive.
+	Chain []sourceaddrs.Source
+
+	// Reason explains why the dependency is missing, as a sentence
+	// fragment suitable for following "missing because".
+	Reason string
+
+	// Err is the error describing why the dependency is missing, whose
+	// message is Reason. It wraps [ErrExternalSource] if the dependency is
+	// in a package that the bundle deliberately doesn't include.
+	Err error
+}
+
+// CanSatisfy uses the given dependency finder to analyze each of the given
+// root sources, and then each of their dependencies in turn, using only the
+// content of the bundle, to find out whether the bundle contains everything
+// they need. This allows a program that consumes bundles to fail early with
+// actionable errors, rather than failing partway through its work.
+//
+// CanSatisfy returns true if the bundle contains all of the dependencies,
+// or false along with a description of each one that's missing. Analysis
+// continues past a missing dependency, so that the result describes
+// everything that's missing. The returned diagnostics are those reported by
+// the dependency finders, and if they include errors then the result is
+// false even if nothing is missing, because the analysis is incomplete.
+//
+// Registry sources are resolved to the newest version in the bundle that
+// the dependency allows, which is the same version a [Builder] would have
+// selected if the registry had offered no newer versions.
+func (b *Bundle) CanSatisfy(roots []sourceaddrs.FinalSource, depFinder DependencyFinder) (bool, []MissingDependency, Diagnostics) {
+	var missing []MissingDependency
+	var diags Diagnostics
+
+	var queue []pendingRemoteArtifact
+	analyzed := make(map[remoteArtifact]struct{})
+	addRemote := func(source sourceaddrs.RemoteSource, depFinder DependencyFinder, node *workNode) {
+		if _, err := b.LocalPathForRemoteSource(source); err != nil {
+			missing = append(missing, MissingDependency{
+				Source: source,
+				Chain:  node.chain(),
+				Reason: err.Error(),
+				Err:    err,
+			})
+			return
+		}
+		artifact := remoteArtifact{sourceAddr: source, depFinder: depFinder}
+		if _, exists := analyzed[artifact]; exists {
+			return
+		}
+		analyzed[artifact] = struct{}{}
+		queue = append(queue, pendingRemoteArtifact{artifact: artifact, node: node})
+	}
+	addRegistry := func(source sourceaddrs.RegistrySource, allowedVersions versions.Set, depFinder DependencyFinder, node *workNode) {
+		pkgAddr := source.Package()
+		version := b.RegistryPackageVersions(pkgAddr).NewestInSet(allowedVersions)
+		if version == versions.Unspecified {
+			err := fmt.Errorf("source bundle does not include %s", pkgAddr)
+			if _, ok := b.registryPackageSources[pkgAddr]; ok {
+				err = fmt.Errorf("source bundle does not include any version of %s that the dependency allows", pkgAddr)
+			} else if reason, external := b.externalRegistry[pkgAddr]; external {
+				err = externalSourceError(pkgAddr, reason)
+			}
+			missing = append(missing, MissingDependency{
+				Source:          source,
+				AllowedVersions: allowedVersions,
+				Chain:           node.chain(),
+				Reason:          err.Error(),
+				Err:             err,
+			})
+			return
+		}
+		realSource, _ := b.RegistryPackageSourceAddr(pkgAddr, version)
+		addRemote(source.FinalSourceAddr(realSource), depFinder, node)
+	}
+
+	for _, root := range roots {
+		switch root := root.(type) {
+		case sourceaddrs.RemoteSource:
+			addRemote(root, depFinder, newWorkNode(root, nil))
+		case sourceaddrs.RegistrySourceFinal:
+			source := root.Unversioned()
+			addRegistry(source, versions.Only(root.SelectedVersion()), depFinder, newWorkNode(source, nil))
+		case sourceaddrs.LocalSource:
+			err := errors.New("source bundle cannot include local sources")
+			missing = append(missing, MissingDependency{
+				Source: root,
+				Chain:  []sourceaddrs.Source{root},
+				Reason: err.Error(),
+				Err:    err,
+			})
+		}
+	}
+
+	for len(queue) != 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		sourceAddr := next.artifact.sourceAddr
+		pkgAddr := sourceAddr.Package()
+		fsys := newAnalysisFS(filepath.Join(b.rootDir, b.remotePackageDirs[pkgAddr]))
+		deps := Dependencies{
+			baseAddr: sourceAddr,
+			remoteCb: func(source sourceaddrs.RemoteSource, depFinder DependencyFinder) {
+				addRemote(source, depFinder, newWorkNode(source, next.node))
+			},
+			registryCb: func(source sourceaddrs.RegistrySource, allowedVersions versions.Set, depFinder DependencyFinder) {
+				addRegistry(source, allowedVersions, depFinder, newWorkNode(source, next.node))
+			},
+			localResolveErrCb: func(err error) {
+				diags = append(diags, &internalDiagnostic{
+					severity: DiagError,
+					summary:  "Invalid relative source address",
+					detail:   fmt.Sprintf("Invalid relative path from %s: %s.", sourceAddr, err),
+				})
+			},
+		}
+		moreDiags := next.artifact.depFinder.FindDependencies(fsys, sourceAddr.SubPath(), &deps)
+		deps.disable()
+		diags = append(diags, moreDiags.inRemoteSourcePackage(pkgAddr)...)
+	}
+
+	return len(missing) == 0 && !diags.HasErrors(), missing, diags
+}
@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// WithSealOnClose is a BuilderOption that makes [Builder.Close] call
+// [Bundle.Seal] on the bundle before returning it, so that a bundle used as
+// a shared cache is protected from accidental modification from the moment
+// it becomes available.
+func WithSealOnClose() BuilderOption {
+	return func(b *Builder) error {
+		b.sealOnClose = true
+		return nil
+	}
+}
+
+// Seal makes every file and directory in the bundle, including the
+// manifest, read-only by removing all of their write permissions. Symlinks
+// are not changed, since their own permissions are not meaningful.
+//
+// Sealing is a safeguard against accidental modification rather than a
+// security boundary: the owner of the files can still restore write
+// permission, and privileged users may be able to write regardless. On
+// Windows, Seal sets the read-only attribute on each file, which Windows
+// does not enforce for directories.
+//
+// Methods that modify the bundle directory, such as [Bundle.Repair], will
+// typically fail while the bundle is sealed. Use [Bundle.Unseal] to make it
+// writable again.
+func (b *Bundle) Seal() error {
+	return b.walkModes(func(mode fs.FileMode) fs.FileMode {
+		return mode &^ 0222
+	})
+}
+
+// Unseal reverses the effect of [Bundle.Seal] by giving the owner of each
+// file and directory in the bundle permission to write to it. Any write
+// permissions that the group or other users had before sealing are not
+// restored.
+func (b *Bundle) Unseal() error {
+	return b.walkModes(func(mode fs.FileMode) fs.FileMode {
+		return mode | 0200
+	})
+}
+
+// walkModes changes the permissions of every file and directory in the
+// bundle using the given function, which receives the current permissions.
+func (b *Bundle) walkModes(change func(fs.FileMode) fs.FileMode) error {
+	err := filepath.Walk(b.rootDir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		mode := info.Mode().Perm()
+		if newMode := change(mode); newMode != mode {
+			if err := os.Chmod(path, newMode); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to change bundle permissions: %w", err)
+	}
+	return nil
+}
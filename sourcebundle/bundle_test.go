@@ -0,0 +1,1605 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/google/go-cmp/cmp"
+	regaddr "github.com/hashicorp/terraform-registry-address"
+
+	"github.com/hashicorp/go-slug"
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+func TestBundleRepair(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/hello.tgz":   "testdata/pkgs/hello",
+			"https://example.com/subdirs.tgz": "testdata/pkgs/subdirs",
+		},
+		nil,
+		nil,
+	)
+	helloSource := sourceaddrs.MustParseSource("https://example.com/hello.tgz").(sourceaddrs.RemoteSource)
+	subdirsSource := sourceaddrs.MustParseSource("https://example.com/subdirs.tgz").(sourceaddrs.RemoteSource)
+	for _, addr := range []sourceaddrs.RemoteSource{helloSource, subdirsSource} {
+		diags := builder.AddRemoteSource(context.Background(), addr, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatal("unexpected diagnostics")
+		}
+	}
+	fetcher := builder.fetcher
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	helloDir, err := bundle.LocalPathForRemoteSource(helloSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helloFile := filepath.Join(helloDir, "hello")
+	err = os.WriteFile(helloFile, []byte("Corrupted!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracer := testBuildTracer{}
+	ctx := tracer.OnContext(context.Background())
+	err = bundle.Repair(ctx, fetcher)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Only the damaged package should have been fetched again.
+	wantLog := []string{
+		"start downloading https://example.com/hello.tgz",
+		"downloaded https://example.com/hello.tgz",
+	}
+	if diff := cmp.Diff(wantLog, tracer.log); diff != "" {
+		t.Errorf("wrong trace events\n%s", diff)
+	}
+
+	got, err := os.ReadFile(helloFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(got), "Hello, world!\n"; got != want {
+		t.Errorf("wrong content after repair\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestBundleRemotePackageStats(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/hello.tgz": "testdata/pkgs/hello",
+		},
+		nil,
+		nil,
+	)
+	helloSource := sourceaddrs.MustParseSource("https://example.com/hello.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), helloSource, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatal("unexpected diagnostics")
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	stats := bundle.RemotePackageStats(helloSource.Package())
+	if stats == nil {
+		t.Fatal("no stats for hello package")
+	}
+	if got, want := stats.FileCount(), 1; got != want {
+		t.Errorf("wrong file count\ngot:  %d\nwant: %d", got, want)
+	}
+	if got, want := stats.Size(), int64(len("Hello, world!\n")); got != want {
+		t.Errorf("wrong size\ngot:  %d\nwant: %d", got, want)
+	}
+	if got := stats.Checksum(); !strings.HasPrefix(got, "h1:") {
+		t.Errorf("checksum %q does not have h1: prefix", got)
+	}
+
+	// Re-opening the bundle should produce the same stats, from the manifest.
+	reopened, err := OpenDir(targetDir)
+	if err != nil {
+		t.Fatalf("failed to reopen bundle: %s", err)
+	}
+	if diff := cmp.Diff(stats, reopened.RemotePackageStats(helloSource.Package()), cmp.AllowUnexported(PackageStats{})); diff != "" {
+		t.Errorf("wrong stats after reopening\n%s", diff)
+	}
+}
+
+// testPackageHasher is a [PackageHasher] that uses a different scheme than
+// [DefaultPackageHasher].
+type testPackageHasher struct{}
+
+func (testPackageHasher) Name() string {
+	return "test"
+}
+
+func (testPackageHasher) HashDir(dir string, files []string, open func(name string) (io.ReadCloser, error)) (string, error) {
+	hash := sha256.New()
+	for _, name := range files {
+		r, err := open(name)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\n", name)
+		_, err = io.Copy(hash, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return "test:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (testPackageHasher) DirName(checksum string) (string, error) {
+	return strings.TrimPrefix(checksum, "test:"), nil
+}
+
+// sliceHasher is a [PackageHasher] whose type isn't comparable.
+type sliceHasher struct {
+	testPackageHasher
+	_ []string
+}
+
+func (sliceHasher) Name() string {
+	return "slice"
+}
+
+func TestBundlePackageHasher(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/hello.tgz": "testdata/pkgs/hello",
+		},
+		nil,
+		nil,
+	)
+	if err := WithPackageHasher(testPackageHasher{})(builder); err != nil {
+		t.Fatal(err)
+	}
+	helloSource := sourceaddrs.MustParseSource("https://example.com/hello.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), helloSource, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatal("unexpected diagnostics")
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	stats := bundle.RemotePackageStats(helloSource.Package())
+	if got, want := stats.HashScheme(), "test"; got != want {
+		t.Errorf("wrong hash scheme\ngot:  %s\nwant: %s", got, want)
+	}
+	localDir, err := bundle.LocalPathForRemoteSource(helloSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := filepath.Base(localDir), strings.TrimPrefix(stats.Checksum(), "test:"); got != want {
+		t.Errorf("wrong local directory\ngot:  %s\nwant: %s", got, want)
+	}
+
+	// The bundle returned by Close knows the builder's hasher, but a bundle
+	// opened separately can only use registered hashers.
+	if err := bundle.CheckIntegrity(CheckPackageContent); err != nil {
+		t.Errorf("integrity check failed: %s", err)
+	}
+	reopened, err := OpenDir(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reopened.RemotePackageStats(helloSource.Package()).HashScheme(), "test"; got != want {
+		t.Errorf("wrong hash scheme after reopening\ngot:  %s\nwant: %s", got, want)
+	}
+	err = reopened.CheckIntegrity(CheckPackageContent)
+	if err == nil || !strings.Contains(err.Error(), `unsupported hashing scheme "test"`) {
+		t.Errorf("wrong error for unregistered hasher: %v", err)
+	}
+	if err := RegisterPackageHasher(testPackageHasher{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.CheckIntegrity(CheckPackageContent); err != nil {
+		t.Errorf("integrity check failed after registering hasher: %s", err)
+	}
+
+	if err := RegisterPackageHasher(h1PackageHasher{}); err != nil {
+		t.Errorf("re-registering the same hasher failed: %s", err)
+	}
+	// A hasher whose type isn't comparable can be registered again too,
+	// but a different type can't reuse its name.
+	if err := RegisterPackageHasher(sliceHasher{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterPackageHasher(sliceHasher{}); err != nil {
+		t.Errorf("re-registering the same hasher failed: %s", err)
+	}
+	if err := RegisterPackageHasher(&sliceHasher{}); err == nil || !strings.Contains(err.Error(), "already registered") {
+		t.Errorf("wrong error for conflicting hasher: %v", err)
+	}
+	if err := WithPackageHasher(nil)(builder); err == nil {
+		t.Error("nil package hasher was accepted")
+	}
+}
+
+func TestBundleTotalSize(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/hello.tgz":  "testdata/pkgs/hello",
+			"https://example.com/hello2.tgz": "testdata/pkgs/hello",
+			"https://example.com/ignore.tgz": "testdata/pkgs/terraformignore",
+		},
+		nil,
+		nil,
+	)
+	var sources []sourceaddrs.RemoteSource
+	for _, addr := range []string{"https://example.com/hello.tgz", "https://example.com/hello2.tgz", "https://example.com/ignore.tgz"} {
+		source := sourceaddrs.MustParseSource(addr).(sourceaddrs.RemoteSource)
+		diags := builder.AddRemoteSource(context.Background(), source, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatal("unexpected diagnostics")
+		}
+		sources = append(sources, source)
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	// The two hello packages share a directory, so count only once.
+	want := bundle.RemotePackageStats(sources[0].Package()).Size() + bundle.RemotePackageStats(sources[2].Package()).Size()
+	if got := bundle.TotalSize(); got != want {
+		t.Errorf("wrong total size\ngot:  %d\nwant: %d", got, want)
+	}
+	if got, want := bundle.TotalSize(), builder.Report().TotalSize(); got != want {
+		t.Errorf("total size %d does not match build report total size %d", got, want)
+	}
+
+	// Manifests that don't record the total size get the same result from
+	// the package sizes.
+	manifestPath := filepath.Join(targetDir, ManifestFilename)
+	src, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest map[string]any
+	if err := json.Unmarshal(src, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifest["total_size"]; !ok {
+		t.Fatal("manifest does not record the total size")
+	}
+	delete(manifest, "total_size")
+	src, err = json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(manifestPath, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenDir(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.TotalSize(); got != want {
+		t.Errorf("wrong total size without manifest total\ngot:  %d\nwant: %d", got, want)
+	}
+}
+
+func TestBundleMetadata(t *testing.T) {
+	targetDir := t.TempDir()
+	createdAt := time.Date(2023, 4, 5, 6, 7, 8, 9, time.UTC)
+	builder, err := NewBuilder(
+		targetDir, nil, nil,
+		WithCreatedAt(createdAt),
+		WithCreator("example-platform"),
+		WithLabels(map[string]string{"run": "run-abc123"}),
+		WithLabels(map[string]string{"tenant": "acme"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := builder.Close(); err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	bundle, err := OpenDir(targetDir)
+	if err != nil {
+		t.Fatalf("failed to open bundle: %s", err)
+	}
+	if got, want := bundle.CreatedAt(), createdAt; !got.Equal(want) {
+		t.Errorf("wrong creation time\ngot:  %s\nwant: %s", got, want)
+	}
+	if got, want := bundle.Creator(), "example-platform"; got != want {
+		t.Errorf("wrong creator\ngot:  %q\nwant: %q", got, want)
+	}
+	wantLabels := map[string]string{"run": "run-abc123", "tenant": "acme"}
+	if diff := cmp.Diff(wantLabels, bundle.Labels()); diff != "" {
+		t.Errorf("wrong labels\n%s", diff)
+	}
+
+	// A bundle built without any metadata has none.
+	targetDir = t.TempDir()
+	builder, err = NewBuilder(targetDir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := builder.Close(); err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+	bundle, err = OpenDir(targetDir)
+	if err != nil {
+		t.Fatalf("failed to open bundle: %s", err)
+	}
+	if !bundle.CreatedAt().IsZero() || bundle.Creator() != "" || bundle.Labels() != nil {
+		t.Errorf("unexpected metadata in bundle built without any")
+	}
+
+	if _, err := NewBuilder(t.TempDir(), nil, nil, WithLabels(map[string]string{"": "x"})); err == nil {
+		t.Errorf("expected error for empty label name")
+	}
+}
+
+func TestBundleCheckIntegrity(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/hello.tgz": "testdata/pkgs/hello",
+		},
+		nil,
+		nil,
+	)
+	clock := newTestClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err := WithClock(clock)(builder); err != nil {
+		t.Fatal(err)
+	}
+	helloSource := sourceaddrs.MustParseSource("https://example.com/hello.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), helloSource, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatal("unexpected diagnostics")
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	for _, level := range []IntegrityCheckLevel{CheckManifest, CheckPackageContent} {
+		if err := bundle.CheckIntegrity(level); err != nil {
+			t.Errorf("unexpected error at level %d: %s", level, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := bundle.WatchIntegrity(ctx, time.Minute, CheckPackageContent)
+
+	localPkgDir, err := bundle.LocalPathForRemoteSource(helloSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(localPkgDir, "hello"), []byte("Goodbye, world!\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bundle.CheckIntegrity(CheckManifest); err != nil {
+		t.Errorf("unexpected error from manifest check: %s", err)
+	}
+	if err := bundle.CheckIntegrity(CheckPackageContent); err == nil {
+		t.Errorf("content check succeeded after modifying package")
+	}
+
+	// The watcher only checks again when the clock ticks.
+	clock.tick()
+	select {
+	case err := <-watch:
+		if err == nil {
+			t.Errorf("watch channel closed without an error")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch did not report the modification")
+	}
+}
+
+func TestBundleSeal(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/hello.tgz": "testdata/pkgs/hello",
+		},
+		nil,
+		nil,
+	)
+	if err := WithSealOnClose()(builder); err != nil {
+		t.Fatal(err)
+	}
+	helloSource := sourceaddrs.MustParseSource("https://example.com/hello.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), helloSource, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatal("unexpected diagnostics")
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+	// The test's temporary directory can't be cleaned up while the bundle
+	// is sealed.
+	defer bundle.Unseal()
+
+	writable := func() []string {
+		var ret []string
+		err := filepath.Walk(targetDir, func(path string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode()&fs.ModeSymlink == 0 && info.Mode().Perm()&0200 != 0 {
+				rel, _ := filepath.Rel(targetDir, path)
+				ret = append(ret, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+
+	if got := writable(); len(got) != 0 {
+		t.Errorf("writable paths after sealing: %s", got)
+	}
+	if err := bundle.CheckIntegrity(CheckPackageContent); err != nil {
+		t.Errorf("sealed bundle fails integrity check: %s", err)
+	}
+
+	if err := bundle.Unseal(); err != nil {
+		t.Fatal(err)
+	}
+	if got := writable(); len(got) == 0 || got[0] != "." {
+		t.Errorf("bundle directory is not writable after unsealing; writable paths: %s", got)
+	}
+	if err := bundle.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	if got := writable(); len(got) != 0 {
+		t.Errorf("writable paths after sealing again: %s", got)
+	}
+}
+
+func TestBundleRegistryDiagnostics(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/foo.tgz": "testdata/pkgs/hello",
+		},
+		map[string]map[string]string{
+			"example.com/foo/bar/baz": {
+				"1.0.0": "https://example.com/foo.tgz",
+			},
+		},
+		map[string]map[string]*ModulePackageVersionDeprecation{
+			"example.com/foo/bar/baz": {
+				"1.0.0": &ModulePackageVersionDeprecation{
+					Reason: "Use version 2 instead.",
+					Link:   "https://example.com/upgrade",
+				},
+			},
+		},
+	)
+	realClient := builder.registryClient
+	builder.registryClient = registryClientFuncs{
+		modulePackageVersions: func(ctx context.Context, pkgAddr regaddr.ModulePackage) (ModulePackageVersionsResponse, error) {
+			resp, err := realClient.ModulePackageVersions(ctx, pkgAddr)
+			resp.Warnings = []string{"This module is no longer maintained."}
+			return resp, err
+		},
+		modulePackageSourceAddr: realClient.ModulePackageSourceAddr,
+	}
+
+	regSource := sourceaddrs.MustParseSource("example.com/foo/bar/baz").(sourceaddrs.RegistrySource)
+	diags := builder.AddRegistrySource(context.Background(), regSource, versions.All, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatal("unexpected diagnostics")
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	// The registry information must survive a round-trip through an
+	// archive, so that it can be reported wherever the bundle is used.
+	var archive bytes.Buffer
+	if err := bundle.WriteArchive(&archive); err != nil {
+		t.Fatal(err)
+	}
+	extracted, err := ExtractArchive(&archive, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkgAddr := regSource.Package()
+	version := versions.MustParseVersion("1.0.0")
+	wantDeprecation := &RegistryVersionDeprecation{
+		Version: "1.0.0",
+		Reason:  "Use version 2 instead.",
+		Link:    "https://example.com/upgrade",
+	}
+	if diff := cmp.Diff(wantDeprecation, extracted.RegistryPackageVersionDeprecation(pkgAddr, version)); diff != "" {
+		t.Errorf("wrong deprecation\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"This module is no longer maintained."}, extracted.RegistryPackageWarnings(pkgAddr)); diff != "" {
+		t.Errorf("wrong warnings\n%s", diff)
+	}
+
+	var got []DiagDescription
+	for _, diag := range extracted.RegistryDiagnostics() {
+		if diag.Severity() != DiagWarning {
+			t.Errorf("unexpected severity %q", diag.Severity())
+		}
+		got = append(got, diag.Description())
+	}
+	want := []DiagDescription{
+		{
+			Summary: "Deprecated module package version",
+			Detail:  "Version 1.0.0 of example.com/foo/bar/baz is deprecated. Use version 2 instead.\n\nFor more information, see https://example.com/upgrade.",
+		},
+		{
+			Summary: "Module registry warning",
+			Detail:  "The registry returned a warning for example.com/foo/bar/baz: This module is no longer maintained.",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong diagnostics\n%s", diff)
+	}
+}
+
+func TestOpenDirManifestV1(t *testing.T) {
+	targetDir := t.TempDir()
+	err := os.Mkdir(filepath.Join(targetDir, "pkg"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(targetDir, ManifestFilename), []byte(`{
+		"terraform_source_bundle": 1,
+		"packages": [
+			{
+				"source": "https://example.com/hello.tgz",
+				"local": "pkg",
+				"meta": {}
+			}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := OpenDir(targetDir)
+	if err != nil {
+		t.Fatalf("failed to open bundle: %s", err)
+	}
+	pkgAddr := sourceaddrs.MustParseSource("https://example.com/hello.tgz").(sourceaddrs.RemoteSource).Package()
+	if got := bundle.RemotePackages(); len(got) != 1 || got[0] != pkgAddr {
+		t.Errorf("wrong packages %#v", got)
+	}
+	if got := bundle.RemotePackageStats(pkgAddr); got != nil {
+		t.Errorf("unexpected stats for version 1 manifest: %#v", got)
+	}
+}
+
+func TestOpenDirManifestDecoding(t *testing.T) {
+	tests := map[string]struct {
+		manifest string
+		wantErr  string
+	}{
+		"minimal": {
+			manifest: `{"terraform_source_bundle": 2}`,
+		},
+		"unknown properties and null lists": {
+			manifest: `{"future": {"a": [1, 2]}, "terraform_source_bundle": 2, "packages": null, "registry": null, "meta": null}`,
+		},
+		"missing version": {
+			manifest: `{"packages": []}`,
+			wantErr:  "invalid manifest: unsupported format version 0",
+		},
+		"unsupported version": {
+			manifest: `{"terraform_source_bundle": 3}`,
+			wantErr:  "invalid manifest: unsupported format version 3",
+		},
+		"packages not a list": {
+			manifest: `{"terraform_source_bundle": 2, "packages": {}}`,
+			wantErr:  "invalid manifest: expected array, not {",
+		},
+		"trailing data": {
+			manifest: `{"terraform_source_bundle": 2} {}`,
+			wantErr:  "invalid manifest: unexpected data after the manifest object",
+		},
+		"invalid package": {
+			manifest: `{"terraform_source_bundle": 2, "packages": [{"source": "https://example.com/a.tgz", "local": "../a"}]}`,
+			wantErr:  `invalid manifest: invalid package directory name "../a"`,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			targetDir := t.TempDir()
+			err := os.WriteFile(filepath.Join(targetDir, ManifestFilename), []byte(test.manifest), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = OpenDir(targetDir)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("unexpected success; want error %q", test.wantErr)
+			case test.wantErr != "" && err.Error() != test.wantErr:
+				t.Fatalf("wrong error\ngot:  %s\nwant: %s", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBundleRangePackages(t *testing.T) {
+	targetDir := t.TempDir()
+	manifestSrc := []byte(`{
+		"terraform_source_bundle": 2,
+		"packages": [
+			{"source": "https://example.com/a.tgz", "local": "a"},
+			{"source": "https://example.com/b.tgz", "local": "b"}
+		],
+		"registry": [
+			{
+				"source": "example.com/foo/bar/baz",
+				"versions": {
+					"1.0.0": {"source": "https://example.com/a.tgz//x"},
+					"2.0.0": {"source": "https://example.com/b.tgz"}
+				}
+			}
+		]
+	}`)
+	err := os.WriteFile(filepath.Join(targetDir, ManifestFilename), manifestSrc, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := OpenDir(targetDir)
+	if err != nil {
+		t.Fatalf("failed to open bundle: %s", err)
+	}
+
+	var gotPkgs []string
+	bundle.RangeRemotePackages(func(pkgAddr sourceaddrs.RemotePackage) bool {
+		gotPkgs = append(gotPkgs, pkgAddr.String())
+		return true
+	})
+	sort.Strings(gotPkgs)
+	if diff := cmp.Diff([]string{"https://example.com/a.tgz", "https://example.com/b.tgz"}, gotPkgs); diff != "" {
+		t.Errorf("wrong packages\n%s", diff)
+	}
+
+	var gotVersions []string
+	bundle.RangeRegistryPackageVersions(func(pkgAddr regaddr.ModulePackage, version versions.Version, sourceAddr sourceaddrs.RemoteSource) bool {
+		gotVersions = append(gotVersions, fmt.Sprintf("%s %s %s", pkgAddr, version, sourceAddr))
+		return true
+	})
+	sort.Strings(gotVersions)
+	wantVersions := []string{
+		"example.com/foo/bar/baz 1.0.0 https://example.com/a.tgz//x",
+		"example.com/foo/bar/baz 2.0.0 https://example.com/b.tgz",
+	}
+	if diff := cmp.Diff(wantVersions, gotVersions); diff != "" {
+		t.Errorf("wrong registry package versions\n%s", diff)
+	}
+
+	calls := 0
+	bundle.RangeRemotePackages(func(pkgAddr sourceaddrs.RemotePackage) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("callback called %d times after returning false", calls)
+	}
+
+	// The checksum must be the same as earlier versions calculated from the
+	// manifest source code.
+	hash := sha256.New()
+	wantChecksum := ChecksumPrefixV1 + hex.EncodeToString(hash.Sum(manifestSrc))
+	if got, err := bundle.ChecksumV1(); err != nil || got != wantChecksum {
+		t.Errorf("wrong checksum %q (error %v)\nwant: %q", got, err, wantChecksum)
+	}
+	err = os.WriteFile(filepath.Join(targetDir, ManifestFilename), []byte(`{"terraform_source_bundle": 2}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bundle.ChecksumV1(); err == nil {
+		t.Errorf("no error for checksum after the manifest changed")
+	}
+}
+
+func TestIsBundleDir(t *testing.T) {
+	targetDir := t.TempDir()
+	if IsBundleDir(targetDir) {
+		t.Errorf("empty directory is a bundle directory")
+	}
+	if IsBundleDir(filepath.Join(targetDir, "nonexist")) {
+		t.Errorf("nonexistent directory is a bundle directory")
+	}
+	err := os.WriteFile(filepath.Join(targetDir, ManifestFilename), []byte(`{"terraform_source_bundle": 1}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsBundleDir(targetDir) {
+		t.Errorf("directory with manifest is not a bundle directory")
+	}
+}
+
+func TestOpenDirStrict(t *testing.T) {
+	targetDir := t.TempDir()
+	err := os.Mkdir(filepath.Join(targetDir, "pkg"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(targetDir, ManifestFilename), []byte(`{
+		"terraform_source_bundle": 1,
+		"packages": [
+			{
+				"source": "https://example.com/hello.tgz",
+				"local": "pkg",
+				"meta": {}
+			}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenDirStrict(targetDir); err != nil {
+		t.Fatalf("failed to open bundle: %s", err)
+	}
+
+	// Now we'll add some content that the manifest doesn't know about.
+	if err := os.Mkdir(filepath.Join(targetDir, ".tmp-12345"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(targetDir, "extra"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := OpenDir(targetDir)
+	if err != nil {
+		t.Fatalf("failed to open bundle: %s", err)
+	}
+	extra, err := bundle.UnreferencedContent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{".tmp-12345", "extra"}, extra); diff != "" {
+		t.Errorf("wrong unreferenced content\n%s", diff)
+	}
+
+	_, err = OpenDirStrict(targetDir)
+	if err == nil {
+		t.Fatal("unexpected success; want error")
+	}
+	if got, want := err.Error(), "bundle directory contains content not referenced by the manifest: .tmp-12345, extra"; got != want {
+		t.Errorf("wrong error\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestBundleRemotePackageMeta(t *testing.T) {
+	fakes := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/hello.tgz": "testdata/pkgs/hello",
+		},
+		nil,
+		nil,
+	)
+	fetchTime := time.Date(2023, 4, 5, 6, 7, 8, 9, time.UTC)
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		ret, err := fakes.fetcher.FetchSourcePackage(ctx, sourceType, url, targetDir)
+		ret.PackageMeta = NewPackageMeta().
+			WithGitMetadata("abc123", "Initial commit").
+			WithResolvedRef("refs/heads/main").
+			WithFetchTime(fetchTime).
+			WithUpstreamChecksum("sha256:beep").
+			WithUpstreamSize(1234)
+		return ret, err
+	})
+	targetDir := t.TempDir()
+	builder, err := NewBuilder(targetDir, fetcher, fakes.registryClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := sourceaddrs.MustParseSource("https://example.com/hello.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), source, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	if _, err := builder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// We reopen the bundle to make sure the metadata survives a round-trip
+	// through the manifest.
+	bundle, err := OpenDir(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := bundle.RemotePackageMeta(source.Package())
+	if meta == nil {
+		t.Fatal("no metadata for package")
+	}
+	got := []any{
+		meta.GitCommitID(),
+		meta.GitCommitMessage(),
+		meta.ResolvedRef(),
+		meta.FetchTime(),
+		meta.UpstreamChecksum(),
+		meta.UpstreamSize(),
+	}
+	want := []any{
+		"abc123",
+		"Initial commit",
+		"refs/heads/main",
+		fetchTime,
+		"sha256:beep",
+		int64(1234),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong metadata\n%s", diff)
+	}
+}
+
+func TestExtractArchivePackage(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/with-deps.tgz":   "testdata/pkgs/with-remote-deps",
+			"https://example.com/dependency1.tgz": "testdata/pkgs/hello",
+			"https://example.com/dependency2.tgz": "testdata/pkgs/terraformignore",
+		},
+		nil,
+		nil,
+	)
+	startSource := sourceaddrs.MustParseSource("https://example.com/with-deps.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), startSource, stubDependencyFinder{filename: "dependencies"})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := bundle.WriteArchive(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	targetDir := t.TempDir()
+	dep1Source := sourceaddrs.MustParseSource("https://example.com/dependency1.tgz//hello").(sourceaddrs.RemoteSource)
+	localPath, err := ExtractArchivePackage(bytes.NewReader(archive.Bytes()), dep1Source, targetDir)
+	if err != nil {
+		t.Fatalf("failed to extract package: %s", err)
+	}
+	if got, want := localPath, filepath.Join(targetDir, "hello"); got != want {
+		t.Errorf("wrong local path\ngot:  %s\nwant: %s", got, want)
+	}
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if diff := cmp.Diff([]string{"hello"}, names); diff != "" {
+		t.Errorf("wrong extracted files\n%s", diff)
+	}
+
+	// The target directory must be empty, and so extracting the same
+	// package there again fails.
+	_, err = ExtractArchivePackage(bytes.NewReader(archive.Bytes()), dep1Source, targetDir)
+	if want := fmt.Sprintf("target directory %s is not empty", targetDir); err == nil || err.Error() != want {
+		t.Errorf("wrong error for non-empty target directory: %v", err)
+	}
+
+	// An archive that doesn't start with a manifest can't be used.
+	var legacyArchive bytes.Buffer
+	if _, err := slug.Pack(bundle.rootDir, &legacyArchive, true); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExtractArchivePackage(&legacyArchive, dep1Source, t.TempDir())
+	if err == nil || err.Error() != "archive does not begin with a source bundle manifest" {
+		t.Errorf("wrong error for archive without leading manifest: %v", err)
+	}
+}
+
+func TestBundleArchiveUnicodeNames(t *testing.T) {
+	names := []string{"テラフォーム.tf", "模块/main.tf", "🚀/launch.tf"}
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		for _, name := range names {
+			path := filepath.Join(targetDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return ret, err
+			}
+			if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+				return ret, err
+			}
+		}
+		return ret, nil
+	})
+	startSource := sourceaddrs.MustParseSource("https://example.com/unicode.tgz").(sourceaddrs.RemoteSource)
+
+	builder, err := NewBuilder(t.TempDir(), fetcher, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := bundle.WriteArchive(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	extracted, err := ExtractArchive(&archive, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to extract archive: %s", err)
+	}
+	localPkgDir, err := extracted.LocalPathForRemoteSource(startSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		got, err := os.ReadFile(filepath.Join(localPkgDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("missing %s: %s", name, err)
+			continue
+		}
+		if string(got) != name {
+			t.Errorf("wrong content for %s: %q", name, got)
+		}
+	}
+}
+
+func TestExtractArchiveVerified(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/subdirs.tgz": "testdata/pkgs/subdirs",
+		},
+		nil,
+		nil,
+	)
+	source := sourceaddrs.MustParseSource("https://example.com/subdirs.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), source, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := bundle.ChecksumV1()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := bundle.WriteArchive(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		extracted, err := ExtractArchiveVerified(bytes.NewReader(archive.Bytes()), t.TempDir(), checksum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := extracted.LocalPathForRemoteSource(source); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("wrong checksum", func(t *testing.T) {
+		targetDir := t.TempDir()
+		_, err := ExtractArchiveVerified(bytes.NewReader(archive.Bytes()), targetDir, "h1:wrong")
+		if err == nil || !strings.Contains(err.Error(), "does not match expected checksum h1:wrong") {
+			t.Fatalf("wrong error: %v", err)
+		}
+		assertEmptyDir(t, targetDir)
+	})
+	t.Run("modified package", func(t *testing.T) {
+		// The manifest is unchanged, so the bundle checksum still matches,
+		// but the package content no longer matches its directory name.
+		localPath, err := bundle.LocalPathForRemoteSource(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(localPath, "a", "b", "beepbeep"), []byte("tampered"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var tampered bytes.Buffer
+		if err := bundle.WriteArchive(&tampered); err != nil {
+			t.Fatal(err)
+		}
+
+		targetDir := t.TempDir()
+		_, err = ExtractArchiveVerified(&tampered, targetDir, checksum)
+		if err == nil || !strings.Contains(err.Error(), "has changed since the bundle was created") {
+			t.Fatalf("wrong error: %v", err)
+		}
+		assertEmptyDir(t, targetDir)
+	})
+}
+
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("unexpected leftover %s", entry.Name())
+	}
+}
+
+func TestBundlePackagePackSlug(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/subdirs.tgz": "testdata/pkgs/subdirs",
+			"https://example.com/ignore.tgz":  "testdata/pkgs/terraformignore",
+		},
+		nil,
+		nil,
+	)
+	for _, addr := range []string{"https://example.com/subdirs.tgz", "https://example.com/ignore.tgz"} {
+		source := sourceaddrs.MustParseSource(addr).(sourceaddrs.RemoteSource)
+		diags := builder.AddRemoteSource(context.Background(), source, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
+		}
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]string{
+		"https://example.com/subdirs.tgz":      {"a/", "a/b/", "a/b/beepbeep"},
+		"https://example.com/subdirs.tgz//a/b": {"beepbeep"},
+		"https://example.com/ignore.tgz":       {".terraformignore", "included"},
+	}
+	for addr, wantFiles := range tests {
+		t.Run(addr, func(t *testing.T) {
+			source := sourceaddrs.MustParseSource(addr).(sourceaddrs.RemoteSource)
+			var buf bytes.Buffer
+			meta, err := bundle.PackagePackSlug(source, &buf)
+			if err != nil {
+				t.Fatalf("failed to pack: %s", err)
+			}
+			if diff := cmp.Diff(wantFiles, meta.Files); diff != "" {
+				t.Errorf("wrong files\n%s", diff)
+			}
+
+			targetDir := t.TempDir()
+			if err := slug.Unpack(&buf, targetDir); err != nil {
+				t.Fatalf("failed to unpack: %s", err)
+			}
+			for _, name := range wantFiles {
+				if _, err := os.Lstat(filepath.Join(targetDir, filepath.FromSlash(name))); err != nil {
+					t.Errorf("missing %s after unpacking: %s", name, err)
+				}
+			}
+		})
+	}
+
+	source := sourceaddrs.MustParseSource("https://example.com/missing.tgz").(sourceaddrs.RemoteSource)
+	if _, err := bundle.PackagePackSlug(source, io.Discard); err == nil {
+		t.Errorf("no error for package not in the bundle")
+	}
+	source = sourceaddrs.MustParseSource("https://example.com/subdirs.tgz//a/b/beepbeep").(sourceaddrs.RemoteSource)
+	if _, err := bundle.PackagePackSlug(source, io.Discard); err == nil {
+		t.Errorf("no error for sub-path that isn't a directory")
+	}
+}
+
+func TestBundleCheckRegistryConstraints(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/foo-1.tgz": "testdata/pkgs/hello",
+			"https://example.com/foo-2.tgz": "testdata/pkgs/hello",
+		},
+		map[string]map[string]string{
+			"example.com/foo/bar/baz": {
+				"1.0.0": "https://example.com/foo-1.tgz",
+				"2.0.0": "https://example.com/foo-2.tgz",
+			},
+		},
+		nil,
+	)
+	regSource := sourceaddrs.MustParseSource("example.com/foo/bar/baz").(sourceaddrs.RegistrySource)
+	diags := builder.AddRegistrySource(context.Background(), regSource, mustParseVersionConstraints(t, "~> 1.0"), noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherSource := sourceaddrs.MustParseSource("example.com/foo/other/baz").(sourceaddrs.RegistrySource)
+	constraints := []RegistryConstraint{
+		{Source: regSource, AllowedVersions: mustParseVersionConstraints(t, "~> 1.0")},
+		{Source: regSource, AllowedVersions: mustParseVersionConstraints(t, ">= 1.0.0")},
+		{Source: regSource, AllowedVersions: mustParseVersionConstraints(t, "~> 2.0")},
+		{Source: otherSource, AllowedVersions: versions.All},
+	}
+	statuses := bundle.CheckRegistryConstraints(constraints)
+
+	var got []string
+	for _, status := range statuses {
+		if status.NeedsResolution {
+			got = append(got, "needs resolution")
+		} else {
+			got = append(got, status.SelectedSource().String())
+		}
+	}
+	want := []string{
+		"example.com/foo/bar/baz@1.0.0",
+		"example.com/foo/bar/baz@1.0.0",
+		"needs resolution",
+		"needs resolution",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong results\n%s", diff)
+	}
+	if !NeedsRegistryResolution(statuses) {
+		t.Errorf("NeedsRegistryResolution returned false")
+	}
+	if NeedsRegistryResolution(statuses[:2]) {
+		t.Errorf("NeedsRegistryResolution returned true for satisfied constraints")
+	}
+}
+
+func mustParseVersionConstraints(t *testing.T, s string) versions.Set {
+	t.Helper()
+	ret, err := sourceaddrs.ParseVersionConstraints(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestBundleCopyPackageTo(t *testing.T) {
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		files := map[string]os.FileMode{
+			"main.tf":           0640,
+			"run.sh":            0700,
+			"shared/common.tf":  0644,
+			"modules/a/main.tf": 0644,
+		}
+		for name, mode := range files {
+			path := filepath.Join(targetDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return ret, err
+			}
+			if err := os.WriteFile(path, []byte(name), mode); err != nil {
+				return ret, err
+			}
+		}
+		return ret, os.Symlink("../../shared/common.tf", filepath.Join(targetDir, "modules", "a", "common.tf"))
+	})
+	builder, err := NewBuilder(t.TempDir(), fetcher, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := sourceaddrs.MustParseSource("https://example.com/copy.tgz").(sourceaddrs.RemoteSource)
+	if diags := builder.AddRemoteSource(context.Background(), source, noDependencyFinder); len(diags) > 0 {
+		t.Fatal("unexpected diagnostics")
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subSource := sourceaddrs.MustParseSource("https://example.com/copy.tgz//modules/a").(sourceaddrs.RemoteSource)
+
+	tests := map[string]struct {
+		source    sourceaddrs.RemoteSource
+		opts      CopyPackageOptions
+		want      []string
+		wantLinks []string
+	}{
+		"whole package": {
+			source:    source,
+			want:      []string{"main.tf", "modules/a/common.tf", "modules/a/main.tf", "run.sh", "shared/common.tf"},
+			wantLinks: []string{"modules/a/common.tf"},
+		},
+		"sub-path with links": {
+			source:    subSource,
+			want:      []string{"common.tf", "main.tf"},
+			wantLinks: []string{"common.tf"},
+		},
+		"sub-path with link targets": {
+			source: subSource,
+			opts:   CopyPackageOptions{Symlinks: CopySymlinkTargets},
+			want:   []string{"common.tf", "main.tf"},
+		},
+		"sub-path without links": {
+			source: subSource,
+			opts:   CopyPackageOptions{Symlinks: SkipSymlinks},
+			want:   []string{"main.tf"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dstDir := filepath.Join(t.TempDir(), "dst")
+			got, err := bundle.CopyPackageTo(test.source, dstDir, test.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong files copied\n%s", diff)
+			}
+			var gotLinks []string
+			for _, name := range got {
+				info, err := os.Lstat(filepath.Join(dstDir, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatalf("missing %s after copying: %s", name, err)
+				}
+				if info.Mode()&fs.ModeSymlink != 0 {
+					gotLinks = append(gotLinks, name)
+				}
+			}
+			if diff := cmp.Diff(test.wantLinks, gotLinks); diff != "" {
+				t.Errorf("wrong symlinks\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("modes", func(t *testing.T) {
+		for _, normalize := range []bool{false, true} {
+			dstDir := t.TempDir()
+			if _, err := bundle.CopyPackageTo(source, dstDir, CopyPackageOptions{NormalizeModes: normalize}); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]os.FileMode{"main.tf": 0640, "run.sh": 0700}
+			if normalize {
+				want = map[string]os.FileMode{"main.tf": 0644, "run.sh": 0755}
+			}
+			for name, wantMode := range want {
+				info, err := os.Stat(filepath.Join(dstDir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := info.Mode().Perm(); got != wantMode {
+					t.Errorf("wrong mode for %s with normalize=%t: got %s, want %s", name, normalize, got, wantMode)
+				}
+			}
+
+			// Copying again into the same directory must not overwrite
+			// anything.
+			if _, err := bundle.CopyPackageTo(source, dstDir, CopyPackageOptions{}); !errors.Is(err, fs.ErrExist) {
+				t.Errorf("wrong error %v; want fs.ErrExist", err)
+			}
+		}
+	})
+
+	t.Run("read-only directory", func(t *testing.T) {
+		pkgDir, err := bundle.LocalPathForSource(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modulesDir := filepath.Join(pkgDir, "modules")
+		if err := os.Chmod(modulesDir, 0555); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(modulesDir, 0755)
+
+		for _, normalize := range []bool{false, true} {
+			dstDir := t.TempDir()
+			t.Cleanup(func() {
+				// Allow the temporary directory to be removed.
+				os.Chmod(filepath.Join(dstDir, "modules"), 0755)
+			})
+			if _, err := bundle.CopyPackageTo(source, dstDir, CopyPackageOptions{NormalizeModes: normalize}); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(filepath.Join(dstDir, "modules"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantMode := os.FileMode(0555)
+			if normalize {
+				wantMode = 0755
+			}
+			if got := info.Mode().Perm(); got != wantMode {
+				t.Errorf("wrong mode for modules with normalize=%t: got %s, want %s", normalize, got, wantMode)
+			}
+			if _, err := os.Stat(filepath.Join(dstDir, "modules", "a", "main.tf")); err != nil {
+				t.Errorf("file was not copied with normalize=%t: %s", normalize, err)
+			}
+		}
+	})
+}
+
+func TestBundleCanSatisfy(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/with-deps.tgz":   "testdata/pkgs/with-remote-deps",
+			"https://example.com/dependency1.tgz": "testdata/pkgs/hello",
+		},
+		map[string]map[string]string{
+			"example.com/foo/bar/baz": {
+				"1.0.0": "https://example.com/dependency1.tgz",
+			},
+		},
+		nil,
+	)
+	startSource := sourceaddrs.MustParseSource("https://example.com/with-deps.tgz").(sourceaddrs.RemoteSource)
+	dep1Source := sourceaddrs.MustParseSource("https://example.com/dependency1.tgz").(sourceaddrs.RemoteSource)
+	regSource := sourceaddrs.MustParseSource("example.com/foo/bar/baz").(sourceaddrs.RegistrySource)
+
+	// The bundle deliberately omits dependency2, which the starting package
+	// depends on, by not analyzing the starting package while building.
+	diags := builder.AddRemoteSource(context.Background(), startSource, noDependencyFinder)
+	diags = append(diags, builder.AddRemoteSource(context.Background(), dep1Source, noDependencyFinder)...)
+	diags = append(diags, builder.AddRegistrySource(context.Background(), regSource, versions.All, noDependencyFinder)...)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	t.Run("satisfied", func(t *testing.T) {
+		roots := []sourceaddrs.FinalSource{
+			dep1Source,
+			regSource.Versioned(versions.MustParseVersion("1.0.0")),
+		}
+		ok, missing, diags := bundle.CanSatisfy(roots, noDependencyFinder)
+		if !ok {
+			t.Error("bundle cannot satisfy roots that it contains")
+		}
+		if len(missing) != 0 {
+			t.Errorf("unexpected missing dependencies: %#v", missing)
+		}
+		if len(diags) != 0 {
+			t.Errorf("unexpected diagnostics: %#v", diags)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		roots := []sourceaddrs.FinalSource{
+			startSource,
+			regSource.Versioned(versions.MustParseVersion("2.0.0")),
+			sourceaddrs.MustParseSource("./local").(sourceaddrs.LocalSource),
+		}
+		ok, missing, diags := bundle.CanSatisfy(roots, stubDependencyFinder{filename: "dependencies"})
+		if ok {
+			t.Error("bundle can satisfy roots with missing dependencies")
+		}
+		if len(diags) != 0 {
+			t.Errorf("unexpected diagnostics: %#v", diags)
+		}
+
+		var got []string
+		for _, m := range missing {
+			var chain []string
+			for _, source := range m.Chain {
+				chain = append(chain, source.String())
+			}
+			got = append(got, fmt.Sprintf("%s (%s) via %s", m.Source, m.Reason, strings.Join(chain, " -> ")))
+		}
+		sort.Strings(got)
+		want := []string{
+			"./local (source bundle cannot include local sources) via ./local",
+			"example.com/foo/bar/baz (source bundle does not include any version of example.com/foo/bar/baz that the dependency allows) via example.com/foo/bar/baz",
+			"https://example.com/dependency2.tgz (source bundle does not include https://example.com/dependency2.tgz) via https://example.com/with-deps.tgz -> https://example.com/dependency2.tgz",
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong missing dependencies\n%s", diff)
+		}
+	})
+}
+
+func TestBuilderExternalSource(t *testing.T) {
+	builder := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/with-deps.tgz":   "testdata/pkgs/with-remote-deps",
+			"https://example.com/dependency1.tgz": "testdata/pkgs/hello",
+		},
+		map[string]map[string]string{
+			"example.com/foo/bar/baz": {
+				"1.0.0": "https://example.com/dependency1.tgz",
+			},
+		},
+		nil,
+	)
+	startSource := sourceaddrs.MustParseRemoteSource("https://example.com/with-deps.tgz")
+	dep2Source := sourceaddrs.MustParseRemoteSource("https://example.com/dependency2.tgz//sub")
+	regSource := sourceaddrs.MustParseRegistrySource("example.com/foo/bar/baz")
+
+	if err := builder.AddExternalSource(sourceaddrs.MustParseSource("./local"), ""); err == nil {
+		t.Error("marked a local source as external")
+	}
+	// The fetcher can't fetch dependency2, so the build succeeds only if the
+	// builder doesn't try.
+	if err := builder.AddExternalSource(dep2Source, "provided by the runtime module cache"); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.AddExternalSource(regSource, ""); err != nil {
+		t.Fatal(err)
+	}
+	diags := builder.AddRemoteSource(context.Background(), startSource, stubDependencyFinder{filename: "dependencies"})
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	dep1Source := sourceaddrs.MustParseRemoteSource("https://example.com/dependency1.tgz")
+	if err := builder.AddExternalSource(dep1Source, ""); err == nil {
+		t.Error("marked an already-included package as external")
+	}
+	bundle, err := builder.Close()
+	if err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	// The external sources survive a round-trip through the manifest.
+	bundle, err = OpenDir(bundle.rootDir)
+	if err != nil {
+		t.Fatalf("failed to reopen bundle: %s", err)
+	}
+	var gotExternal []string
+	for _, external := range bundle.ExternalSources() {
+		gotExternal = append(gotExternal, fmt.Sprintf("%s (%s)", external.Source, external.Reason))
+	}
+	wantExternal := []string{
+		"example.com/foo/bar/baz ()",
+		"https://example.com/dependency2.tgz (provided by the runtime module cache)",
+	}
+	if diff := cmp.Diff(wantExternal, gotExternal); diff != "" {
+		t.Errorf("wrong external sources\n%s", diff)
+	}
+
+	_, err = bundle.LocalPathForRemoteSource(dep2Source)
+	if !errors.Is(err, ErrExternalSource) {
+		t.Errorf("wrong error for external remote source: %v", err)
+	}
+	if got, want := err.Error(), "source bundle does not include https://example.com/dependency2.tgz: source is provided externally (provided by the runtime module cache)"; got != want {
+		t.Errorf("wrong error message\ngot:  %s\nwant: %s", got, want)
+	}
+	if _, err := bundle.LocalPathForRegistrySource(regSource, versions.MustParseVersion("1.0.0")); !errors.Is(err, ErrExternalSource) {
+		t.Errorf("wrong error for external registry source: %v", err)
+	}
+	if _, err := bundle.LocalPathForRemoteSource(dep1Source); err != nil {
+		t.Errorf("non-external dependency is missing: %s", err)
+	}
+
+	ok, missing, diags := bundle.CanSatisfy([]sourceaddrs.FinalSource{startSource}, stubDependencyFinder{filename: "dependencies"})
+	if ok {
+		t.Error("bundle can satisfy roots with external dependencies")
+	}
+	if len(diags) != 0 {
+		t.Errorf("unexpected diagnostics: %#v", diags)
+	}
+	if len(missing) != 1 || !errors.Is(missing[0].Err, ErrExternalSource) {
+		t.Errorf("wrong missing dependencies: %#v", missing)
+	}
+}
+
+func TestBundleRootFiles(t *testing.T) {
+	targetDir := t.TempDir()
+	builder := testingBuilder(
+		t, targetDir,
+		map[string]string{
+			"https://example.com/foo.tgz": "testdata/pkgs/hello",
+		},
+		nil,
+		nil,
+	)
+	for _, name := range []string{"", ".", "a/b", `a\b`, "..", ManifestFilename, OriginalsDirName} {
+		if err := builder.AddRootFile(name, nil); err == nil {
+			t.Errorf("invalid root file name %q was accepted", name)
+		}
+	}
+	content := []byte(`{"run":"example"}`)
+	if err := builder.AddRootFile("run-parameters.json", content); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.AddRootFile("run-parameters.json", content); err == nil {
+		t.Error("duplicate root file was accepted")
+	}
+	if err := builder.AddRootFile("empty", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	source := sourceaddrs.MustParseSource("https://example.com/foo.tgz").(sourceaddrs.RemoteSource)
+	diags := builder.AddRemoteSource(context.Background(), source, noDependencyFinder)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics: %#v", diags)
+	}
+	if _, err := builder.Close(); err != nil {
+		t.Fatalf("failed to close bundle: %s", err)
+	}
+
+	bundle, err := OpenDirStrict(targetDir)
+	if err != nil {
+		t.Fatalf("strict mode rejected root files: %s", err)
+	}
+	if diff := cmp.Diff([]string{"empty", "run-parameters.json"}, bundle.RootFiles()); diff != "" {
+		t.Errorf("wrong root files\n%s", diff)
+	}
+	if got, err := bundle.ReadRootFile("run-parameters.json"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != string(content) {
+		t.Errorf("wrong content %q; want %q", got, content)
+	}
+	if _, err := bundle.ReadRootFile("nonexistent"); err == nil {
+		t.Error("no error for nonexistent root file")
+	}
+
+	// Root files must survive a round-trip through an archive.
+	var archive bytes.Buffer
+	if err := bundle.WriteArchive(&archive); err != nil {
+		t.Fatal(err)
+	}
+	extractedDir := t.TempDir()
+	if _, err := ExtractArchive(&archive, extractedDir); err != nil {
+		t.Fatal(err)
+	}
+	extracted, err := OpenDirStrict(extractedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := extracted.ReadRootFile("run-parameters.json"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != string(content) {
+		t.Errorf("wrong extracted content %q; want %q", got, content)
+	}
+
+	// A root file that has been modified since the bundle was created
+	// must not be returned.
+	if err := os.WriteFile(filepath.Join(targetDir, "run-parameters.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bundle.ReadRootFile("run-parameters.json"); err == nil {
+		t.Error("no error for modified root file")
+	}
+}
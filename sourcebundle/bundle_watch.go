@@ -0,0 +1,110 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// IntegrityCheckLevel selects how thoroughly [Bundle.CheckIntegrity] checks
+// that a bundle directory hasn't changed since it was opened.
+type IntegrityCheckLevel int
+
+const (
+	// CheckManifest checks only that the manifest is unchanged and that
+	// every package directory it refers to still exists. This is cheap
+	// enough to run frequently.
+	CheckManifest IntegrityCheckLevel = iota
+
+	// CheckPackageContent additionally recalculates the checksum of the
+	// content of every package directory, which requires reading every
+	// file in the bundle.
+	CheckPackageContent
+)
+
+// CheckIntegrity returns an error if the bundle directory has changed since
+// the receiver was opened, to the extent that the given level can detect.
+//
+// Changing a bundle directory while a [Bundle] is open is not allowed, so
+// this is intended for long-running processes that want to detect a
+// violation of that rule and then reopen the bundle or fail, rather than
+// continuing with undefined behavior.
+func (b *Bundle) CheckIntegrity(level IntegrityCheckLevel) error {
+	if _, err := b.readManifest(); err != nil {
+		return err
+	}
+
+	localDirs := make(map[string]struct{})
+	for _, localDir := range b.remotePackageDirs {
+		localDirs[localDir] = struct{}{}
+	}
+	sortedDirs := make([]string, 0, len(localDirs))
+	for localDir := range localDirs {
+		sortedDirs = append(sortedDirs, localDir)
+	}
+	sort.Strings(sortedDirs)
+
+	for _, localDir := range sortedDirs {
+		info, err := os.Stat(filepath.Join(b.rootDir, localDir))
+		if err != nil {
+			return fmt.Errorf("package directory %s is missing: %w", localDir, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("package directory %s is not a directory", localDir)
+		}
+		if level < CheckPackageContent {
+			continue
+		}
+		hasher, err := b.packageHasherForDir(localDir)
+		if err != nil {
+			return err
+		}
+		gotDir, _, err := packageDirName(filepath.Join(b.rootDir, localDir), hasher)
+		if err != nil {
+			return fmt.Errorf("cannot check package directory %s: %w", localDir, err)
+		}
+		if gotDir != localDir {
+			return fmt.Errorf("content of package directory %s has changed since the bundle was created", localDir)
+		}
+	}
+	return nil
+}
+
+// WatchIntegrity starts a goroutine that runs [Bundle.CheckIntegrity] with
+// the given level at the given interval until the given context is
+// cancelled, and returns a channel that will receive the error from the
+// first check that fails.
+//
+// The channel is closed either after delivering an error or when the
+// context is cancelled, so callers can select on it alongside other events
+// and then reopen the bundle or shut down when it produces an error.
+//
+// The interval is measured using the [Clock] given to the [Builder] that
+// created the bundle, or using [SystemClock] for bundles opened with
+// [OpenDir].
+func (b *Bundle) WatchIntegrity(ctx context.Context, interval time.Duration, level IntegrityCheckLevel) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		ticker := b.clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				if err := b.CheckIntegrity(level); err != nil {
+					ch <- err
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
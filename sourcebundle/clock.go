@@ -0,0 +1,56 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"time"
+)
+
+// Clock is the source of the current time and of periodic events for the
+// time-dependent behaviors in this package. Tests can provide their own
+// implementation to make those behaviors deterministic and fast.
+//
+// [SystemClock] is the implementation used unless otherwise specified.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a [Ticker] that delivers the current time
+	// repeatedly at the given interval, like [time.NewTicker].
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers periodic events from a [Clock].
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker, like [time.Ticker.Stop].
+	Stop()
+}
+
+// SystemClock is a [Clock] that uses the real system clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
+}
@@ -49,6 +49,11 @@ type DependencyFinder interface {
 	// pass [fs.ValidPath] describing a path from the root of the given fs
 	// to the file containing the error. The builder will then translate those
 	// paths into remote source address strings within the containing package.
+	//
+	// The given filesystem behaves the same way on all platforms: names are
+	// case-sensitive even if the underlying filesystem isn't, and paths
+	// containing backslashes are invalid, so that a finder sees only what
+	// would be included in a bundle archive.
 	FindDependencies(fsys fs.FS, subPath string, deps *Dependencies) Diagnostics
 }
 
@@ -4,6 +4,10 @@
 package sourcebundle
 
 import (
+	"fmt"
+	"path"
+	"strings"
+
 	"github.com/hashicorp/go-slug/sourceaddrs"
 )
 
@@ -125,6 +129,92 @@ func (diag diagnosticInSourcePackage) Source() DiagSource {
 	return ret
 }
 
+// diagnosticIgnoredFile is a thin wrapper around an error diagnostic that
+// seems to be about a file that was removed from its package by ignore rules,
+// which adds a note about that to the diagnostic's detail so that the
+// resulting "file not found" errors are less confusing.
+type diagnosticIgnoredFile struct {
+	wrapped Diagnostic
+	path    string
+	rule    string
+}
+
+// withIgnoredPaths modifies the receiver in-place so that any error
+// diagnostics which refer to one of the given ignored paths, as returned by
+// [preparePackageDir], will mention that the path was excluded by an ignore
+// rule.
+//
+// For convenience, returns the same diags slice whose backing array may
+// now have been modified with different diagnostics.
+func (diags Diagnostics) withIgnoredPaths(ignored map[string]string) Diagnostics {
+	if len(ignored) == 0 {
+		return diags
+	}
+	for i, diag := range diags {
+		if diag.Severity() != DiagError {
+			continue
+		}
+		if p, ok := diagIgnoredPath(diag, ignored); ok {
+			diags[i] = diagnosticIgnoredFile{
+				wrapped: diag,
+				path:    p,
+				rule:    ignored[p],
+			}
+		}
+	}
+	return diags
+}
+
+// diagIgnoredPath finds the ignored path that the given diagnostic refers to,
+// either as the filename of its subject or in the text of its description.
+func diagIgnoredPath(diag Diagnostic, ignored map[string]string) (string, bool) {
+	if subject := diag.Source().Subject; subject != nil && sourceaddrs.ValidSubPath(subject.Filename) {
+		// The file itself may have been ignored, or one of its parent
+		// directories.
+		for p := subject.Filename; p != "."; p = path.Dir(p) {
+			if _, ok := ignored[p]; ok {
+				return p, true
+			}
+		}
+	}
+
+	desc := diag.Description()
+	var found string
+	for p := range ignored {
+		// We prefer the longest match, so that a mention of an ignored
+		// file inside an ignored directory refers to the file itself.
+		if len(p) > len(found) && (strings.Contains(desc.Summary, p) || strings.Contains(desc.Detail, p)) {
+			found = p
+		}
+	}
+	return found, found != ""
+}
+
+var _ Diagnostic = diagnosticIgnoredFile{}
+
+func (diag diagnosticIgnoredFile) Description() DiagDescription {
+	ret := diag.wrapped.Description()
+	note := fmt.Sprintf("The path %q was excluded from this package by the ignore rule %q, typically from the package's .terraformignore file.", diag.path, diag.rule)
+	if ret.Detail == "" {
+		ret.Detail = note
+	} else {
+		ret.Detail = ret.Detail + "\n\n" + note
+	}
+	return ret
+}
+
+func (diag diagnosticIgnoredFile) ExtraInfo() interface{} {
+	return diag.wrapped.ExtraInfo()
+}
+
+func (diag diagnosticIgnoredFile) Severity() DiagSeverity {
+	return diag.wrapped.Severity()
+}
+
+func (diag diagnosticIgnoredFile) Source() DiagSource {
+	return diag.wrapped.Source()
+}
+
 // internalDiagnostic is a diagnostic type used to report this package's own
 // errors as diagnostics.
 //
@@ -0,0 +1,102 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// diskSpaceCheckInterval is how often the builder checks the free disk space
+// while a fetcher is running, when using [WithMinFreeSpace].
+const diskSpaceCheckInterval = time.Second
+
+// freeDiskSpace returns the number of bytes available to unprivileged users
+// on the filesystem containing the given directory, or false if that can't
+// be determined on the current platform. It's a variable only so that tests
+// can simulate running out of space.
+var freeDiskSpace = diskFreeSpace
+
+// WithMinFreeSpace is a BuilderOption that makes the builder fail early,
+// rather than partway through writing a package, if the filesystem
+// containing the target directory has fewer than the given number of bytes
+// available. The builder checks before creating the bundle, before fetching
+// each package, and periodically while each fetcher is running, cancelling
+// the fetch if the free space drops below the minimum.
+//
+// A suitable minimum can be estimated from the [BuildReport.TotalSize] of
+// an earlier build of a similar bundle, plus some margin for the temporary
+// files that fetchers create.
+//
+// The builder cannot measure free space on all platforms, and so this
+// option has no effect on platforms other than Linux and macOS.
+func WithMinFreeSpace(bytes int64) BuilderOption {
+	return func(b *Builder) error {
+		if bytes < 1 {
+			return fmt.Errorf("minimum free space must be positive")
+		}
+		b.minFreeSpace = bytes
+		return nil
+	}
+}
+
+// checkFreeSpace returns an error if the builder has a minimum free space
+// and the target directory's filesystem has less space available.
+func (b *Builder) checkFreeSpace() error {
+	if b.minFreeSpace == 0 {
+		return nil
+	}
+	free, ok, err := freeDiskSpace(b.targetDir)
+	if err != nil {
+		return fmt.Errorf("failed to check free disk space: %w", err)
+	}
+	if ok && free < b.minFreeSpace {
+		return fmt.Errorf("insufficient disk space: %d bytes available, but at least %d bytes are required", free, b.minFreeSpace)
+	}
+	return nil
+}
+
+// watchFreeSpace returns a context derived from the given context that is
+// cancelled if the free disk space drops below the builder's minimum, and a
+// function that stops the watching and returns the error from the check
+// that failed, if any.
+func (b *Builder) watchFreeSpace(ctx context.Context) (context.Context, func() error) {
+	if b.minFreeSpace == 0 {
+		return ctx, func() error { return nil }
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	// spaceErr is written only by the goroutine below, and read only after
+	// it has stopped, so that we can tell our own cancellation apart from
+	// the caller's.
+	var spaceErr error
+	go func() {
+		defer close(stopped)
+		ticker := b.clock.NewTicker(diskSpaceCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				if err := b.checkFreeSpace(); err != nil {
+					spaceErr = err
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+	return ctx, func() error {
+		close(done)
+		<-stopped
+		cancel(nil)
+		return spaceErr
+	}
+}
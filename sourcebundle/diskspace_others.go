@@ -0,0 +1,12 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package sourcebundle
+
+func diskFreeSpace(dir string) (int64, bool, error) {
+	// We don't know how to measure free space on this platform.
+	return 0, false, nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// ErrExternalSource is wrapped by the errors that [Bundle] lookups return
+// for a source in a package that the bundle deliberately doesn't include,
+// because it was marked as external using [Builder.AddExternalSource].
+var ErrExternalSource = errors.New("source is provided externally")
+
+// ExternalSource describes a package that a bundle deliberately doesn't
+// include, as returned by [Bundle.ExternalSources].
+type ExternalSource struct {
+	// Source is the address of the whole package, which is either a
+	// [sourceaddrs.RemoteSource] or a [sourceaddrs.RegistrySource] with no
+	// sub-path.
+	Source sourceaddrs.Source
+
+	// Reason is the explanation given to [Builder.AddExternalSource], which
+	// might be empty.
+	Reason string
+}
+
+// AddExternalSource marks the package containing the given source address
+// as external, meaning that it will be provided some other way at runtime,
+// such as from a module cache hosted by the consumer of the bundle. The
+// builder won't fetch or analyze the package even if other sources depend
+// on it, and the manifest records the package and the given reason so that
+// lookups in the resulting bundle return an error wrapping
+// [ErrExternalSource] instead of a generic error.
+//
+// The address must be either a [sourceaddrs.RemoteSource] or a
+// [sourceaddrs.RegistrySource], and applies to its whole package, and to
+// every version of a registry package. A package can't be marked as
+// external once it has been included in the bundle, and so callers should
+// add external sources before adding the sources that depend on them.
+// Marking a package that's already external again replaces its reason.
+func (b *Builder) AddExternalSource(addr sourceaddrs.Source, reason string) error {
+	if b.targetDir == "" {
+		// The builder has been closed, so cannot be modified further.
+		panic("AddExternalSource on closed sourcebundle.Builder")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch addr := addr.(type) {
+	case sourceaddrs.RemoteSource:
+		pkgAddr := addr.Package()
+		if _, exists := b.remotePackageDirs[pkgAddr]; exists {
+			return fmt.Errorf("cannot mark %s as external: the bundle already includes it", pkgAddr)
+		}
+		b.externalRemote[pkgAddr] = reason
+	case sourceaddrs.RegistrySource:
+		pkgAddr := addr.Package()
+		for resolved := range b.resolvedRegistry {
+			if resolved.pkg == pkgAddr {
+				return fmt.Errorf("cannot mark %s as external: the bundle already includes %s v%s", pkgAddr, pkgAddr, resolved.version)
+			}
+		}
+		b.externalRegistry[pkgAddr] = reason
+	default:
+		return fmt.Errorf("cannot mark %s as external: only remote and registry sources can be external", addr)
+	}
+	return nil
+}
+
+// manifestExternalSources returns the manifest entries for the packages that
+// were marked as external, sorted by address.
+func (b *Builder) manifestExternalSources() []manifestExternalSource {
+	var ret []manifestExternalSource
+	for pkgAddr, reason := range b.externalRemote {
+		ret = append(ret, manifestExternalSource{
+			SourceAddr: pkgAddr.String(),
+			Reason:     reason,
+		})
+	}
+	for pkgAddr, reason := range b.externalRegistry {
+		ret = append(ret, manifestExternalSource{
+			SourceAddr: pkgAddr.String(),
+			Reason:     reason,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].SourceAddr < ret[j].SourceAddr
+	})
+	return ret
+}
+
+// addManifestExternalSource records the external package described by the
+// given manifest entry.
+func (b *Bundle) addManifestExternalSource(es *manifestExternalSource) error {
+	addr, err := sourceaddrs.ParseSource(es.SourceAddr)
+	if err != nil {
+		return fmt.Errorf("invalid external source address %q: %w", es.SourceAddr, err)
+	}
+	switch addr := addr.(type) {
+	case sourceaddrs.RemoteSource:
+		if addr.SubPath() != "" {
+			return fmt.Errorf("invalid external source address %q: must not have a sub-path", es.SourceAddr)
+		}
+		b.externalRemote[addr.Package()] = es.Reason
+	case sourceaddrs.RegistrySource:
+		if addr.SubPath() != "" {
+			return fmt.Errorf("invalid external source address %q: must not have a sub-path", es.SourceAddr)
+		}
+		b.externalRegistry[addr.Package()] = es.Reason
+	default:
+		return fmt.Errorf("invalid external source address %q: must be a remote or registry source", es.SourceAddr)
+	}
+	return nil
+}
+
+// ExternalSources returns the packages that the bundle deliberately doesn't
+// include, as marked using [Builder.AddExternalSource], in lexical order of
+// their addresses.
+func (b *Bundle) ExternalSources() []ExternalSource {
+	var ret []ExternalSource
+	for pkgAddr, reason := range b.externalRemote {
+		ret = append(ret, ExternalSource{
+			Source: pkgAddr.SourceAddr(""),
+			Reason: reason,
+		})
+	}
+	for pkgAddr, reason := range b.externalRegistry {
+		// A valid package address is always also a valid source address.
+		addr := sourceaddrs.MustParseRegistrySource(pkgAddr.String())
+		ret = append(ret, ExternalSource{
+			Source: addr,
+			Reason: reason,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Source.String() < ret[j].Source.String()
+	})
+	return ret
+}
+
+// externalSourceError returns an error wrapping [ErrExternalSource] for the
+// given external package address and the reason it was marked as external.
+func externalSourceError(pkgAddr fmt.Stringer, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("source bundle does not include %s: %w", pkgAddr, ErrExternalSource)
+	}
+	return fmt.Errorf("source bundle does not include %s: %w (%s)", pkgAddr, ErrExternalSource, reason)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// LicenseScanner is the signature of a function that inspects the prepared
+// content of a remote package for licensing information, for use with
+// [WithLicenseScanner].
+//
+// dir is the local directory containing the package content, after the
+// builder has applied the package's ignore rules but before it has
+// calculated the package checksum. The scanner must not modify anything in
+// that directory.
+//
+// If the scanner returns an error then the builder treats it as a failure
+// to fetch the package, which allows callers to enforce a licensing policy
+// by rejecting packages whose findings are unacceptable.
+type LicenseScanner func(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, dir string) ([]LicenseFinding, error)
+
+// LicenseFinding describes licensing information that a [LicenseScanner]
+// found in a remote package.
+type LicenseFinding struct {
+	// Path is the slash-separated sub-path of the file where the license
+	// information was found, such as "LICENSE" or "modules/foo/main.tf".
+	Path string
+
+	// License is the SPDX license expression for the license that was
+	// found, such as "MPL-2.0", or an empty string if the scanner could
+	// not identify the license.
+	License string
+}
+
+// WithLicenseScanner is a BuilderOption that makes the builder call the
+// given scanner for each remote package it fetches or loads from its package
+// cache. The findings are included in the [PackageReport] for the package
+// and recorded in the bundle manifest, where they are available through
+// [Bundle.RemotePackageLicenses].
+func WithLicenseScanner(scanner LicenseScanner) BuilderOption {
+	return func(b *Builder) error {
+		if scanner == nil {
+			return fmt.Errorf("license scanner must not be nil")
+		}
+		b.licenseScanner = scanner
+		return nil
+	}
+}
+
+// scanLicenses runs the builder's license scanner, if any, over the given
+// package directory and records its findings.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) scanLicenses(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, workDir string) error {
+	if b.licenseScanner == nil {
+		return nil
+	}
+	findings, err := b.licenseScanner(ctx, pkgAddr, workDir)
+	if err != nil {
+		return fmt.Errorf("license scan failed: %w", err)
+	}
+	findings = append([]LicenseFinding(nil), findings...)
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Path < findings[j].Path
+	})
+
+	if len(findings) == 0 {
+		delete(b.packageLicenses, pkgAddr)
+	} else {
+		b.packageLicenses[pkgAddr] = findings
+	}
+	b.packageReport(pkgAddr).Licenses = findings
+	return nil
+}
+
+// RemotePackageLicenses returns the licensing information that the
+// [LicenseScanner] given in [WithLicenseScanner] found in the given package
+// when the bundle was built, or nil if there were no findings for that
+// package.
+func (b *Bundle) RemotePackageLicenses(pkgAddr sourceaddrs.RemotePackage) []LicenseFinding {
+	return append([]LicenseFinding(nil), b.remotePackageLicenses[pkgAddr]...)
+}
+
+func manifestLicensesFrom(findings []LicenseFinding) []manifestLicenseFinding {
+	if len(findings) == 0 {
+		return nil
+	}
+	ret := make([]manifestLicenseFinding, len(findings))
+	for i, finding := range findings {
+		ret[i] = manifestLicenseFinding{
+			Path:    finding.Path,
+			License: finding.License,
+		}
+	}
+	return ret
+}
+
+func (m manifestLicenseFinding) licenseFinding() LicenseFinding {
+	return LicenseFinding{
+		Path:    m.Path,
+		License: m.License,
+	}
+}
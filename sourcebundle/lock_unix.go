@@ -0,0 +1,19 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build darwin || linux
+// +build darwin linux
+
+package sourcebundle
+
+import (
+	"errors"
+	"syscall"
+)
+
+func processExists(pid int) bool {
+	// Signal zero performs only the checks for whether a signal could be
+	// sent, which fail with ESRCH if there's no such process.
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -3,19 +3,225 @@
 
 package sourcebundle
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
 // This file contains some internal-only types used to help with marshalling
 // and unmarshalling our manifest file format. The manifest format is not
 // itself a public interface, so these should stay unexported and any caller
 // that needs to interact with previously-generated source bundle manifests
 // should do so via the Bundle type.
 
+// manifestRoot is the top-level object of a manifest.
+//
+// Fields added to the format since version 2 are all optional, and readers
+// that predate any of them will just ignore them.
 type manifestRoot struct {
-	// FormatVersion should always be 1 for now, because there is only
-	// one version of this format.
+	// FormatVersion is 2 for manifests generated by the current version
+	// of Builder. Version 1 manifests are the same except that they lack
+	// the package statistics in manifestRemotePackage, and so we can
+	// read both versions using these same types.
 	FormatVersion uint64 `json:"terraform_source_bundle"`
 
 	Packages     []manifestRemotePackage `json:"packages,omitempty"`
 	RegistryMeta []manifestRegistryMeta  `json:"registry,omitempty"`
+
+	// Meta is optional metadata about the bundle as a whole.
+	Meta *manifestBundleMeta `json:"meta,omitempty"`
+
+	// TotalSize is the total size in bytes of the content of all of the
+	// package directories, counting each directory once. Manifests that
+	// predate it can calculate the same from the package sizes.
+	TotalSize int64 `json:"total_size,omitempty"`
+
+	// RootFiles describes the extra files in the top-level bundle directory
+	// that were added using Builder.AddRootFile. The strict mode of readers
+	// that predate it will reject the files themselves.
+	RootFiles []manifestRootFile `json:"extras,omitempty"`
+
+	// External describes the packages that the bundle deliberately doesn't
+	// include, as marked using Builder.AddExternalSource.
+	External []manifestExternalSource `json:"external,omitempty"`
+}
+
+// manifestDecoder holds the functions that decodeManifest calls for each part
+// of a manifest as it decodes it.
+type manifestDecoder struct {
+	formatVersion func(uint64) error
+	totalSize     func(int64) error
+	meta          func(*manifestBundleMeta) error
+	remotePackage func(*manifestRemotePackage) error
+	registryMeta  func(*manifestRegistryMeta) error
+	rootFile      func(*manifestRootFile) error
+	external      func(*manifestExternalSource) error
+}
+
+// decodeManifest decodes the manifest source code read from r as a stream,
+// equivalent to decoding it into a [manifestRoot] but without ever holding
+// all of its packages in memory at once.
+//
+// The keys recognized here must match the field tags of manifestRoot.
+func decodeManifest(r io.Reader, d manifestDecoder) error {
+	dec := json.NewDecoder(r)
+	if err := decodeManifestDelim(dec, '{'); err != nil {
+		return err
+	}
+	sawVersion := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		// Object keys are always strings.
+		switch key := tok.(string); key {
+		case "terraform_source_bundle":
+			var v uint64
+			if err := dec.Decode(&v); err != nil {
+				return err
+			}
+			if err := d.formatVersion(v); err != nil {
+				return err
+			}
+			sawVersion = true
+		case "total_size":
+			var v int64
+			if err := dec.Decode(&v); err != nil {
+				return err
+			}
+			if err := d.totalSize(v); err != nil {
+				return err
+			}
+		case "meta":
+			var meta *manifestBundleMeta
+			if err := dec.Decode(&meta); err != nil {
+				return err
+			}
+			if err := d.meta(meta); err != nil {
+				return err
+			}
+		case "packages":
+			err := decodeManifestArray(dec, func() error {
+				var rpm manifestRemotePackage
+				if err := dec.Decode(&rpm); err != nil {
+					return err
+				}
+				return d.remotePackage(&rpm)
+			})
+			if err != nil {
+				return err
+			}
+		case "registry":
+			err := decodeManifestArray(dec, func() error {
+				var rpm manifestRegistryMeta
+				if err := dec.Decode(&rpm); err != nil {
+					return err
+				}
+				return d.registryMeta(&rpm)
+			})
+			if err != nil {
+				return err
+			}
+		case "extras":
+			err := decodeManifestArray(dec, func() error {
+				var rf manifestRootFile
+				if err := dec.Decode(&rf); err != nil {
+					return err
+				}
+				return d.rootFile(&rf)
+			})
+			if err != nil {
+				return err
+			}
+		case "external":
+			err := decodeManifestArray(dec, func() error {
+				var es manifestExternalSource
+				if err := dec.Decode(&es); err != nil {
+					return err
+				}
+				return d.external(&es)
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			// Readers ignore properties they don't know about.
+			var ignored json.RawMessage
+			if err := dec.Decode(&ignored); err != nil {
+				return err
+			}
+		}
+	}
+	if err := decodeManifestDelim(dec, '}'); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("unexpected data after the manifest object")
+	}
+	if !sawVersion {
+		return d.formatVersion(0)
+	}
+	return nil
+}
+
+// decodeManifestArray calls elem once for each element of the JSON array
+// that the given decoder is about to read, expecting elem to decode that
+// element. A null value is treated as an empty array.
+func decodeManifestArray(dec *json.Decoder, elem func() error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("expected array, not %v", tok)
+	}
+	for dec.More() {
+		if err := elem(); err != nil {
+			return err
+		}
+	}
+	return decodeManifestDelim(dec, ']')
+}
+
+// decodeManifestDelim reads the next token from the given decoder and
+// returns an error if it isn't the given delimiter.
+func decodeManifestDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected %q, not %v", want, tok)
+	}
+	return nil
+}
+
+type manifestBundleMeta struct {
+	CreatedAt string            `json:"created_at,omitempty"` // RFC 3339 format
+	Creator   string            `json:"creator,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+type manifestExternalSource struct {
+	// SourceAddr is the address of an entire remote or registry package,
+	// meaning that it must not have a sub-path portion.
+	SourceAddr string `json:"source"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+type manifestRootFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"` // lowercase hex-encoded SHA256
 }
 
 type manifestRemotePackage struct {
@@ -28,6 +234,56 @@ type manifestRemotePackage struct {
 	LocalDir string `json:"local"`
 
 	Meta manifestPackageMeta `json:"meta,omitempty"`
+
+	// The remaining fields are present only in format version 2 and later.
+
+	// Checksum is the checksum of the package content, including a scheme
+	// prefix such as "h1:".
+	Checksum string `json:"checksum,omitempty"`
+
+	// HashScheme is the name of the PackageHasher that calculated Checksum
+	// and the local directory name, or empty for the default "h1" scheme.
+	HashScheme string `json:"hash_scheme,omitempty"`
+
+	// Size is the total size in bytes of all of the files in the package.
+	Size int64 `json:"size,omitempty"`
+
+	// FileCount is the number of files in the package.
+	FileCount int `json:"files,omitempty"`
+
+	// SubPaths, if present, are the only sub-paths of the package that
+	// are included in the bundle, because it was fetched sparsely. If
+	// absent then the bundle includes the entire package.
+	SubPaths []string `json:"sub_paths,omitempty"`
+
+	// VCSMetadata is true if the builder kept any version control metadata
+	// in the package, because it was created using WithVCSMetadata.
+	VCSMetadata bool `json:"vcs_metadata,omitempty"`
+
+	// KeepPatterns and DropPatterns are the patterns the builder applied to
+	// the package, because it was created using WithAlwaysKeep or
+	// WithAlwaysDrop.
+	KeepPatterns []string `json:"keep_patterns,omitempty"`
+	DropPatterns []string `json:"drop_patterns,omitempty"`
+
+	// Licenses are the findings of any license scanner used when building
+	// the bundle.
+	Licenses []manifestLicenseFinding `json:"licenses,omitempty"`
+
+	// OriginalArchive is the hex-encoded SHA256 checksum of the original
+	// archive retained for this package, which is therefore in the
+	// originals directory under that name.
+	OriginalArchive string `json:"original_archive,omitempty"`
+
+	// Attestation is the hex-encoded SHA256 checksum of the attestation
+	// generated for this package, which is therefore in the attestations
+	// directory under that name.
+	Attestation string `json:"attestation,omitempty"`
+}
+
+type manifestLicenseFinding struct {
+	Path    string `json:"path"`
+	License string `json:"license,omitempty"`
 }
 
 type manifestRegistryMeta struct {
@@ -37,6 +293,10 @@ type manifestRegistryMeta struct {
 
 	// Versions is a map from string representations of [versions.Version].
 	Versions map[string]manifestRegistryVersion `json:"versions,omitempty"`
+
+	// Warnings are any warnings that the registry returned about the
+	// package.
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 type manifestRegistryVersion struct {
@@ -50,4 +310,85 @@ type manifestRegistryVersion struct {
 type manifestPackageMeta struct {
 	GitCommitID      string `json:"git_commit_id,omitempty"`
 	GitCommitMessage string `json:"git_commit_message,omitempty"`
+
+	ResolvedRef      string `json:"resolved_ref,omitempty"`
+	FetchTime        string `json:"fetch_time,omitempty"` // RFC 3339 format
+	UpstreamChecksum string `json:"upstream_checksum,omitempty"`
+	UpstreamSize     int64  `json:"upstream_size,omitempty"`
+}
+
+func manifestPackageMetaFrom(meta *PackageMeta) manifestPackageMeta {
+	if meta == nil {
+		return manifestPackageMeta{}
+	}
+	ret := manifestPackageMeta{
+		GitCommitID:      meta.gitCommitID,
+		GitCommitMessage: meta.gitCommitMessage,
+		ResolvedRef:      meta.resolvedRef,
+		UpstreamChecksum: meta.upstreamChecksum,
+		UpstreamSize:     meta.upstreamSize,
+	}
+	if !meta.fetchTime.IsZero() {
+		ret.FetchTime = meta.fetchTime.UTC().Format(time.RFC3339Nano)
+	}
+	return ret
+}
+
+// manifestBundleMetaFrom returns the manifest representation of the given
+// bundle metadata, or nil if there is no metadata to record.
+func manifestBundleMetaFrom(meta bundleMeta) *manifestBundleMeta {
+	if meta.createdAt.IsZero() && meta.creator == "" && len(meta.labels) == 0 {
+		return nil
+	}
+	ret := &manifestBundleMeta{
+		Creator: meta.creator,
+		Labels:  meta.labels,
+	}
+	if !meta.createdAt.IsZero() {
+		ret.CreatedAt = meta.createdAt.UTC().Format(time.RFC3339Nano)
+	}
+	return ret
+}
+
+// bundleMeta returns the [bundleMeta] equivalent to the receiver, which
+// may be nil to represent a bundle without any metadata.
+func (m *manifestBundleMeta) bundleMeta() (bundleMeta, error) {
+	if m == nil {
+		return bundleMeta{}, nil
+	}
+	ret := bundleMeta{
+		creator: m.Creator,
+		labels:  m.Labels,
+	}
+	if m.CreatedAt != "" {
+		t, err := time.Parse(time.RFC3339Nano, m.CreatedAt)
+		if err != nil {
+			return bundleMeta{}, fmt.Errorf("invalid creation time: %w", err)
+		}
+		ret.createdAt = t
+	}
+	return ret, nil
+}
+
+// packageMeta returns the [PackageMeta] equivalent to the receiver, or nil
+// if the receiver has no metadata at all.
+func (m manifestPackageMeta) packageMeta() (*PackageMeta, error) {
+	if m == (manifestPackageMeta{}) {
+		return nil, nil
+	}
+	ret := &PackageMeta{
+		gitCommitID:      m.GitCommitID,
+		gitCommitMessage: m.GitCommitMessage,
+		resolvedRef:      m.ResolvedRef,
+		upstreamChecksum: m.UpstreamChecksum,
+		upstreamSize:     m.UpstreamSize,
+	}
+	if m.FetchTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, m.FetchTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fetch time: %w", err)
+		}
+		ret.fetchTime = t
+	}
+	return ret, nil
 }
@@ -0,0 +1,180 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// OriginalsDirName is the name of the directory at the root of a source
+// bundle that contains the original archives retained by
+// [WithRetainedArchives], each named after the hex-encoded SHA256 checksum
+// of its content.
+const OriginalsDirName = "originals"
+
+// WithRetainedArchives is a BuilderOption that makes the builder keep a copy
+// of the original archive for each package whose fetcher reports one in
+// [FetchSourcePackageResponse.ArchiveFile], for use in workflows that must
+// preserve the exact upstream artifact. The archives are then available
+// through [Bundle.RemotePackageOriginalArchive].
+//
+// Identical archives are stored only once. Packages loaded from a
+// [PackageCache] have no original archive, because the cache stores only
+// the extracted content.
+func WithRetainedArchives() BuilderOption {
+	return func(b *Builder) error {
+		b.retainArchives = true
+		return nil
+	}
+}
+
+// takeOriginalArchive removes the archive file that a fetcher reported, if
+// any, from the given package work directory, and then either retains it in
+// the bundle's originals directory or discards it, depending on whether
+// [WithRetainedArchives] is in effect.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) takeOriginalArchive(pkgAddr sourceaddrs.RemotePackage, workDir string, archiveFile string) error {
+	delete(b.packageOriginals, pkgAddr)
+	if archiveFile == "" {
+		return nil
+	}
+	archivePath, err := originalArchivePath(workDir, archiveFile)
+	if err != nil {
+		return err
+	}
+	if !b.retainArchives {
+		return removeOriginalArchive(workDir, archiveFile)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open original archive: %w", err)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read original archive: %w", err)
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	originalsDir := filepath.Join(b.targetDir, OriginalsDirName)
+	if err := os.MkdirAll(originalsDir, 0755); err != nil {
+		return fmt.Errorf("failed to create originals directory: %w", err)
+	}
+	finalPath := filepath.Join(originalsDir, digest)
+	if _, err := os.Lstat(finalPath); err == nil {
+		// We already have an identical archive from another package.
+		if err := os.Remove(archivePath); err != nil {
+			return fmt.Errorf("failed to remove original archive: %w", err)
+		}
+	} else if err := os.Rename(archivePath, finalPath); err != nil {
+		return fmt.Errorf("failed to place original archive: %w", err)
+	}
+	b.packageOriginals[pkgAddr] = digest
+	return nil
+}
+
+// releaseOriginalArchive removes the retained original archive with the
+// given checksum from the bundle's originals directory, unless a package
+// still refers to it. It does nothing if the checksum is empty.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) releaseOriginalArchive(digest string) error {
+	if digest == "" {
+		return nil
+	}
+	for _, other := range b.packageOriginals {
+		if other == digest {
+			return nil
+		}
+	}
+	err := os.Remove(filepath.Join(b.targetDir, OriginalsDirName, digest))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove original archive: %w", err)
+	}
+	return nil
+}
+
+// removeOriginalArchive deletes the archive file that a fetcher reported
+// from the given package work directory.
+func removeOriginalArchive(workDir string, archiveFile string) error {
+	if archiveFile == "" {
+		return nil
+	}
+	archivePath, err := originalArchivePath(workDir, archiveFile)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(archivePath); err != nil {
+		return fmt.Errorf("failed to remove original archive: %w", err)
+	}
+	return nil
+}
+
+// originalArchivePath returns the full path of the archive file that a
+// fetcher reported, after making sure that it refers to a regular file
+// inside the work directory.
+func originalArchivePath(workDir string, archiveFile string) (string, error) {
+	if !fs.ValidPath(archiveFile) || archiveFile == "." {
+		return "", fmt.Errorf("fetcher returned invalid archive file path %q", archiveFile)
+	}
+	ret := filepath.Join(workDir, filepath.FromSlash(archiveFile))
+	info, err := os.Lstat(ret)
+	if err != nil {
+		return "", fmt.Errorf("fetcher returned archive file path %q that cannot be read: %w", archiveFile, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("fetcher returned archive file path %q that is not a regular file", archiveFile)
+	}
+	return ret, nil
+}
+
+// validOriginalDigest returns true if the given string is a valid name for
+// an original archive, which must be a lowercase hex-encoded SHA256 checksum.
+func validOriginalDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// RemotePackageOriginalArchive opens the original archive that was retained
+// for the given package because of [WithRetainedArchives]. The caller must
+// close the result.
+//
+// If no archive was retained for the package then the returned error wraps
+// [fs.ErrNotExist].
+func (b *Bundle) RemotePackageOriginalArchive(pkgAddr sourceaddrs.RemotePackage) (io.ReadCloser, error) {
+	digest, ok := b.remotePackageOriginals[pkgAddr]
+	if !ok {
+		return nil, fmt.Errorf("no original archive retained for %s: %w", pkgAddr, fs.ErrNotExist)
+	}
+	f, err := os.Open(filepath.Join(b.rootDir, OriginalsDirName, digest))
+	if err != nil {
+		return nil, fmt.Errorf("cannot open original archive for %s: %w", pkgAddr, err)
+	}
+	return f, nil
+}
+
+// RemotePackageOriginalArchiveChecksum returns the hex-encoded SHA256
+// checksum of the original archive retained for the given package, or an
+// empty string if no archive was retained.
+func (b *Bundle) RemotePackageOriginalArchiveChecksum(pkgAddr sourceaddrs.RemotePackage) string {
+	return b.remotePackageOriginals[pkgAddr]
+}
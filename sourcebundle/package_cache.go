@@ -0,0 +1,413 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// PackageCache is implemented by caches of already-fetched remote packages,
+// which can be shared between many [Builder] objects in the same process so
+// that popular packages need not be fetched again for every source bundle.
+//
+// Implementations must be safe to call concurrently from multiple
+// goroutines. [DirPackageCache] is a ready-to-use implementation.
+type PackageCache interface {
+	// LoadPackage copies the cached content of the package with the given
+	// key into targetDir, which already exists and is empty, and returns
+	// the package metadata that was stored along with it.
+	//
+	// If the cache has no entry for the given key then LoadPackage returns
+	// false and leaves targetDir unmodified.
+	LoadPackage(ctx context.Context, key PackageCacheKey, targetDir string) (*PackageMeta, bool, error)
+
+	// StorePackage saves a snapshot of the content of the given directory
+	// under the given key. The cache must not retain any reference to
+	// dir after StorePackage returns, because the caller may modify or
+	// move it.
+	StorePackage(ctx context.Context, key PackageCacheKey, dir string, meta *PackageMeta) error
+}
+
+// PackageCacheKey identifies a cached package snapshot.
+type PackageCacheKey struct {
+	// Package is the address that the package was fetched from.
+	Package sourceaddrs.RemotePackage
+
+	// Validator is an optional opaque string that distinguishes different
+	// snapshots of the same package address, such as the commit ID that
+	// a Git ref currently refers to. See [PackageValidator].
+	Validator string
+
+	// Preparation is an opaque string describing the builder options that
+	// affected how the package was prepared after fetching it, such as
+	// [WithAlwaysKeep], [WithAlwaysDrop], and [WithVCSMetadata], so that
+	// builders with different options sharing the same cache never use
+	// each other's snapshots. It's empty for the default preparation.
+	Preparation string
+}
+
+// packageCacheKey returns the key for the given package in the builder's
+// package cache, without any validator.
+func (b *Builder) packageCacheKey(pkgAddr sourceaddrs.RemotePackage) PackageCacheKey {
+	key := PackageCacheKey{Package: pkgAddr}
+	if !b.keepVCSMetadata && len(b.keepPatterns) == 0 && len(b.dropPatterns) == 0 {
+		return key
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "vcs_metadata=%t\n", b.keepVCSMetadata)
+	for _, pattern := range b.keepPatterns {
+		fmt.Fprintf(hash, "keep=%q\n", pattern)
+	}
+	for _, pattern := range b.dropPatterns {
+		fmt.Fprintf(hash, "drop=%q\n", pattern)
+	}
+	key.Preparation = hex.EncodeToString(hash.Sum(nil))
+	return key
+}
+
+// PackageValidator is a callback that a [Builder] uses to find the current
+// validator string for a remote package before consulting its
+// [PackageCache], so that a cached snapshot is used only if the upstream
+// content hasn't changed since it was stored.
+//
+// Returning an error causes the builder to skip the cache and fetch the
+// package directly.
+type PackageValidator func(ctx context.Context, pkgAddr sourceaddrs.RemotePackage) (string, error)
+
+// PackageCacheEntry describes an entry in a [DirPackageCache], for use by
+// a [PackageCacheEvictionPolicy].
+type PackageCacheEntry struct {
+	Key      PackageCacheKey
+	Size     int64
+	LastUsed time.Time
+}
+
+// PackageCacheEvictionPolicy decides which entries a [DirPackageCache]
+// should evict after storing a new entry. It receives all of the current
+// entries ordered from least to most recently used, and returns the keys
+// of those which should be removed.
+type PackageCacheEvictionPolicy func(entries []PackageCacheEntry) []PackageCacheKey
+
+// EvictLeastRecentlyUsed returns a [PackageCacheEvictionPolicy] that keeps
+// at most the given number of the most recently-used entries.
+func EvictLeastRecentlyUsed(maxEntries int) PackageCacheEvictionPolicy {
+	return func(entries []PackageCacheEntry) []PackageCacheKey {
+		if len(entries) <= maxEntries {
+			return nil
+		}
+		var ret []PackageCacheKey
+		for _, entry := range entries[:len(entries)-maxEntries] {
+			ret = append(ret, entry.Key)
+		}
+		return ret
+	}
+}
+
+// DirPackageCache is a [PackageCache] that keeps package snapshots in
+// subdirectories of a local directory. Snapshots are content-addressed, so
+// that multiple package addresses with identical content share storage.
+//
+// The index of entries is kept in memory only, so a DirPackageCache is
+// effective only for the lifetime of the process that created it.
+type DirPackageCache struct {
+	dir   string
+	evict PackageCacheEvictionPolicy
+	clock Clock
+
+	mu        sync.Mutex
+	entries   map[PackageCacheKey]*dirPackageCacheEntry
+	snapshots map[string]int // number of entries and loads referring to each snapshot
+	stores    uint64         // number of calls to StorePackage so far
+}
+
+type dirPackageCacheEntry struct {
+	snapshot string
+	meta     *PackageMeta
+	size     int64
+	lastUsed time.Time
+	stored   uint64 // value of stores when this entry was stored
+}
+
+// NewDirPackageCache creates a new [DirPackageCache] that stores its
+// snapshots in the given directory, which must already exist and must not
+// be modified by anything else while the cache is in use.
+//
+// If evict is nil then the cache will retain all entries indefinitely.
+func NewDirPackageCache(dir string, evict PackageCacheEvictionPolicy) (*DirPackageCache, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache directory: %w", err)
+	}
+	return &DirPackageCache{
+		dir:       absDir,
+		evict:     evict,
+		clock:     SystemClock,
+		entries:   make(map[PackageCacheKey]*dirPackageCacheEntry),
+		snapshots: make(map[string]int),
+	}, nil
+}
+
+// SetClock changes the [Clock] that the cache uses to track when each entry
+// was last used, for its [PackageCacheEvictionPolicy]. The default is
+// [SystemClock].
+func (c *DirPackageCache) SetClock(clock Clock) {
+	c.mu.Lock()
+	c.clock = clock
+	c.mu.Unlock()
+}
+
+// LoadPackage implements [PackageCache].
+func (c *DirPackageCache) LoadPackage(ctx context.Context, key PackageCacheKey, targetDir string) (*PackageMeta, bool, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+	// We copy the snapshot without holding the lock, so that a large
+	// package doesn't block other loads and stores. Our own reference
+	// to the snapshot keeps it from being deleted while we copy it, even
+	// if the entry is evicted in the meantime.
+	snapshot, meta := entry.snapshot, entry.meta
+	entry.lastUsed = c.clock.Now()
+	c.snapshots[snapshot]++
+	c.mu.Unlock()
+
+	err := copyPackageDir(targetDir, filepath.Join(c.dir, snapshot))
+
+	c.mu.Lock()
+	c.releaseSnapshot(snapshot)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to copy cached package: %w", err)
+	}
+	return meta, true, nil
+}
+
+// LoadLatestPackage implements [StalePackageCache].
+func (c *DirPackageCache) LoadLatestPackage(ctx context.Context, key PackageCacheKey, targetDir string) (*PackageMeta, PackageCacheKey, bool, error) {
+	c.mu.Lock()
+	var latestKey PackageCacheKey
+	var latest *dirPackageCacheEntry
+	for candidate, entry := range c.entries {
+		if candidate.Package != key.Package || candidate.Preparation != key.Preparation {
+			continue
+		}
+		if latest == nil || entry.stored > latest.stored {
+			latestKey, latest = candidate, entry
+		}
+	}
+	c.mu.Unlock()
+
+	if latest == nil {
+		return nil, PackageCacheKey{}, false, nil
+	}
+	// LoadPackage will report that there's no entry if it was evicted
+	// since we found it above.
+	meta, ok, err := c.LoadPackage(ctx, latestKey, targetDir)
+	return meta, latestKey, ok, err
+}
+
+// StorePackage implements [PackageCache].
+func (c *DirPackageCache) StorePackage(ctx context.Context, key PackageCacheKey, dir string, meta *PackageMeta) error {
+	snapshot, stats, err := packageDirName(dir, DefaultPackageHasher)
+	if err != nil {
+		return err
+	}
+
+	// If we already have the snapshot then our own reference to it keeps
+	// it from being deleted before we add our entry. Otherwise we copy the
+	// package without holding the lock, so that a large package doesn't
+	// block other loads and stores.
+	c.mu.Lock()
+	cached := c.snapshots[snapshot] > 0
+	if cached {
+		c.snapshots[snapshot]++
+	}
+	c.mu.Unlock()
+	if !cached {
+		workDir, err := ioutil.TempDir(c.dir, ".tmp-")
+		if err != nil {
+			return fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		// If we succeed then workDir will have been renamed away before we
+		// return, in which case this will do nothing.
+		defer os.RemoveAll(workDir)
+		if err := copyPackageDir(workDir, dir); err != nil {
+			return fmt.Errorf("failed to copy package into cache: %w", err)
+		}
+		if err := c.placeSnapshot(snapshot, workDir); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// We release the old snapshot only once the new one is in place, so
+	// that a failure above leaves the old entry usable.
+	if old, ok := c.entries[key]; ok {
+		c.releaseSnapshot(old.snapshot)
+	}
+	c.stores++
+	c.entries[key] = &dirPackageCacheEntry{
+		snapshot: snapshot,
+		meta:     meta,
+		size:     stats.Size(),
+		lastUsed: c.clock.Now(),
+		stored:   c.stores,
+	}
+
+	if c.evict != nil {
+		entries := make([]PackageCacheEntry, 0, len(c.entries))
+		for key, entry := range c.entries {
+			entries = append(entries, PackageCacheEntry{
+				Key:      key,
+				Size:     entry.size,
+				LastUsed: entry.lastUsed,
+			})
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].LastUsed.Before(entries[j].LastUsed)
+		})
+		for _, evictKey := range c.evict(entries) {
+			if entry, ok := c.entries[evictKey]; ok {
+				delete(c.entries, evictKey)
+				c.releaseSnapshot(entry.snapshot)
+			}
+		}
+	}
+	return nil
+}
+
+// placeSnapshot renames the given directory, which contains a copy of the
+// package with the given snapshot name, into place as that snapshot unless
+// another store has placed it in the meantime, and then takes a reference to
+// the snapshot.
+func (c *DirPackageCache) placeSnapshot(snapshot, workDir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.snapshots[snapshot] == 0 {
+		// The index exists only in memory, so there might be a directory
+		// with this name left by an earlier process using the same cache
+		// directory, and it might be incomplete.
+		finalDir := filepath.Join(c.dir, snapshot)
+		if err := os.RemoveAll(finalDir); err != nil {
+			return fmt.Errorf("failed to remove stale cached package directory: %w", err)
+		}
+		if err := os.Rename(workDir, finalDir); err != nil {
+			return fmt.Errorf("failed to place cached package directory: %w", err)
+		}
+	}
+	c.snapshots[snapshot]++
+	return nil
+}
+
+// releaseSnapshot decrements the reference count for the given snapshot,
+// deleting its directory if nothing refers to it anymore.
+//
+// This expects to be called while c.mu is already locked.
+func (c *DirPackageCache) releaseSnapshot(snapshot string) {
+	c.snapshots[snapshot]--
+	if c.snapshots[snapshot] > 0 {
+		return
+	}
+	delete(c.snapshots, snapshot)
+	// If removal fails then we'll just leak the directory, since it's
+	// no longer reachable through the index anyway.
+	os.RemoveAll(filepath.Join(c.dir, snapshot))
+}
+
+// copyPackageDir copies the content of package directory src into the
+// already-existing directory dst, preserving file modes and symlinks.
+func copyPackageDir(dst, src string) error {
+	// Directories are created writable so that their contents can be
+	// copied into them, and then get their real modes once everything
+	// has been copied.
+	type dirMode struct {
+		path string
+		mode fs.FileMode
+	}
+	var dirs []dirMode
+
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, dirMode{dstPath, info.Mode().Perm()})
+			return os.Mkdir(dstPath, 0700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dstPath)
+		case info.Mode().IsRegular():
+			return copyPackageFile(dstPath, path, info.Mode().Perm())
+		default:
+			// Prepared package directories can only contain directories,
+			// regular files, and symlinks.
+			return fmt.Errorf("unsupported file type at %s", path)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Subdirectories come after their parents in walk order, so we apply
+	// the modes in reverse to avoid a parent's mode preventing access to
+	// its children.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyPackageFile(dst, src string, mode fs.FileMode) error {
+	srcF, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcF.Close()
+
+	dstF, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dstF, srcF)
+	if closeErr := dstF.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,396 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+func TestBuilderPackageCache(t *testing.T) {
+	cache, err := NewDirPackageCache(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakes := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/foo.tgz": "testdata/pkgs/hello",
+		},
+		nil,
+		nil,
+	)
+	fetches := 0
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		fetches++
+		return fakes.fetcher.FetchSourcePackage(ctx, sourceType, url, targetDir)
+	})
+
+	realSource := sourceaddrs.MustParseSource("https://example.com/foo.tgz").(sourceaddrs.RemoteSource)
+	var localDirs []string
+	for i := 0; i < 2; i++ {
+		builder, err := NewBuilder(t.TempDir(), fetcher, fakes.registryClient, WithPackageCache(cache, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		diags := builder.AddRemoteSource(context.Background(), realSource, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
+		}
+		bundle, err := builder.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		localDir, err := bundle.LocalPathForSource(realSource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Lstat(filepath.Join(localDir, "hello")); err != nil {
+			t.Errorf("problem with output file: %s", err)
+		}
+		localDirs = append(localDirs, filepath.Base(localDir))
+	}
+
+	if fetches != 1 {
+		t.Errorf("package was fetched %d times; want 1", fetches)
+	}
+	if localDirs[0] != localDirs[1] {
+		t.Errorf("cached package has different content\nfirst:  %s\nsecond: %s", localDirs[0], localDirs[1])
+	}
+}
+
+func TestBuilderPackageCachePreparation(t *testing.T) {
+	cache, err := NewDirPackageCache(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		var ret FetchSourcePackageResponse
+		fetches++
+		if err := copyDir(targetDir, "testdata/pkgs/hello"); err != nil {
+			return ret, err
+		}
+		if err := os.WriteFile(filepath.Join(targetDir, "extra.txt"), []byte("extra"), 0644); err != nil {
+			return ret, err
+		}
+		if err := os.Mkdir(filepath.Join(targetDir, ".hg"), 0755); err != nil {
+			return ret, err
+		}
+		if err := os.WriteFile(filepath.Join(targetDir, ".hg", "metadata"), nil, 0644); err != nil {
+			return ret, err
+		}
+		return ret, nil
+	})
+	realSource := sourceaddrs.MustParseSource("https://example.com/foo.tgz").(sourceaddrs.RemoteSource)
+
+	// Builders with different preparation options must each get content
+	// prepared with their own options, even though they share a cache.
+	tests := []struct {
+		opts        []BuilderOption
+		wantExist   []string
+		wantMissing []string
+		wantFetches int
+	}{
+		{
+			wantExist:   []string{"hello", "extra.txt"},
+			wantMissing: []string{".hg"},
+			wantFetches: 1,
+		},
+		{
+			opts:        []BuilderOption{WithVCSMetadata(), WithAlwaysDrop("extra.txt")},
+			wantExist:   []string{"hello", ".hg"},
+			wantMissing: []string{"extra.txt"},
+			wantFetches: 2,
+		},
+		{
+			opts:        []BuilderOption{WithAlwaysDrop("extra.txt")},
+			wantExist:   []string{"hello"},
+			wantMissing: []string{"extra.txt", ".hg"},
+			wantFetches: 3,
+		},
+		{
+			// The same options as an earlier builder can use its snapshot.
+			opts:        []BuilderOption{WithVCSMetadata(), WithAlwaysDrop("extra.txt")},
+			wantExist:   []string{"hello", ".hg"},
+			wantMissing: []string{"extra.txt"},
+			wantFetches: 3,
+		},
+	}
+	for i, test := range tests {
+		opts := append([]BuilderOption{WithPackageCache(cache, nil)}, test.opts...)
+		builder, err := NewBuilder(t.TempDir(), fetcher, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diags := builder.AddRemoteSource(context.Background(), realSource, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
+		}
+		bundle, err := builder.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		localDir, err := bundle.LocalPathForSource(realSource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range test.wantExist {
+			if _, err := os.Lstat(filepath.Join(localDir, name)); err != nil {
+				t.Errorf("builder %d: %s should exist: %s", i, name, err)
+			}
+		}
+		for _, name := range test.wantMissing {
+			if _, err := os.Lstat(filepath.Join(localDir, name)); err == nil {
+				t.Errorf("builder %d: %s should not exist", i, name)
+			}
+		}
+		if fetches != test.wantFetches {
+			t.Errorf("builder %d: package was fetched %d times in total; want %d", i, fetches, test.wantFetches)
+		}
+	}
+}
+
+func TestDirPackageCacheEviction(t *testing.T) {
+	cacheDir := t.TempDir()
+	cache, err := NewDirPackageCache(cacheDir, EvictLeastRecentlyUsed(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	keyA := PackageCacheKey{Package: sourceaddrs.MustParseSource("https://example.com/a.tgz").(sourceaddrs.RemoteSource).Package()}
+	keyB := PackageCacheKey{Package: sourceaddrs.MustParseSource("https://example.com/b.tgz").(sourceaddrs.RemoteSource).Package()}
+	if err := cache.StorePackage(ctx, keyA, "testdata/pkgs/hello", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.StorePackage(ctx, keyB, "testdata/pkgs/terraformignore", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := cache.LoadPackage(ctx, keyA, t.TempDir()); err != nil || ok {
+		t.Errorf("entry A is still cached (err: %v)", err)
+	}
+	targetDir := t.TempDir()
+	if _, ok, err := cache.LoadPackage(ctx, keyB, targetDir); err != nil || !ok {
+		t.Errorf("entry B is not cached (err: %v)", err)
+	}
+
+	// Only the snapshot for entry B should remain in the cache directory.
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 1; got != want {
+		t.Errorf("cache directory has %d entries; want %d", got, want)
+	}
+	wantName, _, err := packageDirName(targetDir, DefaultPackageHasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantName, entries[0].Name()); diff != "" {
+		t.Errorf("wrong snapshot directory\n%s", diff)
+	}
+}
+
+func TestCopyPackageDirModes(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(srcDir, "ro"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "ro", "main.tf"), []byte("# hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(srcDir, "ro"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Allow the temporary directories to be removed.
+		os.Chmod(filepath.Join(srcDir, "ro"), 0755)
+		os.Chmod(filepath.Join(dstDir, "ro"), 0755)
+	})
+
+	// A read-only directory must still have its contents copied into it.
+	if err := copyPackageDir(dstDir, srcDir); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dstDir, "ro"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0555); got != want {
+		t.Errorf("wrong directory mode %s; want %s", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dstDir, "ro", "main.tf")); err != nil {
+		t.Errorf("file was not copied: %s", err)
+	}
+}
+
+func TestDirPackageCacheStaleSnapshot(t *testing.T) {
+	cacheDir := t.TempDir()
+	snapshot, _, err := packageDirName("testdata/pkgs/hello", DefaultPackageHasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An earlier process using the same cache directory left behind an
+	// incomplete copy of the snapshot, which isn't in the new cache's index.
+	if err := os.MkdirAll(filepath.Join(cacheDir, snapshot, "partial"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewDirPackageCache(cacheDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	key := PackageCacheKey{Package: sourceaddrs.MustParseSource("https://example.com/a.tgz").(sourceaddrs.RemoteSource).Package()}
+	if err := cache.StorePackage(ctx, key, "testdata/pkgs/hello", nil); err != nil {
+		t.Fatalf("failed to store package: %s", err)
+	}
+	targetDir := t.TempDir()
+	if _, ok, err := cache.LoadPackage(ctx, key, targetDir); err != nil || !ok {
+		t.Fatalf("package is not cached (err: %v)", err)
+	}
+	if _, err := os.Lstat(filepath.Join(targetDir, "partial")); !os.IsNotExist(err) {
+		t.Errorf("loaded package includes the stale snapshot's content: %v", err)
+	}
+	gotName, _, err := packageDirName(targetDir, DefaultPackageHasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotName != snapshot {
+		t.Errorf("wrong loaded package %s; want %s", gotName, snapshot)
+	}
+}
+
+func TestDirPackageCacheLoadDuringEviction(t *testing.T) {
+	cache, err := NewDirPackageCache(t.TempDir(), EvictLeastRecentlyUsed(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	keyA := PackageCacheKey{Package: sourceaddrs.MustParseSource("https://example.com/a.tgz").(sourceaddrs.RemoteSource).Package()}
+	keyB := PackageCacheKey{Package: sourceaddrs.MustParseSource("https://example.com/b.tgz").(sourceaddrs.RemoteSource).Package()}
+
+	// Loads run concurrently with the stores that evict the entries they
+	// are loading, and so must either find a complete snapshot or none.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, _, err := cache.LoadPackage(ctx, keyA, t.TempDir()); err != nil {
+					t.Errorf("failed to load: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := cache.StorePackage(ctx, keyA, "testdata/pkgs/hello", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.StorePackage(ctx, keyB, "testdata/pkgs/terraformignore", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestBuilderStaleWhileRevalidate(t *testing.T) {
+	cache, err := NewDirPackageCache(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakes := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/foo.tgz": "testdata/pkgs/hello",
+		},
+		nil,
+		nil,
+	)
+	// The fetcher and validator are called concurrently by background
+	// revalidations, so the test state is guarded by a mutex.
+	var mu sync.Mutex
+	fetches := 0
+	upstream := "v1"
+	fetcher := packageFetcherFunc(func(ctx context.Context, sourceType string, url *url.URL, targetDir string) (FetchSourcePackageResponse, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		// A slow fetch makes it more likely that a background revalidation
+		// is still running when the builder is closed.
+		time.Sleep(10 * time.Millisecond)
+		return fakes.fetcher.FetchSourcePackage(ctx, sourceType, url, targetDir)
+	})
+	validator := func(ctx context.Context, pkgAddr sourceaddrs.RemotePackage) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return upstream, nil
+	}
+
+	realSource := sourceaddrs.MustParseSource("https://example.com/foo.tgz").(sourceaddrs.RemoteSource)
+	build := func() *BuildReport {
+		t.Helper()
+		targetDir := t.TempDir()
+		builder, err := NewBuilder(targetDir, fetcher, fakes.registryClient, WithPackageCache(cache, validator), WithStaleWhileRevalidate())
+		if err != nil {
+			t.Fatal(err)
+		}
+		diags := builder.AddRemoteSource(context.Background(), realSource, noDependencyFinder)
+		if len(diags) > 0 {
+			t.Fatalf("unexpected diagnostics: %#v", diags)
+		}
+		// Close waits for background revalidations, which work inside the
+		// bundle directory, and so it must not contain their leftovers.
+		if _, err := builder.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenDirStrict(targetDir); err != nil {
+			t.Fatal(err)
+		}
+		return builder.Report()
+	}
+	checkBuild := func(wantFromCache, wantStale bool, wantFetches int) {
+		t.Helper()
+		report := build()
+		if got := report.Packages[0].FromCache; got != wantFromCache {
+			t.Errorf("wrong FromCache %t; want %t", got, wantFromCache)
+		}
+		if got := report.Packages[0].PossiblyStale; got != wantStale {
+			t.Errorf("wrong PossiblyStale %t; want %t", got, wantStale)
+		}
+		if fetches != wantFetches {
+			t.Errorf("package was fetched %d times; want %d", fetches, wantFetches)
+		}
+	}
+
+	// The first build must fetch the package, because nothing is cached.
+	checkBuild(false, false, 1)
+
+	// Once the package changes upstream, the next build still uses the
+	// cached snapshot while revalidation fetches the new content.
+	upstream = "v2"
+	checkBuild(true, true, 2)
+
+	// The build after that uses the refreshed snapshot, which revalidation
+	// confirms is current.
+	checkBuild(true, false, 2)
+}
@@ -0,0 +1,226 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// CopySymlinkPolicy describes how [Bundle.CopyPackageTo] deals with
+// symlinks in the content it copies.
+type CopySymlinkPolicy int
+
+const (
+	// CopySymlinksAsLinks recreates each symlink with the same target in
+	// the destination. A symlink whose target is outside of the copied
+	// directory will therefore not resolve in the destination. This is
+	// the default.
+	CopySymlinksAsLinks CopySymlinkPolicy = iota
+
+	// CopySymlinkTargets copies the content that each symlink refers to in
+	// place of the symlink, so that the result contains no symlinks. The
+	// target of each symlink must be within the same package.
+	CopySymlinkTargets
+
+	// SkipSymlinks leaves symlinks out of the copy.
+	SkipSymlinks
+)
+
+// CopyPackageOptions are the options for [Bundle.CopyPackageTo]. The zero
+// value copies symlinks as links and preserves file permissions.
+type CopyPackageOptions struct {
+	// Symlinks selects how symlinks are copied.
+	Symlinks CopySymlinkPolicy
+
+	// NormalizeModes, if set, gives every copied directory and every
+	// executable file the permissions 0755 and every other file 0644,
+	// instead of preserving the permissions from the bundle.
+	NormalizeModes bool
+}
+
+// CopyPackageTo copies the content that the given source address refers to
+// into the directory dstDir, outside of the bundle's own layout, and returns
+// the slash-separated paths relative to dstDir of the files and symlinks
+// that it copied, in lexical order.
+//
+// If the source address refers to a directory, which is typical, then the
+// content of that directory is copied into dstDir. If it refers to a single
+// file then that file is copied into dstDir under its own name. dstDir is
+// created if necessary, but CopyPackageTo fails if any of the files it
+// would copy already exist there.
+//
+// It doesn't make sense to pass a [sourceaddrs.LocalSource], because a
+// source bundle contains only remote packages.
+func (b *Bundle) CopyPackageTo(source sourceaddrs.FinalSource, dstDir string, opts CopyPackageOptions) ([]string, error) {
+	switch opts.Symlinks {
+	case CopySymlinksAsLinks, CopySymlinkTargets, SkipSymlinks:
+	default:
+		return nil, fmt.Errorf("invalid symlink policy %d", opts.Symlinks)
+	}
+	if _, ok := source.(sourceaddrs.LocalSource); ok {
+		return nil, fmt.Errorf("cannot copy local source %s from a source bundle", source)
+	}
+	srcPath, err := b.LocalPathForSource(source)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(b.rootDir, srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find package directory for %s: %w", source, err)
+	}
+	pkgDir, err := filepath.EvalSymlinks(filepath.Join(b.rootDir, strings.SplitN(rel, string(filepath.Separator), 2)[0]))
+	if err != nil {
+		return nil, fmt.Errorf("cannot find package directory for %s: %w", source, err)
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", source, err)
+	}
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	c := &packageCopier{
+		opts:    opts,
+		pkgDir:  pkgDir,
+		visited: make(map[string]bool),
+	}
+	if !info.IsDir() {
+		err = c.copyEntry(filepath.Join(dstDir, info.Name()), srcPath, info.Name())
+	} else {
+		err = c.copyDir(dstDir, srcPath, "")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy %s: %w", source, err)
+	}
+	sort.Strings(c.copied)
+	return c.copied, nil
+}
+
+// packageCopier implements [Bundle.CopyPackageTo].
+type packageCopier struct {
+	opts   CopyPackageOptions
+	pkgDir string
+
+	// visited tracks the real paths of the directories currently being
+	// copied, so that following symlinks can't cause an infinite loop.
+	visited map[string]bool
+
+	copied []string
+}
+
+// copyDir copies the content of the directory src into the already-existing
+// directory dst, where the copied entries have the given slash-separated
+// path prefix in the result.
+func (c *packageCopier) copyDir(dst, src, prefix string) error {
+	realSrc, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	if c.visited[realSrc] {
+		return fmt.Errorf("symlink cycle at %s", src)
+	}
+	c.visited[realSrc] = true
+	defer delete(c.visited, realSrc)
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		err := c.copyEntry(filepath.Join(dst, name), filepath.Join(src, name), prefix+name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyEntry copies the single file, directory, or symlink src to dst, which
+// must not already exist.
+func (c *packageCopier) copyEntry(dst, src, name string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		switch c.opts.Symlinks {
+		case SkipSymlinks:
+			return nil
+		case CopySymlinksAsLinks:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dst); err != nil {
+				return err
+			}
+			c.copied = append(c.copied, name)
+			return nil
+		}
+
+		realSrc, err := filepath.EvalSymlinks(src)
+		if err != nil {
+			return fmt.Errorf("cannot resolve symlink %s: %w", name, err)
+		}
+		if rel, err := filepath.Rel(c.pkgDir, realSrc); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("symlink %s refers to a location outside of its package", name)
+		}
+		src = realSrc
+		info, err = os.Stat(src)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		// The directory gets its real mode only once its contents have
+		// been copied, in case that mode doesn't allow writing to it.
+		if err := os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+		if err := c.copyDir(dst, src, name+"/"); err != nil {
+			return err
+		}
+		return os.Chmod(dst, c.dirMode(info.Mode()))
+	case info.Mode().IsRegular():
+		if err := copyPackageFile(dst, src, c.fileMode(info.Mode())); err != nil {
+			return err
+		}
+		c.copied = append(c.copied, name)
+		return nil
+	default:
+		// Prepared package directories can only contain directories,
+		// regular files, and symlinks.
+		return fmt.Errorf("unsupported file type at %s", name)
+	}
+}
+
+func (c *packageCopier) dirMode(mode fs.FileMode) fs.FileMode {
+	if c.opts.NormalizeModes {
+		return 0755
+	}
+	return mode.Perm()
+}
+
+func (c *packageCopier) fileMode(mode fs.FileMode) fs.FileMode {
+	if !c.opts.NormalizeModes {
+		return mode.Perm()
+	}
+	if mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
@@ -41,5 +41,30 @@ type PackageFetcher interface {
 // the fetch operation. This type may grow to add more data over time in later
 // minor releases.
 type FetchSourcePackageResponse struct {
+	// PackageMeta is optional metadata about the fetched package, which
+	// fetchers can construct using [NewPackageMeta] and its With-prefixed
+	// methods.
 	PackageMeta *PackageMeta
+
+	// RootSubdir is optionally a slash-separated sub-directory of the
+	// target directory which is the real root of the package, for fetchers
+	// whose content is nested, such as in an archive with a wrapper
+	// directory. If set, the builder moves the content of that directory
+	// up to the top level and discards everything else before preparing
+	// and hashing the package.
+	//
+	// Setting RootSubdir disables the builder's automatic removal of
+	// wrapper directories for sources where that would otherwise apply.
+	RootSubdir string
+
+	// Sparse must be set by a [SparsePackageFetcher] that fetched only the
+	// requested sub-paths of a package, rather than the whole package.
+	Sparse bool
+
+	// ArchiveFile is optionally a slash-separated path under the target
+	// directory of a copy of the original archive that the fetcher
+	// downloaded and extracted, if any. The builder always removes this
+	// file from the package content, and retains it in the bundle only if
+	// [WithRetainedArchives] is in effect.
+	ArchiveFile string
 }
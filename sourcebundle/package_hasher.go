@@ -0,0 +1,153 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// PackageHasher calculates the checksum of the content of a remote package,
+// which a [Builder] uses to name the package's local directory in the bundle
+// so that packages with identical content can share a directory.
+//
+// The manifest records the name of the hasher used for each package, so
+// that a bundle can contain packages hashed using different schemes while
+// migrating from one scheme to another. A [Bundle] can verify only packages
+// whose hasher is either the one used by the [Builder] that created it, or
+// has been registered using [RegisterPackageHasher].
+type PackageHasher interface {
+	// Name returns the name of the hashing scheme, such as "h1", which
+	// must be non-empty and unique to the scheme.
+	Name() string
+
+	// HashDir returns the checksum of the package content in the given
+	// directory, which contains the given files, whose names are
+	// slash-separated and relative to the directory. The hasher must read
+	// the files using the given open function, so that the builder can
+	// gather statistics about them.
+	HashDir(dir string, files []string, open func(name string) (io.ReadCloser, error)) (string, error)
+
+	// DirName returns the name of the local directory for a package with
+	// the given checksum, which must be a single path component.
+	DirName(checksum string) (string, error)
+}
+
+// DefaultPackageHasher is the [PackageHasher] that a [Builder] uses unless
+// configured otherwise using [WithPackageHasher]. Its name is "h1", and it
+// uses the same directory tree hashing scheme that Go uses for its modules,
+// producing checksums with the prefix [ChecksumPrefixV1].
+var DefaultPackageHasher PackageHasher = h1PackageHasher{}
+
+type h1PackageHasher struct{}
+
+func (h1PackageHasher) Name() string {
+	return "h1"
+}
+
+func (h1PackageHasher) HashDir(dir string, files []string, open func(name string) (io.ReadCloser, error)) (string, error) {
+	return dirhash.Hash1(files, open)
+}
+
+func (h1PackageHasher) DirName(checksum string) (string, error) {
+	// dirhash produces standard base64 encoding, but we need URL-friendly
+	// base64 encoding since we're using these as filenames.
+	rawChecksum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(checksum, ChecksumPrefixV1))
+	if err != nil {
+		return "", fmt.Errorf("package has invalid checksum: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(rawChecksum), nil
+}
+
+var (
+	packageHashersMu sync.RWMutex
+	packageHashers   = map[string]PackageHasher{
+		DefaultPackageHasher.Name(): DefaultPackageHasher,
+	}
+)
+
+// RegisterPackageHasher makes the given hasher available for verifying the
+// packages in any bundle whose manifest refers to its name, such as when
+// using [Bundle.CheckIntegrity] or [Bundle.Repair] on a bundle opened using
+// [OpenDir].
+//
+// Because each name identifies a single hashing scheme, registering a
+// hasher of the same type under an already-registered name has no effect,
+// while registering a hasher of a different type under that name returns
+// an error.
+func RegisterPackageHasher(hasher PackageHasher) error {
+	if err := validPackageHasher(hasher); err != nil {
+		return err
+	}
+	packageHashersMu.Lock()
+	defer packageHashersMu.Unlock()
+	if existing, ok := packageHashers[hasher.Name()]; ok {
+		// We compare the types rather than the hashers themselves, because
+		// a hasher's dynamic type might not be comparable.
+		if reflect.TypeOf(existing) != reflect.TypeOf(hasher) {
+			return fmt.Errorf("a different package hasher named %q is already registered", hasher.Name())
+		}
+		return nil
+	}
+	packageHashers[hasher.Name()] = hasher
+	return nil
+}
+
+// WithPackageHasher is a BuilderOption that makes the builder use the given
+// hasher to calculate the checksum and local directory name of each remote
+// package, instead of [DefaultPackageHasher].
+func WithPackageHasher(hasher PackageHasher) BuilderOption {
+	return func(b *Builder) error {
+		if err := validPackageHasher(hasher); err != nil {
+			return err
+		}
+		b.packageHasher = hasher
+		return nil
+	}
+}
+
+func validPackageHasher(hasher PackageHasher) error {
+	if hasher == nil {
+		return fmt.Errorf("package hasher must not be nil")
+	}
+	if name := hasher.Name(); name == "" || strings.ContainsAny(name, ": \t\n") {
+		return fmt.Errorf("invalid package hasher name %q", name)
+	}
+	return nil
+}
+
+// packageHasherForDir returns the hasher that calculated the name of the
+// given local package directory.
+func (b *Bundle) packageHasherForDir(localDir string) (PackageHasher, error) {
+	name := DefaultPackageHasher.Name()
+	if stats := b.packageDirStats[localDir]; stats != nil && stats.hashScheme != "" {
+		name = stats.hashScheme
+	}
+	if hasher := b.packageHasher; hasher != nil && hasher.Name() == name {
+		return hasher, nil
+	}
+	packageHashersMu.RLock()
+	defer packageHashersMu.RUnlock()
+	hasher, ok := packageHashers[name]
+	if !ok {
+		return nil, fmt.Errorf("package directory %s uses unsupported hashing scheme %q", localDir, name)
+	}
+	return hasher, nil
+}
+
+// validDirName returns an error if the given local directory name returned
+// by a [PackageHasher] is not a single path component.
+func validDirName(hasher PackageHasher, dirName string) error {
+	if !fs.ValidPath(dirName) || dirName == "." || strings.ContainsAny(dirName, `/\`) || strings.HasPrefix(dirName, ".") {
+		return fmt.Errorf("package hasher %q returned invalid directory name %q", hasher.Name(), dirName)
+	}
+	return nil
+}
@@ -3,6 +3,8 @@
 
 package sourcebundle
 
+import "time"
+
 // PackageMeta is a collection of metadata about how the content of a
 // particular remote package was derived.
 //
@@ -18,6 +20,11 @@ type PackageMeta struct {
 
 	gitCommitID      string
 	gitCommitMessage string
+
+	resolvedRef      string
+	fetchTime        time.Time
+	upstreamChecksum string
+	upstreamSize     int64
 }
 
 type RegistryVersionDeprecation struct {
@@ -42,6 +49,69 @@ func PackageMetaWithGitMetadata(
 	}
 }
 
+// NewPackageMeta returns an empty [PackageMeta] object, which callers can
+// then populate using the With-prefixed methods.
+func NewPackageMeta() *PackageMeta {
+	return &PackageMeta{}
+}
+
+// WithGitMetadata returns a copy of the receiver with the given Git commit
+// ID and message, with the same constraints as for
+// [PackageMetaWithGitMetadata].
+//
+// As with all of the With-prefixed methods, it's valid to call this on a
+// nil PackageMeta, in which case the result has only the given metadata.
+func (m *PackageMeta) WithGitMetadata(commitID string, commitMessage string) *PackageMeta {
+	ret := m.copy()
+	ret.gitCommitID = commitID
+	ret.gitCommitMessage = commitMessage
+	return ret
+}
+
+// WithResolvedRef returns a copy of the receiver with the given resolved
+// ref, such as the fully-qualified Git ref name that an abbreviated or
+// defaulted ref in the source address resolved to.
+func (m *PackageMeta) WithResolvedRef(ref string) *PackageMeta {
+	ret := m.copy()
+	ret.resolvedRef = ref
+	return ret
+}
+
+// WithFetchTime returns a copy of the receiver recording the given time as
+// when the package was fetched.
+func (m *PackageMeta) WithFetchTime(t time.Time) *PackageMeta {
+	ret := m.copy()
+	ret.fetchTime = t
+	return ret
+}
+
+// WithUpstreamChecksum returns a copy of the receiver with the given
+// checksum of the package as it was served by the upstream location, such
+// as a digest of a downloaded archive. The checksum should include a prefix
+// identifying its algorithm, such as "sha256:".
+func (m *PackageMeta) WithUpstreamChecksum(checksum string) *PackageMeta {
+	ret := m.copy()
+	ret.upstreamChecksum = checksum
+	return ret
+}
+
+// WithUpstreamSize returns a copy of the receiver with the given size in
+// bytes of the package as it was served by the upstream location, such as
+// the size of a downloaded archive.
+func (m *PackageMeta) WithUpstreamSize(size int64) *PackageMeta {
+	ret := m.copy()
+	ret.upstreamSize = size
+	return ret
+}
+
+func (m *PackageMeta) copy() *PackageMeta {
+	if m == nil {
+		return &PackageMeta{}
+	}
+	ret := *m
+	return &ret
+}
+
 // If the content of this package was derived from a particular commit
 // from a Git repository, GitCommitID returns the fully-qualified ID of
 // that commit. This is never an abbreviated commit ID, the name of a ref,
@@ -57,3 +127,62 @@ func (m *PackageMeta) GitCommitID() string {
 func (m *PackageMeta) GitCommitMessage() string {
 	return m.gitCommitMessage
 }
+
+// ResolvedRef returns the ref that the package's source address resolved to
+// when it was fetched, or an empty string if no resolved ref was recorded.
+func (m *PackageMeta) ResolvedRef() string {
+	return m.resolvedRef
+}
+
+// FetchTime returns the time when the package was fetched, or the zero
+// value of [time.Time] if no fetch time was recorded.
+func (m *PackageMeta) FetchTime() time.Time {
+	return m.fetchTime
+}
+
+// UpstreamChecksum returns a checksum of the package as it was served by the
+// upstream location, or an empty string if no upstream checksum was
+// recorded.
+func (m *PackageMeta) UpstreamChecksum() string {
+	return m.upstreamChecksum
+}
+
+// UpstreamSize returns the size in bytes of the package as it was served by
+// the upstream location, or zero if no upstream size was recorded.
+func (m *PackageMeta) UpstreamSize() int64 {
+	return m.upstreamSize
+}
+
+// PackageStats describes the content of a remote package as it was included
+// in a source bundle, after applying any .terraformignore rules.
+//
+// A nil value of this type represents that no statistics are available.
+type PackageStats struct {
+	hashScheme string
+	checksum   string
+	size       int64
+	fileCount  int
+}
+
+// Checksum returns a checksum of the package content, with a prefix such as
+// "h1:" identifying the checksum scheme that was used to calculate it.
+func (s *PackageStats) Checksum() string {
+	return s.checksum
+}
+
+// HashScheme returns the name of the [PackageHasher] that calculated the
+// checksum of the package content.
+func (s *PackageStats) HashScheme() string {
+	return s.hashScheme
+}
+
+// Size returns the total size in bytes of the content of all of the files
+// in the package.
+func (s *PackageStats) Size() int64 {
+	return s.size
+}
+
+// FileCount returns the number of files in the package.
+func (s *PackageStats) FileCount() int {
+	return s.fileCount
+}
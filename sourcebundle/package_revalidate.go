@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// StalePackageCache is an optional extension of [PackageCache] for caches
+// that can find the most recently stored snapshot of a package regardless
+// of its validator.
+//
+// A [Builder] uses this interface only when created with
+// [WithStaleWhileRevalidate].
+type StalePackageCache interface {
+	PackageCache
+
+	// LoadLatestPackage is like [PackageCache.LoadPackage] except that it
+	// loads whichever snapshot was stored most recently under a key that
+	// differs from the given one only in its validator, and also returns
+	// the key that the snapshot was stored under.
+	LoadLatestPackage(ctx context.Context, key PackageCacheKey, targetDir string) (*PackageMeta, PackageCacheKey, bool, error)
+}
+
+// WithStaleWhileRevalidate is a BuilderOption that makes the builder use the
+// most recently cached snapshot of each remote package immediately, without
+// waiting for the [PackageValidator] given in [WithPackageCache], and then
+// revalidate the snapshot in the background. If the package has changed
+// upstream then the background revalidation fetches the new content and
+// stores it in the cache, for use by later builders.
+//
+// This trades freshness for latency, and so is intended for builds such as
+// previews where slightly out-of-date content is acceptable. The build
+// report marks each package that might be stale using
+// [PackageReport.PossiblyStale].
+//
+// This option has an effect only if the builder also has both a package
+// cache implementing [StalePackageCache] and a validator. The fetcher must
+// be safe to call concurrently, because background revalidations can run
+// at the same time as the builder's own fetches. Use
+// [Builder.WaitRevalidations] to wait for background revalidations to
+// complete. [Builder.Close] also waits for them, because they work in
+// temporary directories inside the bundle directory.
+func WithStaleWhileRevalidate() BuilderOption {
+	return func(b *Builder) error {
+		b.staleWhileRevalidate = true
+		return nil
+	}
+}
+
+// WaitRevalidations blocks until all of the background revalidations that
+// the builder started because of [WithStaleWhileRevalidate] have completed.
+//
+// [Builder.Close] waits for them too, and so WaitRevalidations is needed
+// only to wait for them before closing the builder. It's safe to call
+// WaitRevalidations after Close.
+func (b *Builder) WaitRevalidations() {
+	b.revalidations.Wait()
+}
+
+// loadStalePackage populates the given empty directory with the most
+// recently cached snapshot of the given package, and starts revalidating
+// that snapshot in the background, if [WithStaleWhileRevalidate] is in
+// effect. It returns false if the builder should load or fetch the package
+// in the usual way instead.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) loadStalePackage(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, workDir string) (*PackageMeta, bool, error) {
+	if !b.staleWhileRevalidate || b.packageValidator == nil {
+		return nil, false, nil
+	}
+	cache, ok := b.packageCache.(StalePackageCache)
+	if !ok {
+		return nil, false, nil
+	}
+	pkgMeta, key, ok, err := cache.LoadLatestPackage(ctx, b.packageCacheKey(pkgAddr), workDir)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	// The cached snapshot was already prepared before it was stored.
+	report := b.packageReport(pkgAddr)
+	report.FromCache = true
+	report.PossiblyStale = true
+	delete(b.packageOriginals, pkgAddr)
+
+	if _, running := b.revalidating[pkgAddr]; !running {
+		b.revalidating[pkgAddr] = struct{}{}
+		b.revalidations.Add(1)
+		targetDir := b.targetDir
+		go func() {
+			defer b.revalidations.Done()
+			// The revalidation outlives the request that caused it, and so
+			// it can't use that request's context.
+			current, err := b.revalidatePackage(context.Background(), pkgAddr, key.Validator, targetDir)
+
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.revalidating, pkgAddr)
+			if err == nil && current {
+				b.packageReport(pkgAddr).PossiblyStale = false
+			}
+		}()
+	}
+	return pkgMeta, true, nil
+}
+
+// revalidatePackage checks whether a cached snapshot of the given package
+// that was stored with the given validator is still current, and if not
+// fetches and prepares the package again, in a temporary directory inside
+// the given bundle directory, and stores the result in the builder's
+// package cache. It returns true if the snapshot was current.
+//
+// This doesn't access any of the builder's mutable state, and so must not
+// be called while b.mu is locked.
+func (b *Builder) revalidatePackage(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, staleValidator string, targetDir string) (bool, error) {
+	validator, err := b.packageValidator(ctx, pkgAddr)
+	if err != nil {
+		return false, fmt.Errorf("failed to validate cached package: %w", err)
+	}
+	if validator == staleValidator {
+		return true, nil
+	}
+
+	workDir, err := ioutil.TempDir(targetDir, ".tmp-")
+	if err != nil {
+		return false, fmt.Errorf("failed to create package directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	response, _, err := fetchPackage(ctx, b.fetcher, pkgAddr.SourceType(), pkgAddr.URL(), workDir, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch package: %w", err)
+	}
+	if err := removeOriginalArchive(workDir, response.ArchiveFile); err != nil {
+		return false, err
+	}
+	_, err = preparePackageDir(pkgAddr, workDir, prepareOptions{
+		rootSubdir:      response.RootSubdir,
+		keepVCSMetadata: b.keepVCSMetadata,
+		keepRules:       b.keepRules,
+		dropRules:       b.dropRules,
+	})
+	if err != nil {
+		return false, err
+	}
+	key := b.packageCacheKey(pkgAddr)
+	key.Validator = validator
+	return false, b.packageCache.StorePackage(ctx, key, workDir, response.PackageMeta)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// PackageVariants describes a set of remote packages that the builder fetched
+// separately because their addresses differ, but whose addresses differ only
+// in their query strings, such as the same Git repository fetched at two
+// different refs.
+//
+// Each variant occupies its own directory in the bundle unless the content
+// happens to be identical, so authors can often make a bundle smaller by
+// changing their dependencies to agree on a single variant.
+type PackageVariants struct {
+	// Base is the address that all of the variants share, without any
+	// query string.
+	Base string
+
+	// Packages are the variants, sorted by address.
+	Packages []sourceaddrs.RemotePackage
+}
+
+// packageVariantBase returns the address of the given package without its
+// query string, which is what all of its variants have in common.
+func packageVariantBase(pkgAddr sourceaddrs.RemotePackage) string {
+	// A literal question mark in any other part of the address is always
+	// percent-encoded, so the first one always begins the query string.
+	base, _, _ := strings.Cut(pkgAddr.String(), "?")
+	return base
+}
+
+// recordPackageVariant records a remote package that the builder has just
+// added to the bundle, returning a warning diagnostic if the bundle already
+// includes other variants of the same package.
+//
+// This expects to be called while b.mu is already locked, and only once for
+// each package.
+func (b *Builder) recordPackageVariant(pkgAddr sourceaddrs.RemotePackage) Diagnostics {
+	base := packageVariantBase(pkgAddr)
+	others := b.packageVariants[base]
+	b.packageVariants[base] = append(others, pkgAddr)
+	if len(others) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(others))
+	for i, other := range others {
+		names[i] = other.String()
+	}
+	sort.Strings(names)
+	return Diagnostics{
+		&internalDiagnostic{
+			severity: DiagWarning,
+			summary:  "Remote package fetched at more than one ref",
+			detail: fmt.Sprintf(
+				"Remote package %s differs only in its query string from %s, which the bundle also includes. If these dependencies can all use the same ref then changing them to agree would avoid fetching and storing the package more than once.",
+				pkgAddr, strings.Join(names, ", "),
+			),
+		},
+	}
+}
+
+// packageVariantsReport returns the package variants for inclusion in a
+// [BuildReport], sorted by base address.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) packageVariantsReport() []PackageVariants {
+	var ret []PackageVariants
+	for base, pkgAddrs := range b.packageVariants {
+		if len(pkgAddrs) < 2 {
+			continue
+		}
+		variants := PackageVariants{
+			Base:     base,
+			Packages: append([]sourceaddrs.RemotePackage(nil), pkgAddrs...),
+		}
+		sort.Slice(variants.Packages, func(i, j int) bool {
+			return variants.Packages[i].String() < variants.Packages[j].String()
+		})
+		ret = append(ret, variants)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Base < ret[j].Base
+	})
+	return ret
+}
@@ -0,0 +1,351 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/hashicorp/go-slug/sourceaddrs"
+	regaddr "github.com/hashicorp/terraform-registry-address"
+)
+
+// ConditionalRegistryClient is an optional extension of [RegistryClient] for
+// clients that can ask the registry whether a version listing has changed
+// since an earlier response, using the ETag the registry returned with that
+// response.
+//
+// A [CachingRegistryClient] uses this interface, if available, to revalidate
+// expired cache entries more cheaply than fetching them again.
+type ConditionalRegistryClient interface {
+	RegistryClient
+
+	// ModulePackageVersionsIfChanged is like
+	// [RegistryClient.ModulePackageVersions] except that if the registry
+	// reports that the listing still matches the given ETag then it
+	// returns notModified as true and an empty response.
+	ModulePackageVersionsIfChanged(ctx context.Context, pkgAddr regaddr.ModulePackage, etag string) (resp ModulePackageVersionsResponse, notModified bool, err error)
+}
+
+// RegistryCacheStore is implemented by the storage backends of a
+// [CachingRegistryClient]. [MemoryRegistryCacheStore] and
+// [DirRegistryCacheStore] are ready-to-use implementations.
+//
+// Implementations must be safe to call concurrently from multiple
+// goroutines.
+type RegistryCacheStore interface {
+	// LoadEntry returns the entry stored under the given key, or false if
+	// there is no such entry.
+	LoadEntry(key string) (RegistryCacheEntry, bool, error)
+
+	// StoreEntry saves the given entry under the given key, replacing any
+	// existing entry.
+	StoreEntry(key string, entry RegistryCacheEntry) error
+}
+
+// RegistryCacheEntry is a single cached registry response, as saved in a
+// [RegistryCacheStore].
+type RegistryCacheEntry struct {
+	// Data is the JSON representation of the cached response.
+	Data json.RawMessage `json:"data"`
+
+	// ETag is the ETag the registry returned along with the response, if
+	// any.
+	ETag string `json:"etag,omitempty"`
+
+	// StoredAt is when the response was last fetched or revalidated.
+	StoredAt time.Time `json:"stored_at"`
+}
+
+// RegistryCacheStats summarizes how a [CachingRegistryClient] has handled
+// the requests made to it.
+type RegistryCacheStats struct {
+	// Hits counts requests answered from an unexpired cache entry.
+	Hits int64
+
+	// Revalidations counts requests answered from an expired cache entry
+	// after the registry confirmed that it was unchanged.
+	Revalidations int64
+
+	// Misses counts requests that were passed on to the underlying client.
+	Misses int64
+}
+
+// HitRate returns the proportion of requests that were answered without
+// fetching a full response from the registry, including revalidations, or
+// zero if there have been no requests.
+func (s RegistryCacheStats) HitRate() float64 {
+	total := s.Hits + s.Revalidations + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.Revalidations) / float64(total)
+}
+
+// CachingRegistryClient is a [RegistryClient] that wraps another client and
+// caches its successful responses, so that many [Builder] objects can share
+// the results of requests for popular packages. Errors are never cached.
+//
+// Cache entries expire after a fixed time-to-live. If the wrapped client
+// implements [ConditionalRegistryClient] then expired version listings that
+// have an ETag are revalidated instead of being fetched again.
+//
+// A CachingRegistryClient is safe to use concurrently from multiple
+// goroutines.
+type CachingRegistryClient struct {
+	client RegistryClient
+	store  RegistryCacheStore
+	ttl    time.Duration
+	clock  Clock
+
+	hits, revalidations, misses atomic.Int64
+}
+
+var _ RegistryClient = (*CachingRegistryClient)(nil)
+
+// NewCachingRegistryClient returns a [CachingRegistryClient] that wraps the
+// given client, saving responses in the given store and treating them as
+// valid for the given duration.
+func NewCachingRegistryClient(client RegistryClient, store RegistryCacheStore, ttl time.Duration) (*CachingRegistryClient, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("cache time-to-live must be positive")
+	}
+	return &CachingRegistryClient{
+		client: client,
+		store:  store,
+		ttl:    ttl,
+		clock:  SystemClock,
+	}, nil
+}
+
+// SetClock changes the [Clock] that the client uses to decide whether cache
+// entries have expired. The default is [SystemClock]. SetClock must not be
+// called concurrently with any other methods of the client.
+func (c *CachingRegistryClient) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+// Stats returns a snapshot of the statistics about how the client has
+// handled requests so far.
+func (c *CachingRegistryClient) Stats() RegistryCacheStats {
+	return RegistryCacheStats{
+		Hits:          c.hits.Load(),
+		Revalidations: c.revalidations.Load(),
+		Misses:        c.misses.Load(),
+	}
+}
+
+// ModulePackageVersions implements [RegistryClient].
+func (c *CachingRegistryClient) ModulePackageVersions(ctx context.Context, pkgAddr regaddr.ModulePackage) (ModulePackageVersionsResponse, error) {
+	var ret ModulePackageVersionsResponse
+	key := "versions " + pkgAddr.String()
+
+	entry, ok := c.loadEntry(key)
+	if ok && c.fresh(entry) && json.Unmarshal(entry.Data, &ret) == nil {
+		c.hits.Add(1)
+		return ret, nil
+	}
+
+	if conditional, isConditional := c.client.(ConditionalRegistryClient); ok && isConditional && entry.ETag != "" {
+		resp, notModified, err := conditional.ModulePackageVersionsIfChanged(ctx, pkgAddr, entry.ETag)
+		if err != nil {
+			return ret, err
+		}
+		if notModified && json.Unmarshal(entry.Data, &ret) == nil {
+			c.revalidations.Add(1)
+			entry.StoredAt = c.clock.Now()
+			c.storeEntry(key, entry)
+			return ret, nil
+		}
+		if !notModified {
+			c.misses.Add(1)
+			c.storeResponse(key, resp, resp.ETag)
+			return resp, nil
+		}
+		// If we get here then the registry says our entry is still valid
+		// but we can't decode it, so we'll just fetch it again below.
+	}
+
+	c.misses.Add(1)
+	resp, err := c.client.ModulePackageVersions(ctx, pkgAddr)
+	if err != nil {
+		return resp, err
+	}
+	c.storeResponse(key, resp, resp.ETag)
+	return resp, nil
+}
+
+// ModulePackageSourceAddr implements [RegistryClient].
+func (c *CachingRegistryClient) ModulePackageSourceAddr(ctx context.Context, pkgAddr regaddr.ModulePackage, version versions.Version) (ModulePackageSourceAddrResponse, error) {
+	key := "source " + pkgAddr.String() + " " + version.String()
+
+	if entry, ok := c.loadEntry(key); ok && c.fresh(entry) {
+		var cached cachedSourceAddr
+		if json.Unmarshal(entry.Data, &cached) == nil {
+			sourceAddr, err := sourceaddrs.ParseRemoteSource(cached.SourceAddr)
+			if err == nil {
+				c.hits.Add(1)
+				return ModulePackageSourceAddrResponse{SourceAddr: sourceAddr}, nil
+			}
+		}
+	}
+
+	c.misses.Add(1)
+	resp, err := c.client.ModulePackageSourceAddr(ctx, pkgAddr, version)
+	if err != nil {
+		return resp, err
+	}
+	c.storeResponse(key, cachedSourceAddr{SourceAddr: resp.SourceAddr.String()}, "")
+	return resp, nil
+}
+
+// cachedSourceAddr is the JSON representation of a cached
+// [ModulePackageSourceAddrResponse].
+type cachedSourceAddr struct {
+	SourceAddr string `json:"source_addr"`
+}
+
+// fresh returns true if the given entry hasn't yet expired.
+func (c *CachingRegistryClient) fresh(entry RegistryCacheEntry) bool {
+	return c.clock.Now().Sub(entry.StoredAt) < c.ttl
+}
+
+// loadEntry returns the entry with the given key, treating any error from
+// the store as a cache miss.
+func (c *CachingRegistryClient) loadEntry(key string) (RegistryCacheEntry, bool) {
+	entry, ok, err := c.store.LoadEntry(key)
+	if err != nil {
+		return RegistryCacheEntry{}, false
+	}
+	return entry, ok
+}
+
+// storeResponse saves the JSON representation of the given response. Failing
+// to save an entry only means that a later request will need to fetch the
+// response again, so errors are ignored.
+func (c *CachingRegistryClient) storeResponse(key string, resp any, etag string) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	c.storeEntry(key, RegistryCacheEntry{
+		Data:     data,
+		ETag:     etag,
+		StoredAt: c.clock.Now(),
+	})
+}
+
+func (c *CachingRegistryClient) storeEntry(key string, entry RegistryCacheEntry) {
+	_ = c.store.StoreEntry(key, entry)
+}
+
+// MemoryRegistryCacheStore is a [RegistryCacheStore] that keeps its entries
+// in memory, and so can be shared only within a single process.
+type MemoryRegistryCacheStore struct {
+	mu      sync.Mutex
+	entries map[string]RegistryCacheEntry
+}
+
+var _ RegistryCacheStore = (*MemoryRegistryCacheStore)(nil)
+
+// NewMemoryRegistryCacheStore returns an empty [MemoryRegistryCacheStore].
+func NewMemoryRegistryCacheStore() *MemoryRegistryCacheStore {
+	return &MemoryRegistryCacheStore{
+		entries: make(map[string]RegistryCacheEntry),
+	}
+}
+
+// LoadEntry implements [RegistryCacheStore].
+func (s *MemoryRegistryCacheStore) LoadEntry(key string) (RegistryCacheEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	return entry, ok, nil
+}
+
+// StoreEntry implements [RegistryCacheStore].
+func (s *MemoryRegistryCacheStore) StoreEntry(key string, entry RegistryCacheEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = entry
+	return nil
+}
+
+// DirRegistryCacheStore is a [RegistryCacheStore] that saves each entry as
+// a file in a local directory, so that the cache can outlive the process
+// and be shared between processes.
+type DirRegistryCacheStore struct {
+	dir string
+}
+
+var _ RegistryCacheStore = (*DirRegistryCacheStore)(nil)
+
+// NewDirRegistryCacheStore returns a [DirRegistryCacheStore] that saves its
+// entries in the given directory, creating it if it doesn't already exist.
+func NewDirRegistryCacheStore(dir string) (*DirRegistryCacheStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create registry cache directory: %w", err)
+	}
+	return &DirRegistryCacheStore{dir: dir}, nil
+}
+
+// LoadEntry implements [RegistryCacheStore].
+func (s *DirRegistryCacheStore) LoadEntry(key string) (RegistryCacheEntry, bool, error) {
+	var entry RegistryCacheEntry
+	src, err := os.ReadFile(s.entryPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entry, false, nil
+		}
+		return entry, false, fmt.Errorf("failed to read registry cache entry: %w", err)
+	}
+	if err := json.Unmarshal(src, &entry); err != nil {
+		return entry, false, fmt.Errorf("invalid registry cache entry: %w", err)
+	}
+	return entry, true, nil
+}
+
+// StoreEntry implements [RegistryCacheStore].
+func (s *DirRegistryCacheStore) StoreEntry(key string, entry RegistryCacheEntry) error {
+	src, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode registry cache entry: %w", err)
+	}
+
+	// We write to a temporary file first and then rename it into place so
+	// that concurrent readers never see a partially-written entry.
+	f, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create registry cache entry: %w", err)
+	}
+	_, err = f.Write(src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.entryPath(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write registry cache entry: %w", err)
+	}
+	return nil
+}
+
+// entryPath returns the path of the file for the entry with the given key.
+// Keys contain characters that aren't safe to use in filenames, so we use a
+// hash of the key instead.
+func (s *DirRegistryCacheStore) entryPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
@@ -0,0 +1,160 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/google/go-cmp/cmp"
+	regaddr "github.com/hashicorp/terraform-registry-address"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+func TestCachingRegistryClient(t *testing.T) {
+	pkgAddr, err := sourceaddrs.ParseRegistryPackage("example.com/foo/bar/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := versions.MustParseVersion("1.0.0")
+	sourceAddr := sourceaddrs.MustParseSource("https://example.com/foo.tgz").(sourceaddrs.RemoteSource)
+
+	stores := map[string]func(t *testing.T) RegistryCacheStore{
+		"memory": func(t *testing.T) RegistryCacheStore {
+			return NewMemoryRegistryCacheStore()
+		},
+		"dir": func(t *testing.T) RegistryCacheStore {
+			store, err := NewDirRegistryCacheStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			var versionsCalls, conditionalCalls, sourceCalls int
+			etag := "v1"
+			client := conditionalRegistryClientFuncs{
+				registryClientFuncs: registryClientFuncs{
+					modulePackageVersions: func(ctx context.Context, pkgAddr regaddr.ModulePackage) (ModulePackageVersionsResponse, error) {
+						versionsCalls++
+						return ModulePackageVersionsResponse{
+							Versions: []ModulePackageInfo{{Version: version}},
+							ETag:     etag,
+						}, nil
+					},
+					modulePackageSourceAddr: func(ctx context.Context, pkgAddr regaddr.ModulePackage, version versions.Version) (ModulePackageSourceAddrResponse, error) {
+						sourceCalls++
+						return ModulePackageSourceAddrResponse{SourceAddr: sourceAddr}, nil
+					},
+				},
+				modulePackageVersionsIfChanged: func(ctx context.Context, pkgAddr regaddr.ModulePackage, given string) (ModulePackageVersionsResponse, bool, error) {
+					conditionalCalls++
+					if given == etag {
+						return ModulePackageVersionsResponse{}, true, nil
+					}
+					return ModulePackageVersionsResponse{}, false, fmt.Errorf("unexpected etag %q", given)
+				},
+			}
+
+			now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+			cached, err := NewCachingRegistryClient(client, newStore(t), time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cached.SetClock(testClock{now: func() time.Time { return now }})
+
+			wantVersions := []ModulePackageInfo{{Version: version}}
+			for i := 0; i < 2; i++ {
+				resp, err := cached.ModulePackageVersions(context.Background(), pkgAddr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(wantVersions, resp.Versions); diff != "" {
+					t.Errorf("wrong versions\n%s", diff)
+				}
+				resp2, err := cached.ModulePackageSourceAddr(context.Background(), pkgAddr, version)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := resp2.SourceAddr.String(), sourceAddr.String(); got != want {
+					t.Errorf("wrong source address %s; want %s", got, want)
+				}
+			}
+			if versionsCalls != 1 || sourceCalls != 1 {
+				t.Errorf("wrong number of calls to underlying client: %d versions, %d source", versionsCalls, sourceCalls)
+			}
+
+			// After the entries expire the version listing is revalidated
+			// using its ETag, while the source address is fetched again.
+			now = now.Add(2 * time.Minute)
+			resp, err := cached.ModulePackageVersions(context.Background(), pkgAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(wantVersions, resp.Versions); diff != "" {
+				t.Errorf("wrong versions after revalidation\n%s", diff)
+			}
+			if _, err := cached.ModulePackageSourceAddr(context.Background(), pkgAddr, version); err != nil {
+				t.Fatal(err)
+			}
+			if versionsCalls != 1 || conditionalCalls != 1 || sourceCalls != 2 {
+				t.Errorf("wrong number of calls after expiry: %d versions, %d conditional, %d source", versionsCalls, conditionalCalls, sourceCalls)
+			}
+
+			want := RegistryCacheStats{Hits: 2, Revalidations: 1, Misses: 3}
+			if diff := cmp.Diff(want, cached.Stats()); diff != "" {
+				t.Errorf("wrong stats\n%s", diff)
+			}
+			if got, want := cached.Stats().HitRate(), 0.5; got != want {
+				t.Errorf("wrong hit rate %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCachingRegistryClientErrors(t *testing.T) {
+	pkgAddr, err := sourceaddrs.ParseRegistryPackage("example.com/foo/bar/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	client := registryClientFuncs{
+		modulePackageVersions: func(ctx context.Context, pkgAddr regaddr.ModulePackage) (ModulePackageVersionsResponse, error) {
+			calls++
+			return ModulePackageVersionsResponse{}, fmt.Errorf("registry unavailable")
+		},
+	}
+	cached, err := NewCachingRegistryClient(client, NewMemoryRegistryCacheStore(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cached.ModulePackageVersions(context.Background(), pkgAddr); err == nil {
+			t.Fatal("unexpected success")
+		}
+	}
+	if calls != 2 {
+		t.Errorf("errors should not be cached, but underlying client was called %d times", calls)
+	}
+
+	if _, err := NewCachingRegistryClient(client, NewMemoryRegistryCacheStore(), 0); err == nil {
+		t.Error("expected error for zero time-to-live")
+	}
+}
+
+type conditionalRegistryClientFuncs struct {
+	registryClientFuncs
+	modulePackageVersionsIfChanged func(ctx context.Context, pkgAddr regaddr.ModulePackage, etag string) (ModulePackageVersionsResponse, bool, error)
+}
+
+func (f conditionalRegistryClientFuncs) ModulePackageVersionsIfChanged(ctx context.Context, pkgAddr regaddr.ModulePackage, etag string) (ModulePackageVersionsResponse, bool, error) {
+	return f.modulePackageVersionsIfChanged(ctx, pkgAddr, etag)
+}
@@ -19,7 +19,8 @@ import (
 // An implementation should not itself attempt to cache the direct results of
 // the client methods, but it can (and probably should) cache prerequisite
 // information such as the results of performing service discovery against
-// the hostname in a module package address.
+// the hostname in a module package address. Callers that want to share the
+// results between builders can wrap a client in a [CachingRegistryClient].
 type RegistryClient interface {
 	// ModulePackageVersions fetches all of the known exact versions
 	// available for the given package in its module registry.
@@ -35,6 +36,16 @@ type RegistryClient interface {
 // functionality over time in later minor releases.
 type ModulePackageVersionsResponse struct {
 	Versions []ModulePackageInfo `json:"versions"`
+
+	// Warnings are any human-readable warnings that the registry returned
+	// about the package as a whole, which the builder records in the
+	// bundle so that they can be reported when the bundle is used.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// ETag is the entity tag that the registry returned with the version
+	// listing, if any. A client that sets this should also implement
+	// [ConditionalRegistryClient].
+	ETag string `json:"-"`
 }
 
 type ModulePackageInfo struct {
@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apparentlymart/go-versions/versions"
+	regaddr "github.com/hashicorp/terraform-registry-address"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// InconsistentRegistryError is the error that a [Builder] reports when the
+// module registry returns a different real source address for a package
+// version than it returned earlier in the same build, such as while a
+// package is being migrated between source repositories.
+//
+// The builder normally asks the registry only once for the source address
+// of each version. After it refreshes its list of a package's available
+// versions, because of [WithRegistryCacheMaxAge] or
+// [Builder.InvalidateRegistryCache], it asks again the next time it selects
+// each version that it has already resolved, and fails rather than silently
+// mixing content from both sources if the answer has changed.
+type InconsistentRegistryError struct {
+	Package regaddr.ModulePackage
+	Version versions.Version
+
+	// First is the source address that the registry returned first, and
+	// Later is the contradictory address it returned subsequently.
+	First, Later sourceaddrs.RemoteSource
+}
+
+func (e *InconsistentRegistryError) Error() string {
+	return fmt.Sprintf(
+		"the registry returned source address %s for %s %s, but earlier in the same build it returned %s",
+		e.Later, e.Package, e.Version, e.First,
+	)
+}
+
+// reconfirmRegistrySources marks each version of the given package that the
+// builder has already resolved so that the builder will ask the registry
+// for its real source address again the next time it selects it.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) reconfirmRegistrySources(pkgAddr regaddr.ModulePackage) {
+	for pkgVer := range b.resolvedRegistry {
+		if pkgVer.pkg == pkgAddr {
+			b.registrySourcesToConfirm[pkgVer] = struct{}{}
+		}
+	}
+}
+
+// confirmRegistrySource asks the registry again for the real source address
+// of the given package version, and returns an [InconsistentRegistryError]
+// if it contradicts the address that the builder resolved earlier.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) confirmRegistrySource(ctx context.Context, pkgVer registryPackageVersion, first sourceaddrs.RemoteSource) error {
+	trace := buildTraceFromContext(ctx)
+
+	delete(b.registrySourcesToConfirm, pkgVer)
+	b.dedupStats.RegistrySourcesFetched++
+	var reqCtx context.Context
+	if cb := trace.RegistryPackageSourceStart; cb != nil {
+		reqCtx = cb(ctx, pkgVer.pkg, pkgVer.version)
+	}
+	if reqCtx == nil {
+		reqCtx = ctx
+	}
+
+	resp, err := b.registryClient.ModulePackageSourceAddr(reqCtx, pkgVer.pkg, pkgVer.version)
+	if err != nil {
+		err = fmt.Errorf("failed to find real source address for %s %s: %w", pkgVer.pkg, pkgVer.version, err)
+	} else if resp.SourceAddr != first {
+		err = &InconsistentRegistryError{
+			Package: pkgVer.pkg,
+			Version: pkgVer.version,
+			First:   first,
+			Later:   resp.SourceAddr,
+		}
+	}
+	if err != nil {
+		if cb := trace.RegistryPackageSourceFailure; cb != nil {
+			cb(reqCtx, pkgVer.pkg, pkgVer.version, err)
+		}
+		return err
+	}
+	if cb := trace.RegistryPackageSourceSuccess; cb != nil {
+		cb(reqCtx, pkgVer.pkg, pkgVer.version, first)
+	}
+	return nil
+}
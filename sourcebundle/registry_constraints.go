@@ -0,0 +1,79 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"github.com/apparentlymart/go-versions/versions"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// RegistryConstraint is a module registry source address along with the
+// set of versions that are acceptable for it, as might be passed to
+// [Builder.AddRegistrySource].
+type RegistryConstraint struct {
+	Source          sourceaddrs.RegistrySource
+	AllowedVersions versions.Set
+}
+
+// RegistryConstraintStatus is the result of checking a [RegistryConstraint]
+// against the registry package versions already included in a bundle.
+type RegistryConstraintStatus struct {
+	RegistryConstraint
+
+	// Selected is the newest version already in the bundle that is
+	// acceptable under the constraint. This is meaningful only if
+	// NeedsResolution is false.
+	Selected versions.Version
+
+	// NeedsResolution is true if the bundle doesn't include any version
+	// of the package that is acceptable under the constraint, and so the
+	// package must be resolved again through the module registry.
+	NeedsResolution bool
+}
+
+// SelectedSource returns the final source address of the selected version,
+// or nil if the constraint needs resolution.
+func (s RegistryConstraintStatus) SelectedSource() sourceaddrs.FinalSource {
+	if s.NeedsResolution {
+		return nil
+	}
+	return s.Source.Versioned(s.Selected)
+}
+
+// CheckRegistryConstraints compares each of the given constraints with the
+// registry package versions already included in the bundle, without
+// contacting the registry, to find which of them the bundle can still
+// satisfy and which require the package to be resolved again.
+//
+// A constraint that the bundle can satisfy is not necessarily satisfied by
+// the newest version that the registry offers, so this is a check that the
+// bundle is still usable, not that it is as up-to-date as possible.
+//
+// The result has one element for each given constraint, in the same order.
+func (b *Bundle) CheckRegistryConstraints(constraints []RegistryConstraint) []RegistryConstraintStatus {
+	ret := make([]RegistryConstraintStatus, len(constraints))
+	for i, c := range constraints {
+		ret[i].RegistryConstraint = c
+		available := b.RegistryPackageVersions(c.Source.Package())
+		selected := available.NewestInSet(c.AllowedVersions)
+		if selected == versions.Unspecified {
+			ret[i].NeedsResolution = true
+			continue
+		}
+		ret[i].Selected = selected
+	}
+	return ret
+}
+
+// NeedsRegistryResolution returns true if any of the given statuses, as
+// returned by [Bundle.CheckRegistryConstraints], requires re-resolution.
+func NeedsRegistryResolution(statuses []RegistryConstraintStatus) bool {
+	for _, s := range statuses {
+		if s.NeedsResolution {
+			return true
+		}
+	}
+	return false
+}
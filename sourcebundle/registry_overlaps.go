@@ -0,0 +1,87 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/apparentlymart/go-versions/versions"
+	regaddr "github.com/hashicorp/terraform-registry-address"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// ResolvedRegistryPackage describes the real source address that the
+// builder found for a particular version of a module registry package.
+type ResolvedRegistryPackage struct {
+	Package regaddr.ModulePackage
+	Version versions.Version
+	Source  sourceaddrs.RemoteSource
+}
+
+// RegistryOverlap describes two different module registry packages whose
+// real source addresses are in the same remote package, where the sub-path
+// of one is the same as or contains the sub-path of the other.
+//
+// The content of the inner package is then also part of the outer package,
+// and so the ignore rules of the remote package apply to both, which can
+// be surprising to authors of the inner package.
+type RegistryOverlap struct {
+	Outer ResolvedRegistryPackage
+	Inner ResolvedRegistryPackage
+}
+
+// recordRegistryOverlaps finds any earlier registry package resolutions that
+// overlap with the given new resolution, and records them in
+// b.registryOverlaps.
+//
+// This expects to be called while b.mu is already locked, and before the
+// new resolution is added to b.resolvedRegistry.
+func (b *Builder) recordRegistryOverlaps(pkgVer registryPackageVersion, sourceAddr sourceaddrs.RemoteSource) {
+	resolved := resolvedRegistryPackage(pkgVer, sourceAddr)
+	var found []RegistryOverlap
+	for otherVer, otherAddr := range b.resolvedRegistry {
+		if otherVer.pkg == pkgVer.pkg || otherAddr.Package() != sourceAddr.Package() {
+			continue
+		}
+		other := resolvedRegistryPackage(otherVer, otherAddr)
+		switch {
+		case subPathsInclude([]string{otherAddr.SubPath()}, sourceAddr.SubPath()):
+			found = append(found, RegistryOverlap{Outer: other, Inner: resolved})
+		case subPathsInclude([]string{sourceAddr.SubPath()}, otherAddr.SubPath()):
+			found = append(found, RegistryOverlap{Outer: resolved, Inner: other})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Outer.Source.String()+found[i].Inner.Source.String() < found[j].Outer.Source.String()+found[j].Inner.Source.String()
+	})
+	b.registryOverlaps = append(b.registryOverlaps, found...)
+}
+
+func resolvedRegistryPackage(pkgVer registryPackageVersion, sourceAddr sourceaddrs.RemoteSource) ResolvedRegistryPackage {
+	return ResolvedRegistryPackage{
+		Package: pkgVer.pkg,
+		Version: pkgVer.version,
+		Source:  sourceAddr,
+	}
+}
+
+// registryOverlapDiagnostics returns a warning diagnostic for each of the
+// given overlaps.
+func registryOverlapDiagnostics(overlaps []RegistryOverlap) Diagnostics {
+	var diags Diagnostics
+	for _, overlap := range overlaps {
+		diags = append(diags, &internalDiagnostic{
+			severity: DiagWarning,
+			summary:  "Overlapping module registry packages",
+			detail: fmt.Sprintf(
+				"Module package %s %s is at %s, which includes the content of module package %s %s at %s. Both are taken from the same remote package, so they share its content and its ignore rules.",
+				overlap.Outer.Package, overlap.Outer.Version, overlap.Outer.Source,
+				overlap.Inner.Package, overlap.Inner.Version, overlap.Inner.Source,
+			),
+		})
+	}
+	return diags
+}
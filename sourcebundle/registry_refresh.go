@@ -0,0 +1,64 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"fmt"
+	"time"
+
+	regaddr "github.com/hashicorp/terraform-registry-address"
+)
+
+// WithRegistryCacheMaxAge is a BuilderOption that limits how long the builder
+// reuses the list of available versions it obtained for each registry
+// package. Once a list is older than the given duration, the builder
+// queries the registry again the next time it needs the list, so that a
+// long-running builder can notice newly-published versions.
+//
+// By default the builder reuses each list for its whole lifetime. Use
+// [Builder.InvalidateRegistryCache] to force a refresh for a particular
+// package instead.
+func WithRegistryCacheMaxAge(maxAge time.Duration) BuilderOption {
+	return func(b *Builder) error {
+		if maxAge <= 0 {
+			return fmt.Errorf("registry cache max age must be positive")
+		}
+		b.registryCacheMaxAge = maxAge
+		return nil
+	}
+}
+
+// InvalidateRegistryCache discards the list of available versions that the
+// builder obtained for the given registry package, if any, so that the
+// builder will query the registry again the next time it needs the list.
+//
+// Versions that the builder has already selected keep the real source
+// addresses that the registry returned for them. The builder asks the
+// registry for each of those addresses again the next time it selects that
+// version, and fails with an [InconsistentRegistryError] if the answer has
+// changed. Refreshing the list can therefore only make new versions
+// available for dependencies that the builder hasn't resolved yet.
+func (b *Builder) InvalidateRegistryCache(pkgAddr regaddr.ModulePackage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.registryPackageVersions, pkgAddr)
+	delete(b.registryPackageVersionsAt, pkgAddr)
+	delete(b.registryPackageWarnings, pkgAddr)
+}
+
+// registryPackageVersionsFresh returns true if the builder has a list of
+// available versions for the given package that it can still use, taking
+// into account any [WithRegistryCacheMaxAge] limit.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) registryPackageVersionsFresh(pkgAddr regaddr.ModulePackage) bool {
+	if _, ok := b.registryPackageVersions[pkgAddr]; !ok {
+		return false
+	}
+	if b.registryCacheMaxAge == 0 {
+		return true
+	}
+	return b.clock.Now().Sub(b.registryPackageVersionsAt[pkgAddr]) < b.registryCacheMaxAge
+}
@@ -0,0 +1,131 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AddRootFile registers a file with the given name and content that
+// [Builder.Close] will write into the top-level bundle directory, alongside
+// the manifest, for callers that want to distribute additional metadata such
+// as run parameters as part of the bundle.
+//
+// The manifest records the name, size, and checksum of each root file, so
+// that [OpenDirStrict] accepts them and [Bundle.RootFiles] can list them.
+// The name must be a single path component that doesn't conflict with the
+// names the bundle itself uses, and each name can be added only once.
+func (b *Builder) AddRootFile(name string, content []byte) error {
+	if b.targetDir == "" {
+		// The builder has been closed, so cannot be modified further.
+		panic("AddRootFile on closed sourcebundle.Builder")
+	}
+	if err := validRootFileName(name); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.rootFiles[name]; exists {
+		return fmt.Errorf("root file %q was already added", name)
+	}
+	b.rootFiles[name] = append([]byte(nil), content...)
+	return nil
+}
+
+// validRootFileName returns an error if the given name is not acceptable for
+// a root file, either in a builder or in a manifest.
+func validRootFileName(name string) error {
+	if !fs.ValidPath(name) || name == "." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid root file name %q: must be a single path component", name)
+	}
+	switch name {
+	case ManifestFilename, OriginalsDirName, AttestationsDirName:
+		return fmt.Errorf("invalid root file name %q: reserved for the bundle's own use", name)
+	}
+	return nil
+}
+
+// writeRootFiles writes the files registered using AddRootFile into the
+// given bundle directory, returning their manifest entries.
+func (b *Builder) writeRootFiles(baseDir string) ([]manifestRootFile, error) {
+	var ret []manifestRootFile
+	for name, content := range b.rootFiles {
+		// We use O_EXCL so that a root file can never overwrite a package
+		// directory or anything else that's already in the bundle.
+		f, err := os.OpenFile(filepath.Join(baseDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0664)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create root file %q: %w", name, err)
+		}
+		_, err = f.Write(content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to write root file %q: %w", name, err)
+		}
+		sum := sha256.Sum256(content)
+		ret = append(ret, manifestRootFile{
+			Name:     name,
+			Size:     int64(len(content)),
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// addManifestRootFile records the root file described by the given manifest
+// entry.
+func (b *Bundle) addManifestRootFile(rf *manifestRootFile) error {
+	if err := validRootFileName(rf.Name); err != nil {
+		return err
+	}
+	if !validOriginalDigest(rf.Checksum) {
+		return fmt.Errorf("invalid checksum %q for root file %q", rf.Checksum, rf.Name)
+	}
+	b.rootFiles[rf.Name] = *rf
+	return nil
+}
+
+// RootFiles returns the names of the files added to the top-level bundle
+// directory using [Builder.AddRootFile], in lexical order.
+func (b *Bundle) RootFiles() []string {
+	if len(b.rootFiles) == 0 {
+		return nil
+	}
+	ret := make([]string, 0, len(b.rootFiles))
+	for name := range b.rootFiles {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ReadRootFile returns the content of the given root file, after verifying
+// that it still matches the size and checksum recorded in the manifest.
+func (b *Bundle) ReadRootFile(name string) ([]byte, error) {
+	rf, ok := b.rootFiles[name]
+	if !ok {
+		return nil, fmt.Errorf("bundle has no root file %q", name)
+	}
+	content, err := os.ReadFile(filepath.Join(b.rootDir, name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read root file %q: %w", name, err)
+	}
+	sum := sha256.Sum256(content)
+	if int64(len(content)) != rf.Size || hex.EncodeToString(sum[:]) != rf.Checksum {
+		return nil, fmt.Errorf("content of root file %q has changed since the bundle was created", name)
+	}
+	return content, nil
+}
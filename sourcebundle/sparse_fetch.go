@@ -0,0 +1,131 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SparsePackageFetcher is an optional extension of [PackageFetcher] for
+// fetchers that can fetch only some sub-paths of a package, such as by
+// performing a sparse checkout of a large Git repository.
+//
+// A [Builder] uses this interface only when created with
+// [WithSparseFetching].
+type SparsePackageFetcher interface {
+	PackageFetcher
+
+	// FetchSourcePackageSubPaths is like
+	// [PackageFetcher.FetchSourcePackage] except that the caller needs only
+	// the given slash-separated sub-paths of the package, each of which
+	// might be either a directory or a file. The fetcher may fetch more
+	// than was requested, including the entire package.
+	//
+	// A fetcher that fetched only some of the package must set
+	// [FetchSourcePackageResponse.Sparse] in its response. In that case the
+	// fetched content must include everything under each of the requested
+	// sub-paths, so that the result is the same as fetching the whole
+	// package and then discarding everything else.
+	FetchSourcePackageSubPaths(ctx context.Context, sourceType string, url *url.URL, targetDir string, subPaths []string) (FetchSourcePackageResponse, error)
+}
+
+// WithSparseFetching is a BuilderOption that allows the builder to fetch
+// only the sub-paths of each remote package that it needs, if the builder's
+// fetcher implements [SparsePackageFetcher].
+//
+// The builder asks for the union of all of the sub-paths it has found so far
+// for each package. If it later finds a source address for a sub-path that
+// isn't already included then it fetches the package again with the larger
+// set of sub-paths. The bundle manifest records the sub-paths included for
+// each package that was fetched sparsely, and [Bundle.LocalPathForSource]
+// returns an error for any source address outside of those sub-paths.
+//
+// Packages that are fetched sparsely are never stored in or loaded from the
+// builder's package cache.
+func WithSparseFetching() BuilderOption {
+	return func(b *Builder) error {
+		b.sparseFetching = true
+		return nil
+	}
+}
+
+// fetchPackage uses the given fetcher to fetch the given package into the
+// given directory, restricting the fetch to the given sub-paths if subPaths
+// is non-nil and the fetcher supports it.
+//
+// The returned sub-paths are those that were actually fetched, or nil if
+// the fetcher fetched the entire package.
+func fetchPackage(ctx context.Context, fetcher PackageFetcher, sourceType string, url *url.URL, workDir string, subPaths []string) (FetchSourcePackageResponse, []string, error) {
+	if sparse, ok := fetcher.(SparsePackageFetcher); ok && subPaths != nil {
+		response, err := sparse.FetchSourcePackageSubPaths(ctx, sourceType, url, workDir, subPaths)
+		if err != nil || !response.Sparse {
+			return response, nil, err
+		}
+		return response, subPaths, nil
+	}
+	response, err := fetcher.FetchSourcePackage(ctx, sourceType, url, workDir)
+	return response, nil, err
+}
+
+// subPathsInclude returns true if the given sub-path is the same as or
+// within any of the given sub-paths, or if subPaths is nil to represent an
+// entire package.
+func subPathsInclude(subPaths []string, subPath string) bool {
+	if subPaths == nil {
+		return true
+	}
+	for _, candidate := range subPaths {
+		if candidate == "" || subPath == candidate || strings.HasPrefix(subPath, candidate+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unionSubPaths returns a sorted set of sub-paths including everything from
+// the given set and the given additional sub-path, with any sub-paths that
+// are within others removed.
+func unionSubPaths(subPaths []string, more string) []string {
+	all := append(append([]string(nil), subPaths...), more)
+	sort.Strings(all)
+	ret := make([]string, 0, len(all))
+	for _, subPath := range all {
+		if subPathsInclude(ret, subPath) {
+			continue
+		}
+		ret = append(ret, subPath)
+	}
+	return ret
+}
+
+// removeSupersededPackageDirs deletes any package directories that the
+// builder replaced with a more complete fetch of the same package, and
+// that no other package shares.
+func (b *Builder) removeSupersededPackageDirs() error {
+	// NOTE: This expects to be called while b.mu is already locked, and
+	// while there are no concurrent analyses that might be reading the
+	// superseded directories.
+
+	inUse := make(map[string]struct{}, len(b.remotePackageDirs))
+	for _, dirName := range b.remotePackageDirs {
+		inUse[dirName] = struct{}{}
+	}
+	for _, dirName := range b.supersededDirs {
+		if _, ok := inUse[dirName]; ok {
+			continue
+		}
+		delete(b.packageDirStats, dirName)
+		if err := os.RemoveAll(filepath.Join(b.targetDir, dirName)); err != nil {
+			return fmt.Errorf("failed to remove superseded package directory: %w", err)
+		}
+	}
+	b.supersededDirs = nil
+	return nil
+}
@@ -5,6 +5,7 @@ package sourcebundle
 
 import (
 	"context"
+	"strconv"
 
 	"github.com/apparentlymart/go-versions/versions"
 	"github.com/hashicorp/go-slug/sourceaddrs"
@@ -53,6 +54,18 @@ type BuildTracer struct {
 	RemotePackageDownloadFailure func(ctx context.Context, pkgAddr sourceaddrs.RemotePackage, err error)
 	RemotePackageDownloadAlready func(ctx context.Context, pkgAddr sourceaddrs.RemotePackage)
 
+	// The ArtifactAnalysis... callbacks frame each call to a
+	// [DependencyFinder] to analyze a source artifact. finderType is the
+	// name of the dependency finder's dynamic type, as would be returned by
+	// the %T verb of package fmt. The Failure callback is called instead
+	// of Success if analysis produced any error diagnostics.
+	//
+	// If the builder was created with [WithConcurrentAnalysis] then these
+	// callbacks may be called concurrently from multiple goroutines.
+	ArtifactAnalysisStart   func(ctx context.Context, sourceAddr sourceaddrs.RemoteSource, finderType string) context.Context
+	ArtifactAnalysisSuccess func(ctx context.Context, sourceAddr sourceaddrs.RemoteSource, finderType string)
+	ArtifactAnalysisFailure func(ctx context.Context, sourceAddr sourceaddrs.RemoteSource, finderType string, diags Diagnostics)
+
 	// Diagnostics will be called for any diagnostics that describe problems
 	// that aren't also reported by calling one of the "Failure" callbacks
 	// above. A recipient that is going to report the errors itself using
@@ -64,6 +77,76 @@ type BuildTracer struct {
 	// should consider each new call to represent additional diagnostics,
 	// not replacing any previously returned.
 	Diagnostics func(ctx context.Context, diags Diagnostics)
+
+	// PackagePathRemoved is called once for each path that the builder
+	// removes while preparing a fetched remote package, to help with
+	// understanding why a file is missing from a bundle. The builder
+	// doesn't track removals in this detail unless this callback is set.
+	//
+	// A directory that is removed as a whole is reported once, without any
+	// separate events for its contents. However, when using
+	// [WithAlwaysKeep] the builder must examine the contents of excluded
+	// directories, and so it reports each removed item inside such a
+	// directory before reporting the directory itself.
+	//
+	// Packages loaded from the builder's [PackageCache] are not reported,
+	// because they were prepared before they were stored.
+	PackagePathRemoved func(ctx context.Context, event IgnoreTraceEvent)
+}
+
+// IgnoreTraceEvent describes a path that a [Builder] removed from a remote
+// package while preparing it, as reported to
+// [BuildTracer.PackagePathRemoved].
+type IgnoreTraceEvent struct {
+	// Package is the remote package that the path belongs to.
+	Package sourceaddrs.RemotePackage
+
+	// Path is the slash-separated sub-path that was removed, relative to
+	// the root of the package.
+	Path string
+
+	// IsDir is true if Path is a directory, in which case everything
+	// beneath it was removed too.
+	IsDir bool
+
+	// Reason classifies why the path was removed.
+	Reason IgnoreTraceReason
+
+	// Rule is the text of the pattern that matched the path, exactly as it
+	// was written, or an empty string if Reason is VCSMetadataRemoved.
+	Rule string
+}
+
+// IgnoreTraceReason classifies why a [Builder] removed a path from a
+// package. See [IgnoreTraceEvent].
+type IgnoreTraceReason int
+
+const (
+	// IgnoreFileRule means that the path matched a rule in the package's
+	// .terraformignore file, or one of the default ignore rules.
+	IgnoreFileRule IgnoreTraceReason = iota
+
+	// DropPatternRule means that the path matched one of the patterns
+	// given in [WithAlwaysDrop].
+	DropPatternRule
+
+	// VCSMetadataRemoved means that the path is version control metadata.
+	// See [WithVCSMetadata].
+	VCSMetadataRemoved
+)
+
+// String returns the name of the reason, as used in the constant names.
+func (r IgnoreTraceReason) String() string {
+	switch r {
+	case IgnoreFileRule:
+		return "IgnoreFileRule"
+	case DropPatternRule:
+		return "DropPatternRule"
+	case VCSMetadataRemoved:
+		return "VCSMetadataRemoved"
+	default:
+		return "IgnoreTraceReason(" + strconv.Itoa(int(r)) + ")"
+	}
 }
 
 // OnContext takes a context and returns a derived context which has everything
@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"fmt"
+
+	"github.com/apparentlymart/go-versions/versions"
+	regaddr "github.com/hashicorp/terraform-registry-address"
+)
+
+// VersionSelectionStrategy describes which of the available versions of a
+// registry package that a dependency allows a [Builder] selects.
+type VersionSelectionStrategy int
+
+const (
+	// SelectNewestVersion selects the newest allowed version, so that
+	// builds pick up new releases as soon as the registry offers them.
+	// This is the default.
+	SelectNewestVersion VersionSelectionStrategy = iota
+
+	// SelectOldestVersion selects the oldest allowed version, which is
+	// often called "minimal version selection". The result changes only
+	// when a dependency's constraint changes, rather than whenever a new
+	// version is released, so this suits callers that value
+	// reproducibility over freshness.
+	SelectOldestVersion
+)
+
+// String returns a short description of the strategy.
+func (s VersionSelectionStrategy) String() string {
+	switch s {
+	case SelectNewestVersion:
+		return "newest"
+	case SelectOldestVersion:
+		return "oldest"
+	default:
+		return fmt.Sprintf("VersionSelectionStrategy(%d)", int(s))
+	}
+}
+
+// PrereleasePolicy describes whether a [Builder] may select a prerelease
+// version of a registry package.
+type PrereleasePolicy int
+
+const (
+	// AllowPrereleases allows the builder to select any prerelease version
+	// that is in a dependency's set of allowed versions. This is the
+	// default.
+	AllowPrereleases PrereleasePolicy = iota
+
+	// ExcludeUnrequestedPrereleases allows the builder to select a
+	// prerelease version only if the dependency's set of allowed versions
+	// explicitly requests it, as a set built from the constraint
+	// "2.0.0-beta1" does, rather than merely including it, as
+	// [versions.All] does. See [versions.Set.Requests].
+	ExcludeUnrequestedPrereleases
+)
+
+// WithVersionSelection is a BuilderOption that changes how the builder
+// selects a version of each registry package from the versions that the
+// dependency allows. The default is [SelectNewestVersion].
+func WithVersionSelection(strategy VersionSelectionStrategy) BuilderOption {
+	return func(b *Builder) error {
+		switch strategy {
+		case SelectNewestVersion, SelectOldestVersion:
+			b.versionStrategy = strategy
+			return nil
+		default:
+			return fmt.Errorf("invalid version selection strategy %d", strategy)
+		}
+	}
+}
+
+// WithPrereleasePolicy is a BuilderOption that changes whether the builder
+// may select prerelease versions of registry packages. The default is
+// [AllowPrereleases].
+func WithPrereleasePolicy(policy PrereleasePolicy) BuilderOption {
+	return func(b *Builder) error {
+		switch policy {
+		case AllowPrereleases, ExcludeUnrequestedPrereleases:
+			b.prereleasePolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid prerelease policy %d", policy)
+		}
+	}
+}
+
+// WithPreferBundledVersions is a BuilderOption that makes the builder prefer
+// a version of a registry package that it has already selected for another
+// dependency, or that one of the given earlier bundles includes, whenever
+// that version is allowed and the registry still offers it. This maximizes
+// the reuse of package content across dependencies and across incremental
+// builds.
+//
+// The builder applies its [VersionSelectionStrategy] to choose between
+// several preferred versions, and selects from all of the available
+// versions only if none of the preferred versions are allowed.
+func WithPreferBundledVersions(previous ...*Bundle) BuilderOption {
+	return func(b *Builder) error {
+		for _, bundle := range previous {
+			if bundle == nil {
+				return fmt.Errorf("previous bundle must not be nil")
+			}
+		}
+		b.preferBundledVersions = true
+		b.previousBundles = append(b.previousBundles, previous...)
+		return nil
+	}
+}
+
+// selectRegistryVersion chooses one of the given available versions of the
+// given registry package that are in the allowed set, according to the
+// builder's version selection options, or returns [versions.Unspecified] if
+// none of them are allowed.
+//
+// This expects to be called while b.mu is already locked.
+func (b *Builder) selectRegistryVersion(pkgAddr regaddr.ModulePackage, available versions.List, allowed versions.Set) versions.Version {
+	if b.prereleasePolicy == ExcludeUnrequestedPrereleases {
+		allowed = allowed.WithoutUnrequestedPrereleases()
+	}
+	if b.preferBundledVersions {
+		var bundled []versions.Version
+		for pkgVer := range b.resolvedRegistry {
+			if pkgVer.pkg == pkgAddr {
+				bundled = append(bundled, pkgVer.version)
+			}
+		}
+		for _, previous := range b.previousBundles {
+			bundled = append(bundled, previous.RegistryPackageVersions(pkgAddr)...)
+		}
+		preferred := available.Filter(versions.Selection(bundled...))
+		if selected := b.versionStrategy.selectFrom(preferred, allowed); selected != versions.Unspecified {
+			return selected
+		}
+	}
+	return b.versionStrategy.selectFrom(available, allowed)
+}
+
+// selectFrom returns the version from the given list that is in the allowed
+// set and that the strategy prefers, or [versions.Unspecified] if none of
+// them are allowed.
+func (s VersionSelectionStrategy) selectFrom(list versions.List, allowed versions.Set) versions.Version {
+	if s != SelectOldestVersion {
+		return list.NewestInSet(allowed)
+	}
+	ret := versions.Unspecified
+	for _, v := range list {
+		if allowed.Has(v) && (ret == versions.Unspecified || v.LessThan(ret)) {
+			ret = v
+		}
+	}
+	return ret
+}
@@ -0,0 +1,127 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apparentlymart/go-versions/versions"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+func TestBuilderVersionSelection(t *testing.T) {
+	fakes := testingBuilder(
+		t, t.TempDir(),
+		map[string]string{
+			"https://example.com/foo.tgz": "testdata/pkgs/hello",
+		},
+		map[string]map[string]string{
+			"example.com/foo/bar/baz": {
+				"1.0.0":       "https://example.com/foo.tgz",
+				"1.1.0":       "https://example.com/foo.tgz",
+				"1.2.0":       "https://example.com/foo.tgz",
+				"2.0.0-beta1": "https://example.com/foo.tgz",
+			},
+		},
+		nil,
+	)
+	regSource := sourceaddrs.MustParseRegistrySource("example.com/foo/bar/baz")
+
+	// build adds the registry source once for each of the given constraints,
+	// and returns the versions that the resulting bundle includes. An empty
+	// constraint allows all versions, including prereleases.
+	build := func(t *testing.T, opts []BuilderOption, constraints ...string) (*Bundle, []string) {
+		t.Helper()
+		builder, err := NewBuilder(t.TempDir(), fakes.fetcher, fakes.registryClient, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, constraint := range constraints {
+			allowed := versions.All
+			if constraint != "" {
+				allowed = versions.MustMakeSet(versions.MeetingConstraintsStringRuby(constraint))
+			}
+			if diags := builder.AddRegistrySource(context.Background(), regSource, allowed, noDependencyFinder); len(diags) > 0 {
+				t.Fatalf("unexpected diagnostics for %q: %#v", constraint, diags)
+			}
+		}
+		bundle, err := builder.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, v := range bundle.RegistryPackageVersions(regSource.Package()) {
+			got = append(got, v.String())
+		}
+		return bundle, got
+	}
+
+	tests := map[string]struct {
+		opts        []BuilderOption
+		constraints []string
+		want        []string
+	}{
+		"newest": {
+			nil,
+			[]string{""},
+			[]string{"2.0.0-beta1"},
+		},
+		"newest release": {
+			[]BuilderOption{WithPrereleasePolicy(ExcludeUnrequestedPrereleases)},
+			[]string{""},
+			[]string{"1.2.0"},
+		},
+		"requested prerelease": {
+			[]BuilderOption{WithPrereleasePolicy(ExcludeUnrequestedPrereleases)},
+			[]string{"2.0.0-beta1"},
+			[]string{"2.0.0-beta1"},
+		},
+		"oldest": {
+			[]BuilderOption{WithVersionSelection(SelectOldestVersion)},
+			[]string{">= 1.1.0", "~> 1.0"},
+			[]string{"1.0.0", "1.1.0"},
+		},
+		"prefer bundled": {
+			[]BuilderOption{WithPreferBundledVersions()},
+			[]string{"~> 1.0.0", ">= 1.0.0"},
+			[]string{"1.0.0"},
+		},
+		"prefer bundled only when allowed": {
+			[]BuilderOption{WithPreferBundledVersions()},
+			[]string{"~> 1.0.0", ">= 1.1.0"},
+			[]string{"1.0.0", "1.2.0"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, got := build(t, test.opts, test.constraints...)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong selected versions\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("prefer previous bundle", func(t *testing.T) {
+		previous, _ := build(t, nil, "~> 1.1.0")
+		_, got := build(t, []BuilderOption{WithPreferBundledVersions(previous)}, ">= 1.0.0")
+		if diff := cmp.Diff([]string{"1.1.0"}, got); diff != "" {
+			t.Errorf("wrong selected versions\n%s", diff)
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		for _, opt := range []BuilderOption{
+			WithVersionSelection(VersionSelectionStrategy(99)),
+			WithPrereleasePolicy(PrereleasePolicy(99)),
+			WithPreferBundledVersions(nil),
+		} {
+			if _, err := NewBuilder(t.TempDir(), fakes.fetcher, fakes.registryClient, opt); err == nil {
+				t.Error("invalid option was accepted")
+			}
+		}
+	})
+}
@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package sourcebundle
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-slug/sourceaddrs"
+)
+
+// workNode is a node in the graph of artifacts that a [Builder] has been
+// asked to include, directly or indirectly. Each node refers to the node of
+// the artifact whose analysis discovered it, so that we can explain how the
+// builder arrived at a particular artifact when something goes wrong.
+//
+// Nodes for artifacts passed directly to a Builder method have no parent.
+type workNode struct {
+	source sourceaddrs.Source
+	parent *workNode
+	depth  int
+}
+
+func newWorkNode(source sourceaddrs.Source, parent *workNode) *workNode {
+	depth := 1
+	if parent != nil {
+		depth = parent.depth + 1
+	}
+	return &workNode{
+		source: source,
+		parent: parent,
+		depth:  depth,
+	}
+}
+
+// chain returns the source addresses of each of the nodes from the root of
+// the graph to the receiver, inclusive.
+func (n *workNode) chain() []sourceaddrs.Source {
+	ret := make([]sourceaddrs.Source, n.depth)
+	for node := n; node != nil; node = node.parent {
+		ret[node.depth-1] = node.source
+	}
+	return ret
+}
+
+// chainString returns a description of the receiver's chain in the form
+// "A → B → C", for inclusion in diagnostic messages.
+func (n *workNode) chainString() string {
+	chain := n.chain()
+	strs := make([]string, len(chain))
+	for i, source := range chain {
+		strs[i] = source.String()
+	}
+	return strings.Join(strs, " → ")
+}
+
+// chainDetail returns a sentence describing the receiver's chain, for
+// appending to the detail of a diagnostic about it, or an empty string if
+// the receiver is a root node and so there's no chain to describe.
+func (n *workNode) chainDetail() string {
+	if n == nil || n.parent == nil {
+		return ""
+	}
+	return fmt.Sprintf("\n\nThis source was required through the dependency chain %s.", n.chainString())
+}
+
+// pendingRemoteArtifact is a remote artifact waiting to be processed,
+// along with its node in the work graph.
+type pendingRemoteArtifact struct {
+	artifact remoteArtifact
+	node     *workNode
+}
+
+// pendingRegistryArtifact is a registry artifact waiting to be resolved,
+// along with its node in the work graph.
+type pendingRegistryArtifact struct {
+	artifact registryArtifact
+	node     *workNode
+}
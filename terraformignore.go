@@ -11,6 +11,42 @@ import (
 	"github.com/hashicorp/go-slug/internal/ignorefiles"
 )
 
+// IgnoreSemantics selects how Pack interprets the rules in a .terraformignore
+// file when using [ApplyTerraformIgnore].
+type IgnoreSemantics int
+
+const (
+	// LegacyIgnoreSemantics is the historical behavior of Pack, which is the
+	// default. Files under an excluded directory can be re-included by
+	// later negated rules, and an unreadable or invalid .terraformignore
+	// file causes a warning on stderr and the default rules to apply.
+	LegacyIgnoreSemantics IgnoreSemantics = iota
+
+	// SourceBundleIgnoreSemantics interprets .terraformignore in the same
+	// way as the sourcebundle package, so that both produce the same set of
+	// files from the same package directory. An excluded directory excludes
+	// everything below it, and an unreadable or invalid .terraformignore
+	// file causes Pack to fail.
+	//
+	// This is expected to become the default in a future version.
+	SourceBundleIgnoreSemantics
+)
+
+// WithIgnoreSemantics is a PackerOption that selects how Pack interprets
+// .terraformignore rules. It has no effect unless used along with
+// [ApplyTerraformIgnore].
+func WithIgnoreSemantics(semantics IgnoreSemantics) PackerOption {
+	return func(p *Packer) error {
+		switch semantics {
+		case LegacyIgnoreSemantics, SourceBundleIgnoreSemantics:
+			p.ignoreSemantics = semantics
+			return nil
+		default:
+			return fmt.Errorf("invalid ignore semantics %d", semantics)
+		}
+	}
+}
+
 func parseIgnoreFile(rootPath string) *ignorefiles.Ruleset {
 	// Look for .terraformignore at our root path/src
 	file, err := os.Open(filepath.Join(rootPath, ".terraformignore"))
@@ -34,6 +70,41 @@ func parseIgnoreFile(rootPath string) *ignorefiles.Ruleset {
 	return ret
 }
 
+// loadIgnoreRules loads the ignore rules for the given source directory
+// using the receiver's ignore semantics.
+func (p *Packer) loadIgnoreRules(src string) (*ignorefiles.Ruleset, error) {
+	if p.ignoreSemantics == SourceBundleIgnoreSemantics {
+		return ignorefiles.LoadPackageIgnoreRules(src)
+	}
+	return parseIgnoreFile(src), nil
+}
+
+// ignoreAction decides what the pack walk should do with the entry at the
+// given path relative to the source directory, returning whether to skip
+// the entry and, for directories, whether to skip everything below it too.
+func (p *Packer) ignoreAction(subpath string, isDir bool, ruleset *ignorefiles.Ruleset) (skip, skipDir bool, err error) {
+	if p.ignoreSemantics == SourceBundleIgnoreSemantics {
+		r, err := ruleset.ExcludesEntry(subpath, isDir)
+		if err != nil {
+			return false, false, fmt.Errorf("invalid .terraformignore rules: %w", err)
+		}
+		return r.Excluded, r.Excluded && isDir, nil
+	}
+
+	if r := matchIgnoreRules(subpath, ruleset); r.Excluded {
+		return true, false, nil
+	}
+
+	// Catch directories so we don't end up with empty directories,
+	// the files are ignored correctly
+	if isDir {
+		if r := matchIgnoreRules(subpath+string(os.PathSeparator), ruleset); r.Excluded {
+			return true, r.Dominating, nil
+		}
+	}
+	return false, false, nil
+}
+
 func matchIgnoreRules(path string, ruleset *ignorefiles.Ruleset) ignorefiles.ExcludesResult {
 	// Ruleset.Excludes explicitly allows ignoring its error, in which
 	// case we are ignoring any individual invalid rules in the set
@@ -0,0 +1,63 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// UnreadableFile describes a file or directory that Pack skipped because
+// of [WithSkipUnreadable].
+type UnreadableFile struct {
+	// Name is the name that the file would have had in the slug. The name
+	// of a directory has a trailing slash, as in the slug.
+	Name string
+
+	// Err is the error that prevented Pack from reading the file.
+	Err error
+}
+
+// WithSkipUnreadable is a PackerOption that makes Pack skip any file or
+// directory that it doesn't have permission to read, instead of failing,
+// and list it in [Meta.UnreadableFiles]. Pack still fails if it can't read
+// the root directory itself, or if reading fails for any other reason.
+//
+// A directory that can't be listed is left out of the slug entirely, along
+// with everything in it.
+//
+// Pack never opens an empty file, because it has no content to read, and so
+// it packs an empty file that it doesn't have permission to read rather than
+// skipping it or failing, regardless of this option.
+func WithSkipUnreadable() PackerOption {
+	return func(p *Packer) error {
+		p.skipUnreadable = true
+		return nil
+	}
+}
+
+// canSkipUnreadable returns true if Pack should skip a file whose reading
+// failed with the given error, rather than failing.
+func (p *Packer) canSkipUnreadable(err error) bool {
+	return p.skipUnreadable && errors.Is(err, fs.ErrPermission)
+}
+
+// unreadableName returns the name in the slug of the file at the given
+// path, for reporting that Pack couldn't read it. isDir is false if Pack
+// couldn't even find out what kind of file it is.
+func unreadableName(root, src, dst, path string, isDir bool) string {
+	name, err := filepath.Rel(root, strings.Replace(path, src, dst, 1))
+	if err != nil {
+		// Should not get here, because the walk only visits paths under
+		// src, but we'll report the real path rather than nothing.
+		name = path
+	}
+	name = filepath.ToSlash(name)
+	if isDir {
+		name += "/"
+	}
+	return name
+}
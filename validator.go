@@ -0,0 +1,332 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/hashicorp/go-slug/internal/unpackinfo"
+)
+
+// validatorRoot is the imaginary destination directory that a [Validator]
+// checks entries against, since it doesn't extract them anywhere.
+var validatorRoot = filepath.FromSlash("/slug")
+
+// ValidationProgress describes how much of a slug a [Validator] has checked.
+type ValidationProgress struct {
+	// Received is the number of bytes of the slug that the validator has
+	// been given so far.
+	Received int64
+
+	// Entries is the number of entries that the validator has fully
+	// checked, including reading their content.
+	Entries int
+
+	// LastEntry is the name of the last entry that the validator has fully
+	// checked, or an empty string if there is none yet.
+	LastEntry string
+
+	// EntryOffset is the offset in the decompressed tar stream of the end
+	// of LastEntry, including its padding. There is no corresponding offset
+	// in the slug itself, because a single block of compressed data can
+	// span several entries.
+	EntryOffset int64
+}
+
+// Validator checks a slug incrementally as its bytes arrive, such as during a
+// chunked or resumable upload, applying the same checks as [Packer.Unpack]
+// but without extracting anything.
+//
+// Write the bytes of the slug to the validator in order, and then call Close
+// once the whole slug has arrived to check that it ends correctly. After
+// each call to Write, Progress describes how much of the slug is valid so
+// far. An error from Write means that the slug is invalid regardless of what
+// follows it.
+//
+// Callers must always call Close, even when abandoning a slug, to release
+// the resources used by the validator. A Validator is not safe for
+// concurrent use.
+type Validator struct {
+	p *Packer
+
+	// chunks carries the data from Write to the goroutine running validate,
+	// which then signals on idle once it has consumed all of it, or closes
+	// done when it has finished.
+	chunks chan []byte
+	idle   chan struct{}
+	done   chan struct{}
+	closed bool
+
+	// The validating goroutine owns these fields while it's running, and
+	// so other goroutines may access them only after synchronizing with it
+	// through the channels above.
+	pending  []byte
+	started  bool
+	eof      bool
+	progress ValidationProgress
+	err      error
+}
+
+var (
+	_ io.WriteCloser = (*Validator)(nil)
+	_ io.WriterAt    = (*Validator)(nil)
+)
+
+// NewValidator returns a [Validator] that checks a slug using the default
+// options.
+func NewValidator() *Validator {
+	p := &Packer{}
+	return p.NewValidator()
+}
+
+// NewValidator returns a [Validator] that checks a slug using the options
+// that the receiver was created with.
+func (p *Packer) NewValidator() *Validator {
+	v := &Validator{
+		p:      p,
+		chunks: make(chan []byte),
+		idle:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(v.done)
+		v.err = v.validate()
+	}()
+	return v
+}
+
+// Write validates the next chunk of the slug, returning an error if the slug
+// is invalid. It returns only once the validator has checked everything it
+// can check using the data received so far.
+func (v *Validator) Write(chunk []byte) (int, error) {
+	if v.closed {
+		return 0, fmt.Errorf("validator is closed")
+	}
+	select {
+	case <-v.done:
+		return 0, v.err
+	default:
+	}
+	if len(chunk) == 0 {
+		return 0, nil
+	}
+
+	v.progress.Received += int64(len(chunk))
+
+	// The validating goroutine might still be using the chunk after we
+	// return, so we must copy it.
+	v.chunks <- append([]byte(nil), chunk...)
+	select {
+	case <-v.idle:
+		return len(chunk), nil
+	case <-v.done:
+		return len(chunk), v.err
+	}
+}
+
+// WriteAt is like Write but takes the offset of the chunk in the slug, so
+// that a caller can pass on chunks of a resumable upload that might overlap
+// with data that was already received. The part of the chunk before
+// [ValidationProgress.Received] is ignored, without checking that it
+// matches what was received before.
+//
+// WriteAt returns an error if the chunk begins after the end of the data
+// received so far, because the validator can't check data out of order.
+func (v *Validator) WriteAt(chunk []byte, off int64) (int, error) {
+	received := v.progress.Received
+	if off > received {
+		return 0, fmt.Errorf("cannot validate data at offset %d before receiving the data at offset %d", off, received)
+	}
+	skip := received - off
+	if skip >= int64(len(chunk)) {
+		return len(chunk), nil
+	}
+	n, err := v.Write(chunk[skip:])
+	return int(skip) + n, err
+}
+
+// Progress describes how much of the slug the validator has checked so far.
+func (v *Validator) Progress() ValidationProgress {
+	return v.progress
+}
+
+// Close tells the validator that it has received the whole slug, and returns
+// an error if the slug is invalid, including if it is incomplete.
+func (v *Validator) Close() error {
+	if !v.closed {
+		v.closed = true
+		close(v.chunks)
+	}
+	<-v.done
+	return v.err
+}
+
+// validate runs in its own goroutine, reading the slug from the chunks given
+// to Write until it finds a problem or reaches the end of the slug.
+func (v *Validator) validate() error {
+	p := v.p
+	uncompressed, br, err := newGzipMemberReader(validatorInput{v})
+	if err != nil {
+		return err
+	}
+	var offset countingWriter
+	counted := io.TeeReader(uncompressed, &offset)
+	untar := tar.NewReader(counted)
+
+	extracted := make(map[string]struct{})
+	symlinks := make(map[string]struct{})
+	var collisions *caseCollisions
+	if p.caseCollisionPolicy == RejectCaseCollisions {
+		// Renaming doesn't affect whether the slug is valid.
+		collisions = p.newCaseCollisions()
+	}
+	var totalSize int64
+	for {
+		header, err := untar.Next()
+		if err == io.EOF {
+			// We read any padding after the end of the archive here, rather
+			// than in nextGzipMember, so that it's counted in the offsets
+			// of entries in any later members.
+			if err := discardTarPadding(counted); err != nil {
+				return err
+			}
+			more, err := p.nextGzipMember(uncompressed, br)
+			if err != nil || !more {
+				return err
+			}
+			untar = tar.NewReader(counted)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to untar slug: %w", gzipMemberTarError(err, br))
+		}
+
+		// Unpack ignores entries with no name.
+		if header.Name == "" {
+			continue
+		}
+
+		// Unpack checks each entry under the name that the remapper gives
+		// it, and doesn't check the entries that it skips at all.
+		original := header.Name
+		header, err = p.remapEntry(header)
+		if err != nil {
+			return err
+		}
+		if header != nil {
+			if err := p.checkSizeLimit(totalSize, header); err != nil {
+				return err
+			}
+			if header.Typeflag == tar.TypeReg {
+				totalSize += header.Size
+			}
+			if err := p.validateEntry(header, extracted, symlinks, collisions); err != nil {
+				return err
+			}
+		}
+		if _, err := io.Copy(io.Discard, untar); err != nil {
+			return fmt.Errorf("failed to untar slug: %w", gzipMemberTarError(err, br))
+		}
+
+		v.progress.Entries++
+		v.progress.LastEntry = original
+		v.progress.EntryOffset = (offset.n + blockSize - 1) / blockSize * blockSize
+	}
+}
+
+// blockSize is the size of the blocks that make up a tar archive.
+const blockSize = 512
+
+// validateEntry applies the same checks to the entry with the given header
+// as unpackEntry does, but without extracting it, instead recording the
+// paths of the entries and symlinks it would have extracted in the given
+// maps.
+func (p *Packer) validateEntry(header *tar.Header, extracted, symlinks map[string]struct{}, collisions *caseCollisions) error {
+	name, err := p.windowsEntryName(header.Name)
+	if err != nil {
+		return err
+	}
+	name, err = p.caseCollisionName(collisions, name)
+	if err != nil {
+		return err
+	}
+	if name != header.Name {
+		renamed := *header
+		renamed.Name = name
+		header = &renamed
+	}
+
+	if err := p.checkControlCharacters(header); err != nil {
+		return err
+	}
+	if err := p.checkPathLimits(header.Name); err != nil {
+		return err
+	}
+
+	info, err := unpackinfo.NewUnpackInfoWith(validatorRoot, header, func(path string) (bool, error) {
+		_, ok := symlinks[path]
+		return ok, nil
+	})
+	if err != nil {
+		return &IllegalSlugError{Code: unpackInfoErrorCode(err), Err: err}
+	}
+
+	if !info.IsDirectory() && !info.IsTypeX() {
+		if _, exists := extracted[info.Path]; exists && p.duplicatePolicy == RejectDuplicateEntries {
+			return &IllegalSlugError{
+				Code: DuplicateEntry,
+				Err:  fmt.Errorf("duplicate entry %q", header.Name),
+			}
+		}
+		extracted[info.Path] = struct{}{}
+	}
+
+	if info.IsSymlink() {
+		if _, ok, err := p.symlinkAllowed(validatorRoot, header.Name, header.Linkname); !ok {
+			return err
+		}
+		symlinks[info.Path] = struct{}{}
+	}
+	return nil
+}
+
+// validatorInput is the reader that a [Validator] decompresses, which returns
+// the chunks given to Write.
+type validatorInput struct {
+	v *Validator
+}
+
+func (in validatorInput) Read(buf []byte) (int, error) {
+	if err := in.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(buf, in.v.pending)
+	in.v.pending = in.v.pending[n:]
+	return n, nil
+}
+
+// fill waits for the next chunk if all of the earlier chunks have been
+// consumed, first signaling the pending call to Write that it can return.
+func (in validatorInput) fill() error {
+	v := in.v
+	for len(v.pending) == 0 {
+		if v.eof {
+			return io.EOF
+		}
+		if v.started {
+			v.idle <- struct{}{}
+		}
+		chunk, ok := <-v.chunks
+		if !ok {
+			v.eof = true
+			return io.EOF
+		}
+		v.started = true
+		v.pending = chunk
+	}
+	return nil
+}
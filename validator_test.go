@@ -0,0 +1,229 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidator(t *testing.T) {
+	var slug bytes.Buffer
+	if _, err := Pack("testdata/archive-dir-no-external", &slug, true); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data := slug.Bytes()
+
+	// We'll find the names of the entries the slug actually contains, to
+	// compare with what the validator reports.
+	var names []string
+	gzipR, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tarR := tar.NewReader(gzipR)
+	for {
+		header, err := tarR.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+
+	t.Run("small chunks", func(t *testing.T) {
+		v := NewValidator()
+		entries := 0
+		for start := 0; start < len(data); start += 7 {
+			end := start + 7
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := v.Write(data[start:end]); err != nil {
+				t.Fatalf("unexpected error at offset %d: %s", start, err)
+			}
+			progress := v.Progress()
+			if progress.Received != int64(end) {
+				t.Fatalf("wrong received count %d; want %d", progress.Received, end)
+			}
+			if progress.Entries < entries {
+				t.Fatalf("entry count went backwards from %d to %d", entries, progress.Entries)
+			}
+			entries = progress.Entries
+		}
+		if err := v.Close(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		progress := v.Progress()
+		if progress.Entries != len(names) {
+			t.Errorf("wrong entry count %d; want %d", progress.Entries, len(names))
+		}
+		if got, want := progress.LastEntry, names[len(names)-1]; got != want {
+			t.Errorf("wrong last entry %q; want %q", got, want)
+		}
+		if progress.EntryOffset == 0 || progress.EntryOffset%blockSize != 0 {
+			t.Errorf("invalid entry offset %d", progress.EntryOffset)
+		}
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		v := NewValidator()
+		if _, err := v.Write(data[:len(data)/2]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := v.Close(); err == nil {
+			t.Fatal("expected error for incomplete slug, got none")
+		}
+	})
+
+	t.Run("resumed", func(t *testing.T) {
+		v := NewValidator()
+		if _, err := v.WriteAt(data[:100], 0); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// This chunk overlaps with the one before.
+		if n, err := v.WriteAt(data[50:200], 50); err != nil || n != 150 {
+			t.Fatalf("unexpected result %d, %v", n, err)
+		}
+		// This chunk leaves a gap after the ones before.
+		if _, err := v.WriteAt(data[300:], 300); err == nil {
+			t.Fatal("expected error for data out of order, got none")
+		}
+		if _, err := v.WriteAt(data[200:], 200); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := v.Close(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got := v.Progress().Entries; got != len(names) {
+			t.Errorf("wrong entry count %d; want %d", got, len(names))
+		}
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		v := NewValidator()
+		_, err := v.Write(append(append([]byte(nil), data...), "garbage"...))
+		var illegalErr *IllegalSlugError
+		if !errors.As(err, &illegalErr) || illegalErr.Code != TrailingData {
+			t.Fatalf("expected TrailingData error, got %v", err)
+		}
+		if err := v.Close(); err == nil {
+			t.Fatal("expected error from Close, got none")
+		}
+	})
+}
+
+func TestValidatorIllegalEntries(t *testing.T) {
+	tests := map[string]struct {
+		headers  []*tar.Header
+		wantCode IllegalSlugErrorCode
+	}{
+		"traversal": {
+			headers: []*tar.Header{
+				{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			wantCode: TraversalOutsideRoot,
+		},
+		"external symlink": {
+			headers: []*tar.Header{
+				{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"},
+			},
+			wantCode: SymlinkExternalTarget,
+		},
+		"through symlink": {
+			headers: []*tar.Header{
+				{Name: "sub", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "sub"},
+				{Name: "link/file", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			wantCode: ExtractThroughSymlink,
+		},
+		"unsupported type": {
+			headers: []*tar.Header{
+				{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644},
+			},
+			wantCode: UnsupportedType,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			gzipW := gzip.NewWriter(&buf)
+			tarW := tar.NewWriter(gzipW)
+			if err := tarW.WriteHeader(&tar.Header{Name: "good", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+				t.Fatal(err)
+			}
+			for _, header := range test.headers {
+				if err := tarW.WriteHeader(header); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tarW.Close()
+			gzipW.Close()
+
+			v := NewValidator()
+			_, err := v.Write(buf.Bytes())
+			var illegalErr *IllegalSlugError
+			if !errors.As(err, &illegalErr) {
+				t.Fatalf("expected *IllegalSlugError, got %T %v", err, err)
+			}
+			if illegalErr.Code != test.wantCode {
+				t.Errorf("wrong error code %s; want %s", illegalErr.Code, test.wantCode)
+			}
+			// All of the entries before the illegal one are valid.
+			if got, want := v.Progress().Entries, len(test.headers); got != want {
+				t.Errorf("wrong entry count %d; want %d", got, want)
+			}
+			if !errors.Is(v.Close(), err) {
+				t.Errorf("Close returned a different error")
+			}
+		})
+	}
+}
+
+func TestValidatorRemapper(t *testing.T) {
+	var buf bytes.Buffer
+	gzipW := gzip.NewWriter(&buf)
+	tarW := tar.NewWriter(gzipW)
+	for _, name := range []string{"mod/main.tf", "../escape"} {
+		if err := tarW.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tarW.Close()
+	gzipW.Close()
+
+	validate := func(remap UnpackRemapper) error {
+		p, err := NewPacker(WithUnpackRemapper(remap))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := p.NewValidator()
+		if _, err := v.Write(buf.Bytes()); err != nil {
+			v.Close()
+			return err
+		}
+		return v.Close()
+	}
+
+	// Unpack would skip the illegal entry, and so it's valid.
+	err := validate(func(header *tar.Header) (string, bool) {
+		return header.Name, !strings.HasPrefix(header.Name, "mod/")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Unpack would extract a legal entry outside of the destination.
+	err = validate(func(header *tar.Header) (string, bool) {
+		return "../" + header.Name, false
+	})
+	var illegalErr *IllegalSlugError
+	if !errors.As(err, &illegalErr) || illegalErr.Code != TraversalOutsideRoot {
+		t.Fatalf("expected TraversalOutsideRoot error, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileLister decides which files in a source directory Pack should include
+// in a slug, such as the files tracked by a version control system.
+type FileLister interface {
+	// ListFiles returns the slash-separated paths, relative to root, of the
+	// files to include. Any directory containing a listed file is included
+	// implicitly. If a listed path is itself a directory, such as a Git
+	// submodule, then everything under it is included.
+	ListFiles(root string) ([]string, error)
+}
+
+// FileListerFunc is an adapter to allow using an ordinary function as a
+// [FileLister].
+type FileListerFunc func(root string) ([]string, error)
+
+// ListFiles implements [FileLister].
+func (f FileListerFunc) ListFiles(root string) ([]string, error) {
+	return f(root)
+}
+
+// GitTrackedFiles is a [FileLister] that lists the files in the Git index
+// of the repository containing the source directory, by running the "git"
+// command. This excludes untracked files and files ignored by .gitignore.
+var GitTrackedFiles FileLister = FileListerFunc(gitTrackedFiles)
+
+func gitTrackedFiles(root string) ([]string, error) {
+	cmd := exec.Command("git", "ls-files", "-z", "--cached")
+	cmd.Dir = root
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("failed to list git-tracked files: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("failed to list git-tracked files: %w", err)
+	}
+
+	var ret []string
+	for _, name := range strings.Split(stdout.String(), "\x00") {
+		if name != "" {
+			ret = append(ret, name)
+		}
+	}
+	return ret, nil
+}
+
+// WithFileLister is a PackerOption that makes Pack include only the files
+// chosen by the given [FileLister], in addition to applying any other rules
+// such as .terraformignore exclusions.
+func WithFileLister(lister FileLister) PackerOption {
+	return func(p *Packer) error {
+		if lister == nil {
+			return fmt.Errorf("file lister must not be nil")
+		}
+		p.fileLister = lister
+		return nil
+	}
+}
+
+// WithGitTrackedOnly is a PackerOption that makes Pack include only the files
+// that are tracked in the Git repository containing the source directory,
+// using [GitTrackedFiles]. The "git" command must be available at the time
+// of packing.
+func WithGitTrackedOnly() PackerOption {
+	return WithFileLister(GitTrackedFiles)
+}
+
+// includedFiles is the set of files and directories chosen by a FileLister.
+type includedFiles struct {
+	files map[string]struct{}
+	dirs  map[string]struct{}
+}
+
+func newIncludedFiles(paths []string) *includedFiles {
+	ret := &includedFiles{
+		files: make(map[string]struct{}, len(paths)),
+		dirs:  make(map[string]struct{}),
+	}
+	for _, p := range paths {
+		p = path.Clean(filepath.ToSlash(p))
+		ret.files[p] = struct{}{}
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			ret.dirs[dir] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// Includes returns true if the entry at the given slash-separated path
+// should be included in the slug.
+func (i *includedFiles) Includes(name string, isDir bool) bool {
+	if isDir {
+		if _, ok := i.dirs[name]; ok {
+			return true
+		}
+	}
+	// A path is also included if it or any of its ancestors were listed
+	// directly, which covers both listed files and listed directories.
+	for p := name; p != "."; p = path.Dir(p) {
+		if _, ok := i.files[p]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// WindowsNamePolicy describes how Unpack should react to entries whose
+// names cannot be used as file names on Windows, such as "con.tf" or names
+// ending with a space or a period.
+type WindowsNamePolicy int
+
+const (
+	// CheckWindowsNamesOnWindows rejects entries with names that are not
+	// valid on Windows only when Unpack is running on Windows, where
+	// extracting them would otherwise fail confusingly or write somewhere
+	// unexpected. This is the default.
+	CheckWindowsNamesOnWindows WindowsNamePolicy = iota
+
+	// RejectWindowsNames rejects entries with names that are not valid on
+	// Windows regardless of the current platform, so that the extracted
+	// files are portable.
+	RejectWindowsNames
+
+	// EscapeWindowsNames extracts entries with names that are not valid
+	// on Windows under an escaped name, regardless of the current platform.
+	// Each offending character is replaced by a percent sign followed by
+	// its two-digit hexadecimal code, so "con.tf" becomes "co%6E.tf" and
+	// "notes. " becomes "notes.%20".
+	//
+	// Escaping is one-way, and symlink targets are not rewritten, so
+	// symlinks referring to an escaped name will be broken.
+	EscapeWindowsNames
+)
+
+// WithWindowsNamePolicy is a PackerOption that selects how Unpack deals with
+// entries whose names cannot be used on Windows.
+func WithWindowsNamePolicy(policy WindowsNamePolicy) PackerOption {
+	return func(p *Packer) error {
+		switch policy {
+		case CheckWindowsNamesOnWindows, RejectWindowsNames, EscapeWindowsNames:
+			p.windowsNamePolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("invalid Windows name policy %d", policy)
+		}
+	}
+}
+
+// onWindows is true if the current platform is Windows. This is a variable
+// only so that tests can simulate the Windows behavior on other platforms.
+var onWindows = runtime.GOOS == "windows"
+
+// windowsReservedNames are the device names that Windows reserves in every
+// directory, regardless of any extension that follows them.
+var windowsReservedNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {},
+	"COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {},
+	"LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// windowsEntryName applies the packer's Windows name policy to the name of
+// an entry, returning the name that the entry should be extracted as.
+func (p *Packer) windowsEntryName(name string) (string, error) {
+	switch p.windowsNamePolicy {
+	case CheckWindowsNamesOnWindows:
+		if !onWindows {
+			return name, nil
+		}
+	case EscapeWindowsNames:
+		parts := strings.Split(name, "/")
+		for i, part := range parts {
+			parts[i] = escapeWindowsName(part)
+		}
+		return strings.Join(parts, "/"), nil
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if problem := windowsNameProblem(part); problem != "" {
+			return "", &IllegalSlugError{
+				Code: WindowsIncompatibleName,
+				Err:  fmt.Errorf("entry %q cannot be extracted on Windows: %s", name, problem),
+			}
+		}
+	}
+	return name, nil
+}
+
+// windowsNameProblem returns a description of why the given path component
+// is not a valid file name on Windows, or an empty string if it is valid.
+func windowsNameProblem(part string) string {
+	if part == "" || part == "." || part == ".." {
+		// These are handled by the general path validation in unpackinfo.
+		return ""
+	}
+	for _, r := range part {
+		if r < 0x20 {
+			return fmt.Sprintf("name %q contains control character %U", part, r)
+		}
+		if strings.ContainsRune(`<>:"\|?*`, r) {
+			return fmt.Sprintf("name %q contains reserved character %q", part, r)
+		}
+	}
+	if last := part[len(part)-1]; last == ' ' || last == '.' {
+		return fmt.Sprintf("name %q ends with %q", part, last)
+	}
+	stem, _, _ := strings.Cut(part, ".")
+	if _, reserved := windowsReservedNames[strings.ToUpper(strings.TrimRight(stem, " "))]; reserved {
+		return fmt.Sprintf("name %q uses the reserved device name %q", part, stem)
+	}
+	return ""
+}
+
+// escapeWindowsName returns a version of the given path component that is
+// a valid file name on Windows, using the scheme described for
+// [EscapeWindowsNames].
+func escapeWindowsName(part string) string {
+	if part == "" || part == "." || part == ".." || windowsNameProblem(part) == "" {
+		return part
+	}
+
+	escape := func(b byte) string {
+		return fmt.Sprintf("%%%02X", b)
+	}
+
+	var buf strings.Builder
+	for i := 0; i < len(part); i++ {
+		b := part[i]
+		if b < 0x20 || strings.IndexByte(`<>:"\|?*`, b) >= 0 {
+			buf.WriteString(escape(b))
+		} else {
+			buf.WriteByte(b)
+		}
+	}
+	ret := buf.String()
+
+	// Escaping only the last of any trailing spaces or periods is enough
+	// to make the name end with a valid character.
+	if last := ret[len(ret)-1]; last == ' ' || last == '.' {
+		ret = ret[:len(ret)-1] + escape(last)
+	}
+
+	// Reserved device names are disguised by escaping their last character.
+	stem, rest, hasExt := strings.Cut(ret, ".")
+	if _, reserved := windowsReservedNames[strings.ToUpper(strings.TrimRight(stem, " "))]; reserved {
+		stem = stem[:len(stem)-1] + escape(stem[len(stem)-1])
+		ret = stem
+		if hasExt {
+			ret += "." + rest
+		}
+	}
+	return ret
+}
@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package slug
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-slug/internal/unpackinfo"
+)
+
+// xattr is an extended attribute to set with [WithSetXattr].
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// WithClearedXattrs is a PackerOption that makes Unpack remove the extended
+// attributes with the given names from each regular file it extracts, such
+// as the "com.apple.quarantine" attribute that macOS uses to block the
+// execution of downloaded programs. This is useful when intermediate
+// tooling adds such attributes to the files it handles.
+//
+// Extended attributes are supported only on Linux and macOS, and this
+// option has no effect on other platforms.
+func WithClearedXattrs(names ...string) PackerOption {
+	return func(p *Packer) error {
+		for _, name := range names {
+			if name == "" {
+				return fmt.Errorf("extended attribute name must not be empty")
+			}
+		}
+		p.clearedXattrs = append(p.clearedXattrs, names...)
+		return nil
+	}
+}
+
+// WithSetXattr is a PackerOption that makes Unpack set the extended
+// attribute with the given name to the given value on each regular file it
+// extracts. Calling WithSetXattr more than once sets all of the given
+// attributes, which are set after removing any attributes given in
+// [WithClearedXattrs].
+//
+// Extended attributes are supported only on Linux and macOS, and this
+// option has no effect on other platforms. On Linux, the name must include
+// a namespace prefix such as "user.".
+func WithSetXattr(name string, value []byte) PackerOption {
+	return func(p *Packer) error {
+		if name == "" {
+			return fmt.Errorf("extended attribute name must not be empty")
+		}
+		p.setXattrs = append(p.setXattrs, xattr{
+			name:  name,
+			value: append([]byte(nil), value...),
+		})
+		return nil
+	}
+}
+
+// applyXattrs applies the packer's extended attribute options to the
+// extracted file at the given path, which will be named name in any error.
+func (p *Packer) applyXattrs(path, name string) error {
+	if len(p.clearedXattrs) == 0 && len(p.setXattrs) == 0 {
+		return nil
+	}
+	if !unpackinfo.CanManageXattrs() {
+		return nil
+	}
+	for _, attr := range p.clearedXattrs {
+		if err := unpackinfo.RemoveXattr(path, attr); err != nil {
+			return fmt.Errorf("failed to remove extended attribute %q from %q: %w", attr, name, err)
+		}
+	}
+	for _, attr := range p.setXattrs {
+		if err := unpackinfo.SetXattr(path, attr.name, attr.value); err != nil {
+			return fmt.Errorf("failed to set extended attribute %q on %q: %w", attr.name, name, err)
+		}
+	}
+	return nil
+}
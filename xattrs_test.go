@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build darwin || linux
+// +build darwin linux
+
+package slug
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-slug/internal/unpackinfo"
+	"golang.org/x/sys/unix"
+)
+
+func TestUnpackXattrs(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	slug := bytes.NewBuffer(nil)
+	if _, err := Pack(src, slug, false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	archive := slug.Bytes()
+
+	dst := t.TempDir()
+	path := filepath.Join(dst, "run.sh")
+	const quarantine = "user.go-slug.quarantine"
+
+	// First we'll extract with an attribute set, simulating the
+	// intermediate tooling that adds it.
+	p, err := NewPacker(WithSetXattr(quarantine, []byte("0081;tool")))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := p.Unpack(bytes.NewReader(archive), dst); err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+			t.Skipf("extended attributes are not supported here: %s", err)
+		}
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 64)
+	n, err := unix.Lgetxattr(path, quarantine, buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := string(buf[:n]), "0081;tool"; got != want {
+		t.Errorf("wrong attribute value %q; want %q", got, want)
+	}
+
+	// Extracting over the same file again keeps its attributes unless
+	// they are cleared explicitly.
+	p, err = NewPacker(WithClearedXattrs(quarantine, "user.go-slug.absent"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := p.Unpack(bytes.NewReader(archive), dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := unix.Lgetxattr(path, quarantine, buf); !errors.Is(err, unpackinfo.ErrNoXattr) {
+		t.Errorf("expected attribute to be removed, got %v", err)
+	}
+
+	if _, err := NewPacker(WithSetXattr("", nil)); err == nil {
+		t.Error("expected error for empty attribute name")
+	}
+}